@@ -1 +1 @@
-make client amp pcp balancer latency load
+make client amp pcp balancer latency load replay
@@ -0,0 +1,171 @@
+package main
+
+// Print packets recorded with the -capture flag, or send them again to a server.
+// Captures taken on a client replay the requests the client sent (-role client),
+// captures taken on a server replay the requests the server received (-role server).
+// Replies are never replayed.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/golib"
+)
+
+var (
+	print_only     = false
+	target_addr    = ""
+	only_dest      = ""
+	only_protocol  = ""
+	speed          = 1.0
+	reply_timeout  = 500 * time.Millisecond
+	receive_buffer = 32768 // Default buffer size of the tcp transport, the largest accepted reply
+	role           = "client"
+)
+
+func main() {
+	file := flag.String("file", "", "The capture file to read")
+	flag.BoolVar(&print_only, "print", print_only, "Only print the captured packets, do not replay them")
+	flag.StringVar(&target_addr, "target", target_addr, "Send all replayed packets to this server instead of the originally captured destination")
+	flag.StringVar(&only_dest, "dest", only_dest, "Only use packets that were originally sent to this address")
+	flag.StringVar(&only_protocol, "protocol", only_protocol, "Only use packets of this protocol")
+	flag.Float64Var(&speed, "speed", speed, "Factor for the delays between replayed packets. 0 means no delays.")
+	flag.StringVar(&role, "role", role, "Where the capture was taken: 'client' replays the sent requests, 'server' the received requests")
+	flag.IntVar(&receive_buffer, "buffer", receive_buffer, "Buffer size for receiving replies to replayed packets")
+	flag.Parse()
+	if *file == "" {
+		log.Fatalln("file parameter required")
+	}
+	var direction protocols.PacketDirection
+	switch role {
+	case "client":
+		direction = protocols.PacketSent
+	case "server":
+		direction = protocols.PacketReceived
+	default:
+		log.Fatalf("Illegal role %v, must be 'client' or 'server'\n", role)
+	}
+
+	reader, err := protocols.OpenCapture(*file)
+	golib.Checkerr(err)
+	defer reader.Close()
+
+	var lastCaptured time.Time
+	requests := make(map[string]bool) // Source and destination of requests, to recognize the replies
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		golib.Checkerr(err)
+		if !matches(packet) {
+			continue
+		}
+		if print_only {
+			fmt.Println(packet)
+			continue
+		}
+		if isReply(packet, requests) || packet.Direction != direction {
+			continue
+		}
+		if !lastCaptured.IsZero() && speed > 0 {
+			time.Sleep(time.Duration(float64(packet.Time.Sub(lastCaptured)) * speed))
+		}
+		lastCaptured = packet.Time
+		replay(packet)
+	}
+}
+
+func matches(packet *protocols.CapturedPacket) bool {
+	if only_dest != "" && packet.Dest != only_dest {
+		return false
+	}
+	if only_protocol != "" && packet.Protocol != only_protocol {
+		return false
+	}
+	return true
+}
+
+// Replies carry CodeOK, CodeError or CodeQuotaExceeded, or answer an earlier packet in the opposite direction.
+// Requests are remembered in requests. Data that could not be decoded is replayed as a request.
+func isReply(packet *protocols.CapturedPacket, requests map[string]bool) bool {
+	if packet.Err == "" {
+		switch packet.Code {
+		case protocols.CodeOK, protocols.CodeError, protocols.CodeQuotaExceeded:
+			return true
+		}
+	}
+	if requests[packet.Dest+" "+packet.Source] {
+		return true
+	}
+	requests[packet.Source+" "+packet.Dest] = true
+	return false
+}
+
+func replay(packet *protocols.CapturedPacket) {
+	target := packet.Dest
+	if target_addr != "" {
+		target = target_addr
+	}
+	if packet.Err != "" {
+		log.Printf("Replaying %v bytes of undecodable %v data to %v\n", len(packet.Data), packet.Protocol, target)
+	} else {
+		log.Printf("Replaying %v code %v to %v: %v\n", packet.Protocol, packet.Code, target, packet.Val)
+	}
+	conn, err := net.Dial(packet.Network, target)
+	if err != nil {
+		log.Println("Error connecting:", err)
+		return
+	}
+	defer conn.Close()
+	// Captured packets do not include the framing of the tcp transport
+	stream := strings.HasPrefix(packet.Network, "tcp")
+	if stream {
+		err = protocols.WriteTcpFrame(conn, packet.Data)
+	} else {
+		_, err = conn.Write(packet.Data)
+	}
+	if err != nil {
+		log.Println("Error sending:", err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(reply_timeout))
+	var reply []byte
+	if stream {
+		reply, err = protocols.ReadTcpFrame(conn, receive_buffer)
+	} else {
+		buf := make([]byte, receive_buffer)
+		var n int
+		n, err = conn.Read(buf)
+		reply = buf[:n]
+	}
+	if err != nil {
+		// Not all packets receive a reply
+		return
+	}
+	log.Println("\tReply:", formatReply(reply))
+}
+
+func formatReply(data []byte) string {
+	// Only the code and error strings can be decoded without knowing the protocol
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	var code protocols.Code
+	if err := dec.Decode(&code); err != nil {
+		return fmt.Sprintf("%v bytes, failed to decode code: %v", len(data), err)
+	}
+	if code == protocols.CodeError {
+		var errString string
+		if err := dec.Decode(&errString); err == nil {
+			return fmt.Sprintf("Error: %v", errString)
+		}
+	}
+	return fmt.Sprintf("code %v (%v bytes)", code, len(data))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func TestIsReply(t *testing.T) {
+	requests := make(map[string]bool)
+	for i, test := range []struct {
+		code   protocols.Code
+		source string
+		dest   string
+		reply  bool
+	}{
+		{protocols.Code(10), "client:1", "server:1", false},
+		{protocols.CodeOK, "server:1", "client:1", true},
+		{protocols.CodeError, "server:1", "client:1", true},
+		{protocols.CodeQuotaExceeded, "server:1", "client:1", true},
+		{protocols.Code(11), "server:1", "client:1", true}, // Answers the first request
+		{protocols.Code(11), "client:1", "server:1", false},
+		{protocols.Code(10), "client:2", "server:1", false},
+		{protocols.Code(12), "server:2", "client:2", false},
+	} {
+		packet := &protocols.CapturedPacket{Code: test.code, Source: test.source, Dest: test.dest}
+		if reply := isReply(packet, requests); reply != test.reply {
+			t.Errorf("Packet %v (%v -> %v, code %v): isReply() = %v, expected %v",
+				i, test.source, test.dest, test.code, reply, test.reply)
+		}
+	}
+}
@@ -1,16 +1,24 @@
 package amp
 
-import "github.com/antongulenko/RTP/protocols"
+import (
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
 
 type Client struct {
 	protocols.Client
+
+	// If >0, streams are started with this lease and renewed automatically until stopped.
+	Lease   time.Duration
+	renewer protocols.LeaseRenewer
 }
 
 func NewClient(client protocols.Client) (*Client, error) {
 	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
 		return nil, err
 	}
-	return &Client{client}, nil
+	return &Client{Client: client}, nil
 }
 
 func NewClientFor(server_addr string) (*Client, error) {
@@ -18,7 +26,12 @@ func NewClientFor(server_addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client}, nil
+	return &Client{Client: client}, nil
+}
+
+func (client *Client) Close() error {
+	client.renewer.StopAll()
+	return client.Client.Close()
 }
 
 func (client *Client) StartStream(clientHost string, port int, mediaFile string) error {
@@ -28,12 +41,53 @@ func (client *Client) StartStream(clientHost string, port int, mediaFile string)
 			Port:         port,
 		},
 		MediaFile: mediaFile,
+		Lease:     client.Lease,
 	}
 	reply, err := client.SendRequest(CodeStartStream, val)
 	if err != nil {
 		return err
 	}
-	return client.CheckReply(reply)
+	if err = client.CheckReply(reply); err != nil {
+		return err
+	}
+	if val.Lease > 0 {
+		client.startRenewing(val.ClientDescription, val.Lease)
+	}
+	return nil
+}
+
+// Must be called after the stream was redirected through the AMPcontrol protocol,
+// so that renewing the lease continues for the new client.
+func (client *Client) StreamRedirected(oldHost string, oldPort int, newHost string, newPort int) {
+	oldDesc := ClientDescription{ReceiverHost: oldHost, Port: oldPort}
+	client.renewer.Stop(oldDesc.Client())
+	if client.Lease > 0 {
+		client.startRenewing(ClientDescription{ReceiverHost: newHost, Port: newPort}, client.Lease)
+	}
+}
+
+// Take over renewing the lease of a stream started by another client, e.g. in another process.
+func (client *Client) AdoptStream(clientHost string, port int) {
+	if client.Lease > 0 {
+		client.startRenewing(ClientDescription{ReceiverHost: clientHost, Port: port}, client.Lease)
+	}
+}
+
+// Stop renewing the lease of a stream without stopping it, e.g. after another client adopted it.
+func (client *Client) ReleaseStream(clientHost string, port int) {
+	desc := ClientDescription{ReceiverHost: clientHost, Port: port}
+	client.renewer.Stop(desc.Client())
+}
+
+func (client *Client) startRenewing(desc ClientDescription, lease time.Duration) {
+	client.renewer.Start(desc.Client(), lease, func() error {
+		reply, err := client.SendRequest(CodeKeepAlive, &KeepAlive{desc})
+		if err != nil {
+			// Server might be temporarily unreachable, keep trying
+			return nil
+		}
+		return client.CheckReply(reply)
+	})
 }
 
 func (client *Client) StopStream(clientHost string, port int) error {
@@ -43,9 +97,24 @@ func (client *Client) StopStream(clientHost string, port int) error {
 			Port:         port,
 		},
 	}
+	client.renewer.Stop(val.Client())
 	reply, err := client.SendRequest(CodeStopStream, val)
 	if err != nil {
 		return err
 	}
 	return client.CheckReply(reply)
 }
+
+func (client *Client) KeepAlive(clientHost string, port int) error {
+	val := &KeepAlive{
+		ClientDescription{
+			ReceiverHost: clientHost,
+			Port:         port,
+		},
+	}
+	reply, err := client.SendRequest(CodeKeepAlive, val)
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
@@ -0,0 +1,16 @@
+package amp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzAmp(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: CodeStartStream, Val: &StartStream{ClientDescription{"127.0.0.1", 9000}, "video.mp4", time.Second}},
+		{Code: CodeStopStream, Val: &StopStream{ClientDescription{"127.0.0.1", 9000}}},
+		{Code: CodeKeepAlive, Val: &KeepAlive{ClientDescription{"127.0.0.1", 9000}}},
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 )
@@ -22,6 +23,10 @@ const (
 	CodeStopStream
 )
 
+const (
+	CodeKeepAlive = protocols.Code(24)
+)
+
 // ======================= Packets =======================
 
 type ClientDescription struct {
@@ -32,12 +37,17 @@ type ClientDescription struct {
 type StartStream struct {
 	ClientDescription
 	MediaFile string
+	Lease     time.Duration // If >0, the stream is stopped unless renewed with KeepAlive
 }
 
 type StopStream struct {
 	ClientDescription
 }
 
+type KeepAlive struct {
+	ClientDescription
+}
+
 func (client *ClientDescription) Client() string {
 	return net.JoinHostPort(client.ReceiverHost, strconv.Itoa(client.Port))
 }
@@ -55,6 +65,7 @@ func (proto *ampProtocol) Decoders() protocols.DecoderMap {
 	return protocols.DecoderMap{
 		CodeStartStream: proto.decodeStartStream,
 		CodeStopStream:  proto.decodeStopStream,
+		CodeKeepAlive:   proto.decodeKeepAlive,
 	}
 }
 
@@ -74,3 +85,12 @@ func (proto *ampProtocol) decodeStopStream(decoder *gob.Decoder) (interface{}, e
 	}
 	return &val, nil
 }
+
+func (proto *ampProtocol) decodeKeepAlive(decoder *gob.Decoder) (interface{}, error) {
+	var val KeepAlive
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding AMP KeepAlive value: %v", err)
+	}
+	return &val, nil
+}
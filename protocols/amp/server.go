@@ -10,6 +10,7 @@ type Handler interface {
 	StopServer()
 	StartStream(val *StartStream) error
 	StopStream(val *StopStream) error
+	KeepAlive(val *KeepAlive) error
 }
 
 func RegisterServer(server *protocols.Server, handler Handler) error {
@@ -23,6 +24,7 @@ func RegisterServer(server *protocols.Server, handler Handler) error {
 	if err := server.RegisterHandlers(protocols.ServerHandlerMap{
 		CodeStartStream: state.handleStartStream,
 		CodeStopStream:  state.handleStopStream,
+		CodeKeepAlive:   state.handleKeepAlive,
 	}); err != nil {
 		return err
 	}
@@ -56,3 +58,12 @@ func (server *serverState) handleStopStream(packet *protocols.Packet) *protocols
 		return server.ReplyError(fmt.Errorf("Illegal value for AMP StopStream: %v", packet.Val))
 	}
 }
+
+func (server *serverState) handleKeepAlive(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*KeepAlive); ok {
+		return server.ReplyCheck(server.handler.KeepAlive(desc))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for AMP KeepAlive: %v", packet.Val))
+	}
+}
@@ -0,0 +1,16 @@
+package amp_control
+
+import (
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/amp"
+)
+
+func FuzzAmpControl(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: CodeRedirectStream, Val: &RedirectStream{amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000}, amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 9002}}},
+		{Code: CodePauseStream, Val: &PauseStream{amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000}}},
+		{Code: CodeResumeStream, Val: &ResumeStream{amp.ClientDescription{ReceiverHost: "127.0.0.1", Port: 9000}}},
+	})
+}
@@ -4,17 +4,83 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
 )
 
+// Sessions, BackupSessions, Load and removed are guarded by Plugin.serversLock,
+// together with the servers of the BalancingSessions.
 type BackendServer struct {
 	Addr           protocols.Addr
 	Client         protocols.CircuitBreaker
-	Sessions       map[*BalancingSession]bool
+	Detector       protocols.FaultDetector
 	Plugin         *BalancingPlugin
+	Sessions       map[*BalancingSession]bool
 	BackupSessions uint
 	Load           float64 // 1 per session + backup_session_weight per backup session
+	removed        bool    // Removed from the plugin, the sessions are already failed over
+
+	// When the current sessions were moved to the server, in ascending order. Only kept
+	// until a load report received afterwards includes them, see CurrentLoad().
+	recentSessions []time.Time
+}
+
+// Implemented by FaultDetectors that receive load reports from the observed server, e.g. via heartbeats.
+// received is the local time when the latest report was received.
+type LoadReporter interface {
+	ReportedLoad() (load float64, received time.Time, ok bool)
+}
+
+// Plugin.serversLock must be held.
+// The load reported by the server itself, if available, plus the sessions registered
+// after the report was received and the weight of the backup sessions.
+// Otherwise, the load is estimated from the registered sessions.
+func (server *BackendServer) CurrentLoad() float64 {
+	if reporter, ok := server.Detector.(LoadReporter); ok {
+		if load, received, ok := reporter.ReportedLoad(); ok {
+			return load + float64(server.sessionsSince(received)) + float64(server.BackupSessions)*backup_session_weight
+		}
+	}
+	return server.Load
+}
+
+// The number of sessions that were moved to the server after the given time.
+// Older sessions are forgotten, the reports only get newer.
+func (server *BackendServer) sessionsSince(since time.Time) int {
+	older := sort.Search(len(server.recentSessions), func(i int) bool {
+		return server.recentSessions[i].After(since)
+	})
+	if older > 0 {
+		server.recentSessions = append(server.recentSessions[:0], server.recentSessions[older:]...)
+	}
+	return len(server.recentSessions)
+}
+
+func (server *BackendServer) addRecentSession(session *BalancingSession) {
+	session.primarySince = time.Now()
+	server.recentSessions = append(server.recentSessions, session.primarySince)
+}
+
+// The session left the server before a load report included it.
+func (server *BackendServer) removeRecentSession(session *BalancingSession) {
+	for i, since := range server.recentSessions {
+		if since.Equal(session.primarySince) {
+			server.recentSessions = append(server.recentSessions[:i], server.recentSessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// The round-trip time measured by the FaultDetector, if it measures the latency.
+func (server *BackendServer) Latency() (stats.RttSummary, bool) {
+	if detector, ok := server.Detector.(protocols.LatencyDetector); ok {
+		if summary := detector.Latency(); summary.Samples > 0 {
+			return summary, true
+		}
+	}
+	return stats.RttSummary{}, false
 }
 
 func (server *BackendServer) String() string {
@@ -28,7 +94,14 @@ func (slice BackendServerSlice) Len() int {
 	return len(slice)
 }
 func (slice BackendServerSlice) Less(i, j int) bool {
-	return slice[i].Load < slice[j].Load
+	loadI, loadJ := slice[i].CurrentLoad(), slice[j].CurrentLoad()
+	if loadI != loadJ {
+		return loadI < loadJ
+	}
+	// Equally loaded servers: prefer the one with the lower measured latency
+	latencyI, okI := slice[i].Latency()
+	latencyJ, okJ := slice[j].Latency()
+	return okI && okJ && latencyI.Smoothed < latencyJ.Smoothed
 }
 func (slice BackendServerSlice) Swap(i, j int) {
 	tmp := slice[i]
@@ -39,14 +112,22 @@ func (slice BackendServerSlice) Sort() {
 	sort.Sort(slice)
 }
 
-func (slice BackendServerSlice) pickServer(client string) (primary *BackendServer, backups BackendServerSlice) {
-	// Lowest loaded server for the primary, next lowest loaded servers for backups
-	sort.Sort(slice)
+// The strategy orders the servers, the first online server within its quota is the primary server.
+// The session is counted in the quota of the primary server, see ReserveBackend().
+// If no primary server is found because all online servers reached their quota,
+// the QuotaExceededError is returned.
+func (slice BackendServerSlice) pickServer(client string, strategy Strategy, quota *protocols.SessionQuota) (primary *BackendServer, backups BackendServerSlice, quotaErr error) {
+	ordered := strategy.Order(client, slice)
 	backups = make(BackendServerSlice, 0, num_backup_servers)
-	for i := 0; i < len(slice) && len(backups) < num_backup_servers; i++ {
-		if server := slice[i]; server.Client.Online() {
+	for i := 0; i < len(ordered) && len(backups) < num_backup_servers; i++ {
+		if server := ordered[i]; server.Client.Online() {
 			if primary == nil {
+				if err := quota.ReserveBackend(server.Addr.String()); err != nil {
+					quotaErr = err
+					continue
+				}
 				primary = server
+				quotaErr = nil
 			} else {
 				backups = append(backups, server)
 			}
@@ -73,18 +154,28 @@ func (_slice *BackendServerSlice) removeServer(toRemove *BackendServer) {
 	*_slice = slice[:len(slice)-1]
 }
 
-func (server *BackendServer) registerSession(session *BalancingSession) {
+// The session must already be counted in the quota of the server, see pickServer().
+// Plugin.serversLock must be held. Fails, if the server was removed in the meantime.
+func (server *BackendServer) registerSession(session *BalancingSession) error {
+	if server.removed {
+		return fmt.Errorf("%v was removed", server)
+	}
+	server.addRecentSession(session)
 	server.Sessions[session] = true
 	server.Load++
 	for _, backup := range session.BackupServers {
 		backup.BackupSessions++
 		backup.Load += backup_session_weight
 	}
+	return nil
 }
 
+// Plugin.serversLock must be held.
 func (server *BackendServer) unregisterSession(session *BalancingSession) {
 	delete(server.Sessions, session)
+	server.removeRecentSession(session)
 	server.Load--
+	server.Plugin.Server.Quota.RemoveBackend(server.Addr.String())
 	for _, backup := range session.BackupServers {
 		backup.BackupSessions--
 		backup.Load -= backup_session_weight
@@ -98,20 +189,53 @@ type failoverResults struct {
 }
 
 func (server *BackendServer) handleStateChanged() {
+	server.Plugin.serversLock.Lock()
+	removed := server.removed
+	server.Plugin.serversLock.Unlock()
+	if removed {
+		return
+	}
 	if err := server.Client.Error(); err != nil {
 		// Server fault detected!
+		server.failoverSessions(nil)
+	}
+}
+
+// Asynchronously fail over all sessions of the server. done is called afterwards, if not nil.
+func (server *BackendServer) failoverSessions(done func()) {
+	go func() {
+		sessions := server.committedSessions()
+		failoverChan := make(chan failoverResults, len(sessions))
+		var wg sync.WaitGroup
+		wg.Add(len(sessions))
+		for _, session := range sessions {
+			go server.failoverSession(session, failoverChan, &wg)
+		}
+		finished := make(chan struct{})
 		go func() {
-			failoverChan := make(chan failoverResults, len(server.Sessions))
-			var wg sync.WaitGroup
-			wg.Add(len(server.Sessions))
-			for session := range server.Sessions {
-				go server.failoverSession(session, failoverChan, &wg)
-			}
-			go server.handleFinishedFailovers(failoverChan)
-			wg.Wait()
-			close(failoverChan)
+			server.handleFinishedFailovers(failoverChan)
+			close(finished)
 		}()
+		wg.Wait()
+		close(failoverChan)
+		<-finished
+		if done != nil {
+			done()
+		}
+	}()
+}
+
+// Sessions that are not committed yet are not failed over. They fail to commit, if the server was removed.
+func (server *BackendServer) committedSessions() []*BalancingSession {
+	server.Plugin.serversLock.Lock()
+	defer server.Plugin.serversLock.Unlock()
+	sessions := make([]*BalancingSession, 0, len(server.Sessions))
+	for session := range server.Sessions {
+		if session.Handler != nil {
+			sessions = append(sessions, session)
+		}
 	}
+	return sessions
 }
 
 func (server *BackendServer) failoverSession(session *BalancingSession, failoverChan chan<- failoverResults, wg *sync.WaitGroup) {
@@ -126,25 +250,66 @@ func (server *BackendServer) failoverSession(session *BalancingSession, failover
 func (server *BackendServer) handleFinishedFailovers(failoverChan <-chan failoverResults) {
 	for failover := range failoverChan {
 		newServer, session, failoverErr := failover.newServer, failover.session, failover.err
+		var moved bool
 		if failoverErr == nil {
-			// Remove session from old server
-			server.Load--
-			session.BackupServers.removeServer(server)
-			delete(server.Sessions, session)
-
-			// Add session to new server
-			newServer.BackupSessions--
-			newServer.Load += 1 - backup_session_weight
-			newServer.Sessions[session] = true
-			session.PrimaryServer = newServer
-
-			session.LogServerError(fmt.Errorf("Session for %v failed over to %v", session.Client, newServer))
-		} else {
+			moved, failoverErr = server.moveSession(session, newServer)
+		}
+		if failoverErr != nil {
 			// Failover failed - stop session
 			err := fmt.Errorf("Could not handle server fault for session %v: %v", session.Client, failoverErr)
 			session.LogServerError(err)
 			session.failoverError = err
+			server.publishFailover(session, nil, err)
 			_ = session.StopContainingSession() // Drop error
+		} else if moved {
+			session.LogServerError(fmt.Errorf("Session for %v failed over to %v", session.Client, newServer))
+			if err := session.Plugin.Server.UpdateJournal(session.Client); err != nil {
+				session.LogServerError(fmt.Errorf("Error updating journal for session %v: %v", session.Client, err))
+			}
+			server.publishFailover(session, newServer, nil)
 		}
 	}
 }
+
+// Returns false, if the handler keeps the session on the server, hoping that it comes back online.
+func (server *BackendServer) moveSession(session *BalancingSession, newServer *BackendServer) (bool, error) {
+	server.Plugin.serversLock.Lock()
+	defer server.Plugin.serversLock.Unlock()
+	if newServer == server {
+		if !server.removed {
+			return false, nil
+		}
+		return false, fmt.Errorf("%v was removed and no other server took over the session", server)
+	}
+
+	// Remove session from old server
+	server.Load--
+	session.BackupServers.removeServer(server)
+	delete(server.Sessions, session)
+	server.removeRecentSession(session)
+	server.Plugin.Server.Quota.RemoveBackend(server.Addr.String())
+
+	// Add session to new server
+	newServer.BackupSessions--
+	newServer.Load += 1 - backup_session_weight
+	newServer.Sessions[session] = true
+	newServer.addRecentSession(session)
+	newServer.Plugin.Server.Quota.AddBackend(newServer.Addr.String())
+	session.PrimaryServer = newServer
+	return true, nil
+}
+
+// Published to the events of the PluginServer. Session is the *BalancingSession.
+func (server *BackendServer) publishFailover(session *BalancingSession, newServer *BackendServer, err error) {
+	event := &protocols.SessionEvent{
+		Type:    protocols.SessionFailoverEvent,
+		Key:     session.Client,
+		Session: session,
+		From:    server.Addr.String(),
+		Err:     err,
+	}
+	if newServer != nil {
+		event.To = newServer.Addr.String()
+	}
+	server.Plugin.Server.Events.Publish(event)
+}
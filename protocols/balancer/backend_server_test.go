@@ -0,0 +1,162 @@
+package balancer
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Only implements LoadReporter, the other methods of the FaultDetector must not be called.
+type testLoadDetector struct {
+	protocols.FaultDetector
+	load     float64
+	received time.Time
+	ok       bool
+}
+
+func (detector *testLoadDetector) ReportedLoad() (float64, time.Time, bool) {
+	return detector.load, detector.received, detector.ok
+}
+
+func TestCurrentLoad(t *testing.T) {
+	now := time.Now()
+	before, after := now.Add(-time.Second), now.Add(time.Second)
+	for _, test := range []struct {
+		name     string
+		detector protocols.FaultDetector
+		sessions []time.Time // primarySince of the registered sessions, ascending
+		backups  uint
+		expected float64
+	}{
+		{"no reporter", nil, []time.Time{before, after}, 2, 2 + 2*backup_session_weight},
+		{"no report", &testLoadDetector{load: 10}, []time.Time{before}, 0, 1},
+		{"reported", &testLoadDetector{load: 0.5, received: now, ok: true}, nil, 0, 0.5},
+		{"sessions before report", &testLoadDetector{load: 0.5, received: now, ok: true},
+			[]time.Time{before, before}, 0, 0.5},
+		{"sessions after report", &testLoadDetector{load: 0.5, received: now, ok: true},
+			[]time.Time{before, after, after}, 0, 2.5},
+		{"backups", &testLoadDetector{load: 3, received: now, ok: true},
+			[]time.Time{after}, 4, 4 + 4*backup_session_weight},
+	} {
+		server := &BackendServer{
+			Detector:       test.detector,
+			Sessions:       make(map[*BalancingSession]bool),
+			BackupSessions: test.backups,
+		}
+		for _, since := range test.sessions {
+			server.Sessions[&BalancingSession{primarySince: since}] = true
+			server.recentSessions = append(server.recentSessions, since)
+			server.Load++
+		}
+		server.Load += float64(test.backups) * backup_session_weight
+		if load := server.CurrentLoad(); load != test.expected {
+			t.Errorf("%v: CurrentLoad() = %v, expected %v", test.name, load, test.expected)
+		}
+	}
+}
+
+// Marks sessions as committed, its methods must not be called.
+type testHandler struct {
+	BalancingSessionHandler
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	plugin := NewBalancingPlugin(nil, nil)
+	plugin.Server = &protocols.PluginServer{Quota: protocols.NewSessionQuota()}
+	servers := newTestServers(t, 0, 0)
+	for _, server := range servers {
+		server.Plugin = plugin
+	}
+	plugin.BackendServers = servers
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				plugin.serversLock.Lock()
+				primary, backups, _ := plugin.BackendServers.pickServer("127.0.0.1:5000", plugin.Strategy, plugin.Server.Quota)
+				session := &BalancingSession{Plugin: plugin, PrimaryServer: primary, BackupServers: backups, Handler: testHandler{}}
+				err := primary.registerSession(session)
+				plugin.serversLock.Unlock()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				session.Servers()
+				session.unregister()
+			}
+		}()
+	}
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *BackendServer) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				server.committedSessions()
+			}
+		}(server)
+	}
+	wg.Wait()
+	for _, server := range servers {
+		if len(server.Sessions) != 0 || server.Load != 0 || server.BackupSessions != 0 {
+			t.Errorf("%v: %v sessions, load %v, %v backup sessions left", server.Addr, len(server.Sessions), server.Load, server.BackupSessions)
+		}
+	}
+	if usage := plugin.Server.Quota.Usage(); len(usage.Backends) != 0 {
+		t.Errorf("Backend quota not released: %v", usage.Backends)
+	}
+}
+
+func TestRemovedServer(t *testing.T) {
+	plugin := NewBalancingPlugin(nil, nil)
+	servers := newTestServers(t, 0)
+	servers[0].Plugin = plugin
+	servers[0].removed = true
+	session := &BalancingSession{Plugin: plugin, PrimaryServer: servers[0]}
+	if err := servers[0].registerSession(session); err == nil {
+		t.Errorf("Session registered at a removed server")
+	}
+	if len(servers[0].Sessions) != 0 || servers[0].Load != 0 {
+		t.Errorf("Removed server has sessions or load")
+	}
+}
+
+func TestRecentSessions(t *testing.T) {
+	plugin := NewBalancingPlugin(nil, nil)
+	plugin.Server = &protocols.PluginServer{Quota: protocols.NewSessionQuota()}
+	detector := &testLoadDetector{load: 1, received: time.Now(), ok: true}
+	server := newTestServers(t, 0)[0]
+	server.Plugin = plugin
+	server.Detector = detector
+	sessions := make([]*BalancingSession, 3)
+	for i := range sessions {
+		sessions[i] = &BalancingSession{Plugin: plugin, PrimaryServer: server}
+		if err := server.registerSession(sessions[i]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, test := range []struct {
+		name     string
+		action   func()
+		expected float64
+	}{
+		{"registered after report", func() {}, 4},
+		{"unregistered before report", func() { server.unregisterSession(sessions[1]) }, 3},
+		{"report includes first session", func() { detector.received = sessions[0].primarySince }, 2},
+		{"report includes all sessions", func() { detector.received = time.Now() }, 1},
+		{"unregistered after report", func() { server.unregisterSession(sessions[2]) }, 1},
+	} {
+		test.action()
+		if load := server.CurrentLoad(); load != test.expected {
+			t.Errorf("%v: CurrentLoad() = %v, expected %v", test.name, load, test.expected)
+		}
+	}
+	if len(server.recentSessions) != 0 {
+		t.Errorf("Sessions included in the load report are still kept: %v", server.recentSessions)
+	}
+}
@@ -3,8 +3,11 @@ package balancer
 import (
 	"fmt"
 	"sort"
+	"sync"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/golib"
 )
 
@@ -17,7 +20,11 @@ type FaultDetectorFactory func(endpoint string) (protocols.FaultDetector, error)
 
 type BalancingPlugin struct {
 	Server         *protocols.PluginServer
-	BackendServers BackendServerSlice
+	BackendServers BackendServerSlice // Guarded by serversLock, servers can be added and removed at runtime
+	serversLock    sync.Mutex         // Also guards the sessions and load of the BackendServers
+
+	// Selects the servers for new sessions. Defaults to LeastLoad, can be replaced before the first session.
+	Strategy Strategy
 
 	make_detector FaultDetectorFactory
 	handler       BalancingPluginHandler
@@ -27,10 +34,27 @@ type BalancingPluginHandler interface {
 	NewClient(detector protocols.FaultDetector) (protocols.CircuitBreaker, error)
 	Protocol() protocols.Protocol
 
-	// Create and fully initialize new session. The param data is passed from
-	// plugin to plugin, enabling one plugin to modify the input data for the next plugin.
+	// Reserve the resources for a new session on balancingSession.PrimaryServer, without starting it.
+	// The param data is passed from plugin to plugin, enabling one plugin to modify the input data for the next plugin.
 	// Modify param if necessary and copy values from it. Do not store it.
-	NewSession(balancingSession *BalancingSession, param protocols.SessionParameter) (BalancingSessionHandler, error)
+	// Return protocols.SkipPlugin to not take part in this session.
+	PrepareSession(balancingSession *BalancingSession, param protocols.SessionParameter) (PreparedBalancingSession, error)
+
+	// Stop the remote resources of a session that was orphaned in the journal.
+	// value was returned by BalancingSessionHandler.JournalValue().
+	CleanupOrphanedSession(server *BackendServer, value interface{}) error
+
+	// Take over the remote resources of a session migrated from another balancer.
+	// value was returned by BalancingSessionHandler.JournalValue().
+	AdoptSession(balancingSession *BalancingSession, value interface{}) (BalancingSessionHandler, error)
+}
+
+type PreparedBalancingSession interface {
+	Commit() (BalancingSessionHandler, error)
+
+	// Release the remote resources, or stop the remote session if it was already committed.
+	// Only return an error if the backend server did not confirm this, the abort will be retried.
+	Abort() error
 }
 
 type BalancingSession struct {
@@ -39,15 +63,37 @@ type BalancingSession struct {
 	SendingSession protocols.PluginSessionHandler
 	Handler        BalancingSessionHandler
 
+	// Guarded by Plugin.serversLock, changed when failing over
 	PrimaryServer *BackendServer
 	BackupServers BackendServerSlice
+
 	failoverError error
+	primarySince  time.Time // When the session was registered at PrimaryServer
 }
 
 type BalancingSessionHandler interface {
 	StopRemote() error
 	RedirectStream(newHost string, newPort int) error
 	HandleServerFault() (*BackendServer, error)
+
+	// Everything needed to stop the remote resources of the session after a restart,
+	// or to adopt the session in another balancer.
+	// The type of the result must be registered with protocols.RegisterJournalValue.
+	JournalValue() interface{}
+
+	// Stop handling the session locally, e.g. renewing its lease, without stopping the
+	// remote resources. Called after the session was migrated to another balancer.
+	Release()
+}
+
+type JournalValue struct {
+	Server  string   // Address of the primary BackendServer
+	Backups []string // Addresses of the backup BackendServers
+	Value   interface{}
+}
+
+func init() {
+	protocols.RegisterJournalValue(new(JournalValue))
 }
 
 func NewBalancingPlugin(handler BalancingPluginHandler, make_detector FaultDetectorFactory) *BalancingPlugin {
@@ -55,6 +101,7 @@ func NewBalancingPlugin(handler BalancingPluginHandler, make_detector FaultDetec
 		handler:        handler,
 		BackendServers: make(BackendServerSlice, 0, 10),
 		make_detector:  make_detector,
+		Strategy:       new(LeastLoad),
 	}
 }
 
@@ -82,11 +129,14 @@ func (plugin *BalancingPlugin) AddBackendServer(addr string, callback protocols.
 	server := &BackendServer{
 		Addr:     serverAddr,
 		Client:   client,
+		Detector: detector,
 		Sessions: make(map[*BalancingSession]bool),
 		Plugin:   plugin,
 	}
+	plugin.serversLock.Lock()
 	plugin.BackendServers = append(plugin.BackendServers, server)
 	sort.Sort(plugin.BackendServers)
+	plugin.serversLock.Unlock()
 	if callback != nil {
 		client.AddCallback(callback, client)
 	}
@@ -94,14 +144,59 @@ func (plugin *BalancingPlugin) AddBackendServer(addr string, callback protocols.
 	return nil
 }
 
+// The server does not receive new sessions anymore. Its running sessions are failed over,
+// and the connection to it is closed afterwards.
+func (plugin *BalancingPlugin) RemoveBackendServer(addr string) error {
+	serverAddr, err := plugin.Server.Protocol().Transport().Resolve(addr)
+	if err != nil {
+		return fmt.Errorf("Error resolving backend server: %v", err)
+	}
+	plugin.serversLock.Lock()
+	server := plugin.findServerLocked(serverAddr.String())
+	if server != nil {
+		server.removed = true
+		plugin.BackendServers.removeServer(server)
+	}
+	plugin.serversLock.Unlock()
+	if server == nil {
+		return fmt.Errorf("Unknown %s backend server %v", plugin.handler.Protocol().Name(), addr)
+	}
+	server.failoverSessions(func() {
+		if err := server.Client.Close(); err != nil {
+			plugin.Server.LogError(fmt.Errorf("Error closing connection to %s: %v", server.Client, err))
+		}
+	})
+	return nil
+}
+
 func (plugin *BalancingPlugin) Start(server *protocols.PluginServer) {
 	plugin.Server = server
 }
 
 func (plugin *BalancingPlugin) NewSession(param protocols.SessionParameter) (protocols.PluginSessionHandler, error) {
+	prepared, err := plugin.PrepareSession(param)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := prepared.Commit()
+	if err != nil {
+		if abortErr := prepared.Abort(); abortErr != nil {
+			plugin.Server.LogError(fmt.Errorf("Error aborting %s session after failed commit: %v", plugin.handler.Protocol().Name(), abortErr))
+		}
+		return nil, err
+	}
+	return handler, nil
+}
+
+func (plugin *BalancingPlugin) PrepareSession(param protocols.SessionParameter) (protocols.PreparedSession, error) {
 	clientAddr := param.Client()
-	server, backups := plugin.BackendServers.pickServer(clientAddr)
+	plugin.serversLock.Lock()
+	server, backups, quotaErr := plugin.BackendServers.pickServer(clientAddr, plugin.Strategy, plugin.Server.Quota)
+	plugin.serversLock.Unlock()
 	if server == nil {
+		if quotaErr != nil {
+			return nil, quotaErr
+		}
 		return nil, fmt.Errorf("No %s server available to handle your request", plugin.handler.Protocol().Name())
 	}
 	session := &BalancingSession{
@@ -110,17 +205,37 @@ func (plugin *BalancingPlugin) NewSession(param protocols.SessionParameter) (pro
 		Client:        clientAddr,
 		BackupServers: backups,
 	}
-	var err error
-	session.Handler, err = plugin.handler.NewSession(session, param)
+	prepared, err := plugin.handler.PrepareSession(session, param)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create %s session: %s", plugin.handler.Protocol().Name(), err)
+		plugin.Server.Quota.RemoveBackend(server.Addr.String())
 	}
-	server.registerSession(session)
-	return session, nil
+	if err == protocols.SkipPlugin {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to prepare %s session: %s", plugin.handler.Protocol().Name(), err)
+	}
+	// The capacity of the backend servers stays reserved until the session is aborted or cleaned up.
+	plugin.serversLock.Lock()
+	err = server.registerSession(session)
+	plugin.serversLock.Unlock()
+	if err != nil {
+		plugin.Server.Quota.RemoveBackend(server.Addr.String())
+		if abortErr := prepared.Abort(); abortErr != nil {
+			plugin.Server.LogError(fmt.Errorf("Error aborting %s session: %v", plugin.handler.Protocol().Name(), abortErr))
+		}
+		return nil, fmt.Errorf("Failed to prepare %s session: %s", plugin.handler.Protocol().Name(), err)
+	}
+	return &preparedSession{
+		session:  session,
+		prepared: prepared,
+	}, nil
 }
 
 func (plugin *BalancingPlugin) Stop() error {
 	var errors golib.MultiError
+	plugin.serversLock.Lock()
+	defer plugin.serversLock.Unlock()
 	for _, server := range plugin.BackendServers {
 		if err := server.Client.Close(); err != nil {
 			errors = append(errors, fmt.Errorf("Error closing connection to %s: %v", server.Client, err))
@@ -129,6 +244,81 @@ func (plugin *BalancingPlugin) Stop() error {
 	return errors.NilOrError()
 }
 
+// Implements protocols.ObservingPlugin.
+func (plugin *BalancingPlugin) DetectorHistories() []*protocols.DetectorHistory {
+	plugin.serversLock.Lock()
+	defer plugin.serversLock.Unlock()
+	histories := make([]*protocols.DetectorHistory, 0, len(plugin.BackendServers))
+	for _, server := range plugin.BackendServers {
+		histories = append(histories, server.Detector.History())
+	}
+	return histories
+}
+
+func (plugin *BalancingPlugin) CleanupOrphanedSession(value interface{}) error {
+	journaled, ok := value.(*JournalValue)
+	if !ok {
+		return fmt.Errorf("Illegal journal value for %s session: (%T) %v", plugin.handler.Protocol().Name(), value, value)
+	}
+	if server := plugin.findServer(journaled.Server); server != nil {
+		return plugin.handler.CleanupOrphanedSession(server, journaled.Value)
+	}
+	return fmt.Errorf("Orphaned %s session on unknown server %v", plugin.handler.Protocol().Name(), journaled.Server)
+}
+
+func (plugin *BalancingPlugin) AdoptSession(client string, value interface{}) (protocols.PluginSessionHandler, error) {
+	journaled, ok := value.(*JournalValue)
+	if !ok {
+		return nil, fmt.Errorf("Illegal migrated %s session: (%T) %v", plugin.handler.Protocol().Name(), value, value)
+	}
+	server := plugin.findServer(journaled.Server)
+	if server == nil {
+		return nil, fmt.Errorf("Migrated %s session on unknown server %v", plugin.handler.Protocol().Name(), journaled.Server)
+	}
+	session := &BalancingSession{
+		PrimaryServer: server,
+		Plugin:        plugin,
+		Client:        client,
+	}
+	for _, addr := range journaled.Backups {
+		// Backup servers unknown to this balancer are not used
+		if backup := plugin.findServer(addr); backup != nil {
+			session.BackupServers = append(session.BackupServers, backup)
+		}
+	}
+	handler, err := plugin.handler.AdoptSession(session, journaled.Value)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to adopt %s session: %s", plugin.handler.Protocol().Name(), err)
+	}
+	// Migrated sessions are taken over regardless of the backend limits
+	plugin.Server.Quota.AddBackend(server.Addr.String())
+	plugin.serversLock.Lock()
+	session.Handler = handler
+	err = server.registerSession(session)
+	plugin.serversLock.Unlock()
+	if err != nil {
+		plugin.Server.Quota.RemoveBackend(server.Addr.String())
+		handler.Release()
+		return nil, fmt.Errorf("Failed to adopt %s session: %s", plugin.handler.Protocol().Name(), err)
+	}
+	return session, nil
+}
+
+func (plugin *BalancingPlugin) findServer(addr string) *BackendServer {
+	plugin.serversLock.Lock()
+	defer plugin.serversLock.Unlock()
+	return plugin.findServerLocked(addr)
+}
+
+func (plugin *BalancingPlugin) findServerLocked(addr string) *BackendServer {
+	for _, server := range plugin.BackendServers {
+		if server.Addr.String() == addr {
+			return server
+		}
+	}
+	return nil
+}
+
 func (plugin *BalancingPlugin) serverStateChanged(key interface{}) {
 	server, ok := key.(*BackendServer)
 	if !ok {
@@ -146,9 +336,43 @@ func (plugin *BalancingPlugin) assertStarted() {
 	}
 }
 
+type preparedSession struct {
+	session  *BalancingSession
+	prepared PreparedBalancingSession
+	released bool
+}
+
+func (prepared *preparedSession) Commit() (protocols.PluginSessionHandler, error) {
+	handler, err := prepared.prepared.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start %s session: %s", prepared.session.Plugin.handler.Protocol().Name(), err)
+	}
+	session := prepared.session
+	session.Plugin.serversLock.Lock()
+	session.Handler = handler
+	removed := session.PrimaryServer.removed
+	session.Plugin.serversLock.Unlock()
+	if removed {
+		// The session was not failed over, it will be aborted
+		return nil, fmt.Errorf("Failed to start %s session: %v was removed", session.Plugin.handler.Protocol().Name(), session.PrimaryServer)
+	}
+	return session, nil
+}
+
+func (prepared *preparedSession) Abort() error {
+	if err := prepared.prepared.Abort(); err != nil {
+		return err
+	}
+	if !prepared.released {
+		prepared.released = true
+		prepared.session.unregister()
+	}
+	return nil
+}
+
 func (session *BalancingSession) StopContainingSession() error {
 	session.Plugin.assertStarted()
-	return session.Plugin.Server.StopSession(session.Client)
+	return session.Plugin.Server.StopSession(session.Client, protocols.StopFailoverFailed)
 }
 
 func (session *BalancingSession) LogServerError(err error) {
@@ -158,15 +382,30 @@ func (session *BalancingSession) LogServerError(err error) {
 
 func (session *BalancingSession) Start(sendingSession protocols.PluginSessionHandler) {
 	session.SendingSession = sendingSession
-	// Nothing else to do. BalancingSession.NewSession() fully starts the session.
+	// Nothing else to do. The session was fully started when it was committed.
 }
 
 func (session *BalancingSession) Tasks() []golib.Task {
 	return nil // No tasks
 }
 
-func (session *BalancingSession) Cleanup() error {
+func (session *BalancingSession) unregister() {
+	session.Plugin.serversLock.Lock()
+	defer session.Plugin.serversLock.Unlock()
 	session.PrimaryServer.unregisterSession(session)
+}
+
+// The current primary server, and a copy of the backup servers.
+func (session *BalancingSession) Servers() (*BackendServer, BackendServerSlice) {
+	session.Plugin.serversLock.Lock()
+	defer session.Plugin.serversLock.Unlock()
+	backups := make(BackendServerSlice, len(session.BackupServers))
+	copy(backups, session.BackupServers)
+	return session.PrimaryServer, backups
+}
+
+func (session *BalancingSession) Cleanup() error {
+	session.unregister()
 	if session.failoverError == nil {
 		return session.Handler.StopRemote()
 	} else {
@@ -175,6 +414,33 @@ func (session *BalancingSession) Cleanup() error {
 	}
 }
 
+func (session *BalancingSession) DescribeSession(info *session_query.SessionInfo) {
+	primary, _ := session.Servers()
+	info.Servers = append(info.Servers, primary.Addr.String())
+	if described, ok := session.Handler.(session_query.DescribedSession); ok {
+		described.DescribeSession(info)
+	}
+}
+
+func (session *BalancingSession) JournalValue() interface{} {
+	primary, backupServers := session.Servers()
+	backups := make([]string, len(backupServers))
+	for i, backup := range backupServers {
+		backups[i] = backup.Addr.String()
+	}
+	return &JournalValue{
+		Server:  primary.Addr.String(),
+		Backups: backups,
+		Value:   session.Handler.JournalValue(),
+	}
+}
+
+func (session *BalancingSession) Release() {
+	session.unregister()
+	session.Handler.Release()
+}
+
 func (session *BalancingSession) String() string {
-	return session.PrimaryServer.String()
+	primary, _ := session.Servers()
+	return primary.String()
 }
@@ -0,0 +1,280 @@
+package balancer
+
+// Strategies for selecting the primary and backup servers of new sessions
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	consistent_hash_replicas = 100 // Points per server on the hash ring
+)
+
+var (
+	strategyRand     = rand.New(rand.NewSource(time.Now().Unix()))
+	strategyRandLock sync.Mutex
+
+	// Names accepted by NewStrategy
+	StrategyNames = []string{"least-load", "round-robin", "weighted-random", "power-of-two", "consistent-hash"}
+)
+
+// Orders the backend servers for a new session. The first online server that is within its quota
+// becomes the primary server, the following online servers become backup servers.
+type Strategy interface {
+	// Must not modify servers. Offline servers can be included, they are skipped.
+	Order(client string, servers BackendServerSlice) BackendServerSlice
+	String() string
+}
+
+// Strategies can keep state, so every BalancingPlugin needs its own instance.
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "least-load":
+		return new(LeastLoad), nil
+	case "round-robin":
+		return new(RoundRobin), nil
+	case "weighted-random":
+		return new(WeightedRandom), nil
+	case "power-of-two":
+		return new(PowerOfTwo), nil
+	case "consistent-hash":
+		return new(ConsistentHash), nil
+	}
+	return nil, fmt.Errorf("Unknown balancing strategy %v, must be one of %v", name, strings.Join(StrategyNames, ", "))
+}
+
+func randIntn(n int) int {
+	strategyRandLock.Lock()
+	defer strategyRandLock.Unlock()
+	return strategyRand.Intn(n)
+}
+
+func randFloat64() float64 {
+	strategyRandLock.Lock()
+	defer strategyRandLock.Unlock()
+	return strategyRand.Float64()
+}
+
+func sortedByLoad(servers BackendServerSlice) BackendServerSlice {
+	result := make(BackendServerSlice, len(servers))
+	copy(result, servers)
+	sort.Sort(result)
+	return result
+}
+
+// ======================= Least load =======================
+
+// Lowest loaded server for the primary, next lowest loaded servers for backups.
+type LeastLoad struct {
+}
+
+func (*LeastLoad) Order(client string, servers BackendServerSlice) BackendServerSlice {
+	return sortedByLoad(servers)
+}
+
+func (*LeastLoad) String() string {
+	return "least-load"
+}
+
+// ======================= Round robin =======================
+
+// Every session starts at the server following the previous start server.
+// Backups are the servers following the primary server.
+type RoundRobin struct {
+	lock sync.Mutex
+	next int
+}
+
+func (strategy *RoundRobin) Order(client string, servers BackendServerSlice) BackendServerSlice {
+	if len(servers) == 0 {
+		return nil
+	}
+	strategy.lock.Lock()
+	start := strategy.next % len(servers)
+	strategy.next = start + 1
+	strategy.lock.Unlock()
+	result := make(BackendServerSlice, 0, len(servers))
+	result = append(result, servers[start:]...)
+	return append(result, servers[:start]...)
+}
+
+func (*RoundRobin) String() string {
+	return "round-robin"
+}
+
+// ======================= Weighted random =======================
+
+// Servers are drawn randomly without replacement, with a probability proportional to 1 / (1 + load).
+type WeightedRandom struct {
+}
+
+func (*WeightedRandom) Order(client string, servers BackendServerSlice) BackendServerSlice {
+	remaining := make(BackendServerSlice, len(servers))
+	copy(remaining, servers)
+	weights := make([]float64, len(remaining))
+	var total float64
+	for i, server := range remaining {
+		weights[i] = 1 / (1 + server.CurrentLoad())
+		total += weights[i]
+	}
+	result := make(BackendServerSlice, 0, len(servers))
+	for len(remaining) > 0 {
+		chosen := len(remaining) - 1
+		point := randFloat64() * total
+		for i, weight := range weights {
+			if point < weight {
+				chosen = i
+				break
+			}
+			point -= weight
+		}
+		result = append(result, remaining[chosen])
+		total -= weights[chosen]
+		remaining = append(remaining[:chosen], remaining[chosen+1:]...)
+		weights = append(weights[:chosen], weights[chosen+1:]...)
+	}
+	return result
+}
+
+func (*WeightedRandom) String() string {
+	return "weighted-random"
+}
+
+// ======================= Power of two choices =======================
+
+// The lower loaded of two random servers is the primary server, the other one the first backup.
+// The remaining servers follow ordered by load.
+type PowerOfTwo struct {
+}
+
+func (*PowerOfTwo) Order(client string, servers BackendServerSlice) BackendServerSlice {
+	if len(servers) < 2 {
+		return sortedByLoad(servers)
+	}
+	first := randIntn(len(servers))
+	second := randIntn(len(servers) - 1)
+	if second >= first {
+		second++
+	}
+	a, b := servers[first], servers[second]
+	if b.CurrentLoad() < a.CurrentLoad() {
+		a, b = b, a
+	}
+	result := make(BackendServerSlice, 0, len(servers))
+	result = append(result, a, b)
+	for _, server := range sortedByLoad(servers) {
+		if server != a && server != b {
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+func (*PowerOfTwo) String() string {
+	return "power-of-two"
+}
+
+// ======================= Consistent hashing =======================
+
+// Sessions of the same client host go to the same server, as long as it is online.
+// Adding or removing a server only moves the clients of that server.
+// Backups are the next distinct servers on the hash ring.
+type ConsistentHash struct {
+	lock    sync.Mutex
+	ring    hashRing
+	servers BackendServerSlice // The servers the ring was built for
+}
+
+type hashRingPoint struct {
+	hash   uint32
+	server *BackendServer
+}
+
+type hashRing []hashRingPoint
+
+func (strategy *ConsistentHash) Order(client string, servers BackendServerSlice) BackendServerSlice {
+	if len(servers) == 0 {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	strategy.lock.Lock()
+	defer strategy.lock.Unlock()
+	strategy.updateRing(servers)
+	ring := strategy.ring
+	hash := hashString(client)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	result := make(BackendServerSlice, 0, len(servers))
+	added := make(map[*BackendServer]bool, len(servers))
+	for i := 0; i < len(ring) && len(result) < len(servers); i++ {
+		server := ring[(start+i)%len(ring)].server
+		if !added[server] {
+			added[server] = true
+			result = append(result, server)
+		}
+	}
+	return result
+}
+
+func (strategy *ConsistentHash) updateRing(servers BackendServerSlice) {
+	if strategy.ring != nil && sameServers(servers, strategy.servers) {
+		return
+	}
+	ring := make(hashRing, 0, len(servers)*consistent_hash_replicas)
+	for _, server := range servers {
+		addr := server.Addr.String()
+		for replica := 0; replica < consistent_hash_replicas; replica++ {
+			hash := hashString(addr + "#" + strconv.Itoa(replica))
+			ring = append(ring, hashRingPoint{hash, server})
+		}
+	}
+	sort.Sort(ring)
+	strategy.ring = ring
+	strategy.servers = make(BackendServerSlice, len(servers))
+	copy(strategy.servers, servers)
+}
+
+func sameServers(a, b BackendServerSlice) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (*ConsistentHash) String() string {
+	return "consistent-hash"
+}
+
+// md5 spreads similar strings like addresses evenly over the ring, unlike simpler hash functions.
+func hashString(str string) uint32 {
+	sum := md5.Sum([]byte(str))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Implement sort.Interface
+func (ring hashRing) Len() int {
+	return len(ring)
+}
+func (ring hashRing) Less(i, j int) bool {
+	return ring[i].hash < ring[j].hash
+}
+func (ring hashRing) Swap(i, j int) {
+	ring[i], ring[j] = ring[j], ring[i]
+}
@@ -0,0 +1,237 @@
+package balancer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Only implements Online(), the other methods of the CircuitBreaker must not be called.
+type testBreaker struct {
+	protocols.CircuitBreaker
+	online bool
+}
+
+func (breaker *testBreaker) Online() bool {
+	return breaker.online
+}
+
+func newTestServers(t *testing.T, loads ...float64) BackendServerSlice {
+	servers := make(BackendServerSlice, len(loads))
+	for i, load := range loads {
+		addr, err := protocols.UdpTransport().Resolve(fmt.Sprintf("127.0.0.1:%v", 8000+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers[i] = &BackendServer{
+			Addr:     addr,
+			Client:   &testBreaker{online: true},
+			Sessions: make(map[*BalancingSession]bool),
+			Load:     load,
+		}
+	}
+	return servers
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range StrategyNames {
+		strategy, err := NewStrategy(name)
+		if err != nil {
+			t.Errorf("NewStrategy(%v): %v", name, err)
+		} else if strategy.String() != name {
+			t.Errorf("NewStrategy(%v) returned %v", name, strategy)
+		}
+	}
+	if _, err := NewStrategy("unknown"); err == nil {
+		t.Errorf("No error for unknown strategy")
+	}
+}
+
+func TestStrategyOrder(t *testing.T) {
+	for _, test := range []struct {
+		loads []float64
+		first map[string]int // Index of the expected first server per strategy, if deterministic
+	}{
+		{nil, nil},
+		{[]float64{3}, map[string]int{"least-load": 0, "power-of-two": 0}},
+		{[]float64{3, 1}, map[string]int{"least-load": 1, "power-of-two": 1}},
+		{[]float64{5, 2, 0, 4, 1}, map[string]int{"least-load": 2}},
+	} {
+		for _, name := range StrategyNames {
+			strategy, err := NewStrategy(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			servers := newTestServers(t, test.loads...)
+			original := make(BackendServerSlice, len(servers))
+			copy(original, servers)
+			ordered := strategy.Order("127.0.0.1:5000", servers)
+
+			if !sameServers(servers, original) {
+				t.Errorf("%v with loads %v: input servers modified", name, test.loads)
+			}
+			seen := make(map[*BackendServer]bool)
+			for _, server := range ordered {
+				seen[server] = true
+			}
+			if len(ordered) != len(servers) || len(seen) != len(servers) {
+				t.Errorf("%v with loads %v: result is not a permutation of the servers: %v", name, test.loads, ordered)
+				continue
+			}
+			if index, ok := test.first[name]; ok && ordered[0] != servers[index] {
+				t.Errorf("%v with loads %v: first server %v, expected %v", name, test.loads, ordered[0], servers[index])
+			}
+			if name == "least-load" {
+				for i := 1; i < len(ordered); i++ {
+					if ordered[i].Load < ordered[i-1].Load {
+						t.Errorf("least-load: not ordered by load: %v", ordered)
+					}
+				}
+			}
+			if name == "power-of-two" && len(ordered) >= 2 && ordered[0].Load > ordered[1].Load {
+				t.Errorf("power-of-two: first server has a higher load than the second: %v", ordered)
+			}
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	servers := newTestServers(t, 0, 0, 0)
+	strategy := new(RoundRobin)
+	for i := 0; i < 7; i++ {
+		ordered := strategy.Order("", servers)
+		for j, server := range ordered {
+			if expected := servers[(i+j)%len(servers)]; server != expected {
+				t.Errorf("Round %v: server %v is %v, expected %v", i, j, server.Addr, expected.Addr)
+			}
+		}
+	}
+	// The next server is chosen modulo the current number of servers
+	if ordered := strategy.Order("", servers[:2]); ordered[0] != servers[1] {
+		t.Errorf("Unexpected first server after removing a server: %v", ordered[0].Addr)
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	servers := newTestServers(t, 0, 9)
+	strategy := new(WeightedRandom)
+	first := 0
+	rounds := 1000
+	for i := 0; i < rounds; i++ {
+		if strategy.Order("", servers)[0] == servers[0] {
+			first++
+		}
+	}
+	// Expected probability: 1 / (1 + 0.1) = 0.91
+	if ratio := float64(first) / float64(rounds); ratio < 0.8 || ratio > 0.98 {
+		t.Errorf("The idle server was chosen first in %v%% of the cases, expected about 91%%", ratio*100)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	servers := newTestServers(t, 0, 0, 0, 0, 0)
+	strategy := new(ConsistentHash)
+	clients := make([]string, 50)
+	primaries := make(map[string]*BackendServer)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("10.0.0.%v", i)
+		primaries[clients[i]] = strategy.Order(clients[i]+":1000", servers)[0]
+	}
+	for _, client := range clients {
+		// The port of the client is ignored
+		if primary := strategy.Order(client+":2000", servers)[0]; primary != primaries[client] {
+			t.Errorf("Client %v moved from %v to %v", client, primaries[client].Addr, primary.Addr)
+		}
+	}
+	used := make(map[*BackendServer]bool)
+	for _, primary := range primaries {
+		used[primary] = true
+	}
+	if len(used) < 3 {
+		t.Errorf("Only %v of %v servers are used for %v clients", len(used), len(servers), len(clients))
+	}
+
+	// Removing a server only moves its own clients
+	removed := servers[2]
+	remaining := append(append(BackendServerSlice{}, servers[:2]...), servers[3:]...)
+	for _, client := range clients {
+		primary := strategy.Order(client, remaining)[0]
+		if primaries[client] != removed && primary != primaries[client] {
+			t.Errorf("Client %v moved from %v to %v after removing %v", client, primaries[client].Addr, primary.Addr, removed.Addr)
+		}
+		if primary == removed {
+			t.Errorf("Client %v still uses the removed server", client)
+		}
+	}
+}
+
+func TestSameServers(t *testing.T) {
+	servers := newTestServers(t, 0, 0, 0)
+	for _, test := range []struct {
+		a, b BackendServerSlice
+		same bool
+	}{
+		{nil, nil, true},
+		{nil, BackendServerSlice{}, true},
+		{servers, servers, true},
+		{servers[:2], servers, false},
+		{BackendServerSlice{servers[0], servers[1]}, BackendServerSlice{servers[1], servers[0]}, false},
+		{BackendServerSlice{servers[0]}, BackendServerSlice{servers[0]}, true},
+	} {
+		if same := sameServers(test.a, test.b); same != test.same {
+			t.Errorf("sameServers(%v, %v) = %v, expected %v", test.a, test.b, same, test.same)
+		}
+	}
+}
+
+func TestPickServer(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		loads    []float64
+		offline  []int
+		quota    int // MaxSessionsPerBackend
+		reserved []int
+		primary  int // -1 for none
+		backups  []int
+		quotaErr bool
+	}{
+		{"least loaded", []float64{2, 0, 1}, nil, 0, nil, 1, []int{2}, false},
+		{"offline skipped", []float64{2, 0, 1}, []int{1}, 0, nil, 2, []int{0}, false},
+		{"quota skipped", []float64{2, 0, 1}, nil, 1, []int{1}, 2, []int{0}, false},
+		{"no backup", []float64{0}, nil, 0, nil, 0, []int{}, false},
+		{"all offline", []float64{0, 1}, []int{0, 1}, 0, nil, -1, []int{}, false},
+		{"all full", []float64{0, 1}, nil, 1, []int{0, 1}, -1, []int{}, true},
+	} {
+		servers := newTestServers(t, test.loads...)
+		for _, i := range test.offline {
+			servers[i].Client.(*testBreaker).online = false
+		}
+		quota := protocols.NewSessionQuota()
+		quota.MaxSessionsPerBackend = test.quota
+		for _, i := range test.reserved {
+			quota.AddBackend(servers[i].Addr.String())
+		}
+		primary, backups, quotaErr := servers.pickServer("127.0.0.1:5000", new(LeastLoad), quota)
+		if test.primary < 0 && primary != nil || test.primary >= 0 && primary != servers[test.primary] {
+			t.Errorf("%v: unexpected primary server %v", test.name, primary)
+		}
+		if len(backups) != len(test.backups) {
+			t.Errorf("%v: unexpected backups %v", test.name, backups)
+		} else {
+			for i, backup := range backups {
+				if backup != servers[test.backups[i]] {
+					t.Errorf("%v: backup %v is %v, expected %v", test.name, i, backup.Addr, servers[test.backups[i]].Addr)
+				}
+			}
+		}
+		if (quotaErr != nil) != test.quotaErr {
+			t.Errorf("%v: unexpected quota error: %v", test.name, quotaErr)
+		}
+		if primary != nil {
+			if usage := quota.Usage().Backends[primary.Addr.String()]; usage != 1 {
+				t.Errorf("%v: primary server reserved %v times in the quota, expected once", test.name, usage)
+			}
+		}
+	}
+}
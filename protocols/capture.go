@@ -0,0 +1,221 @@
+package protocols
+
+// Optional recording of all packets sent and received through a Conn.
+// The recorded file can be inspected and replayed with the packetReplay tool.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+var (
+	// If non-nil, every packet sent or received by any Conn is recorded here.
+	// Only accessed through StartCapture(), StopCapture() and CurrentCapture().
+	capture     *PacketRecorder
+	captureLock sync.RWMutex
+)
+
+type PacketDirection int
+
+const (
+	PacketSent = PacketDirection(iota)
+	PacketReceived
+)
+
+func (dir PacketDirection) String() string {
+	switch dir {
+	case PacketSent:
+		return "sent"
+	case PacketReceived:
+		return "received"
+	default:
+		return fmt.Sprintf("PacketDirection(%d)", int(dir))
+	}
+}
+
+type CapturedPacket struct {
+	Time      time.Time
+	Direction PacketDirection
+	Network   string // E.g. tcp4 or udp4
+	Protocol  string
+	Code      Code
+	Val       string // Decoded value, formatted for reading
+	Err       string // Set if the received data could not be decoded. Code and Val are not set then.
+	Source    string
+	Dest      string
+	Data      []byte // Marshalled packet as sent over the wire, used for replaying
+}
+
+func (packet *CapturedPacket) String() string {
+	if packet.Err != "" {
+		return fmt.Sprintf("%v %v %v %v -> %v: %v bytes not decoded: %v", packet.Time.Format("15:04:05.000000"),
+			packet.Protocol, packet.Direction, packet.Source, packet.Dest, len(packet.Data), packet.Err)
+	}
+	return fmt.Sprintf("%v %v %v %v -> %v: code %v: %v", packet.Time.Format("15:04:05.000000"),
+		packet.Protocol, packet.Direction, packet.Source, packet.Dest, packet.Code, packet.Val)
+}
+
+type PacketRecorder struct {
+	lock    sync.Mutex
+	file    *os.File
+	encoder *gob.Encoder
+	err     error // First error that occurred while recording. Recording stops afterwards.
+}
+
+func NewPacketRecorder(filename string) (*PacketRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketRecorder{
+		file:    file,
+		encoder: gob.NewEncoder(file),
+	}, nil
+}
+
+// Create a PacketRecorder and install it as the global Capture.
+func StartCapture(filename string) error {
+	recorder, err := NewPacketRecorder(filename)
+	if err != nil {
+		return err
+	}
+	captureLock.Lock()
+	previous := capture
+	capture = recorder
+	captureLock.Unlock()
+	if previous != nil {
+		return previous.Close()
+	}
+	return nil
+}
+
+// Uninstall and close the global Capture. Returns the first error that occurred while recording, if any.
+func StopCapture() error {
+	captureLock.Lock()
+	recorder := capture
+	capture = nil
+	captureLock.Unlock()
+	if recorder == nil {
+		return nil
+	}
+	if err := recorder.Close(); err != nil {
+		return err
+	}
+	return recorder.Error()
+}
+
+// Stops the global Capture when the main program shuts down. Add it to the TaskGroup
+// after the servers, so that the packets sent while stopping them are still recorded.
+func StopCaptureTask() golib.Task {
+	return &golib.CleanupTask{Description: "stop packet capture", Cleanup: func() {
+		if err := StopCapture(); err != nil {
+			log.Printf("Error capturing packets: %v\n", err)
+		}
+	}}
+}
+
+// The global Capture, or nil.
+func CurrentCapture() *PacketRecorder {
+	captureLock.RLock()
+	defer captureLock.RUnlock()
+	return capture
+}
+
+func (recorder *PacketRecorder) Close() error {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.file == nil {
+		return nil
+	}
+	err := recorder.file.Close()
+	recorder.file = nil
+	return err
+}
+
+func (recorder *PacketRecorder) Record(packet *CapturedPacket) {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	if recorder.file == nil || recorder.err != nil {
+		return
+	}
+	if err := recorder.encoder.Encode(packet); err != nil {
+		recorder.err = fmt.Errorf("Error recording packet: %v", err)
+	}
+}
+
+// The first error that occurred while recording. Recording stops afterwards.
+func (recorder *PacketRecorder) Error() error {
+	recorder.lock.Lock()
+	defer recorder.lock.Unlock()
+	return recorder.err
+}
+
+// decodeErr is the result of decoding received data. packet is nil if it is set.
+func capturePacket(dir PacketDirection, network string, protocol Protocol, packet *Packet, decodeErr error, data []byte, source, dest Addr) {
+	recorder := CurrentCapture()
+	if recorder == nil {
+		return
+	}
+	captured := &CapturedPacket{
+		Time:      time.Now(),
+		Direction: dir,
+		Network:   network,
+		Protocol:  protocol.Name(),
+		Data:      data,
+	}
+	if decodeErr != nil {
+		captured.Err = decodeErr.Error()
+	} else {
+		captured.Code = packet.Code
+		captured.Val = fmt.Sprintf("%+v", packet.Val)
+	}
+	if source != nil {
+		captured.Source = source.String()
+	}
+	if dest != nil {
+		captured.Dest = dest.String()
+	}
+	recorder.Record(captured)
+}
+
+// ========================== Reading captures ==========================
+
+type CaptureReader struct {
+	file    *os.File
+	decoder *gob.Decoder
+}
+
+func OpenCapture(filename string) (*CaptureReader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureReader{
+		file:    file,
+		decoder: gob.NewDecoder(file),
+	}, nil
+}
+
+// Returns io.EOF after the last packet.
+func (reader *CaptureReader) Next() (*CapturedPacket, error) {
+	var packet CapturedPacket
+	if err := reader.decoder.Decode(&packet); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A truncated last record is expected if the recording process was killed.
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("Error reading captured packet: %v", err)
+	}
+	return &packet, nil
+}
+
+func (reader *CaptureReader) Close() error {
+	return reader.file.Close()
+}
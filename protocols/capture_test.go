@@ -0,0 +1,69 @@
+package protocols
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	protocol, err := NewProtocol("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []struct {
+		dir    PacketDirection
+		packet *Packet
+		err    error
+		data   []byte
+	}{
+		{PacketSent, &Packet{Code: CodeOK, Val: ""}, nil, []byte{1, 2, 3}},
+		{PacketReceived, &Packet{Code: CodeError, Val: "failed"}, nil, []byte{4}},
+		{PacketSent, &Packet{Code: Code(100), Val: 42}, nil, nil},
+		{PacketReceived, nil, errors.New("garbage"), []byte{5, 6}},
+	}
+
+	filename := filepath.Join(t.TempDir(), "capture")
+	if err := StartCapture(filename); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range packets {
+		capturePacket(p.dir, "udp4", protocol, p.packet, p.err, p.data, nil, nil)
+	}
+	if err := StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	if CurrentCapture() != nil {
+		t.Fatal("Capture still installed after StopCapture()")
+	}
+	// Not recorded anymore
+	capturePacket(PacketSent, "udp4", protocol, packets[0].packet, nil, nil, nil, nil)
+
+	reader, err := OpenCapture(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for i, p := range packets {
+		captured, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Packet %v: %v", i, err)
+		}
+		if captured.Direction != p.dir || captured.Protocol != "Test" ||
+			captured.Network != "udp4" || string(captured.Data) != string(p.data) {
+			t.Errorf("Packet %v: captured %v with data %v, expected %v %v with data %v",
+				i, captured, captured.Data, p.dir, p.packet, p.data)
+		}
+		if p.err != nil {
+			if captured.Err != p.err.Error() {
+				t.Errorf("Packet %v: captured decoding error %q, expected %q", i, captured.Err, p.err)
+			}
+		} else if captured.Code != p.packet.Code || captured.Err != "" {
+			t.Errorf("Packet %v: captured %v, expected %v", i, captured, p.packet)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last packet, got %v", err)
+	}
+}
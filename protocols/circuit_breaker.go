@@ -17,6 +17,7 @@ type CircuitBreaker interface {
 	Error() error
 	Online() bool
 	AddCallback(callback FaultDetectorCallback, key interface{})
+	History() *DetectorHistory
 }
 
 type circuitBreaker struct {
@@ -115,6 +116,18 @@ func (breaker *circuitBreaker) SendRequestPacket(packet *Packet) (reply *Packet,
 	}
 }
 
+func (breaker *circuitBreaker) SendRequestTimed(code Code, val interface{}) (reply *Packet, rtt time.Duration, err error) {
+	if breaker.Online() {
+		reply, rtt, err := breaker.client.SendRequestTimed(code, val)
+		if err != nil {
+			breaker.ErrorDetected(err)
+		}
+		return reply, rtt, err
+	} else {
+		return nil, 0, breaker.Error()
+	}
+}
+
 func (breaker *circuitBreaker) Send(code Code, val interface{}) error {
 	return breaker.SendPacket(&Packet{
 		Code: code,
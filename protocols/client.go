@@ -27,6 +27,11 @@ type Client interface {
 	Send(code Code, val interface{}) error
 	SendRequest(code Code, val interface{}) (*Packet, error)
 	SendRequestPacket(packet *Packet) (reply *Packet, err error)
+
+	// Like SendRequest, and also returns the time from sending the request until the reply is received.
+	// Establishing the connection to the server is not included.
+	SendRequestTimed(code Code, val interface{}) (reply *Packet, rtt time.Duration, err error)
+
 	CheckReply(reply *Packet) error
 	CheckError(reply *Packet, expectedCode Code) error
 }
@@ -139,13 +144,20 @@ func (client *client) SendPacket(packet *Packet) error {
 }
 
 func (client *client) SendRequestPacket(packet *Packet) (reply *Packet, err error) {
+	reply, _, err = client.sendRequestPacket(packet)
+	return
+}
+
+func (client *client) sendRequestPacket(packet *Packet) (reply *Packet, rtt time.Duration, err error) {
 	client.connLock.Lock()
 	defer client.connLock.Unlock()
 	if err = client.checkServer(); err != nil {
 		return
 	}
+	start := time.Now()
 	if err = client.conn.Send(packet, client.timeout); err == nil {
 		reply, err = client.conn.Receive(client.timeout)
+		rtt = time.Now().Sub(start)
 		if err != nil {
 			err = fmt.Errorf("Receiving %s reply from %s: %s", client.protocol.Name(), client.conn.RemoteAddr(), err)
 		}
@@ -170,13 +182,41 @@ func (client *client) SendRequest(code Code, val interface{}) (*Packet, error) {
 	})
 }
 
+func (client *client) SendRequestTimed(code Code, val interface{}) (*Packet, time.Duration, error) {
+	return client.sendRequestPacket(&Packet{
+		Code: code,
+		Val:  val,
+	})
+}
+
+// Returned by CheckError and CheckReply when the server replied with an error.
+// In contrast to transport errors, the request has definitely been processed by the server.
+type RemoteError struct {
+	Protocol string
+	Message  string
+}
+
+func (err *RemoteError) Error() string {
+	return fmt.Sprintf("%v error: %v", err.Protocol, err.Message)
+}
+
+func IsRemoteError(err error) bool {
+	_, ok := err.(*RemoteError)
+	return ok
+}
+
 func (client *client) CheckError(reply *Packet, expectedCode Code) error {
+	if reply.Code == CodeQuotaExceeded {
+		if quotaErr, ok := reply.Val.(*QuotaExceededError); ok {
+			return quotaErr
+		}
+	}
 	if reply.Code == CodeError {
 		var errString string
 		if reply.Code == CodeError {
 			errString, _ = reply.Val.(string)
 		}
-		return fmt.Errorf("%v error: %v", client.Protocol().Name(), errString)
+		return &RemoteError{Protocol: client.Protocol().Name(), Message: errString}
 	}
 	if reply.Code != expectedCode {
 		return fmt.Errorf("Unexpected %s reply code %v. Expected %v. Payload: %v",
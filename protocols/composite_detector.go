@@ -0,0 +1,196 @@
+package protocols
+
+// A FaultDetector combining several other detectors observing the same server,
+// e.g. ping- and heartbeat-based detection.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antongulenko/RTP/stats"
+	"github.com/antongulenko/golib"
+)
+
+type CompositePolicy int
+
+const (
+	AnyDown  = CompositePolicy(iota) // Offline when any detector is offline
+	AllDown                          // Offline when all detectors are offline
+	KOfNDown                         // Offline when at least K detectors are offline
+)
+
+var compositePolicyNames = map[CompositePolicy]string{
+	AnyDown:  "any",
+	AllDown:  "all",
+	KOfNDown: "k-of-n",
+}
+
+func (policy CompositePolicy) String() string {
+	if name, ok := compositePolicyNames[policy]; ok {
+		return name
+	}
+	return fmt.Sprintf("CompositePolicy(%d)", int(policy))
+}
+
+// Parses "any", "all", or a number k for KOfNDown.
+func ParseCompositePolicy(str string) (policy CompositePolicy, k int, err error) {
+	switch str {
+	case "any":
+		return AnyDown, 0, nil
+	case "all":
+		return AllDown, 0, nil
+	}
+	k, err = strconv.Atoi(str)
+	if err != nil || k < 1 {
+		return 0, 0, fmt.Errorf("Illegal composite detector policy %v: must be 'any', 'all', or a positive number", str)
+	}
+	return KOfNDown, k, nil
+}
+
+type CompositeFaultDetector struct {
+	*FaultDetectorBase
+	Detectors []FaultDetector
+	Policy    CompositePolicy
+	K         int
+}
+
+// Returned by CompositeFaultDetector.Error(), contains the errors of the detectors that are offline.
+type CompositeError struct {
+	Policy CompositePolicy
+	Down   int
+	Total  int
+	Causes []error
+}
+
+func (err *CompositeError) Error() string {
+	causes := make([]string, len(err.Causes))
+	for i, cause := range err.Causes {
+		causes[i] = cause.Error()
+	}
+	return fmt.Sprintf("%v of %v detectors offline (policy %v): %s", err.Down, err.Total, err.Policy, strings.Join(causes, "; "))
+}
+
+// All detectors must observe the same server. The detectors are closed together with the composite detector.
+// k is only used for KOfNDown.
+func NewCompositeFaultDetector(policy CompositePolicy, k int, detectors ...FaultDetector) (*CompositeFaultDetector, error) {
+	if len(detectors) == 0 {
+		return nil, fmt.Errorf("Need at least one FaultDetector to combine")
+	}
+	if policy == KOfNDown && (k < 1 || k > len(detectors)) {
+		return nil, fmt.Errorf("Illegal k=%v for %v detectors", k, len(detectors))
+	}
+	server := detectors[0].ObservedServer()
+	for _, detector := range detectors[1:] {
+		if other := detector.ObservedServer(); other.String() != server.String() {
+			return nil, fmt.Errorf("Cannot combine FaultDetectors observing different servers: %v and %v", server, other)
+		}
+	}
+	composite := &CompositeFaultDetector{
+		FaultDetectorBase: NewFaultDetectorBase(nil, server),
+		Detectors:         detectors,
+		Policy:            policy,
+		K:                 k,
+	}
+	// The combined detectors already apply their own thresholds and flap damping
+	composite.FailureThreshold = 1
+	composite.SuccessThreshold = 1
+	composite.FlapPenalty = 0
+	for _, detector := range detectors {
+		detector.AddCallback(composite.detectorStateChanged, detector)
+	}
+	return composite, nil
+}
+
+func (composite *CompositeFaultDetector) detectorStateChanged(key interface{}) {
+	composite.PerformCheck(composite.combinedError)
+}
+
+// Checks all detectors and re-evaluates the combined state.
+func (composite *CompositeFaultDetector) Check() {
+	for _, detector := range composite.Detectors {
+		detector.Check()
+	}
+	composite.PerformCheck(composite.combinedError)
+}
+
+func (composite *CompositeFaultDetector) combinedError() error {
+	var causes []error
+	for _, detector := range composite.Detectors {
+		if err := detector.Error(); err != nil {
+			causes = append(causes, err)
+		}
+	}
+	var offline bool
+	switch composite.Policy {
+	case AnyDown:
+		offline = len(causes) > 0
+	case AllDown:
+		offline = len(causes) == len(composite.Detectors)
+	default:
+		offline = len(causes) >= composite.K
+	}
+	if !offline {
+		return nil
+	}
+	return &CompositeError{
+		Policy: composite.Policy,
+		Down:   len(causes),
+		Total:  len(composite.Detectors),
+		Causes: causes,
+	}
+}
+
+// Forwarded to all combined detectors, the combined state follows their state immediately.
+func (composite *CompositeFaultDetector) ErrorDetected(err error) {
+	for _, detector := range composite.Detectors {
+		detector.ErrorDetected(err)
+	}
+	composite.checkResult(composite.combinedError(), true)
+}
+
+// Overrides FaultDetectorBase.Error(), because there is no single observed protocol.
+func (composite *CompositeFaultDetector) Error() (err error) {
+	if lastErr := composite.lastError(); lastErr != nil {
+		err = fmt.Errorf("%s is currently offline: %v", composite.ObservedServer(), lastErr)
+	}
+	return
+}
+
+// Implements balancer.LoadReporter, if any of the combined detectors receives load reports.
+func (composite *CompositeFaultDetector) ReportedLoad() (float64, time.Time, bool) {
+	for _, detector := range composite.Detectors {
+		if reporter, ok := detector.(interface {
+			ReportedLoad() (float64, time.Time, bool)
+		}); ok {
+			if load, received, ok := reporter.ReportedLoad(); ok {
+				return load, received, true
+			}
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+// Implements LatencyDetector with the latency measured by the first combined LatencyDetector.
+// Samples is 0, if none of the combined detectors measured the latency.
+func (composite *CompositeFaultDetector) Latency() stats.RttSummary {
+	for _, detector := range composite.Detectors {
+		if latency, ok := detector.(LatencyDetector); ok {
+			if summary := latency.Latency(); summary.Samples > 0 {
+				return summary
+			}
+		}
+	}
+	return stats.RttSummary{}
+}
+
+func (composite *CompositeFaultDetector) Close() error {
+	var errors golib.MultiError
+	composite.Closed.Enable(func() {
+		for _, detector := range composite.Detectors {
+			errors.Add(detector.Close())
+		}
+	})
+	return errors.NilOrError()
+}
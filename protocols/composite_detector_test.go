@@ -0,0 +1,171 @@
+package protocols
+
+import (
+	"fmt"
+	"testing"
+)
+
+// A FaultDetector reporting the configured error on every check. The thresholds
+// are 1 and flap damping is disabled, so the state follows the error immediately.
+type testDetector struct {
+	*FaultDetectorBase
+	err error
+}
+
+func newTestDetector(t *testing.T, server string) *testDetector {
+	addr, err := UdpTransport().Resolve(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protocol, err := NewProtocol("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector := &testDetector{FaultDetectorBase: NewFaultDetectorBase(protocol, addr)}
+	detector.FailureThreshold = 1
+	detector.SuccessThreshold = 1
+	detector.FlapPenalty = 0
+	return detector
+}
+
+func (detector *testDetector) Check() {
+	detector.PerformCheck(func() error { return detector.err })
+}
+
+func (detector *testDetector) Close() error {
+	return nil
+}
+
+func TestParseCompositePolicy(t *testing.T) {
+	for _, test := range []struct {
+		str    string
+		policy CompositePolicy
+		k      int
+		err    bool
+	}{
+		{"any", AnyDown, 0, false},
+		{"all", AllDown, 0, false},
+		{"1", KOfNDown, 1, false},
+		{"3", KOfNDown, 3, false},
+		{"0", 0, 0, true},
+		{"-1", 0, 0, true},
+		{"some", 0, 0, true},
+		{"", 0, 0, true},
+	} {
+		policy, k, err := ParseCompositePolicy(test.str)
+		if (err != nil) != test.err {
+			t.Errorf("ParseCompositePolicy(%q): unexpected error result: %v", test.str, err)
+		} else if policy != test.policy || k != test.k {
+			t.Errorf("ParseCompositePolicy(%q) = %v, %v; expected %v, %v", test.str, policy, k, test.policy, test.k)
+		}
+	}
+}
+
+func TestNewCompositeFaultDetector(t *testing.T) {
+	a1 := newTestDetector(t, "127.0.0.1:1000")
+	a2 := newTestDetector(t, "127.0.0.1:1000")
+	b := newTestDetector(t, "127.0.0.1:2000")
+	for _, test := range []struct {
+		name      string
+		policy    CompositePolicy
+		k         int
+		detectors []FaultDetector
+		err       bool
+	}{
+		{"no detectors", AnyDown, 0, nil, true},
+		{"single", AnyDown, 0, []FaultDetector{a1}, false},
+		{"same server", AllDown, 0, []FaultDetector{a1, a2}, false},
+		{"different servers", AnyDown, 0, []FaultDetector{a1, b}, true},
+		{"k too small", KOfNDown, 0, []FaultDetector{a1, a2}, true},
+		{"k too large", KOfNDown, 3, []FaultDetector{a1, a2}, true},
+		{"k valid", KOfNDown, 2, []FaultDetector{a1, a2}, false},
+	} {
+		_, err := NewCompositeFaultDetector(test.policy, test.k, test.detectors...)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error result: %v", test.name, err)
+		}
+	}
+}
+
+func TestCompositePolicies(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	for _, test := range []struct {
+		policy CompositePolicy
+		k      int
+		down   [][]bool // Failing detectors in each step
+		online []bool   // Expected combined state after each step
+	}{
+		{AnyDown, 0,
+			[][]bool{{false, false, false}, {true, false, false}, {false, false, false}, {true, true, true}},
+			[]bool{true, false, true, false}},
+		{AllDown, 0,
+			[][]bool{{false, false, false}, {true, true, false}, {true, true, true}, {false, true, true}},
+			[]bool{true, true, false, true}},
+		{KOfNDown, 2,
+			[][]bool{{false, false, false}, {false, true, false}, {true, false, true}, {false, false, true}},
+			[]bool{true, true, false, true}},
+		{KOfNDown, 1,
+			[][]bool{{true, false, false}, {false, false, false}},
+			[]bool{false, true}},
+	} {
+		detectors := make([]*testDetector, 3)
+		combined := make([]FaultDetector, len(detectors))
+		for i := range detectors {
+			detectors[i] = newTestDetector(t, "127.0.0.1:1000")
+			combined[i] = detectors[i]
+		}
+		composite, err := NewCompositeFaultDetector(test.policy, test.k, combined...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for step, down := range test.down {
+			numDown := 0
+			for i, detector := range detectors {
+				detector.err = nil
+				if down[i] {
+					detector.err = failed
+					numDown++
+				}
+			}
+			composite.Check()
+			if online := composite.Online(); online != test.online[step] {
+				t.Errorf("%v (k=%v), step %v %v: online %v, expected %v", test.policy, test.k, step, down, online, test.online[step])
+			}
+			err := composite.Error()
+			if (err == nil) != test.online[step] {
+				t.Errorf("%v (k=%v), step %v: unexpected error %v", test.policy, test.k, step, err)
+			}
+			if err != nil {
+				lastErr, ok := composite.lastError().(*CompositeError)
+				if !ok || lastErr.Down != numDown || lastErr.Total != len(detectors) || len(lastErr.Causes) != numDown {
+					t.Errorf("%v (k=%v), step %v: unexpected CompositeError %v", test.policy, test.k, step, composite.lastError())
+				}
+			}
+		}
+	}
+}
+
+func TestCompositeErrorDetected(t *testing.T) {
+	detectors := []*testDetector{newTestDetector(t, "127.0.0.1:1000"), newTestDetector(t, "127.0.0.1:1000")}
+	for _, detector := range detectors {
+		// Without ErrorDetected, several failed checks would be required
+		detector.FailureThreshold = 3
+	}
+	composite, err := NewCompositeFaultDetector(AllDown, 0, detectors[0], detectors[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite.Check()
+	if !composite.Online() {
+		t.Fatalf("Composite detector offline after successful checks: %v", composite.Error())
+	}
+	composite.ErrorDetected(fmt.Errorf("connection refused"))
+	for i, detector := range detectors {
+		if detector.Online() {
+			t.Errorf("Detector %v still online after ErrorDetected()", i)
+		}
+	}
+	if composite.Online() {
+		t.Errorf("Composite detector still online after ErrorDetected()")
+	}
+}
@@ -0,0 +1,138 @@
+package protocols
+
+// Bounded history of the state transitions of a FaultDetectorBase, for reconstructing
+// when an observed server was considered offline.
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// Number of transitions kept by new instances of FaultDetectorBase
+	DefaultHistorySize = 100
+)
+
+type DetectorState int
+
+const (
+	DetectorUnknown = DetectorState(iota) // Not checked yet
+	DetectorOnline
+	DetectorSuspected
+	DetectorOffline
+)
+
+var detectorStateNames = map[DetectorState]string{
+	DetectorUnknown:   "unknown",
+	DetectorOnline:    "online",
+	DetectorSuspected: "suspected",
+	DetectorOffline:   "offline",
+}
+
+func (state DetectorState) String() string {
+	if name, ok := detectorStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("DetectorState(%d)", int(state))
+}
+
+type DetectorTransition struct {
+	Time     time.Time
+	State    DetectorState // The state entered at Time
+	Error    string        // The error causing the transition, empty when entering DetectorOnline
+	Duration time.Duration // Time spent in State. For the current state, up to the time of the snapshot.
+}
+
+func (transition DetectorTransition) String() string {
+	str := fmt.Sprintf("%v %v for %v", transition.Time.Format("15:04:05.000"), transition.State, transition.Duration)
+	if transition.Error != "" {
+		str += ": " + transition.Error
+	}
+	return str
+}
+
+// Snapshot of the history of one FaultDetectorBase. Can be sent through the SessionQuery protocol.
+type DetectorHistory struct {
+	Server      string
+	Protocol    string // Empty for detectors not using a single protocol, e.g. CompositeFaultDetector
+	Created     time.Time
+	State       DetectorState
+	Transitions []DetectorTransition // Oldest first. Only the last HistorySize transitions are kept.
+	Dropped     uint64               // Number of older transitions that are not kept anymore
+
+	// Since the first check, including dropped transitions
+	TimeOnline    time.Duration
+	TimeSuspected time.Duration
+	TimeOffline   time.Duration
+	Availability  float64 // Ratio of the time online or suspected, 1 if not checked yet
+}
+
+func (history *DetectorHistory) String() string {
+	return fmt.Sprintf("%v %v %v (availability %.3f%%, %v transitions)",
+		history.Protocol, history.Server, history.State, history.Availability*100, uint64(len(history.Transitions))+history.Dropped)
+}
+
+type detectorHistory struct {
+	created     time.Time
+	transitions []DetectorTransition // Duration is filled in when leaving the state
+	dropped     uint64
+	timeInState map[DetectorState]time.Duration // Excluding the current state
+}
+
+func newDetectorHistory() detectorHistory {
+	return detectorHistory{
+		created:     time.Now(),
+		timeInState: make(map[DetectorState]time.Duration),
+	}
+}
+
+func (history *detectorHistory) record(state DetectorState, err error, size int) {
+	now := time.Now()
+	if last := history.current(); last != nil {
+		last.Duration = now.Sub(last.Time)
+		history.timeInState[last.State] += last.Duration
+	}
+	transition := DetectorTransition{
+		Time:  now,
+		State: state,
+	}
+	if err != nil {
+		transition.Error = err.Error()
+	}
+	history.transitions = append(history.transitions, transition)
+	if drop := len(history.transitions) - size; drop > 0 && size > 0 {
+		history.transitions = append(history.transitions[:0], history.transitions[drop:]...)
+		history.dropped += uint64(drop)
+	}
+}
+
+func (history *detectorHistory) current() *DetectorTransition {
+	if len(history.transitions) == 0 {
+		return nil
+	}
+	return &history.transitions[len(history.transitions)-1]
+}
+
+func (history *detectorHistory) snapshot(result *DetectorHistory) {
+	now := time.Now()
+	result.Created = history.created
+	result.Dropped = history.dropped
+	result.Transitions = make([]DetectorTransition, len(history.transitions))
+	copy(result.Transitions, history.transitions)
+	timeInState := make(map[DetectorState]time.Duration, len(history.timeInState)+1)
+	for state, duration := range history.timeInState {
+		timeInState[state] = duration
+	}
+	if num := len(result.Transitions); num > 0 {
+		last := &result.Transitions[num-1]
+		last.Duration = now.Sub(last.Time)
+		timeInState[last.State] += last.Duration
+	}
+	result.TimeOnline = timeInState[DetectorOnline]
+	result.TimeSuspected = timeInState[DetectorSuspected]
+	result.TimeOffline = timeInState[DetectorOffline]
+	result.Availability = 1
+	if total := result.TimeOnline + result.TimeSuspected + result.TimeOffline; total > 0 {
+		result.Availability = float64(result.TimeOnline+result.TimeSuspected) / float64(total)
+	}
+}
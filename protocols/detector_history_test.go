@@ -0,0 +1,113 @@
+package protocols
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDetectorHistoryRecord(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	online, suspected, offline := DetectorOnline, DetectorSuspected, DetectorOffline
+	for _, test := range []struct {
+		name    string
+		size    int
+		states  []DetectorState
+		kept    []DetectorState
+		dropped uint64
+	}{
+		{"empty", 5, nil, []DetectorState{}, 0},
+		{"below size", 5, []DetectorState{online, suspected, offline}, []DetectorState{online, suspected, offline}, 0},
+		{"exactly size", 3, []DetectorState{online, suspected, offline}, []DetectorState{online, suspected, offline}, 0},
+		{"dropped", 2, []DetectorState{online, suspected, offline, online, offline}, []DetectorState{online, offline}, 3},
+		{"unbounded", 0, []DetectorState{online, offline, online, offline}, []DetectorState{online, offline, online, offline}, 0},
+	} {
+		history := newDetectorHistory()
+		for _, state := range test.states {
+			var err error
+			if state != online {
+				err = failed
+			}
+			history.record(state, err, test.size)
+		}
+		var snapshot DetectorHistory
+		history.snapshot(&snapshot)
+		if snapshot.Dropped != test.dropped {
+			t.Errorf("%v: %v transitions dropped, expected %v", test.name, snapshot.Dropped, test.dropped)
+		}
+		if len(snapshot.Transitions) != len(test.kept) {
+			t.Errorf("%v: %v transitions kept, expected %v", test.name, len(snapshot.Transitions), len(test.kept))
+			continue
+		}
+		for i, transition := range snapshot.Transitions {
+			if transition.State != test.kept[i] {
+				t.Errorf("%v: transition %v is %v, expected %v", test.name, i, transition.State, test.kept[i])
+			}
+			if (transition.Error != "") != (transition.State != online) {
+				t.Errorf("%v: unexpected error in transition %v: %v", test.name, i, transition)
+			}
+			if i > 0 && transition.Time.Before(snapshot.Transitions[i-1].Time) {
+				t.Errorf("%v: transitions not in order: %v", test.name, snapshot.Transitions)
+			}
+		}
+	}
+}
+
+func TestDetectorHistoryAvailability(t *testing.T) {
+	step := 50 * time.Millisecond
+	for _, test := range []struct {
+		name         string
+		states       []DetectorState // Each state is kept for one step
+		availability float64
+	}{
+		{"not checked", nil, 1},
+		{"online", []DetectorState{DetectorOnline}, 1},
+		{"suspected counts as available", []DetectorState{DetectorOnline, DetectorSuspected}, 1},
+		{"offline", []DetectorState{DetectorOffline}, 0},
+		{"half offline", []DetectorState{DetectorOnline, DetectorOffline}, 0.5},
+		{"quarter offline", []DetectorState{DetectorOnline, DetectorSuspected, DetectorOffline, DetectorOnline}, 0.75},
+	} {
+		history := newDetectorHistory()
+		for _, state := range test.states {
+			history.record(state, nil, DefaultHistorySize)
+			time.Sleep(step)
+		}
+		var snapshot DetectorHistory
+		history.snapshot(&snapshot)
+		if diff := snapshot.Availability - test.availability; diff > 0.1 || diff < -0.1 {
+			t.Errorf("%v: availability %v, expected %v", test.name, snapshot.Availability, test.availability)
+		}
+		total := snapshot.TimeOnline + snapshot.TimeSuspected + snapshot.TimeOffline
+		if expected := time.Duration(len(test.states)) * step; total < expected {
+			t.Errorf("%v: %v recorded in total, expected at least %v", test.name, total, expected)
+		}
+		if num := len(snapshot.Transitions); num > 0 && snapshot.Transitions[num-1].Duration < step {
+			t.Errorf("%v: duration of the current state %v, expected at least %v", test.name, snapshot.Transitions[num-1].Duration, step)
+		}
+	}
+}
+
+func TestFaultDetectorHistory(t *testing.T) {
+	detector := newTestDetector(t, "127.0.0.1:1000")
+	detector.FailureThreshold = 2
+	detector.HistorySize = 3
+	failed := fmt.Errorf("check failed")
+	// Only changes of the state are recorded, repeated checks with the same result are not
+	for _, err := range []error{nil, nil, failed, failed, failed, nil, nil} {
+		detector.err = err
+		detector.Check()
+	}
+	history := detector.History()
+	expected := []DetectorState{DetectorSuspected, DetectorOffline, DetectorOnline}
+	if history.Dropped != 1 || len(history.Transitions) != len(expected) {
+		t.Fatalf("Unexpected history: %v %v", history, history.Transitions)
+	}
+	for i, transition := range history.Transitions {
+		if transition.State != expected[i] {
+			t.Errorf("Transition %v is %v, expected %v", i, transition.State, expected[i])
+		}
+	}
+	if history.State != DetectorOnline || history.Server != "127.0.0.1:1000" || history.Protocol != "Test" {
+		t.Errorf("Unexpected history: %v", history)
+	}
+}
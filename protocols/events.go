@@ -0,0 +1,145 @@
+package protocols
+
+// Typed events about the lifecycle of sessions, delivered asynchronously to multiple subscribers
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Number of events buffered for every subscriber. When the buffer is full,
+	// further events are dropped for that subscriber.
+	SessionEventBufferSize = 64
+)
+
+type SessionEventType int
+
+const (
+	SessionStartedEvent = SessionEventType(iota)
+	SessionStoppedEvent
+	SessionFailoverEvent
+	SessionRedirectedEvent
+	SessionPausedEvent
+	SessionResumedEvent
+)
+
+var sessionEventTypeNames = map[SessionEventType]string{
+	SessionStartedEvent:    "started",
+	SessionStoppedEvent:    "stopped",
+	SessionFailoverEvent:   "failed over",
+	SessionRedirectedEvent: "redirected",
+	SessionPausedEvent:     "paused",
+	SessionResumedEvent:    "resumed",
+}
+
+func (eventType SessionEventType) String() string {
+	if name, ok := sessionEventTypeNames[eventType]; ok {
+		return name
+	}
+	return fmt.Sprintf("SessionEventType(%d)", int(eventType))
+}
+
+// Events are shared between all subscribers and must not be modified.
+type SessionEvent struct {
+	Type    SessionEventType
+	Time    time.Time   // Set when publishing, if empty
+	Key     interface{} // Key of the session in its SessionManager
+	Session interface{} // The server-specific session, e.g. *PluginSession
+
+	Stop    StopInfo // For SessionStoppedEvent
+	From    string   // For SessionFailoverEvent: the failed server. For SessionRedirectedEvent: the old receiver.
+	To      string   // For SessionFailoverEvent: the new server. For SessionRedirectedEvent: the new receiver.
+	Err     error    // For SessionFailoverEvent: the error that prevented the failover
+	Message string   // Optional details about the session
+}
+
+func (event *SessionEvent) String() string {
+	str := fmt.Sprintf("Session %v %v", event.Key, event.Type)
+	if event.From != "" {
+		str += fmt.Sprintf(" from %v", event.From)
+	}
+	if event.To != "" {
+		str += fmt.Sprintf(" to %v", event.To)
+	}
+	if event.Type == SessionStoppedEvent {
+		str += fmt.Sprintf(": %v", event.Stop)
+	}
+	if event.Err != nil {
+		str += fmt.Sprintf(": %v", event.Err)
+	}
+	if event.Message != "" {
+		str += fmt.Sprintf(" (%v)", event.Message)
+	}
+	return str
+}
+
+// All methods are safe for concurrent use.
+type SessionEventBus struct {
+	lock        sync.Mutex
+	subscribers []*SessionSubscription
+}
+
+type SessionSubscription struct {
+	bus     *SessionEventBus
+	events  chan *SessionEvent
+	dropped uint64
+}
+
+func NewSessionEventBus() *SessionEventBus {
+	return new(SessionEventBus)
+}
+
+// handler is called in a dedicated goroutine, in the order in which the events were published.
+func (bus *SessionEventBus) Subscribe(handler func(event *SessionEvent)) *SessionSubscription {
+	sub := &SessionSubscription{
+		bus:    bus,
+		events: make(chan *SessionEvent, SessionEventBufferSize),
+	}
+	bus.lock.Lock()
+	bus.subscribers = append(bus.subscribers, sub)
+	bus.lock.Unlock()
+	go func() {
+		for event := range sub.events {
+			handler(event)
+		}
+	}()
+	return sub
+}
+
+// Never blocks: events are dropped for subscribers that are too slow.
+func (bus *SessionEventBus) Publish(event *SessionEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for _, sub := range bus.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Events that were already published are still delivered to the handler.
+func (sub *SessionSubscription) Unsubscribe() {
+	bus := sub.bus
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+	for i, other := range bus.subscribers {
+		if other == sub {
+			bus.subscribers = append(bus.subscribers[:i], bus.subscribers[i+1:]...)
+			close(sub.events)
+			return
+		}
+	}
+}
+
+// Number of events that were not delivered because the buffer was full.
+func (sub *SessionSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
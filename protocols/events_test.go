@@ -0,0 +1,120 @@
+package protocols
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects the events received by a subscriber.
+type testEventHandler struct {
+	lock     sync.Mutex
+	events   []*SessionEvent
+	received chan struct{}
+	block    chan struct{} // If not nil, the handler blocks until it is closed
+}
+
+func newTestEventHandler() *testEventHandler {
+	return &testEventHandler{received: make(chan struct{}, 1000)}
+}
+
+func (handler *testEventHandler) handle(event *SessionEvent) {
+	if handler.block != nil {
+		<-handler.block
+	}
+	handler.lock.Lock()
+	handler.events = append(handler.events, event)
+	handler.lock.Unlock()
+	handler.received <- struct{}{}
+}
+
+func (handler *testEventHandler) wait(t *testing.T, num int) []*SessionEvent {
+	for i := 0; i < num; i++ {
+		select {
+		case <-handler.received:
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for event %v of %v", i+1, num)
+		}
+	}
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	return handler.events
+}
+
+func TestSessionEventBus(t *testing.T) {
+	bus := NewSessionEventBus()
+	first, second := newTestEventHandler(), newTestEventHandler()
+	firstSub := bus.Subscribe(first.handle)
+	bus.Subscribe(second.handle)
+	types := []SessionEventType{SessionStartedEvent, SessionRedirectedEvent, SessionPausedEvent, SessionResumedEvent, SessionStoppedEvent}
+	for i, eventType := range types {
+		bus.Publish(&SessionEvent{Type: eventType, Key: i})
+	}
+	for _, handler := range []*testEventHandler{first, second} {
+		events := handler.wait(t, len(types))
+		for i, event := range events {
+			if event.Type != types[i] || event.Key != i {
+				t.Errorf("Event %v delivered out of order: %v", i, event)
+			}
+			if event.Time.IsZero() {
+				t.Errorf("Event %v published without time", i)
+			}
+		}
+	}
+
+	// Events published after unsubscribing are not delivered anymore
+	firstSub.Unsubscribe()
+	firstSub.Unsubscribe()
+	bus.Publish(&SessionEvent{Type: SessionStoppedEvent, Key: "last"})
+	if events := second.wait(t, 1); events[len(events)-1].Key != "last" {
+		t.Errorf("Event not delivered to the remaining subscriber")
+	}
+	select {
+	case <-first.received:
+		t.Errorf("Event delivered after unsubscribing")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSessionEventsDropped(t *testing.T) {
+	bus := NewSessionEventBus()
+	slow, fast := newTestEventHandler(), newTestEventHandler()
+	slow.block = make(chan struct{})
+	slowSub := bus.Subscribe(slow.handle)
+	fastSub := bus.Subscribe(fast.handle)
+
+	// The slow handler takes one event out of the buffer and blocks
+	published := SessionEventBufferSize + 10
+	bus.Publish(&SessionEvent{Type: SessionStartedEvent})
+	fast.wait(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	for i := 1; i < published; i++ {
+		bus.Publish(&SessionEvent{Type: SessionStartedEvent})
+		fast.wait(t, 1)
+	}
+	close(slow.block)
+	slow.wait(t, SessionEventBufferSize+1)
+	if dropped := slowSub.Dropped(); dropped != uint64(published-SessionEventBufferSize-1) {
+		t.Errorf("Slow subscriber dropped %v events, expected %v", dropped, published-SessionEventBufferSize-1)
+	}
+	if dropped := fastSub.Dropped(); dropped != 0 {
+		t.Errorf("Fast subscriber dropped %v events", dropped)
+	}
+}
+
+func TestSessionEventString(t *testing.T) {
+	for _, test := range []struct {
+		event    SessionEvent
+		expected string
+	}{
+		{SessionEvent{Type: SessionStartedEvent, Key: "a"}, "Session a started"},
+		{SessionEvent{Type: SessionFailoverEvent, Key: "a", From: "x", To: "y"}, "Session a failed over from x to y"},
+		{SessionEvent{Type: SessionStoppedEvent, Key: "a"}, "Session a stopped: not stopped"},
+		{SessionEvent{Type: SessionRedirectedEvent, Key: "a", To: "y", Message: "by client"}, "Session a redirected to y (by client)"},
+		{SessionEvent{Type: SessionEventType(42), Key: 1}, "Session 1 SessionEventType(42)"},
+	} {
+		if str := test.event.String(); str != test.expected {
+			t.Errorf("Event string %q, expected %q", str, test.expected)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package protocols
 
 import (
+	"flag"
 	"fmt"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/antongulenko/RTP/stats"
 	"github.com/antongulenko/golib"
 )
 
@@ -13,8 +17,27 @@ const (
 
 var (
 	stateUnknown = fmt.Errorf("Status was not checked yet")
+
+	// Defaults for new instances of FaultDetectorBase. A server changes state
+	// after a single check, unless the thresholds or flap damping are configured.
+	DefaultFailureThreshold = 1
+	DefaultSuccessThreshold = 1
+	DefaultFlapPenalty      = 0.0 // No flap damping
+	DefaultFlapSuppress     = 3.0
+	DefaultFlapReuse        = 1.5
+	DefaultFlapHalfLife     = 30 * time.Second
 )
 
+// Must be called before flag.Parse(), e.g. before ParseServerFlags().
+func FaultDetectorFlags() {
+	flag.IntVar(&DefaultFailureThreshold, "failure_threshold", DefaultFailureThreshold, "Number of consecutive failed checks before a server is considered offline")
+	flag.IntVar(&DefaultSuccessThreshold, "success_threshold", DefaultSuccessThreshold, "Number of consecutive successful checks before a server is considered online again")
+	flag.Float64Var(&DefaultFlapPenalty, "flap_penalty", DefaultFlapPenalty, "Penalty added to the flap penalty of a server on every state change (0: no flap damping)")
+	flag.Float64Var(&DefaultFlapSuppress, "flap_suppress", DefaultFlapSuppress, "Keep flapping servers offline when their flap penalty exceeds this")
+	flag.Float64Var(&DefaultFlapReuse, "flap_reuse", DefaultFlapReuse, "Let suppressed servers come back online when their flap penalty decays below this")
+	flag.DurationVar(&DefaultFlapHalfLife, "flap_half_life", DefaultFlapHalfLife, "Half-life of the flap penalty of servers")
+}
+
 type FaultDetectorCallback func(key interface{})
 
 type FaultDetector interface {
@@ -27,6 +50,14 @@ type FaultDetector interface {
 	ErrorDetected(err error)
 	ObservedServer() Addr
 	AddCallback(callback FaultDetectorCallback, key interface{})
+	State() DetectorState
+	History() *DetectorHistory
+}
+
+// A FaultDetector implementing this measures the round-trip time to the observed server.
+type LatencyDetector interface {
+	FaultDetector
+	Latency() stats.RttSummary
 }
 
 type faultDetectorCallbackData struct {
@@ -39,16 +70,51 @@ type observedServer struct {
 	addr     Addr
 }
 
+// A failed check makes an online server suspected. It goes offline after FailureThreshold
+// consecutive failed checks, or immediately when an error is reported with ErrorDetected(), and comes back online after SuccessThreshold consecutive successful checks.
+// Additionally, every state change adds FlapPenalty to a penalty decaying exponentially with FlapHalfLife.
+// When the penalty exceeds FlapSuppress, the server is kept offline until it decays below FlapReuse.
+// The last HistorySize transitions between online, suspected and offline are kept, see History().
+//
+// All methods are safe for concurrent use. The configuration fields must be set before the first check.
+// Callbacks are only invoked when the online/offline state changes. They are invoked by a dispatcher
+// goroutine in the order of the state changes, one at a time, and without holding any lock of the detector.
 type FaultDetectorBase struct {
+	FailureThreshold int
+	SuccessThreshold int
+	FlapPenalty      float64
+	FlapSuppress     float64
+	FlapReuse        float64
+	FlapHalfLife     time.Duration
+	HistorySize      int
+
+	lock           sync.Mutex // Guards all following fields
 	callbacks      []faultDetectorCallbackData
-	lastErr        error
+	lastErr        error // Error of the stable state, nil if online
+	lastCheckErr   error // Result of the last check
+	failures       int   // Consecutive failed checks
+	successes      int   // Consecutive successful checks
+	penalty        float64
+	penaltyTime    time.Time
+	suppressed     bool
+	history        detectorHistory
+	pending        [][]faultDetectorCallbackData // Callbacks of state changes, not yet delivered
+	dispatching    bool                          // The dispatcher goroutine is running
 	observedServer observedServer
 	Closed         golib.StopChan
 }
 
 func NewFaultDetectorBase(observedProtocol Protocol, server Addr) *FaultDetectorBase {
 	return &FaultDetectorBase{
-		lastErr: stateUnknown,
+		FailureThreshold: DefaultFailureThreshold,
+		SuccessThreshold: DefaultSuccessThreshold,
+		FlapPenalty:      DefaultFlapPenalty,
+		FlapSuppress:     DefaultFlapSuppress,
+		FlapReuse:        DefaultFlapReuse,
+		FlapHalfLife:     DefaultFlapHalfLife,
+		HistorySize:      DefaultHistorySize,
+		lastErr:          stateUnknown,
+		history:          newDetectorHistory(),
 		observedServer: observedServer{
 			observedProtocol,
 			server,
@@ -62,19 +128,86 @@ func (detector *FaultDetectorBase) ObservedServer() Addr {
 }
 
 func (detector *FaultDetectorBase) AddCallback(callback FaultDetectorCallback, key interface{}) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
 	detector.callbacks = append(detector.callbacks, faultDetectorCallbackData{callback, key})
 }
 
+// Takes the server offline immediately, regardless of FailureThreshold.
 func (detector *FaultDetectorBase) ErrorDetected(err error) {
-	detector.lastErr = err
+	detector.checkResult(err, true)
 }
 
+// Also true while the server is suspected.
 func (detector *FaultDetectorBase) Online() bool {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
 	return detector.lastErr == nil
 }
 
+// The server is still online, but the last check failed.
+func (detector *FaultDetectorBase) Suspected() bool {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.lastErr == nil && detector.lastCheckErr != nil
+}
+
+// The current flap penalty, including the decay up to now.
+func (detector *FaultDetectorBase) FlapPenaltyLevel() float64 {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.decayedPenalty(time.Now())
+}
+
+func (detector *FaultDetectorBase) State() DetectorState {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.state()
+}
+
+func (detector *FaultDetectorBase) state() DetectorState {
+	switch {
+	case detector.lastErr == stateUnknown:
+		return DetectorUnknown
+	case detector.lastErr != nil:
+		return DetectorOffline
+	case detector.lastCheckErr != nil:
+		return DetectorSuspected
+	default:
+		return DetectorOnline
+	}
+}
+
+// Snapshot of the recorded state transitions, including the time spent in each state.
+func (detector *FaultDetectorBase) History() *DetectorHistory {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	history := &DetectorHistory{State: detector.state()}
+	if addr := detector.observedServer.addr; addr != nil {
+		history.Server = addr.String()
+	}
+	if protocol := detector.observedServer.protocol; protocol != nil {
+		history.Protocol = protocol.Name()
+	}
+	detector.history.snapshot(history)
+	return history
+}
+
+func (detector *FaultDetectorBase) recordState(previous DetectorState) {
+	if state := detector.state(); state != previous {
+		var err error
+		switch state {
+		case DetectorOffline:
+			err = detector.lastErr
+		case DetectorSuspected:
+			err = detector.lastCheckErr
+		}
+		detector.history.record(state, err, detector.HistorySize)
+	}
+}
+
 func (detector *FaultDetectorBase) Error() (err error) {
-	lastErr := detector.lastErr
+	lastErr := detector.lastError()
 	if lastErr != nil {
 		err = fmt.Errorf("%v on %s is currently offline: %v",
 			detector.observedServer.protocol.Name(), detector.observedServer.addr, lastErr)
@@ -82,19 +215,117 @@ func (detector *FaultDetectorBase) Error() (err error) {
 	return
 }
 
+func (detector *FaultDetectorBase) lastError() error {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.lastErr
+}
+
+// Queues the callbacks, if the online/offline state differs from wasOnline.
 func (detector *FaultDetectorBase) InvokeCallback(wasOnline bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	detector.invokeCallback(wasOnline)
+}
+
+func (detector *FaultDetectorBase) invokeCallback(wasOnline bool) {
 	isOnline := detector.lastErr == nil
-	if wasOnline != isOnline && detector.lastErr != stateUnknown {
-		for _, data := range detector.callbacks {
+	if wasOnline != isOnline && detector.lastErr != stateUnknown && len(detector.callbacks) > 0 {
+		// Callbacks added later are not invoked for this state change
+		callbacks := make([]faultDetectorCallbackData, len(detector.callbacks))
+		copy(callbacks, detector.callbacks)
+		detector.pending = append(detector.pending, callbacks)
+		if !detector.dispatching {
+			detector.dispatching = true
+			go detector.dispatchCallbacks()
+		}
+	}
+}
+
+// Runs until all pending callbacks are delivered. At most one instance runs per detector.
+func (detector *FaultDetectorBase) dispatchCallbacks() {
+	for {
+		detector.lock.Lock()
+		if len(detector.pending) == 0 {
+			detector.dispatching = false
+			detector.lock.Unlock()
+			return
+		}
+		callbacks := detector.pending[0]
+		detector.pending[0] = nil
+		detector.pending = detector.pending[1:]
+		detector.lock.Unlock()
+
+		for _, data := range callbacks {
 			data.callback(data.key)
 		}
 	}
 }
 
+// The checker is executed without holding the lock of the detector.
 func (detector *FaultDetectorBase) PerformCheck(checker func() error) {
-	wasOnline := detector.Online()
-	detector.lastErr = checker()
-	detector.InvokeCallback(wasOnline)
+	detector.checkResult(checker(), false)
+}
+
+func (detector *FaultDetectorBase) checkResult(err error, immediate bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	wasOnline, previous := detector.lastErr == nil, detector.state()
+	detector.lastCheckErr = err
+	if err == nil {
+		detector.successes++
+		detector.failures = 0
+	} else {
+		detector.failures++
+		detector.successes = 0
+	}
+	switch {
+	case detector.lastErr == stateUnknown:
+		// The first check determines the initial state
+		detector.lastErr = err
+	case wasOnline && err != nil:
+		if immediate || detector.failures >= detector.FailureThreshold {
+			detector.lastErr = err
+			detector.stateChanged()
+		}
+	case !wasOnline && err != nil:
+		detector.lastErr = err
+	case !wasOnline && err == nil:
+		if detector.successes >= detector.SuccessThreshold {
+			if detector.isSuppressed() {
+				detector.lastErr = fmt.Errorf("Flapping, kept offline with penalty %.2f", detector.decayedPenalty(time.Now()))
+			} else {
+				detector.lastErr = nil
+				detector.stateChanged()
+			}
+		}
+	}
+	detector.recordState(previous)
+	detector.invokeCallback(wasOnline)
+}
+
+func (detector *FaultDetectorBase) stateChanged() {
+	now := time.Now()
+	detector.penalty = detector.decayedPenalty(now) + detector.FlapPenalty
+	detector.penaltyTime = now
+	if detector.FlapPenalty > 0 && detector.penalty > detector.FlapSuppress {
+		detector.suppressed = true
+	}
+}
+
+func (detector *FaultDetectorBase) isSuppressed() bool {
+	if detector.suppressed && detector.decayedPenalty(time.Now()) < detector.FlapReuse {
+		detector.suppressed = false
+	}
+	return detector.suppressed
+}
+
+func (detector *FaultDetectorBase) decayedPenalty(now time.Time) float64 {
+	if detector.penalty == 0 || detector.FlapHalfLife <= 0 {
+		return detector.penalty
+	}
+	halfLives := float64(now.Sub(detector.penaltyTime)) / float64(detector.FlapHalfLife)
+	return detector.penalty * math.Pow(0.5, halfLives)
 }
 
 func (detector *FaultDetectorBase) LoopCheck(checker func(), timeout time.Duration) {
@@ -102,10 +333,14 @@ func (detector *FaultDetectorBase) LoopCheck(checker func(), timeout time.Durati
 		checker()
 		time.Sleep(timeout)
 	}
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	previous := detector.state()
 	if detector.lastErr == nil {
 		detector.lastErr = fmt.Errorf("FaultDetector for %v is closed", detector.observedServer.addr)
 	} else {
 		detector.lastErr = fmt.Errorf("FaultDetector for %v is closed. Previous error: %v", detector.observedServer.addr, detector.lastErr)
 	}
-	detector.InvokeCallback(detector.lastErr == nil)
+	detector.recordState(previous)
+	// Closing is not a state change of the observed server, the callbacks are not invoked
 }
@@ -0,0 +1,207 @@
+package protocols
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFaultDetectorThresholds(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	for _, test := range []struct {
+		name      string
+		failure   int
+		success   int
+		checks    []bool // true: failed check, false: successful check
+		immediate int    // Index of the check reported with ErrorDetected(), -1 for none
+		states    []DetectorState
+	}{
+		{"first check online", 3, 2, []bool{false}, -1,
+			[]DetectorState{DetectorOnline}},
+		{"first check offline", 3, 2, []bool{true}, -1,
+			[]DetectorState{DetectorOffline}},
+		{"failure threshold", 3, 2, []bool{false, true, true, true, true}, -1,
+			[]DetectorState{DetectorOnline, DetectorSuspected, DetectorSuspected, DetectorOffline, DetectorOffline}},
+		{"suspicion cleared", 3, 2, []bool{false, true, true, false, true}, -1,
+			[]DetectorState{DetectorOnline, DetectorSuspected, DetectorSuspected, DetectorOnline, DetectorSuspected}},
+		{"success threshold", 1, 3, []bool{false, true, false, false, true, false, false, false}, -1,
+			[]DetectorState{DetectorOnline, DetectorOffline, DetectorOffline, DetectorOffline, DetectorOffline,
+				DetectorOffline, DetectorOffline, DetectorOnline}},
+		{"error detected", 3, 2, []bool{false, true}, 1,
+			[]DetectorState{DetectorOnline, DetectorOffline}},
+		{"error detected while suspected", 3, 2, []bool{false, true, true}, 2,
+			[]DetectorState{DetectorOnline, DetectorSuspected, DetectorOffline}},
+	} {
+		detector := newTestDetector(t, "127.0.0.1:1000")
+		detector.FailureThreshold = test.failure
+		detector.SuccessThreshold = test.success
+		for i, fail := range test.checks {
+			detector.err = nil
+			if fail {
+				detector.err = failed
+			}
+			if i == test.immediate {
+				detector.ErrorDetected(detector.err)
+			} else {
+				detector.Check()
+			}
+			if state := detector.State(); state != test.states[i] {
+				t.Errorf("%v: state after check %v is %v, expected %v", test.name, i, state, test.states[i])
+			}
+			if online := detector.Online(); online != (test.states[i] == DetectorOnline || test.states[i] == DetectorSuspected) {
+				t.Errorf("%v: Online() after check %v returned %v in state %v", test.name, i, online, test.states[i])
+			}
+		}
+	}
+}
+
+func TestFaultDetectorFlapDamping(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	for _, test := range []struct {
+		name     string
+		penalty  float64
+		halfLife time.Duration
+		flaps    int  // Number of offline/online cycles
+		online   bool // Expected state after the flaps
+	}{
+		{"no damping", 0, time.Hour, 5, true},
+		{"below suppress limit", 1, time.Hour, 1, true},
+		{"suppressed", 1, time.Hour, 3, false},
+		{"decayed", 1, time.Nanosecond, 5, true},
+	} {
+		detector := newTestDetector(t, "127.0.0.1:1000")
+		detector.FlapPenalty = test.penalty
+		detector.FlapSuppress = 3
+		detector.FlapReuse = 1.5
+		detector.FlapHalfLife = test.halfLife
+		detector.Check()
+		for i := 0; i < test.flaps; i++ {
+			detector.err = failed
+			detector.Check()
+			detector.err = nil
+			detector.Check()
+		}
+		if online := detector.Online(); online != test.online {
+			t.Errorf("%v: online %v after %v flaps, expected %v (penalty %v)", test.name, online, test.flaps, test.online, detector.FlapPenaltyLevel())
+		}
+	}
+}
+
+func TestFaultDetectorFlapReuse(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	detector := newTestDetector(t, "127.0.0.1:1000")
+	detector.FlapPenalty = 1
+	detector.FlapSuppress = 1.5
+	detector.FlapReuse = 1
+	detector.FlapHalfLife = 50 * time.Millisecond
+	detector.Check()
+	// Penalty 2 after coming back online: suppressed at the next recovery
+	for _, err := range []error{failed, nil, failed, nil} {
+		detector.err = err
+		detector.Check()
+	}
+	if detector.Online() {
+		t.Fatalf("Flapping detector not suppressed, penalty %v", detector.FlapPenaltyLevel())
+	}
+	// Still suppressed with the decayed penalty of 1.5 after one half-life
+	time.Sleep(detector.FlapHalfLife)
+	detector.Check()
+	msg := detector.Error().Error()
+	var penalty float64
+	if _, err := fmt.Sscanf(msg[strings.LastIndex(msg, "penalty ")+len("penalty "):], "%f", &penalty); err != nil || penalty < 1 || penalty > 1.5 {
+		t.Errorf("Expected the decayed penalty in the error: %v", msg)
+	}
+	// Decays from 3 to below 0.4 after three half-lives
+	time.Sleep(2 * detector.FlapHalfLife)
+	detector.Check()
+	if !detector.Online() {
+		t.Errorf("Detector still suppressed with penalty %v: %v", detector.FlapPenaltyLevel(), detector.Error())
+	}
+}
+
+func TestFaultDetectorCallbacks(t *testing.T) {
+	failed := fmt.Errorf("check failed")
+	detector := newTestDetector(t, "127.0.0.1:1000")
+	var lock sync.Mutex
+	var invoked []interface{}
+	callback := func(key interface{}) {
+		lock.Lock()
+		defer lock.Unlock()
+		invoked = append(invoked, key)
+	}
+	detector.AddCallback(callback, "a")
+	detector.AddCallback(callback, "b")
+
+	// Only changes between online and offline invoke the callbacks, including the first successful check
+	for _, err := range []error{nil, nil, failed, failed, nil, nil} {
+		detector.err = err
+		detector.Check()
+	}
+	expected := []interface{}{"a", "b", "a", "b", "a", "b"}
+	for start := time.Now(); time.Now().Sub(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		lock.Lock()
+		num := len(invoked)
+		lock.Unlock()
+		if num >= len(expected) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if fmt.Sprint(invoked) != fmt.Sprint(expected) {
+		t.Errorf("Callbacks invoked in order %v, expected %v", invoked, expected)
+	}
+}
+
+func TestFaultDetectorConcurrentChecks(t *testing.T) {
+	detector := newTestDetector(t, "127.0.0.1:1000")
+	failed := fmt.Errorf("check failed")
+	var lock sync.Mutex
+	var states []bool
+	// Callbacks are invoked without holding the lock of the detector, so they can query it
+	detector.AddCallback(func(key interface{}) {
+		online := detector.Online()
+		lock.Lock()
+		defer lock.Unlock()
+		states = append(states, online)
+	}, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if (i+j)%2 == 0 {
+					detector.PerformCheck(func() error { return nil })
+				} else {
+					detector.ErrorDetected(failed)
+				}
+				detector.State()
+				detector.History()
+			}
+		}(i)
+	}
+	wg.Wait()
+	detector.PerformCheck(func() error { return nil })
+	numCallbacks := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(states)
+	}
+	// Wait until no more callbacks are delivered
+	for num := -1; num != numCallbacks(); time.Sleep(50 * time.Millisecond) {
+		num = numCallbacks()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(states) == 0 || !states[len(states)-1] {
+		t.Errorf("The last callback did not observe the final online state: %v callbacks", len(states))
+	}
+	if !detector.Online() {
+		t.Errorf("Detector offline after the final successful check: %v", detector.Error())
+	}
+}
@@ -0,0 +1,46 @@
+package protocols
+
+// Used by the fuzz targets (FuzzXxx in fuzz_test.go) of every package defining a ProtocolFragment.
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Seed the fuzz target with the marshalled packets, and check every input with CheckUnmarshal.
+func FuzzPackets(f *testing.F, protocol Protocol, packets []*Packet) {
+	for _, packet := range packets {
+		data, err := Marshaller.MarshalPacket(packet)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if err := CheckUnmarshal(data, protocol); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Decodes data and checks that everything that was decoded survives another round trip.
+// Data that cannot be decoded is not an error.
+func CheckUnmarshal(data []byte, protocol Protocol) error {
+	packet, err := Marshaller.UnmarshalPacket(data, protocol)
+	if err != nil || packet.Val == nil {
+		// OK packets are decoded to nil and cannot be marshalled again
+		return nil
+	}
+	data2, err := Marshaller.MarshalPacket(packet)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal decoded %v packet %v: %v", protocol.Name(), packet, err)
+	}
+	packet2, err := Marshaller.UnmarshalPacket(data2, protocol)
+	if err != nil {
+		return fmt.Errorf("Failed to decode re-marshalled %v packet %v: %v", protocol.Name(), packet, err)
+	}
+	if packet2.Code != packet.Code {
+		return fmt.Errorf("%v packet code changed after round trip: %v -> %v", protocol.Name(), packet.Code, packet2.Code)
+	}
+	return nil
+}
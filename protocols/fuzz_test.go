@@ -0,0 +1,15 @@
+package protocols
+
+import "testing"
+
+func FuzzDefault(f *testing.F) {
+	protocol, err := NewProtocol("Default")
+	if err != nil {
+		f.Fatal(err)
+	}
+	FuzzPackets(f, protocol, []*Packet{
+		{Code: CodeOK, Val: ""},
+		{Code: CodeError, Val: "error"},
+		{Code: CodeQuotaExceeded, Val: &QuotaExceededError{Limit: LimitSessionsPerBackend, Key: "localhost:7777", Max: 3}},
+	})
+}
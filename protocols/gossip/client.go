@@ -0,0 +1,88 @@
+package gossip
+
+import (
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+type Client struct {
+	protocols.Client
+}
+
+func NewClient(client protocols.Client) (*Client, error) {
+	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+func NewClientFor(server_addr string) (*Client, error) {
+	client, err := protocols.NewMiniClientFor(server_addr, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+// Returns the updates piggybacked on the Ack.
+func (client *Client) Ping(from Member, updates []Update) ([]Update, error) {
+	reply, err := client.SendRequest(codePing, &Ping{
+		From:    from,
+		Updates: updates,
+	})
+	return client.checkAck(reply, err)
+}
+
+// Only confirms that the server received the request. The result of the probe is sent
+// back later to the server of from, in an IndirectAck with the given seq.
+func (client *Client) PingReq(from Member, seq uint64, target string, updates []Update) error {
+	reply, err := client.SendRequest(codePingReq, &PingReq{
+		From:    from,
+		Seq:     seq,
+		Target:  target,
+		Updates: updates,
+	})
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
+
+func (client *Client) IndirectAck(seq uint64, target string, updates []Update) error {
+	return client.Send(codeIndirectAck, &IndirectAck{
+		Seq:     seq,
+		Target:  target,
+		Updates: updates,
+	})
+}
+
+func (client *Client) checkAck(reply *protocols.Packet, err error) ([]Update, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeAck); err != nil {
+		return nil, err
+	}
+	ack, ok := reply.Val.(*Ack)
+	if !ok {
+		return nil, fmt.Errorf("Illegal Gossip Ack payload: (%T) %v", reply.Val, reply.Val)
+	}
+	return ack.Updates, nil
+}
+
+// Returns the full membership list of the server.
+func (client *Client) Join(from Member) ([]Update, error) {
+	reply, err := client.SendRequest(codeJoin, &Join{From: from})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeMembers); err != nil {
+		return nil, err
+	}
+	members, ok := reply.Val.(*Members)
+	if !ok {
+		return nil, fmt.Errorf("Illegal Gossip Members payload: (%T) %v", reply.Val, reply.Val)
+	}
+	return members.Updates, nil
+}
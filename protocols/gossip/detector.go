@@ -0,0 +1,84 @@
+package gossip
+
+import (
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+// Reports a member as offline, when the gossip group declared it dead, or when it left.
+// Suspected members are still online.
+type MemberDetector struct {
+	*protocols.FaultDetectorBase
+	node *Node
+	addr string
+}
+
+func (node *Node) NewDetector(endpoint string) (*MemberDetector, error) {
+	addr, err := node.Protocol().Transport().Resolve(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	detector := &MemberDetector{
+		FaultDetectorBase: protocols.NewFaultDetectorBase(MiniProtocol, addr),
+		node:              node,
+		addr:              endpoint,
+	}
+	// The group already agreed on the state of the member
+	detector.FailureThreshold = 1
+	detector.SuccessThreshold = 1
+	detector.FlapPenalty = 0
+	node.lock.Lock()
+	node.detectors[endpoint] = append(node.detectors[endpoint], detector)
+	node.lock.Unlock()
+	detector.Check()
+	return detector, nil
+}
+
+// Can be used as balancer.FaultDetectorFactory.
+func (node *Node) DetectorFactory() func(endpoint string) (protocols.FaultDetector, error) {
+	return func(endpoint string) (protocols.FaultDetector, error) {
+		detector, err := node.NewDetector(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return detector, nil
+	}
+}
+
+func (detector *MemberDetector) String() string {
+	return fmt.Sprintf("Gossip MemberDetector for %v", detector.addr)
+}
+
+// Called automatically when the state of the member changes.
+func (detector *MemberDetector) Check() {
+	detector.PerformCheck(func() error {
+		member, ok := detector.node.Member(detector.addr)
+		if !ok {
+			return fmt.Errorf("Not a member of the gossip group")
+		}
+		if !member.State.Reachable() {
+			return fmt.Errorf("Gossip member %v", member.State)
+		}
+		return nil
+	})
+}
+
+func (detector *MemberDetector) Close() error {
+	detector.Closed.Enable(func() {
+		node := detector.node
+		node.lock.Lock()
+		defer node.lock.Unlock()
+		detectors := node.detectors[detector.addr]
+		for i, other := range detectors {
+			if other == detector {
+				node.detectors[detector.addr] = append(detectors[:i], detectors[i+1:]...)
+				break
+			}
+		}
+		if len(node.detectors[detector.addr]) == 0 {
+			delete(node.detectors, detector.addr)
+		}
+	})
+	return nil
+}
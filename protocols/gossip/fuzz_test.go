@@ -0,0 +1,18 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzGossip(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codePing, Val: &Ping{From: Member{"127.0.0.1:7777", RoleAmp}, Updates: []Update{{Member{"127.0.0.1:7778", RolePcp}, MemberSuspect, 2}}}},
+		{Code: codePingReq, Val: &PingReq{From: Member{"127.0.0.1:7777", RoleAmp}, Seq: 4, Target: "127.0.0.1:7778"}},
+		{Code: codeIndirectAck, Val: &IndirectAck{Seq: 4, Target: "127.0.0.1:7778", Updates: []Update{{Member{"127.0.0.1:7778", RolePcp}, MemberAlive, 3}}}},
+		{Code: codeAck, Val: &Ack{Updates: []Update{{Member{"127.0.0.1:7778", RolePcp}, MemberAlive, 3}}}},
+		{Code: codeJoin, Val: &Join{From: Member{"127.0.0.1:7777", RoleAmp}}},
+		{Code: codeMembers, Val: &Members{Updates: []Update{{Member{"127.0.0.1:7779", RoleBalancer}, MemberLeft, 1}}}},
+	})
+}
@@ -0,0 +1,629 @@
+package gossip
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/golib"
+)
+
+var (
+	ProbeInterval    = 1 * time.Second
+	ProbeTimeout     = 300 * time.Millisecond
+	IndirectProbes   = 3               // Number of members asked to probe a member that did not answer
+	SuspicionTimeout = 5 * time.Second // Suspected members are declared dead after this
+	MaxPiggyback     = 10              // Maximum number of updates piggybacked on one packet
+
+	// Number of buffered membership events. When the buffer is full, the node blocks until
+	// the subscribers have handled the previous events.
+	MemberEventBufferSize = 64
+
+	gossipRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+const (
+	// Every update is piggybacked retransmit_mult * log10(number of members) times.
+	retransmit_mult = 3
+)
+
+// Must be called before flag.Parse(), e.g. before ParseServerFlags().
+func NodeFlags() *NodeConfig {
+	config := new(NodeConfig)
+	flag.StringVar(&config.Seeds, "gossip", "", "Join the gossip membership group through these comma-separated nodes. The own address can be included.")
+	flag.StringVar(&config.Advertise, "gossip_addr", "", "Address announced to other gossip members (default: the listen address, with 127.0.0.1 for an unspecified host)")
+	return config
+}
+
+type NodeConfig struct {
+	Seeds     string
+	Advertise string
+}
+
+func (config *NodeConfig) Enabled() bool {
+	return config.Seeds != ""
+}
+
+func (config *NodeConfig) SeedList() []string {
+	var seeds []string
+	for _, seed := range strings.Split(config.Seeds, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+func (config *NodeConfig) NewNode(server *protocols.Server, role string) (*Node, error) {
+	addr := config.Advertise
+	if addr == "" {
+		local := server.LocalAddr()
+		ip := local.IP()
+		if ip == nil || ip.IsUnspecified() {
+			ip = net.IPv4(127, 0, 0, 1)
+		}
+		_, port, err := net.SplitHostPort(local.String())
+		if err != nil {
+			return nil, err
+		}
+		addr = net.JoinHostPort(ip.String(), port)
+	}
+	return RegisterNode(server, Member{Addr: addr, Role: role})
+}
+
+// Published when a member is learned or changes its state. Not published for the own member.
+type MemberEvent struct {
+	Update
+	Previous MemberState
+	New      bool // The member was not known before
+}
+
+func (event *MemberEvent) String() string {
+	if event.New {
+		return fmt.Sprintf("New member %v", event.Update)
+	}
+	return fmt.Sprintf("Member %v (previously %v)", event.Update, event.Previous)
+}
+
+// All methods are safe for concurrent use.
+type Node struct {
+	*protocols.Server
+	Self Member
+
+	lock        sync.Mutex
+	incarnation uint64
+	members     map[string]*memberInfo
+	broadcasts  []*broadcast
+	probeOrder  []string
+	probeIndex  int
+	detectors   map[string][]*MemberDetector
+	handlers    []func(event *MemberEvent)
+	indirectSeq uint64
+	indirect    map[uint64]chan []Update // Pending indirect probes, receiving the IndirectAcks
+
+	events chan *MemberEvent
+	stop   chan struct{}
+}
+
+type memberInfo struct {
+	Update
+	changed time.Time
+}
+
+// An update that is piggybacked on outgoing packets
+type broadcast struct {
+	update    Update
+	transmits int
+}
+
+func RegisterNode(server *protocols.Server, self Member) (*Node, error) {
+	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	node := &Node{
+		Server:    server,
+		Self:      self,
+		members:   make(map[string]*memberInfo),
+		detectors: make(map[string][]*MemberDetector),
+		indirect:  make(map[uint64]chan []Update),
+		events:    make(chan *MemberEvent, MemberEventBufferSize),
+		stop:      make(chan struct{}),
+	}
+	node.members[self.Addr] = &memberInfo{
+		Update:  Update{Member: self, State: MemberAlive},
+		changed: time.Now(),
+	}
+	err := server.RegisterHandlers(protocols.ServerHandlerMap{
+		codePing:    node.handlePing,
+		codePingReq: node.handlePingReq,
+		codeJoin:    node.handleJoin,
+
+		codeIndirectAck: node.handleIndirectAck,
+	})
+	if err != nil {
+		return nil, err
+	}
+	server.RegisterStopHandler(node.leave)
+	go node.dispatchEvents()
+	return node, nil
+}
+
+// handler is called in a dedicated goroutine, in the order in which the membership changed.
+// Subscribe before calling Join(), to receive the members learned when joining.
+func (node *Node) Subscribe(handler func(event *MemberEvent)) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	node.handlers = append(node.handlers, handler)
+}
+
+// Join the group through the seeds, and start probing other members.
+// Errors reaching the seeds are logged: the first node of a group has nobody to join.
+func (node *Node) Join(seeds []string) {
+	node.lock.Lock()
+	node.enqueue(node.members[node.Self.Addr].Update)
+	node.lock.Unlock()
+	joined := false
+	var errors golib.MultiError
+	for _, seed := range seeds {
+		if seed == node.Self.Addr {
+			continue
+		}
+		if err := node.join(seed); err != nil {
+			errors.Add(fmt.Errorf("Failed to join gossip group through %v: %v", seed, err))
+		} else {
+			joined = true
+		}
+	}
+	if !joined {
+		if err := errors.NilOrError(); err != nil {
+			node.LogError(err)
+		}
+	}
+	go node.probeLoop()
+}
+
+func (node *Node) join(seed string) error {
+	client, err := NewClientFor(seed)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.SetTimeout(ProbeTimeout)
+	updates, err := client.Join(node.Self)
+	if err != nil {
+		return err
+	}
+	node.merge(updates)
+	return nil
+}
+
+// Snapshot of all known members, including the own member.
+func (node *Node) Members() []Update {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	updates := make([]Update, 0, len(node.members))
+	for _, info := range node.members {
+		updates = append(updates, info.Update)
+	}
+	return updates
+}
+
+func (node *Node) Member(addr string) (Update, bool) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	if info, ok := node.members[addr]; ok {
+		return info.Update, true
+	}
+	return Update{}, false
+}
+
+// ======================= Probing =======================
+
+func (node *Node) probeLoop() {
+	for {
+		select {
+		case <-time.After(ProbeInterval):
+		case <-node.stop:
+			return
+		}
+		node.expireSuspects()
+		if target := node.nextTarget(); target != "" {
+			node.probe(target)
+		}
+	}
+}
+
+func (node *Node) probe(target string) {
+	updates, err := node.ping(target, ProbeTimeout)
+	if err == nil {
+		node.merge(updates)
+		return
+	}
+	if !node.probeIndirect(target) {
+		node.suspect(target, err)
+	}
+}
+
+func (node *Node) ping(target string, timeout time.Duration) ([]Update, error) {
+	client, err := NewClientFor(target)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	client.SetTimeout(timeout)
+	return client.Ping(node.Self, node.piggyback())
+}
+
+// The helpers answer asynchronously with an IndirectAck, if they reached the target.
+func (node *Node) probeIndirect(target string) bool {
+	helpers := node.randomMembers(IndirectProbes, target)
+	if len(helpers) == 0 {
+		return false
+	}
+	acks := make(chan []Update, len(helpers))
+	node.lock.Lock()
+	node.indirectSeq++
+	seq := node.indirectSeq
+	node.indirect[seq] = acks
+	node.lock.Unlock()
+	defer func() {
+		node.lock.Lock()
+		delete(node.indirect, seq)
+		node.lock.Unlock()
+	}()
+	for _, helper := range helpers {
+		go func(helper string) {
+			client, err := NewClientFor(helper)
+			if err != nil {
+				return
+			}
+			defer client.Close()
+			client.SetTimeout(ProbeTimeout)
+			_ = client.PingReq(node.Self, seq, target, node.piggyback()) // Drop error, the probe times out
+		}(helper)
+	}
+	select {
+	case updates := <-acks:
+		node.merge(updates)
+		return true
+	case <-time.After(2 * ProbeTimeout):
+		// The helpers need time to probe the target themselves
+		return false
+	case <-node.stop:
+		return false
+	}
+}
+
+// Round-robin through the members in random order, shuffled after every round.
+func (node *Node) nextTarget() string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	for round := 0; round < 2; round++ {
+		for node.probeIndex < len(node.probeOrder) {
+			addr := node.probeOrder[node.probeIndex]
+			node.probeIndex++
+			if info, ok := node.members[addr]; ok && info.State.Reachable() && addr != node.Self.Addr {
+				return addr
+			}
+		}
+		node.probeOrder = node.probeOrder[:0]
+		for addr := range node.members {
+			node.probeOrder = append(node.probeOrder, addr)
+		}
+		for i := range node.probeOrder {
+			j := gossipRand.Intn(i + 1)
+			node.probeOrder[i], node.probeOrder[j] = node.probeOrder[j], node.probeOrder[i]
+		}
+		node.probeIndex = 0
+	}
+	return ""
+}
+
+func (node *Node) randomMembers(num int, exclude string) []string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	var candidates []string
+	for addr, info := range node.members {
+		if addr != exclude && addr != node.Self.Addr && info.State.Reachable() {
+			candidates = append(candidates, addr)
+		}
+	}
+	result := make([]string, 0, num)
+	for _, i := range gossipRand.Perm(len(candidates)) {
+		if len(result) >= num {
+			break
+		}
+		result = append(result, candidates[i])
+	}
+	return result
+}
+
+func (node *Node) suspect(addr string, err error) {
+	node.lock.Lock()
+	var event *MemberEvent
+	if info, ok := node.members[addr]; ok && info.State == MemberAlive {
+		event = node.apply(Update{Member: info.Member, State: MemberSuspect, Incarnation: info.Incarnation})
+	}
+	node.lock.Unlock()
+	if event != nil {
+		node.LogError(fmt.Errorf("Suspecting gossip member %v: %v", addr, err))
+		node.publish(event)
+	}
+}
+
+func (node *Node) expireSuspects() {
+	now := time.Now()
+	var events []*MemberEvent
+	node.lock.Lock()
+	for _, info := range node.members {
+		if info.State == MemberSuspect && now.Sub(info.changed) >= SuspicionTimeout {
+			if event := node.apply(Update{Member: info.Member, State: MemberDead, Incarnation: info.Incarnation}); event != nil {
+				events = append(events, event)
+			}
+		}
+	}
+	node.lock.Unlock()
+	for _, event := range events {
+		node.publish(event)
+	}
+}
+
+// Announce that this node leaves the group. Called when the server is stopped.
+func (node *Node) leave() {
+	node.lock.Lock()
+	node.incarnation++
+	left := Update{Member: node.Self, State: MemberLeft, Incarnation: node.incarnation}
+	node.members[node.Self.Addr].Update = left
+	node.enqueue(left)
+	node.lock.Unlock()
+	close(node.stop)
+	for _, target := range node.randomMembers(IndirectProbes, "") {
+		if _, err := node.ping(target, ProbeTimeout); err != nil {
+			node.LogError(fmt.Errorf("Failed to announce leaving the gossip group to %v: %v", target, err))
+		}
+	}
+}
+
+// ======================= Membership updates =======================
+
+func (node *Node) merge(updates []Update) {
+	var events []*MemberEvent
+	node.lock.Lock()
+	for _, update := range updates {
+		if event := node.apply(update); event != nil {
+			events = append(events, event)
+		}
+	}
+	node.lock.Unlock()
+	for _, event := range events {
+		node.publish(event)
+	}
+}
+
+// Handle the updates received from a member. Unless it announces that it is leaving, the sender is alive.
+func (node *Node) receivedFrom(from Member, updates []Update) {
+	for _, update := range updates {
+		if update.Member.Addr == from.Addr && update.State == MemberLeft {
+			node.merge(updates)
+			return
+		}
+	}
+	node.learn(from)
+	node.merge(updates)
+}
+
+// A member that sent us a packet is alive. Unknown members are added,
+// members that were dead or left re-join with a higher incarnation.
+func (node *Node) learn(member Member) {
+	node.lock.Lock()
+	update := Update{Member: member, State: MemberAlive}
+	if info, ok := node.members[member.Addr]; ok {
+		if info.State.Reachable() {
+			node.lock.Unlock()
+			return
+		}
+		update.Incarnation = info.Incarnation + 1
+	}
+	event := node.apply(update)
+	node.lock.Unlock()
+	if event != nil {
+		node.publish(event)
+	}
+}
+
+// Must be called with node.lock held. Returns the resulting event, if the state of a member changed.
+func (node *Node) apply(update Update) *MemberEvent {
+	addr := update.Member.Addr
+	if addr == node.Self.Addr {
+		// Refute suspicions about ourselves
+		if (update.State == MemberSuspect || update.State == MemberDead) && update.Incarnation >= node.incarnation {
+			node.incarnation = update.Incarnation + 1
+			self := Update{Member: node.Self, State: MemberAlive, Incarnation: node.incarnation}
+			node.members[addr].Update = self
+			node.enqueue(self)
+		}
+		return nil
+	}
+	info, known := node.members[addr]
+	if !known {
+		if !update.State.Reachable() {
+			return nil // Do not learn about members that are already gone
+		}
+		node.members[addr] = &memberInfo{Update: update, changed: time.Now()}
+		node.enqueue(update)
+		return &MemberEvent{Update: update, New: true}
+	}
+	if !overrides(update, info.Update) {
+		return nil
+	}
+	previous := info.State
+	info.Update = update
+	info.changed = time.Now()
+	node.enqueue(update)
+	if previous == update.State {
+		return nil
+	}
+	return &MemberEvent{Update: update, Previous: previous}
+}
+
+func overrides(update, current Update) bool {
+	switch update.State {
+	case MemberAlive:
+		return update.Incarnation > current.Incarnation
+	case MemberSuspect:
+		return (current.State == MemberAlive && update.Incarnation >= current.Incarnation) ||
+			(current.State == MemberSuspect && update.Incarnation > current.Incarnation)
+	default:
+		return current.State.Reachable() || update.Incarnation > current.Incarnation
+	}
+}
+
+// Must be called with node.lock held.
+func (node *Node) enqueue(update Update) {
+	for _, existing := range node.broadcasts {
+		if existing.update.Member.Addr == update.Member.Addr {
+			existing.update = update
+			existing.transmits = 0
+			return
+		}
+	}
+	node.broadcasts = append(node.broadcasts, &broadcast{update: update})
+}
+
+// The least transmitted updates. Updates are dropped after being transmitted often enough.
+func (node *Node) piggyback() []Update {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	limit := retransmit_mult * int(math.Ceil(math.Log10(float64(len(node.members)+1))))
+	sort.Stable(byTransmits(node.broadcasts))
+	var updates []Update
+	remaining := node.broadcasts[:0]
+	for _, b := range node.broadcasts {
+		if len(updates) < MaxPiggyback {
+			updates = append(updates, b.update)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			remaining = append(remaining, b)
+		}
+	}
+	node.broadcasts = remaining
+	return updates
+}
+
+type byTransmits []*broadcast
+
+func (b byTransmits) Len() int {
+	return len(b)
+}
+func (b byTransmits) Less(i, j int) bool {
+	return b[i].transmits < b[j].transmits
+}
+func (b byTransmits) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// ======================= Events =======================
+
+func (node *Node) publish(event *MemberEvent) {
+	select {
+	case node.events <- event:
+	case <-node.stop:
+	}
+}
+
+func (node *Node) dispatchEvents() {
+	for {
+		select {
+		case event := <-node.events:
+			node.lock.Lock()
+			handlers := make([]func(event *MemberEvent), len(node.handlers))
+			copy(handlers, node.handlers)
+			detectors := make([]*MemberDetector, len(node.detectors[event.Member.Addr]))
+			copy(detectors, node.detectors[event.Member.Addr])
+			node.lock.Unlock()
+			for _, handler := range handlers {
+				handler(event)
+			}
+			for _, detector := range detectors {
+				detector.Check()
+			}
+		case <-node.stop:
+			return
+		}
+	}
+}
+
+// ======================= Server =======================
+
+func (node *Node) handlePing(packet *protocols.Packet) *protocols.Packet {
+	if ping, ok := packet.Val.(*Ping); ok {
+		node.receivedFrom(ping.From, ping.Updates)
+		return node.Reply(codeAck, &Ack{Updates: node.piggyback()})
+	} else {
+		return node.ReplyError(fmt.Errorf("Illegal value for Gossip Ping: %v", packet.Val))
+	}
+}
+
+// The target is probed in the background, so the server does not wait for it.
+func (node *Node) handlePingReq(packet *protocols.Packet) *protocols.Packet {
+	if req, ok := packet.Val.(*PingReq); ok {
+		node.receivedFrom(req.From, req.Updates)
+		go node.pingFor(req)
+		return node.ReplyOK()
+	} else {
+		return node.ReplyError(fmt.Errorf("Illegal value for Gossip PingReq: %v", packet.Val))
+	}
+}
+
+// Nothing is sent back if the target does not answer, the requesting node times out instead.
+func (node *Node) pingFor(req *PingReq) {
+	updates, err := node.ping(req.Target, ProbeTimeout)
+	if err != nil {
+		return
+	}
+	node.merge(updates)
+	client, err := NewClientFor(req.From.Addr)
+	if err == nil {
+		defer client.Close()
+		client.SetTimeout(ProbeTimeout)
+		err = client.IndirectAck(req.Seq, req.Target, updates)
+	}
+	if err != nil {
+		node.LogError(fmt.Errorf("Failed to send indirect ack for %v to %v: %v", req.Target, req.From.Addr, err))
+	}
+}
+
+func (node *Node) handleIndirectAck(packet *protocols.Packet) *protocols.Packet {
+	if ack, ok := packet.Val.(*IndirectAck); ok {
+		node.lock.Lock()
+		acks, ok := node.indirect[ack.Seq]
+		node.lock.Unlock()
+		if ok {
+			select {
+			case acks <- ack.Updates:
+			default:
+				// Another helper already answered
+			}
+		}
+	} else {
+		node.LogError(fmt.Errorf("Illegal value for Gossip IndirectAck: %v", packet.Val))
+	}
+	return nil
+}
+
+func (node *Node) handleJoin(packet *protocols.Packet) *protocols.Packet {
+	if join, ok := packet.Val.(*Join); ok {
+		node.learn(join.From)
+		return node.Reply(codeMembers, &Members{Updates: node.Members()})
+	} else {
+		return node.ReplyError(fmt.Errorf("Illegal value for Gossip Join: %v", packet.Val))
+	}
+}
@@ -0,0 +1,135 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOverrides(t *testing.T) {
+	alive, suspect, dead, left := MemberAlive, MemberSuspect, MemberDead, MemberLeft
+	for _, test := range []struct {
+		update, current MemberState
+		inc, currentInc uint64
+		overrides       bool
+	}{
+		{alive, alive, 1, 1, false},
+		{alive, alive, 2, 1, true},
+		{alive, suspect, 1, 1, false},
+		{alive, suspect, 2, 1, true},
+		{alive, dead, 2, 1, true},
+		{alive, left, 1, 1, false},
+
+		{suspect, alive, 1, 1, true},
+		{suspect, alive, 0, 1, false},
+		{suspect, suspect, 1, 1, false},
+		{suspect, suspect, 2, 1, true},
+		{suspect, dead, 2, 1, false},
+		{suspect, left, 5, 1, false},
+
+		{dead, alive, 0, 1, true},
+		{dead, suspect, 0, 1, true},
+		{dead, dead, 1, 1, false},
+		{dead, dead, 2, 1, true},
+		{left, alive, 0, 1, true},
+		{left, dead, 1, 1, false},
+	} {
+		update := Update{Member: Member{Addr: "a"}, State: test.update, Incarnation: test.inc}
+		current := Update{Member: Member{Addr: "a"}, State: test.current, Incarnation: test.currentInc}
+		if result := overrides(update, current); result != test.overrides {
+			t.Errorf("overrides(%v, %v) = %v, expected %v", update, current, result, test.overrides)
+		}
+	}
+}
+
+func newTestNode(self string) *Node {
+	node := &Node{
+		Self:    Member{Addr: self, Role: RoleAmp},
+		members: make(map[string]*memberInfo),
+	}
+	node.members[self] = &memberInfo{Update: Update{Member: node.Self, State: MemberAlive}, changed: time.Now()}
+	return node
+}
+
+func TestApply(t *testing.T) {
+	self, other := "127.0.0.1:1", "127.0.0.1:2"
+	update := func(addr string, state MemberState, inc uint64) Update {
+		return Update{Member: Member{Addr: addr, Role: RoleAmp}, State: state, Incarnation: inc}
+	}
+	type step struct {
+		update      Update
+		event       bool // An event is returned
+		newMember   bool
+		state       MemberState // Resulting state of the member, if known
+		known       bool
+		incarnation uint64 // Own incarnation afterwards
+	}
+	for _, test := range []struct {
+		name  string
+		steps []step
+	}{
+		{"learn and forget", []step{
+			{update(other, MemberAlive, 0), true, true, MemberAlive, true, 0},
+			{update(other, MemberAlive, 0), false, false, MemberAlive, true, 0},
+			{update(other, MemberSuspect, 0), true, false, MemberSuspect, true, 0},
+			{update(other, MemberSuspect, 1), false, false, MemberSuspect, true, 0}, // No state change, but newer
+			{update(other, MemberAlive, 2), true, false, MemberAlive, true, 0},
+			{update(other, MemberDead, 2), true, false, MemberDead, true, 0},
+			{update(other, MemberSuspect, 2), false, false, MemberDead, true, 0},
+		}},
+		{"unknown members that are gone", []step{
+			{update(other, MemberDead, 0), false, false, 0, false, 0},
+			{update(other, MemberLeft, 0), false, false, 0, false, 0},
+			{update(other, MemberSuspect, 0), true, true, MemberSuspect, true, 0},
+		}},
+		{"refute suspicion", []step{
+			{update(self, MemberSuspect, 0), false, false, MemberAlive, true, 1},
+			{update(self, MemberSuspect, 0), false, false, MemberAlive, true, 1}, // Outdated
+			{update(self, MemberDead, 3), false, false, MemberAlive, true, 4},
+			{update(self, MemberAlive, 7), false, false, MemberAlive, true, 4},
+		}},
+	} {
+		node := newTestNode(self)
+		for i, step := range test.steps {
+			event := node.apply(step.update)
+			if (event != nil) != step.event || (event != nil && event.New != step.newMember) {
+				t.Errorf("%v: step %v (%v): unexpected event %v", test.name, i, step.update, event)
+			}
+			info, known := node.members[step.update.Member.Addr]
+			if known != step.known || (known && info.State != step.state) {
+				t.Errorf("%v: step %v (%v): member known %v (%v), expected %v (%v)", test.name, i, step.update, known, info, step.known, step.state)
+			}
+			if node.incarnation != step.incarnation {
+				t.Errorf("%v: step %v (%v): own incarnation %v, expected %v", test.name, i, step.update, node.incarnation, step.incarnation)
+			}
+		}
+	}
+}
+
+func TestPiggyback(t *testing.T) {
+	node := newTestNode("127.0.0.1:1")
+	for i := 0; i < MaxPiggyback+2; i++ {
+		node.lock.Lock()
+		node.apply(Update{Member: Member{Addr: fmt.Sprintf("127.0.0.1:%v", 100+i)}, State: MemberAlive})
+		node.lock.Unlock()
+	}
+	// 13 members: every update is sent 3 * ceil(log10(14)) = 6 times
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		updates := node.piggyback()
+		if len(updates) > MaxPiggyback {
+			t.Fatalf("%v updates piggybacked, maximum is %v", len(updates), MaxPiggyback)
+		}
+		for _, update := range updates {
+			counts[update.Member.Addr]++
+		}
+	}
+	if len(counts) != MaxPiggyback+2 {
+		t.Errorf("%v members were piggybacked, expected %v", len(counts), MaxPiggyback+2)
+	}
+	for addr, count := range counts {
+		if count != 2*retransmit_mult {
+			t.Errorf("Update for %v piggybacked %v times, expected %v", addr, count, 2*retransmit_mult)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package gossip
+
+// SWIM-style membership protocol: nodes probe each other periodically, use other members
+// for indirect probes, and piggyback membership updates on the probe packets.
+
+import (
+	"encoding/gob"
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+var (
+	Protocol     *gossipProtocol
+	MiniProtocol = protocols.NewMiniProtocol(Protocol)
+)
+
+const (
+	// Full membership lists can get large. The tcp transport must be able to receive packets of this size.
+	maxValueSize = 16384
+)
+
+// Roles of the nodes in this repository
+const (
+	RoleBalancer = "balancer"
+	RoleAmp      = "amp"
+	RolePcp      = "pcp"
+	RoleLoad     = "load"
+)
+
+// ======================= Packets =======================
+
+const (
+	codePing = protocols.Code(35 + iota)
+	codePingReq
+	codeAck
+	codeJoin
+	codeMembers
+
+	codeIndirectAck = protocols.Code(42)
+)
+
+type Member struct {
+	Addr string // Address of the server running the node, also identifies the member
+	Role string
+}
+
+type MemberState int
+
+const (
+	MemberAlive = MemberState(iota)
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+var memberStateNames = map[MemberState]string{
+	MemberAlive:   "alive",
+	MemberSuspect: "suspect",
+	MemberDead:    "dead",
+	MemberLeft:    "left",
+}
+
+func (state MemberState) String() string {
+	if name, ok := memberStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("MemberState(%d)", int(state))
+}
+
+// Reachable members are alive or suspected.
+func (state MemberState) Reachable() bool {
+	return state == MemberAlive || state == MemberSuspect
+}
+
+type Update struct {
+	Member      Member
+	State       MemberState
+	Incarnation uint64 // Increased by the member itself to refute suspicions
+}
+
+func (update Update) String() string {
+	return fmt.Sprintf("%v %v %v (incarnation %v)", update.Member.Role, update.Member.Addr, update.State, update.Incarnation)
+}
+
+// Answered with Ack
+type Ping struct {
+	From    Member
+	Updates []Update
+}
+
+// Ask another member to ping Target on our behalf. Answered with OK right away.
+// If Target answers, the updates of its Ack are sent back to From in an IndirectAck.
+type PingReq struct {
+	From    Member
+	Seq     uint64 // Copied into the IndirectAck
+	Target  string
+	Updates []Update
+}
+
+type Ack struct {
+	Updates []Update
+}
+
+// Sent without expecting a reply
+type IndirectAck struct {
+	Seq     uint64
+	Target  string
+	Updates []Update // From the Ack of Target
+}
+
+// Answered with Members
+type Join struct {
+	From Member
+}
+
+// The complete membership list known to the answering node
+type Members struct {
+	Updates []Update
+}
+
+// ======================= Protocol =======================
+
+type gossipProtocol struct {
+}
+
+func (*gossipProtocol) Name() string {
+	return "Gossip"
+}
+
+func (*gossipProtocol) MaxValueSize() int {
+	return maxValueSize
+}
+
+func (proto *gossipProtocol) Decoders() protocols.DecoderMap {
+	return protocols.DecoderMap{
+		codePing:    proto.decodePing,
+		codePingReq: proto.decodePingReq,
+		codeAck:     proto.decodeAck,
+		codeJoin:    proto.decodeJoin,
+		codeMembers: proto.decodeMembers,
+
+		codeIndirectAck: proto.decodeIndirectAck,
+	}
+}
+
+func (proto *gossipProtocol) decodePing(decoder *gob.Decoder) (interface{}, error) {
+	var val Ping
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip Ping value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *gossipProtocol) decodePingReq(decoder *gob.Decoder) (interface{}, error) {
+	var val PingReq
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip PingReq value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *gossipProtocol) decodeAck(decoder *gob.Decoder) (interface{}, error) {
+	var val Ack
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip Ack value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *gossipProtocol) decodeIndirectAck(decoder *gob.Decoder) (interface{}, error) {
+	var val IndirectAck
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip IndirectAck value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *gossipProtocol) decodeJoin(decoder *gob.Decoder) (interface{}, error) {
+	var val Join
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip Join value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *gossipProtocol) decodeMembers(decoder *gob.Decoder) (interface{}, error) {
+	var val Members
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Gossip Members value: %v", err)
+	}
+	return &val, nil
+}
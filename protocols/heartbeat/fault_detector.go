@@ -2,23 +2,47 @@ package heartbeat
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
 	"github.com/antongulenko/golib"
 )
 
 // ======================= Server for receiving heartbeats =======================
 
+const (
+	heartbeat_stats_window = 100
+
+	// Minimum time between two stop requests for the same removed token
+	removed_token_stop_interval = 1 * time.Second
+
+	// Removed tokens are forgotten when no heartbeats arrived for them for this long.
+	// They are still never accepted again, only no more stop requests are sent.
+	removed_token_retention = 1 * time.Minute
+)
+
 var (
 	tokenRand = rand.New(rand.NewSource(time.Now().Unix()))
 )
 
 type HeartbeatServer struct {
 	*protocols.Server
+
+	lock      sync.Mutex
+	started   bool
 	detectors map[int64]*HeartbeatFaultDetector
+	removed   map[int64]*removedToken
+}
+
+// Heartbeats with the token of a removed detector are answered with another stop request,
+// in case the first one was lost.
+type removedToken struct {
+	endpoint string
+	lastStop time.Time
 }
 
 type serverStopper struct {
@@ -29,6 +53,7 @@ type serverStopper struct {
 func NewHeartbeatServer(local_addr string) (*HeartbeatServer, error) {
 	heartbeatServer := &HeartbeatServer{
 		detectors: make(map[int64]*HeartbeatFaultDetector),
+		removed:   make(map[int64]*removedToken),
 	}
 	if server, err := protocols.NewServer(local_addr, &serverStopper{MiniProtocol, heartbeatServer}); err == nil {
 		heartbeatServer.Server = server
@@ -42,46 +67,119 @@ func NewHeartbeatServer(local_addr string) (*HeartbeatServer, error) {
 	}
 }
 
+// Starts all detectors created so far. Detectors created afterwards are started immediately.
 func (server *HeartbeatServer) Start(wg *sync.WaitGroup) golib.StopChan {
 	res := server.Server.Start(wg)
-	for _, detector := range server.detectors {
+	server.lock.Lock()
+	server.started = true
+	detectors := server.detectorList()
+	server.lock.Unlock()
+	for _, detector := range detectors {
 		detector.Start()
 	}
 	return res
 }
 
 func (server *serverStopper) StopServer() {
-	for _, detector := range server.detectors {
+	server.lock.Lock()
+	detectors := server.detectorList()
+	server.lock.Unlock()
+	for _, detector := range detectors {
 		if err := detector.Close(); err != nil {
 			server.LogError(fmt.Errorf("Error closing %v: %v", detector, err))
 		}
 	}
 }
 
+func (server *HeartbeatServer) detectorList() []*HeartbeatFaultDetector {
+	detectors := make([]*HeartbeatFaultDetector, 0, len(server.detectors))
+	for _, detector := range server.detectors {
+		detectors = append(detectors, detector)
+	}
+	return detectors
+}
+
+// Stops observing the server and closes the detector. Same as detector.Close().
+func (server *HeartbeatServer) StopObserving(detector protocols.FaultDetector) error {
+	heartbeatDetector, ok := detector.(*HeartbeatFaultDetector)
+	if !ok || heartbeatDetector.server != server {
+		return fmt.Errorf("%v was not created by %v", detector, server)
+	}
+	return heartbeatDetector.Close()
+}
+
 func (server *HeartbeatServer) HeartbeatReceived(beat *HeartbeatPacket) {
 	received := time.Now()
 	token := beat.Token
-	if detector, ok := server.detectors[token]; ok {
+	server.lock.Lock()
+	detector, ok := server.detectors[token]
+	removed, wasRemoved := server.removed[token]
+	resendStop := wasRemoved && received.Sub(removed.lastStop) >= removed_token_stop_interval
+	if resendStop {
+		removed.lastStop = received
+	}
+	server.lock.Unlock()
+
+	if ok {
 		detector.heartbeatReceived(received, beat)
+	} else if wasRemoved {
+		if resendStop {
+			go server.sendStop(removed.endpoint, token)
+		}
 	} else {
 		server.LogError(fmt.Errorf("Unexpected heartbeat (seq %v) from %v", beat.Seq, beat.Source))
 	}
 }
 
+func (server *HeartbeatServer) removeDetector(detector *HeartbeatFaultDetector) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	now := time.Now()
+	for token, removed := range server.removed {
+		if now.Sub(removed.lastStop) > removed_token_retention {
+			delete(server.removed, token)
+		}
+	}
+	delete(server.detectors, detector.token)
+	server.removed[detector.token] = &removedToken{
+		endpoint: detector.client.Server().String(),
+		lastStop: now,
+	}
+}
+
+func (server *HeartbeatServer) sendStop(endpoint string, token int64) {
+	client, err := NewClientFor(endpoint)
+	if err == nil {
+		err = client.ConfigureHeartbeat(server.Server, token, 0)
+		_ = client.Close()
+	}
+	if err != nil {
+		server.LogError(fmt.Errorf("Error stopping heartbeats with removed token from %v: %v", endpoint, err))
+	}
+}
+
 // ======================= FaultDetector interface =======================
 
 type HeartbeatFaultDetector struct {
 	*protocols.FaultDetectorBase
 	server             *HeartbeatServer
 	client             *Client
-	configError        error
 	acceptableTimeout  time.Duration
 	heartbeatFrequency time.Duration
+	phi                *protocols.PhiAccrual // Replaces acceptableTimeout, if set
 
-	token                 int64
+	token   int64
+	started bool
+	stats   *stats.HeartbeatStats
+
+	// Written by the heartbeat handler, read by the check loop
+	lock                  sync.Mutex // Guards the following fields
 	seq                   uint64
 	lastHeartbeatSent     time.Time
 	lastHeartbeatReceived time.Time
+	metrics               *Metrics
+	metricsReceived       time.Time
+	configError           error
 }
 
 func (detector *HeartbeatFaultDetector) String() string {
@@ -89,38 +187,78 @@ func (detector *HeartbeatFaultDetector) String() string {
 }
 
 func (server *HeartbeatServer) ObserveServer(endpoint string, heartbeatFrequency time.Duration, acceptableTimeout time.Duration) (protocols.FaultDetector, error) {
+	detector, err := server.observe(endpoint, heartbeatFrequency, acceptableTimeout, nil)
+	if err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+// Instead of a fixed timeout, the distribution of the heartbeat intervals is learned.
+// The server is considered offline when the suspicion level phi reaches threshold.
+func (server *HeartbeatServer) ObservePhi(endpoint string, heartbeatFrequency time.Duration, threshold float64) (protocols.SuspicionDetector, error) {
+	detector, err := server.observe(endpoint, heartbeatFrequency, heartbeatFrequency, protocols.NewPhiAccrual(threshold, heartbeatFrequency))
+	if err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+func (server *HeartbeatServer) observe(endpoint string, heartbeatFrequency time.Duration, acceptableTimeout time.Duration, phi *protocols.PhiAccrual) (*HeartbeatFaultDetector, error) {
 	client, err := NewClientFor(endpoint)
 	if err != nil {
 		return nil, err
 	}
+	server.lock.Lock()
 	var token int64
 	for {
 		token = tokenRand.Int63()
-		if _, ok := server.detectors[token]; !ok && token != 0 {
+		_, used := server.detectors[token]
+		_, removed := server.removed[token]
+		if !used && !removed && token != 0 {
 			break
 		}
 	}
 	detector := &HeartbeatFaultDetector{
-		FaultDetectorBase:  protocols.NewFaultDetectorBase(server.Protocol(), client.Server()),
-		client:             client,
-		acceptableTimeout:  acceptableTimeout,
-		heartbeatFrequency: heartbeatFrequency,
-		server:             server,
-		token:              token,
+		FaultDetectorBase:     protocols.NewFaultDetectorBase(server.Protocol(), client.Server()),
+		client:                client,
+		acceptableTimeout:     acceptableTimeout,
+		heartbeatFrequency:    heartbeatFrequency,
+		phi:                   phi,
+		server:                server,
+		token:                 token,
+		stats:                 stats.NewHeartbeatStats(heartbeat_stats_window),
 		lastHeartbeatReceived: time.Now(),
 	}
 	server.detectors[token] = detector
+	started := server.started
+	server.lock.Unlock()
+	if started {
+		detector.Start()
+	}
 	return detector, nil
 }
 
 func (detector *HeartbeatFaultDetector) heartbeatReceived(received time.Time, beat *HeartbeatPacket) {
-	if detector.seq != 0 && detector.seq != beat.Seq {
-		detector.server.LogError(fmt.Errorf("Heartbeat sequence jump (%v -> %v) for %v", detector.seq, beat.Seq, detector))
-	}
+	detector.lock.Lock()
+	expectedSeq := detector.seq
 	detector.seq = beat.Seq + 1
 	detector.lastHeartbeatReceived = received
 	detector.lastHeartbeatSent = beat.TimeSent
-	detector.Check()
+	if beat.Metrics != nil {
+		detector.metrics = beat.Metrics
+		detector.metricsReceived = received
+	}
+	detector.lock.Unlock()
+	if expectedSeq != 0 && expectedSeq != beat.Seq {
+		detector.server.LogError(fmt.Errorf("Heartbeat sequence jump (%v -> %v) for %v", expectedSeq, beat.Seq, detector))
+	}
+	detector.stats.Received(beat.Seq, beat.TimeSent, received)
+	if detector.phi != nil {
+		detector.phi.Heartbeat(received)
+	}
+	// Not checked here: the failure and success thresholds count the checks of the
+	// check loop, so they must not depend on the heartbeat frequency.
 }
 
 func (detector *HeartbeatFaultDetector) IsStopped() bool {
@@ -129,38 +267,99 @@ func (detector *HeartbeatFaultDetector) IsStopped() bool {
 
 func (detector *HeartbeatFaultDetector) Check() {
 	detector.PerformCheck(func() error {
+		if detector.phi != nil {
+			return detector.configErr(detector.phi.Check(time.Now()))
+		}
+		detector.lock.Lock()
 		timeSinceLastHeartbeat := time.Now().Sub(detector.lastHeartbeatReceived)
+		detector.lock.Unlock()
 		if timeSinceLastHeartbeat <= detector.acceptableTimeout {
 			return nil
 		} else {
-			var configErr string
-			if detector.configError != nil {
-				configErr = fmt.Sprintf(". Error configuring remote server: %v", detector.configError)
-			}
-			return fmt.Errorf("Heartbeat timeout: last heartbeat %v ago%s", timeSinceLastHeartbeat, configErr)
+			return detector.configErr(fmt.Errorf("Heartbeat timeout: last heartbeat %v ago", timeSinceLastHeartbeat))
 		}
 	})
-	if !detector.Online() {
+}
+
+// Check, and ask an offline server to send heartbeats again, e.g. after it was restarted.
+// Only executed by the check loop, so received heartbeats are not delayed by the reconfiguration.
+func (detector *HeartbeatFaultDetector) loopCheck() {
+	detector.Check()
+	if detector.State() == protocols.DetectorOffline {
 		detector.configureObservedServer()
 	}
 }
 
+// Loss, delay and jitter of the heartbeats received from the observed server.
+func (detector *HeartbeatFaultDetector) LinkStats() stats.HeartbeatSummary {
+	return detector.stats.Summary()
+}
+
+// The metrics piggybacked on the latest heartbeat, or nil.
+func (detector *HeartbeatFaultDetector) Metrics() *Metrics {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	return detector.metrics
+}
+
+// Implements balancer.LoadReporter.
+func (detector *HeartbeatFaultDetector) ReportedLoad() (float64, time.Time, bool) {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	if detector.metrics != nil {
+		return detector.metrics.Load, detector.metricsReceived, true
+	}
+	return 0, time.Time{}, false
+}
+
+func (detector *HeartbeatFaultDetector) configErr(err error) error {
+	detector.lock.Lock()
+	defer detector.lock.Unlock()
+	if err != nil && detector.configError != nil {
+		err = fmt.Errorf("%v. Error configuring remote server: %v", err, detector.configError)
+	}
+	return err
+}
+
+// Implements protocols.SuspicionDetector. Without phi-accrual detection,
+// the suspicion is either 0 or +Inf.
+func (detector *HeartbeatFaultDetector) Suspicion() float64 {
+	if detector.phi == nil {
+		if detector.Online() {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return detector.phi.Phi(time.Now())
+}
+
 func (detector *HeartbeatFaultDetector) configureObservedServer() {
+	detector.lock.Lock()
 	detector.seq = 0
-	detector.configError = detector.client.ConfigureHeartbeat(detector.server.Server, detector.token, detector.heartbeatFrequency)
-	if detector.configError != nil {
+	detector.lock.Unlock()
+	detector.stats.ResetSequence()
+	err := detector.client.ConfigureHeartbeat(detector.server.Server, detector.token, detector.heartbeatFrequency)
+	if err != nil {
 		detector.client.ResetConnection()
 	}
+	detector.lock.Lock()
+	detector.configError = err
+	detector.lock.Unlock()
 }
 
+// Called automatically by the HeartbeatServer. Only the first call has an effect.
 func (detector *HeartbeatFaultDetector) Start() {
-	if !detector.IsStopped() {
+	detector.server.lock.Lock()
+	started := detector.started
+	detector.started = true
+	detector.server.lock.Unlock()
+	if !started && !detector.IsStopped() {
 		detector.configureObservedServer() // Once when starting up
 		go func() {
 			// TODO sleep something less than the timeout. This is random and probably will not scale.
 			timeout := detector.acceptableTimeout
 			time.Sleep(timeout) // Sleep now to wait for first heartbeat
-			detector.LoopCheck(detector.Check, timeout)
+			detector.LoopCheck(detector.loopCheck, timeout)
 		}()
 	}
 }
@@ -168,11 +367,9 @@ func (detector *HeartbeatFaultDetector) Start() {
 func (detector *HeartbeatFaultDetector) Close() error {
 	var err golib.MultiError
 	detector.Closed.Enable(func() {
-		delete(detector.server.detectors, detector.token)
-		// Notify remote server to stop sending heartbeats.
-		if detector.Online() {
-			err.Add(detector.client.ConfigureHeartbeat(detector.server.Server, 0, 0))
-		}
+		detector.server.removeDetector(detector)
+		// Notify remote server to stop sending heartbeats. Further heartbeats with this token are rejected.
+		err.Add(detector.client.ConfigureHeartbeat(detector.server.Server, detector.token, 0))
 		err.Add(detector.client.Close())
 	})
 	return err.NilOrError()
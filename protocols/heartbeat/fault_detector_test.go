@@ -0,0 +1,140 @@
+package heartbeat
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+const (
+	test_heartbeat_frequency = 20 * time.Millisecond
+	test_heartbeat_timeout   = 200 * time.Millisecond
+)
+
+// A server sending heartbeats, and a HeartbeatServer receiving them.
+func newTestHeartbeatServers(t *testing.T) (sender *protocols.Server, receiver *HeartbeatServer) {
+	sender, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err = NewHeartbeatServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.Start(new(sync.WaitGroup))
+	return
+}
+
+func waitFor(t *testing.T, description string, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().Sub(start) > 5*test_heartbeat_timeout {
+			t.Fatalf("Timed out waiting for %v", description)
+		}
+	}
+}
+
+func TestDetectorStartStop(t *testing.T) {
+	// The servers keep running: Server.Stopped is read by the listen loop without synchronization.
+	// Closing the detectors stops all heartbeats.
+	sender, receiver := newTestHeartbeatServers(t)
+	endpoint := sender.LocalAddr().String()
+	sendersLock.Lock()
+	senderState := senders[sender]
+	sendersLock.Unlock()
+
+	// Detectors created before starting the server do not request heartbeats yet
+	before, err := receiver.ObserveServer(endpoint, test_heartbeat_frequency, test_heartbeat_timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * test_heartbeat_frequency)
+	if subs := senderState.subscriptionNames(); len(subs) != 0 {
+		t.Fatalf("Heartbeats configured before starting the server: %v", subs)
+	}
+	receiver.Start(new(sync.WaitGroup))
+	after, err := receiver.ObserveServer(endpoint, test_heartbeat_frequency, test_heartbeat_timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, detector := range []protocols.FaultDetector{before, after} {
+		heartbeatDetector := detector.(*HeartbeatFaultDetector)
+		waitFor(t, "heartbeats", func() bool {
+			return heartbeatDetector.LinkStats().Received > 1
+		})
+		// The state is only updated by the check loop
+		waitFor(t, "the detector to come online", detector.Online)
+	}
+	if subs := senderState.subscriptionNames(); len(subs) != 2 {
+		t.Errorf("Expected 2 heartbeat subscriptions, have %v", subs)
+	}
+
+	// Stopping one detector does not affect the other one
+	if err := receiver.StopObserving(before); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the subscription to be stopped", func() bool {
+		return len(senderState.subscriptionNames()) == 1
+	})
+	received := after.(*HeartbeatFaultDetector).LinkStats().Received
+	waitFor(t, "more heartbeats", func() bool {
+		return after.(*HeartbeatFaultDetector).LinkStats().Received > received
+	})
+	if !after.Online() {
+		t.Errorf("Remaining detector offline: %v", after.Error())
+	}
+	if err := after.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "all subscriptions to be stopped", func() bool {
+		return len(senderState.subscriptionNames()) == 0
+	})
+}
+
+func TestHeartbeatTokens(t *testing.T) {
+	receiver, err := NewHeartbeatServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Stop()
+	detector, err := receiver.observe("127.0.0.1:17003", test_heartbeat_frequency, test_heartbeat_timeout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := receiver.observe("127.0.0.1:17003", test_heartbeat_frequency, test_heartbeat_timeout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not started: closing would request the remote server to stop, which is not running
+	receiver.removeDetector(removed)
+	for _, test := range []struct {
+		name     string
+		token    int64
+		received uint64 // Heartbeats received by the detector afterwards
+		logged   bool   // An error is logged for the heartbeat
+	}{
+		{"known token", detector.token, 1, false},
+		{"known token again", detector.token, 2, false},
+		{"removed token", removed.token, 2, false},
+		{"unknown token", removed.token + detector.token + 1, 2, true},
+	} {
+		receiver.HeartbeatReceived(&HeartbeatPacket{Token: test.token, TimeSent: time.Now(), Seq: detector.LinkStats().Received})
+		if received := detector.LinkStats().Received; received != test.received {
+			t.Errorf("%v: detector received %v heartbeats, expected %v", test.name, received, test.received)
+		}
+		select {
+		case err := <-receiver.Errors():
+			if !test.logged {
+				t.Errorf("%v: unexpected error: %v", test.name, err)
+			}
+		default:
+			if test.logged {
+				t.Errorf("%v: no error logged", test.name)
+			}
+		}
+	}
+	if removed.LinkStats().Received > 0 {
+		t.Errorf("Heartbeat with removed token was delivered")
+	}
+}
@@ -0,0 +1,16 @@
+package heartbeat
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzHeartbeat(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeHeartbeat, Val: &HeartbeatPacket{Token: 1, Source: "127.0.0.1:7777", TimeSent: time.Now(), Seq: 2}},
+		{Code: codeHeartbeat, Val: &HeartbeatPacket{Token: 1, Source: "127.0.0.1:7777", Metrics: &Metrics{Sessions: 3, Load: 3, Values: map[string]float64{"cpu": 0.5}}}},
+		{Code: codeConfigureHeartbeat, Val: &ConfigureHeartbeatPacket{Token: 1, TargetServer: "127.0.0.1:7776", Timeout: time.Second}},
+	})
+}
@@ -25,6 +25,27 @@ type HeartbeatPacket struct {
 	Source   string
 	TimeSent time.Time
 	Seq      uint64
+	Metrics  *Metrics // Optional, nil if the sending server has no MetricsProvider
+}
+
+// Describes the current state of the server sending the heartbeat.
+type Metrics struct {
+	Sessions       int
+	Load           float64 // Compared between servers of the same kind, e.g. by a balancer
+	BytesPerSecond float64
+	Values         map[string]float64 // Additional server-specific metrics
+}
+
+// Counts the sessions that are starting or running. Load is set to the number of sessions.
+func SessionMetrics(sessions []*protocols.SessionSnapshot) *Metrics {
+	metrics := new(Metrics)
+	for _, session := range sessions {
+		if session.State == protocols.SessionStarting || session.State == protocols.SessionRunning {
+			metrics.Sessions++
+		}
+	}
+	metrics.Load = float64(metrics.Sessions)
+	return metrics
 }
 
 type ConfigureHeartbeatPacket struct {
@@ -88,6 +109,8 @@ func NewClientFor(server_addr string) (*Client, error) {
 	return &Client{client}, nil
 }
 
+// Every combination of receiver and token is an independent heartbeat subscription.
+// A zero timeout stops the subscription, a zero token stops all subscriptions of the receiver.
 func (client *Client) ConfigureHeartbeat(receiver *protocols.Server, token int64, timeout time.Duration) error {
 	packet := ConfigureHeartbeatPacket{
 		Token:        token,
@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
-	"github.com/antongulenko/golib"
 )
 
 // ======================= Receiving heartbeats =======================
@@ -34,21 +33,67 @@ func RegisterServerHandler(server *protocols.Server, handler HeartbeatServerHand
 
 // ======================= Sending heartbeats =======================
 
+// Implemented by servers that piggyback metrics on the heartbeats they send.
+// HeartbeatMetrics is called for every heartbeat and should return quickly.
+type MetricsProvider interface {
+	HeartbeatMetrics() *Metrics
+}
+
+var (
+	senders     = make(map[*protocols.Server]*serverState)
+	sendersLock sync.Mutex
+)
+
+func RegisterMetricsProvider(server *protocols.Server, provider MetricsProvider) error {
+	sendersLock.Lock()
+	defer sendersLock.Unlock()
+	state, ok := senders[server]
+	if !ok {
+		return fmt.Errorf("Server %v does not include the %v protocol", server, Protocol.Name())
+	}
+	state.metricsLock.Lock()
+	defer state.metricsLock.Unlock()
+	state.metrics = provider
+	return nil
+}
+
 type serverState struct {
 	*protocols.Server
-	wg               *sync.WaitGroup
-	token            int64
-	heartbeatClient  protocols.Client
-	heartbeatRunning golib.StopChan
-	heartbeatTimeout time.Duration
-	heartbeatSeq     uint64
+
+	subscriptions map[subscriptionKey]*heartbeatSubscription
+	lock          sync.Mutex
+	stopped       bool // Set by the stop handler of the server
+
+	metrics     MetricsProvider
+	metricsLock sync.Mutex
+}
+
+// Every receiver can observe the server with multiple tokens.
+type subscriptionKey struct {
+	receiver string
+	token    int64
+}
+
+type heartbeatSubscription struct {
+	key    subscriptionKey
+	server *serverState
+	client protocols.Client
+	stop   chan struct{}
+
+	lock     sync.Mutex
+	interval time.Duration
+	seq      uint64
 }
 
 func (proto *heartbeatProtocol) ServerHandlers(server *protocols.Server) protocols.ServerHandlerMap {
 	state := &serverState{
-		Server:           server,
-		heartbeatRunning: golib.NewStopChan(),
+		Server:        server,
+		subscriptions: make(map[subscriptionKey]*heartbeatSubscription),
 	}
+	sendersLock.Lock()
+	senders[server] = state
+	sendersLock.Unlock()
+	server.RegisterStopHandler(state.stopServer)
 	return protocols.ServerHandlerMap{
 		codeConfigureHeartbeat: state.handleConfigureHeartbeat,
 	}
@@ -64,71 +109,120 @@ func (server *serverState) handleConfigureHeartbeat(request *protocols.Packet) *
 	}
 }
 
-func (server *serverState) configureHeartbeat(receiver string, token int64, timeout time.Duration) error {
-	if server.heartbeatClient == nil {
-		client, err := protocols.NewClientFor(receiver, server.Protocol())
+// A zero interval stops sending heartbeats to the receiver with the given token.
+// A zero token stops all heartbeats to the receiver.
+func (server *serverState) configureHeartbeat(receiver string, token int64, interval time.Duration) error {
+	addr, err := server.Protocol().Transport().Resolve(receiver)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve heartbeat-receiver %s: %v", receiver, err)
+	}
+	key := subscriptionKey{receiver: addr.String(), token: token}
+	if interval <= 0 || token == 0 {
+		server.stopSubscriptions(key)
+		return nil
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.stopped {
+		return fmt.Errorf("Server is stopped")
+	}
+	if sub, ok := server.subscriptions[key]; ok {
+		sub.lock.Lock()
+		sub.interval = interval
+		sub.seq = 0
+		sub.lock.Unlock()
+	} else {
+		client, err := protocols.NewClientFor(key.receiver, server.Protocol())
 		if err != nil {
 			return err
 		}
 		client.SetTimeout(500 * time.Millisecond) // TODO this is arbitrary
-		server.heartbeatClient = client
+		sub = &heartbeatSubscription{
+			key:      key,
+			server:   server,
+			client:   client,
+			stop:     make(chan struct{}),
+			interval: interval,
+		}
+		server.subscriptions[key] = sub
+		go sub.sendHeartbeats()
 	}
+	// Not really an error.
+	server.LogError(fmt.Errorf("Sending heartbeats to %s every %v", key.receiver, interval))
+	return nil
+}
 
-	// TODO potential race condition. This entire thing should only be called once.
-	// TODO once started the sendHeartbeats routine will keep spinning even if heartbeats are disabled again
-	server.heartbeatSeq = 0
-	err := server.heartbeatClient.SetServer(receiver)
-
-	if err == nil && timeout > 0 && token != 0 {
-		// Not really an error.
-		server.LogError(fmt.Errorf("Sending heartbeats to %s every %v", server.heartbeatClient.Server(), timeout))
-		server.heartbeatTimeout = timeout
-		server.token = token
-		server.heartbeatRunning.Enable(server.sendHeartbeats)
-	} else {
-		server.heartbeatTimeout = 0
-		server.token = 0
-		server.LogError(fmt.Errorf("Stopped sending heartbeats"))
-		if err != nil {
-			return fmt.Errorf("Failed to resolve heartbeat-receiver %s: %v", receiver, err)
+func (server *serverState) stopSubscriptions(key subscriptionKey) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for otherKey, sub := range server.subscriptions {
+		if otherKey == key || (key.token == 0 && otherKey.receiver == key.receiver) {
+			close(sub.stop)
+			delete(server.subscriptions, otherKey)
+			server.LogError(fmt.Errorf("Stopped sending heartbeats to %s", otherKey.receiver))
 		}
 	}
-	return nil
 }
 
-func (server *serverState) Start(wg *sync.WaitGroup) golib.StopChan {
-	res := server.Server.Start(wg)
-	server.wg = wg
-	return res
+func (server *serverState) stopServer() {
+	sendersLock.Lock()
+	delete(senders, server.Server)
+	sendersLock.Unlock()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.stopped = true
+	for key, sub := range server.subscriptions {
+		close(sub.stop)
+		delete(server.subscriptions, key)
+	}
 }
 
-func (server *serverState) sendHeartbeats() {
-	server.wg.Add(1)
-	go func() {
-		defer server.wg.Done()
-		for !server.Stopped {
-			timeout := server.heartbeatTimeout
-			token := server.token
-			if timeout != 0 && token != 0 {
-				packet := &HeartbeatPacket{
-					Token:    token,
-					TimeSent: time.Now(),
-					Seq:      server.heartbeatSeq,
-				}
-				server.heartbeatSeq++
-				err := server.heartbeatClient.Send(codeHeartbeat, packet)
-				if server.Stopped {
-					break
-				}
-				if err != nil {
-					server.LogError(fmt.Errorf("Error sending heartbeat to %v: %v", server.heartbeatClient.Server(), err))
-				}
-				server.heartbeatClient.ResetConnection()
-			} else {
-				// TODO can take up to 1 second until we start sending heartbeats
-				timeout = 1 * time.Second
-			}
-			time.Sleep(timeout)
+func (sub *heartbeatSubscription) sendHeartbeats() {
+	defer func() {
+		if err := sub.client.Close(); err != nil {
+			sub.server.LogError(fmt.Errorf("Error closing heartbeat client for %v: %v", sub.key.receiver, err))
 		}
 	}()
+	for {
+		sub.lock.Lock()
+		interval := sub.interval
+		packet := &HeartbeatPacket{
+			Token:    sub.key.token,
+			TimeSent: time.Now(),
+			Seq:      sub.seq,
+			Metrics:  sub.server.currentMetrics(),
+		}
+		sub.seq++
+		sub.lock.Unlock()
+		if err := sub.client.Send(codeHeartbeat, packet); err != nil && !sub.stopped() {
+			sub.server.LogError(fmt.Errorf("Error sending heartbeat to %v: %v", sub.key.receiver, err))
+		}
+		sub.client.ResetConnection()
+		select {
+		case <-time.After(interval):
+		case <-sub.stop:
+			return
+		}
+	}
+}
+
+// Errors of stopped subscriptions are not logged, they are expected while the server is stopping.
+func (sub *heartbeatSubscription) stopped() bool {
+	select {
+	case <-sub.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (server *serverState) currentMetrics() *Metrics {
+	server.metricsLock.Lock()
+	provider := server.metrics
+	server.metricsLock.Unlock()
+	if provider == nil {
+		return nil
+	}
+	return provider.HeartbeatMetrics()
 }
@@ -0,0 +1,95 @@
+package heartbeat
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func TestConfigureSubscriptions(t *testing.T) {
+	type op struct {
+		receiver string
+		token    int64
+		interval time.Duration
+		expected []string // Subscriptions after the operation
+	}
+	a, b := "127.0.0.1:17001", "127.0.0.1:17002"
+	for _, test := range []struct {
+		name string
+		ops  []op
+	}{
+		{"independent tokens", []op{
+			{a, 1, time.Hour, []string{a + "/1"}},
+			{a, 2, time.Hour, []string{a + "/1", a + "/2"}},
+			{b, 1, time.Hour, []string{a + "/1", a + "/2", b + "/1"}},
+		}},
+		{"reconfigure", []op{
+			{a, 1, time.Hour, []string{a + "/1"}},
+			{a, 1, 2 * time.Hour, []string{a + "/1"}},
+		}},
+		{"stop token", []op{
+			{a, 1, time.Hour, []string{a + "/1"}},
+			{a, 2, time.Hour, []string{a + "/1", a + "/2"}},
+			{a, 1, 0, []string{a + "/2"}},
+			{a, 3, 0, []string{a + "/2"}},
+		}},
+		{"stop receiver", []op{
+			{a, 1, time.Hour, []string{a + "/1"}},
+			{a, 2, time.Hour, []string{a + "/1", a + "/2"}},
+			{b, 1, time.Hour, []string{a + "/1", a + "/2", b + "/1"}},
+			{a, 0, time.Hour, []string{b + "/1"}},
+		}},
+	} {
+		server, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendersLock.Lock()
+		state := senders[server]
+		sendersLock.Unlock()
+		for i, op := range test.ops {
+			if err := state.configureHeartbeat(op.receiver, op.token, op.interval); err != nil {
+				t.Fatalf("%v: op %v: %v", test.name, i, err)
+			}
+			if subs := state.subscriptionNames(); fmt.Sprint(subs) != fmt.Sprint(op.expected) {
+				t.Errorf("%v: subscriptions after op %v: %v, expected %v", test.name, i, subs, op.expected)
+			}
+			if op.interval > 0 && op.token != 0 {
+				sub := state.subscriptions[subscriptionKey{op.receiver, op.token}]
+				sub.lock.Lock()
+				interval := sub.interval
+				sub.lock.Unlock()
+				if interval != op.interval {
+					t.Errorf("%v: op %v: interval %v, expected %v", test.name, i, interval, op.interval)
+				}
+			}
+		}
+		server.Stop()
+		if subs := state.subscriptionNames(); len(subs) > 0 {
+			t.Errorf("%v: subscriptions left after stopping the server: %v", test.name, subs)
+		}
+		if err := state.configureHeartbeat(a, 1, time.Hour); err == nil {
+			t.Errorf("%v: no error when configuring a stopped server", test.name)
+		}
+		sendersLock.Lock()
+		_, registered := senders[server]
+		sendersLock.Unlock()
+		if registered {
+			t.Errorf("%v: stopped server still registered as heartbeat sender", test.name)
+		}
+	}
+}
+
+func (server *serverState) subscriptionNames() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	names := make([]string, 0, len(server.subscriptions))
+	for key := range server.subscriptions {
+		names = append(names, fmt.Sprintf("%v/%v", key.receiver, key.token))
+	}
+	sort.Strings(names)
+	return names
+}
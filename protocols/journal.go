@@ -0,0 +1,253 @@
+package protocols
+
+// Optional append-only journal of the sessions in a SessionManager.
+// After a restart, the sessions that were not deleted before can be restored
+// or cleaned up, so that resources referenced by them are not orphaned.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type JournalOp int
+
+const (
+	JournalCreate = JournalOp(iota)
+	JournalUpdate
+	JournalReKey
+	JournalDelete
+)
+
+func (op JournalOp) String() string {
+	switch op {
+	case JournalCreate:
+		return "create"
+	case JournalUpdate:
+		return "update"
+	case JournalReKey:
+		return "rekey"
+	case JournalDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("JournalOp(%d)", int(op))
+	}
+}
+
+type JournalEntry struct {
+	Time   time.Time
+	Op     JournalOp
+	Key    interface{}
+	NewKey interface{}   // Only for JournalReKey
+	Value  interface{}   // From JournaledSession.JournalValue(), for JournalCreate and JournalUpdate
+	Lease  time.Duration // For JournalCreate and JournalUpdate
+}
+
+// Sessions implementing this are recorded in the journal of their SessionManager.
+type JournaledSession interface {
+	Session
+
+	// Everything needed to restore the session or clean up its resources.
+	// The type of the result must be registered with RegisterJournalValue.
+	JournalValue() interface{}
+}
+
+// Values stored in JournalEntry are gob-encoded as interface{}, so their types must be known.
+func RegisterJournalValue(value interface{}) {
+	gob.Register(value)
+}
+
+// Entries are encoded when they are recorded, and written and synced to the file by a separate
+// goroutine, so that recording does not wait for the disk. Entries recorded while the previous
+// ones are synced are written together.
+type SessionJournal struct {
+	lock     sync.Mutex // Guards buf, encoder, closed and err
+	buf      bytes.Buffer
+	encoder  *gob.Encoder // Encodes into buf
+	closed   bool
+	err      error // First error that occurred while writing. Writing stops afterwards.
+	file     *os.File
+	orphaned []*JournalEntry
+	pending  chan struct{} // Signals the writer that buf contains entries
+	done     chan struct{} // Closed when the writer has finished after Close()
+}
+
+// Read the journal file, if it exists, and open it for writing. The sessions that
+// were not deleted are available through Orphaned(). Only those are kept in the file,
+// so it does not grow without bounds across restarts.
+func OpenSessionJournal(filename string) (*SessionJournal, error) {
+	orphaned, err := readJournal(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpname := filename + ".tmp"
+	file, err := os.Create(tmpname)
+	if err != nil {
+		return nil, err
+	}
+	journal := &SessionJournal{
+		file:     file,
+		orphaned: orphaned,
+		pending:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	journal.encoder = gob.NewEncoder(&journal.buf)
+	for _, entry := range orphaned {
+		if err := journal.encoder.Encode(entry); err != nil {
+			_ = file.Close() // Drop error
+			return nil, fmt.Errorf("Error writing session journal: %v", err)
+		}
+	}
+	if err := journal.flush(); err != nil {
+		_ = file.Close() // Drop error
+		return nil, err
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		_ = file.Close() // Drop error
+		return nil, err
+	}
+	go journal.write()
+	return journal, nil
+}
+
+// Replay the journal and return one JournalCreate entry for every session that was not deleted.
+func readJournal(filename string) ([]*JournalEntry, error) {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := gob.NewDecoder(file)
+	sessions := make(map[interface{}]*JournalEntry)
+	var order []interface{}
+	for {
+		var entry JournalEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// A truncated last entry is expected if the server was killed.
+				break
+			}
+			return nil, fmt.Errorf("Error reading session journal %v: %v", filename, err)
+		}
+		switch entry.Op {
+		case JournalCreate:
+			entry.NewKey = nil
+			sessions[entry.Key] = &entry
+			order = append(order, entry.Key)
+		case JournalUpdate:
+			if session, ok := sessions[entry.Key]; ok {
+				session.Value = entry.Value
+				session.Lease = entry.Lease
+			}
+		case JournalReKey:
+			if session, ok := sessions[entry.Key]; ok {
+				delete(sessions, entry.Key)
+				session.Key = entry.NewKey
+				sessions[entry.NewKey] = session
+				order = append(order, entry.NewKey)
+			}
+		case JournalDelete:
+			delete(sessions, entry.Key)
+		}
+	}
+	var result []*JournalEntry
+	for _, key := range order {
+		if session, ok := sessions[key]; ok {
+			result = append(result, session)
+			delete(sessions, key) // Keys can occur multiple times in order
+		}
+	}
+	return result, nil
+}
+
+// The sessions that were still running when the journal was last used.
+func (journal *SessionJournal) Orphaned() []*JournalEntry {
+	return journal.orphaned
+}
+
+// Does not block on the disk. Write errors are available through Error().
+func (journal *SessionJournal) Record(entry *JournalEntry) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	if journal.closed || journal.err != nil {
+		return
+	}
+	entry.Time = time.Now()
+	if err := journal.encoder.Encode(entry); err != nil {
+		journal.err = fmt.Errorf("Error writing session journal: %v", err)
+		return
+	}
+	select {
+	case journal.pending <- struct{}{}:
+	default:
+	}
+}
+
+// The first error that occurred while writing. Writing stops afterwards.
+func (journal *SessionJournal) Error() error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	return journal.err
+}
+
+func (journal *SessionJournal) write() {
+	defer close(journal.done)
+	for range journal.pending {
+		journal.flushOrFail()
+	}
+	// Entries recorded right before Close()
+	journal.flushOrFail()
+}
+
+func (journal *SessionJournal) flushOrFail() {
+	if err := journal.flush(); err != nil {
+		journal.lock.Lock()
+		if journal.err == nil {
+			journal.err = err
+		}
+		journal.lock.Unlock()
+	}
+}
+
+// Write and sync the encoded entries.
+func (journal *SessionJournal) flush() error {
+	journal.lock.Lock()
+	data := make([]byte, journal.buf.Len())
+	copy(data, journal.buf.Bytes())
+	journal.buf.Reset()
+	journal.lock.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := journal.file.Write(data); err != nil {
+		return fmt.Errorf("Error writing session journal: %v", err)
+	}
+	if err := journal.file.Sync(); err != nil {
+		return fmt.Errorf("Error syncing session journal: %v", err)
+	}
+	return nil
+}
+
+// Writes the remaining entries before closing the file.
+func (journal *SessionJournal) Close() error {
+	journal.lock.Lock()
+	if journal.closed {
+		journal.lock.Unlock()
+		return nil
+	}
+	journal.closed = true
+	close(journal.pending)
+	journal.lock.Unlock()
+	<-journal.done
+	err := journal.Error()
+	if closeErr := journal.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
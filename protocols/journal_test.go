@@ -0,0 +1,196 @@
+package protocols
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testJournalValue struct {
+	Name string
+}
+
+func init() {
+	RegisterJournalValue(new(testJournalValue))
+}
+
+type journaledTestSession struct {
+	testSession
+	value string
+}
+
+func (session *journaledTestSession) JournalValue() interface{} {
+	return &testJournalValue{session.value}
+}
+
+// Deletes itself while starting.
+type deletingTestSession struct {
+	journaledTestSession
+	sessions *SessionManager
+	key      interface{}
+}
+
+func (session *deletingTestSession) Start(base *SessionBase) {
+	session.journaledTestSession.Start(base)
+	_ = session.sessions.DeleteSession(session.key)
+}
+
+type journalResult struct {
+	Key   interface{}
+	Value string
+	Lease time.Duration
+}
+
+func TestSessionJournal(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		actions  func(sessions *SessionManager) error
+		orphaned []journalResult
+	}{
+		{
+			name:    "empty",
+			actions: func(sessions *SessionManager) error { return nil },
+		},
+		{
+			name: "created",
+			actions: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("a", &journaledTestSession{value: "A"}); err != nil {
+					return err
+				}
+				return sessions.StartSession("b", &journaledTestSession{value: "B"})
+			},
+			orphaned: []journalResult{{"a", "A", 0}, {"b", "B", 0}},
+		},
+		{
+			name: "not journaled",
+			actions: func(sessions *SessionManager) error {
+				return sessions.StartSession("a", new(testSession))
+			},
+		},
+		{
+			name: "deleted",
+			actions: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("a", &journaledTestSession{value: "A"}); err != nil {
+					return err
+				}
+				if err := sessions.StartSession("b", &journaledTestSession{value: "B"}); err != nil {
+					return err
+				}
+				return sessions.DeleteSession("a")
+			},
+			orphaned: []journalResult{{"b", "B", 0}},
+		},
+		{
+			name: "deleted while creating",
+			actions: func(sessions *SessionManager) error {
+				return sessions.NewSession("a", func() (Session, error) {
+					if err := sessions.DeleteSession("a"); err != nil {
+						return nil, err
+					}
+					return &journaledTestSession{value: "A"}, nil
+				})
+			},
+		},
+		{
+			name: "deleted while starting",
+			actions: func(sessions *SessionManager) error {
+				return sessions.StartSession("a", &deletingTestSession{journaledTestSession{value: "A"}, sessions, "a"})
+			},
+		},
+		{
+			name: "stopped",
+			actions: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("a", &journaledTestSession{value: "A"}); err != nil {
+					return err
+				}
+				if err := sessions.StopSession("a", StopFailoverFailed); err != nil {
+					return err
+				}
+				return sessions.UpdateJournal("a")
+			},
+		},
+		{
+			name: "stopped and deleted",
+			actions: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("a", &journaledTestSession{value: "A"}); err != nil {
+					return err
+				}
+				if err := sessions.StopSession("a", StopFailoverFailed); err != nil {
+					return err
+				}
+				_ = sessions.DeleteSession("a") // Reports that the session stopped prematurely
+				return sessions.StartSession("a", &journaledTestSession{value: "A2"})
+			},
+			orphaned: []journalResult{{"a", "A2", 0}},
+		},
+		{
+			name: "updated",
+			actions: func(sessions *SessionManager) error {
+				session := &journaledTestSession{value: "A"}
+				if err := sessions.StartSession("a", session); err != nil {
+					return err
+				}
+				if err := sessions.SetLease("a", time.Hour); err != nil {
+					return err
+				}
+				session.value = "A2"
+				return sessions.UpdateJournal("a")
+			},
+			orphaned: []journalResult{{"a", "A2", time.Hour}},
+		},
+		{
+			name: "rekeyed",
+			actions: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("a", &journaledTestSession{value: "A"}); err != nil {
+					return err
+				}
+				_, err := sessions.ReKeySession("a", "c")
+				return err
+			},
+			orphaned: []journalResult{{"c", "A", 0}},
+		},
+	} {
+		filename := filepath.Join(t.TempDir(), "journal")
+		journal, err := OpenSessionJournal(filename)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if orphaned := journal.Orphaned(); len(orphaned) != 0 {
+			t.Errorf("%v: new journal contains orphaned sessions: %v", test.name, orphaned)
+		}
+		sessions := NewSessionManager()
+		sessions.Journal = journal
+		if err := test.actions(sessions); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if err := journal.Close(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		// Read it twice: the first time the journal is compacted
+		for i := 0; i < 2; i++ {
+			journal, err = OpenSessionJournal(filename)
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			var orphaned []journalResult
+			for _, entry := range journal.Orphaned() {
+				result := journalResult{Key: entry.Key, Lease: entry.Lease}
+				if value, ok := entry.Value.(*testJournalValue); ok {
+					result.Value = value.Name
+				} else {
+					t.Errorf("%v: illegal journal value (%T) %v", test.name, entry.Value, entry.Value)
+				}
+				orphaned = append(orphaned, result)
+			}
+			if !reflect.DeepEqual(orphaned, test.orphaned) {
+				t.Errorf("%v: orphaned sessions %v, expected %v", test.name, orphaned, test.orphaned)
+			}
+			if err := journal.Close(); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+		}
+		_ = sessions.DeleteSessions()
+	}
+}
@@ -0,0 +1,74 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Leases are renewed this many times per lease duration
+	leaseRenewalsPerLease = 3
+)
+
+// Used by clients to periodically renew the leases of their sessions on a server.
+type LeaseRenewer struct {
+	lock     sync.Mutex
+	renewing map[interface{}]chan struct{}
+}
+
+// Call renew periodically until Stop is called for the key. If renew returns
+// an error, the session is assumed to be gone and renewing stops.
+func (renewer *LeaseRenewer) Start(key interface{}, lease time.Duration, renew func() error) {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+	if renewer.renewing == nil {
+		renewer.renewing = make(map[interface{}]chan struct{})
+	}
+	if stop, ok := renewer.renewing[key]; ok {
+		close(stop)
+	}
+	stop := make(chan struct{})
+	renewer.renewing[key] = stop
+	go renewer.renew(key, lease/leaseRenewalsPerLease, renew, stop)
+}
+
+func (renewer *LeaseRenewer) renew(key interface{}, interval time.Duration, renew func() error, stop chan struct{}) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+		if err := renew(); err != nil {
+			renewer.stop(key, stop)
+			return
+		}
+	}
+}
+
+func (renewer *LeaseRenewer) Stop(key interface{}) {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+	if stop, ok := renewer.renewing[key]; ok {
+		close(stop)
+		delete(renewer.renewing, key)
+	}
+}
+
+func (renewer *LeaseRenewer) stop(key interface{}, stop chan struct{}) {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+	if renewer.renewing[key] == stop {
+		close(stop)
+		delete(renewer.renewing, key)
+	}
+}
+
+func (renewer *LeaseRenewer) StopAll() {
+	renewer.lock.Lock()
+	defer renewer.lock.Unlock()
+	for key, stop := range renewer.renewing {
+		close(stop)
+		delete(renewer.renewing, key)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
 	"github.com/antongulenko/golib"
 )
 
@@ -19,12 +20,15 @@ type Client struct {
 
 	pausedCond *sync.Cond
 	paused     bool
+
+	Stats *stats.Stats // Successfully sent Load packets
 }
 
 func NewClient() *Client {
 	client := &Client{
 		Client:     protocols.NewClient(MiniProtocol),
 		pausedCond: sync.NewCond(new(sync.Mutex)),
+		Stats:      stats.NewStats("Load"),
 	}
 	client.Pause()
 	client.sendLoad()
@@ -40,12 +44,16 @@ func (client *Client) SetPayload(size uint) {
 }
 
 func (client *Client) SendLoad() error {
-	err := client.Send(codeLoad, &LoadPacket{
+	packet := &LoadPacket{
 		Seq:       client.seq,
 		Payload:   client.extraPayload,
 		Timestamp: time.Now(),
-	})
+	}
+	err := client.Send(codeLoad, packet)
 	client.seq++
+	if err == nil {
+		client.Stats.AddNow(packet.Size())
+	}
 	return err
 }
 
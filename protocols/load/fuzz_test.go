@@ -0,0 +1,14 @@
+package load
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzLoad(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeLoad, Val: &LoadPacket{Seq: 1, Payload: []byte("payload"), Timestamp: time.Now()}},
+	})
+}
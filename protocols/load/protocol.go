@@ -16,8 +16,9 @@ var (
 )
 
 const (
-	codeLoad   = protocols.Code(100)
-	PacketSize = 105 // Reported by tcpdump, size of LoadPacket with empty Payload. Varies between 105-107.
+	codeLoad     = protocols.Code(100)
+	PacketSize   = 105  // Reported by tcpdump, size of LoadPacket with empty Payload. Varies between 105-107.
+	maxValueSize = 2048 // Same as the buffer of the UDP transport used by MiniProtocol
 )
 
 type LoadPacket struct {
@@ -47,6 +48,10 @@ func (*loadProtocol) Name() string {
 	return "Load"
 }
 
+func (*loadProtocol) MaxValueSize() int {
+	return maxValueSize
+}
+
 func (proto *loadProtocol) Decoders() protocols.DecoderMap {
 	return protocols.DecoderMap{
 		codeLoad: proto.decodeLoad,
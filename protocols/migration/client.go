@@ -0,0 +1,40 @@
+package migration
+
+import (
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+type Client struct {
+	protocols.Client
+}
+
+func NewClient(client protocols.Client) (*Client, error) {
+	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+func NewClientFor(server_addr string) (*Client, error) {
+	client, err := protocols.NewMiniClientFor(server_addr, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+// Can be used as protocols.SessionMigrator, e.g. for PluginServer.MigrateOnStop.
+func (client *Client) MigrateSession(clientAddr string, lease time.Duration, value *protocols.PluginJournalValue) error {
+	val := &MigrateSession{
+		Client: clientAddr,
+		Lease:  lease,
+		Value:  value,
+	}
+	reply, err := client.SendRequest(codeMigrateSession, val)
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
@@ -0,0 +1,14 @@
+package migration
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzMigration(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeMigrateSession, Val: &MigrateSession{Client: "127.0.0.1:9000", Lease: time.Second, Value: &protocols.PluginJournalValue{}}},
+	})
+}
@@ -0,0 +1,61 @@
+package migration
+
+// Protocol for handing over running sessions from one PluginServer to another
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+var (
+	Protocol     *migrationProtocol
+	MiniProtocol = protocols.NewMiniProtocol(Protocol)
+)
+
+const (
+	// Sessions with many plugins can get large. The tcp transport must be able to receive packets of this size.
+	maxValueSize = 16384
+)
+
+// ======================= Packets =======================
+
+const (
+	codeMigrateSession = protocols.Code(32)
+)
+
+type MigrateSession struct {
+	Client string
+	Lease  time.Duration // Remaining lease of the session, 0 if it does not expire
+	Value  *protocols.PluginJournalValue
+}
+
+// ======================= Protocol =======================
+
+type migrationProtocol struct {
+}
+
+func (*migrationProtocol) Name() string {
+	return "Migration"
+}
+
+func (*migrationProtocol) MaxValueSize() int {
+	return maxValueSize
+}
+
+func (proto *migrationProtocol) Decoders() protocols.DecoderMap {
+	return protocols.DecoderMap{
+		codeMigrateSession: proto.decodeMigrateSession,
+	}
+}
+
+func (proto *migrationProtocol) decodeMigrateSession(decoder *gob.Decoder) (interface{}, error) {
+	var val MigrateSession
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Migration MigrateSession value: %v", err)
+	}
+	return &val, nil
+}
@@ -0,0 +1,39 @@
+package migration
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+type Handler interface {
+	// Implemented by protocols.PluginServer
+	AdoptSession(client string, lease time.Duration, value *protocols.PluginJournalValue) error
+}
+
+func RegisterServer(server *protocols.Server, handler Handler) error {
+	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return err
+	}
+	state := &serverState{
+		Server:  server,
+		handler: handler,
+	}
+	return server.RegisterHandlers(protocols.ServerHandlerMap{
+		codeMigrateSession: state.handleMigrateSession,
+	})
+}
+
+type serverState struct {
+	*protocols.Server
+	handler Handler
+}
+
+func (server *serverState) handleMigrateSession(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*MigrateSession); ok && desc.Value != nil {
+		return server.ReplyCheck(server.handler.AdoptSession(desc.Client, desc.Lease, desc.Value))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for Migration MigrateSession: %v", packet.Val))
+	}
+}
@@ -46,7 +46,7 @@ func (m *gobMarshallingProvider) MarshalPacket(packet *Packet) ([]byte, error) {
 }
 
 func (m *gobMarshallingProvider) UnmarshalPacket(buf []byte, protocol Protocol) (*Packet, error) {
-	return m.decode(bytes.NewReader(buf), protocol)
+	return m.decode(buf, protocol)
 }
 
 func (m *gobMarshallingProvider) safeEncode(enc *gob.Encoder, val interface{}) (err error) {
@@ -72,18 +72,43 @@ func (m *gobMarshallingProvider) encode(packet *Packet, writer io.Writer) error
 	return nil
 }
 
-func (m *gobMarshallingProvider) decode(reader io.Reader, protocol Protocol) (*Packet, error) {
+func (m *gobMarshallingProvider) safeDecode(decode func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic decoding: %v", r)
+		}
+	}()
+	err = decode()
+	return
+}
+
+func (m *gobMarshallingProvider) decode(buf []byte, protocol Protocol) (*Packet, error) {
+	reader := bytes.NewReader(buf)
 	dec := gob.NewDecoder(reader)
 	var packet Packet
-	err := dec.Decode(&packet.Code)
+	err := m.safeDecode(func() error {
+		return dec.Decode(&packet.Code)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Error decoding %v status code: %v", protocol.Name(), err)
 	}
+	// The allocations made by gob are bounded by the size of the input,
+	// so limiting the remaining bytes limits the memory used for the value.
+	if size, max := reader.Len(), protocol.maxValueSize(packet.Code); size > max {
+		return nil, fmt.Errorf("%v value for code %v too large: %v bytes (maximum %v)", protocol.Name(), packet.Code, size, max)
+	}
 	// TODO move the gob-specific decoding here completely!
-	val, err := protocol.decodeValue(packet.Code, dec)
+	var val interface{}
+	err = m.safeDecode(func() (err error) {
+		val, err = protocol.decodeValue(packet.Code, dec)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
+	if trailing := reader.Len(); trailing > 0 {
+		return nil, fmt.Errorf("%v trailing bytes after %v value for code %v", trailing, protocol.Name(), packet.Code)
+	}
 	packet.Val = val
 	return &packet, nil
 }
@@ -0,0 +1,38 @@
+package protocols
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaxValueSize(t *testing.T) {
+	protocol, err := NewProtocol("Default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		size int
+		err  bool
+	}{
+		{"small", 10, false},
+		{"multiple errors", 4000, false},
+		{"too large", DefaultMaxValueSize, true},
+	} {
+		packet := &Packet{Code: CodeError, Val: strings.Repeat("x", test.size)}
+		data, err := Marshaller.MarshalPacket(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Marshaller.UnmarshalPacket(data, protocol)
+		if test.err {
+			if err == nil {
+				t.Errorf("%v: decoding value of %v bytes should fail", test.name, test.size)
+			}
+		} else if err != nil {
+			t.Errorf("%v: error decoding value of %v bytes: %v", test.name, test.size, err)
+		} else if decoded.Val != packet.Val {
+			t.Errorf("%v: decoded value of %v bytes differs", test.name, test.size)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package pcp
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 )
@@ -10,13 +11,17 @@ import (
 
 type Client struct {
 	protocols.Client
+
+	// If >0, proxies are started with this lease and renewed automatically until stopped.
+	Lease   time.Duration
+	renewer protocols.LeaseRenewer
 }
 
 func NewClient(client protocols.Client) (*Client, error) {
 	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
 		return nil, err
 	}
-	return &Client{client}, nil
+	return &Client{Client: client}, nil
 }
 
 func NewClientFor(server_addr string) (*Client, error) {
@@ -24,21 +29,37 @@ func NewClientFor(server_addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{client}, nil
+	return &Client{Client: client}, nil
+}
+
+func (client *Client) Close() error {
+	client.renewer.StopAll()
+	return client.Client.Close()
 }
 
 func (client *Client) StartProxy(listenAddr string, targetAddr string) error {
 	val := &StartProxy{
-		ProxyDescription{
+		ProxyDescription: ProxyDescription{
 			ListenAddr: listenAddr,
 			TargetAddr: targetAddr,
 		},
+		Lease: client.Lease,
+	}
+	port, err := val.ListenPort()
+	if err != nil {
+		return err
 	}
 	reply, err := client.SendRequest(codeStartProxy, val)
 	if err != nil {
 		return err
 	}
-	return client.CheckReply(reply)
+	if err = client.CheckReply(reply); err != nil {
+		return err
+	}
+	if val.Lease > 0 {
+		client.startRenewing(port, val.Lease)
+	}
+	return nil
 }
 
 func (client *Client) StopProxy(listenAddr string, targetAddr string) error {
@@ -48,6 +69,9 @@ func (client *Client) StopProxy(listenAddr string, targetAddr string) error {
 			TargetAddr: targetAddr,
 		},
 	}
+	if port, err := val.ListenPort(); err == nil {
+		client.renewer.Stop(port)
+	}
 	reply, err := client.SendRequest(codeStopProxy, val)
 	if err != nil {
 		return err
@@ -61,6 +85,7 @@ func (client *Client) StartProxyPair(proxyHost, receiverHost string, receiverPor
 		ReceiverHost:  receiverHost,
 		ReceiverPort1: receiverPort1,
 		ReceiverPort2: receiverPort2,
+		Lease:         client.Lease,
 	}
 	reply, err := client.SendRequest(codeStartProxyPair, val)
 	if err != nil {
@@ -73,16 +98,93 @@ func (client *Client) StartProxyPair(proxyHost, receiverHost string, receiverPor
 	if !ok {
 		return nil, fmt.Errorf("Illegal StartProxyPairResponse payload: (%T) %s", reply.Val, reply.Val)
 	}
+	if val.Lease > 0 {
+		client.startRenewing(response.ProxyPort1, val.Lease)
+	}
 	return response, nil
 }
 
+// The proxy pair is not started until CommitProxyPair is called.
+func (client *Client) PrepareProxyPair(proxyHost, receiverHost string, receiverPort1, receiverPort2 int) (*StartProxyPairResponse, error) {
+	val := &PrepareProxyPair{
+		StartProxyPair{
+			ProxyHost:     proxyHost,
+			ReceiverHost:  receiverHost,
+			ReceiverPort1: receiverPort1,
+			ReceiverPort2: receiverPort2,
+			Lease:         client.Lease,
+		},
+	}
+	reply, err := client.SendRequest(codePrepareProxyPair, val)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeStartProxyPairResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*StartProxyPairResponse)
+	if !ok {
+		return nil, fmt.Errorf("Illegal StartProxyPairResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
+}
+
+func (client *Client) CommitProxyPair(proxyPort1 int) error {
+	val := &CommitProxyPair{
+		ProxyPort1: proxyPort1,
+	}
+	reply, err := client.SendRequest(codeCommitProxyPair, val)
+	if err != nil {
+		return err
+	}
+	if err = client.CheckReply(reply); err != nil {
+		return err
+	}
+	if client.Lease > 0 {
+		client.startRenewing(proxyPort1, client.Lease)
+	}
+	return nil
+}
+
 func (client *Client) StopProxyPair(proxyPort1 int) error {
 	val := &StopProxyPair{
 		ProxyPort1: proxyPort1,
 	}
+	client.renewer.Stop(proxyPort1)
 	reply, err := client.SendRequest(codeStopProxyPair, val)
 	if err != nil {
 		return err
 	}
 	return client.CheckReply(reply)
 }
+
+func (client *Client) KeepAlive(proxyPort int) error {
+	reply, err := client.SendRequest(codeKeepAlive, &KeepAlive{proxyPort})
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
+
+// Take over renewing the lease of a proxy pair started by another client, e.g. in another process.
+func (client *Client) AdoptProxyPair(proxyPort1 int) {
+	if client.Lease > 0 {
+		client.startRenewing(proxyPort1, client.Lease)
+	}
+}
+
+// Stop renewing the lease of a proxy pair without stopping it, e.g. after another client adopted it.
+func (client *Client) ReleaseProxyPair(proxyPort1 int) {
+	client.renewer.Stop(proxyPort1)
+}
+
+func (client *Client) startRenewing(proxyPort int, lease time.Duration) {
+	client.renewer.Start(proxyPort, lease, func() error {
+		reply, err := client.SendRequest(codeKeepAlive, &KeepAlive{proxyPort})
+		if err != nil {
+			// Server might be temporarily unreachable, keep trying
+			return nil
+		}
+		return client.CheckReply(reply)
+	})
+}
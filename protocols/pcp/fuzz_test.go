@@ -0,0 +1,21 @@
+package pcp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzPcp(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeStartProxy, Val: &StartProxy{ProxyDescription{"127.0.0.1:8000", "127.0.0.1:9000"}, time.Second}},
+		{Code: codeStopProxy, Val: &StopProxy{ProxyDescription{"127.0.0.1:8000", "127.0.0.1:9000"}}},
+		{Code: codeStartProxyPair, Val: &StartProxyPair{"127.0.0.1", "127.0.0.1", 9000, 9001, time.Second}},
+		{Code: codeStopProxyPair, Val: &StopProxyPair{8000}},
+		{Code: codeStartProxyPairResponse, Val: &StartProxyPairResponse{"127.0.0.1", 8000, 8001}},
+		{Code: codeKeepAlive, Val: &KeepAlive{8000}},
+		{Code: codePrepareProxyPair, Val: &PrepareProxyPair{StartProxyPair{"127.0.0.1", "127.0.0.1", 9000, 9001, 0}}},
+		{Code: codeCommitProxyPair, Val: &CommitProxyPair{8000}},
+	})
+}
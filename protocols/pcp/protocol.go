@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 )
@@ -25,6 +26,15 @@ const (
 	codeStartProxyPairResponse
 )
 
+const (
+	codeKeepAlive = protocols.Code(25)
+)
+
+const (
+	codePrepareProxyPair = protocols.Code(30 + iota)
+	codeCommitProxyPair
+)
+
 // ======================= Packets =======================
 
 type ProxyDescription struct {
@@ -34,6 +44,7 @@ type ProxyDescription struct {
 
 type StartProxy struct {
 	ProxyDescription
+	Lease time.Duration // If >0, the proxy is stopped unless renewed with KeepAlive
 }
 
 type StopProxy struct {
@@ -45,12 +56,29 @@ type StartProxyPair struct {
 	ReceiverHost  string
 	ReceiverPort1 int
 	ReceiverPort2 int
+	Lease         time.Duration // If >0, the proxies are stopped unless renewed with KeepAlive
 }
 
 type StopProxyPair struct {
 	ProxyPort1 int
 }
 
+// Allocates the ports for a proxy pair without starting it. The proxy pair is
+// released unless committed with CommitProxyPair or stopped with StopProxyPair.
+// The Lease starts when the proxy pair is committed.
+type PrepareProxyPair struct {
+	StartProxyPair
+}
+
+type CommitProxyPair struct {
+	ProxyPort1 int
+}
+
+// Renews the lease of a proxy or proxy pair
+type KeepAlive struct {
+	ProxyPort int // Listen port of the proxy, or first port of the proxy pair
+}
+
 type StartProxyPairResponse struct {
 	ProxyHost  string
 	ProxyPort1 int
@@ -81,6 +109,9 @@ func (proto *pcpProtocol) Decoders() protocols.DecoderMap {
 		codeStartProxyPair:         proto.decodeStartProxyPair,
 		codeStopProxyPair:          proto.decodeStopProxyPair,
 		codeStartProxyPairResponse: proto.decodeStartProxyPairResponse,
+		codeKeepAlive:              proto.decodeKeepAlive,
+		codePrepareProxyPair:       proto.decodePrepareProxyPair,
+		codeCommitProxyPair:        proto.decodeCommitProxyPair,
 	}
 }
 
@@ -124,3 +155,27 @@ func (proto *pcpProtocol) decodeStartProxyPairResponse(decoder *gob.Decoder) (in
 	}
 	return &val, nil
 }
+func (proto *pcpProtocol) decodeKeepAlive(decoder *gob.Decoder) (interface{}, error) {
+	var val KeepAlive
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding PCP KeepAlive value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *pcpProtocol) decodePrepareProxyPair(decoder *gob.Decoder) (interface{}, error) {
+	var val PrepareProxyPair
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding PCP PrepareProxyPair value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *pcpProtocol) decodeCommitProxyPair(decoder *gob.Decoder) (interface{}, error) {
+	var val CommitProxyPair
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding PCP CommitProxyPair value: %v", err)
+	}
+	return &val, nil
+}
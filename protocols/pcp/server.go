@@ -11,6 +11,9 @@ type Handler interface {
 	StopProxy(val *StopProxy) error
 	StartProxyPair(val *StartProxyPair) (*StartProxyPairResponse, error)
 	StopProxyPair(val *StopProxyPair) error
+	KeepAlive(val *KeepAlive) error
+	PrepareProxyPair(val *PrepareProxyPair) (*StartProxyPairResponse, error)
+	CommitProxyPair(val *CommitProxyPair) error
 	StopServer()
 }
 
@@ -23,10 +26,13 @@ func RegisterServer(server *protocols.Server, handler Handler) error {
 		handler: handler,
 	}
 	if err := server.RegisterHandlers(protocols.ServerHandlerMap{
-		codeStartProxy:     state.handleStartProxy,
-		codeStopProxy:      state.handleStopProxy,
-		codeStartProxyPair: state.handleStartProxyPair,
-		codeStopProxyPair:  state.handleStopProxyPair,
+		codeStartProxy:       state.handleStartProxy,
+		codeStopProxy:        state.handleStopProxy,
+		codeStartProxyPair:   state.handleStartProxyPair,
+		codeStopProxyPair:    state.handleStopProxyPair,
+		codeKeepAlive:        state.handleKeepAlive,
+		codePrepareProxyPair: state.handlePrepareProxyPair,
+		codeCommitProxyPair:  state.handleCommitProxyPair,
 	}); err != nil {
 		return err
 	}
@@ -79,3 +85,32 @@ func (server *serverState) handleStopProxyPair(packet *protocols.Packet) *protoc
 		return server.ReplyError(fmt.Errorf("Illegal value for Pcp StopProxyPair: %v", packet.Val))
 	}
 }
+
+func (server *serverState) handleKeepAlive(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*KeepAlive); ok {
+		return server.ReplyCheck(server.handler.KeepAlive(desc))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for Pcp KeepAlive: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handlePrepareProxyPair(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*PrepareProxyPair); ok {
+		reply, err := server.handler.PrepareProxyPair(desc)
+		if err == nil {
+			return server.Reply(codeStartProxyPairResponse, reply)
+		} else {
+			return server.ReplyError(err)
+		}
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for Pcp PrepareProxyPair: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handleCommitProxyPair(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*CommitProxyPair); ok {
+		return server.ReplyCheck(server.handler.CommitProxyPair(desc))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for Pcp CommitProxyPair: %v", packet.Val))
+	}
+}
@@ -0,0 +1,125 @@
+package protocols
+
+// Phi-accrual failure detection: instead of a fixed timeout, the distribution of the intervals
+// between heartbeats is learned. The suspicion level phi expresses how unlikely it is,
+// that the next heartbeat is just late: phi = -log10(probability of a heartbeat arriving later).
+// phi=1 means a 10% chance of a false positive, phi=2 1%, phi=3 0.1%, and so on.
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPhiThreshold  = 8.0
+	default_phi_window   = 100
+	phi_min_stddev_ratio = 0.25 // Relative to the expected interval
+)
+
+// A FaultDetector implementing this reports a continuous suspicion level
+// in addition to the binary Online() state.
+type SuspicionDetector interface {
+	FaultDetector
+	Suspicion() float64
+}
+
+// All methods are safe for concurrent use.
+type PhiAccrual struct {
+	Threshold float64       // Considered offline when phi reaches this value
+	MinStdDev time.Duration // Avoids over-sensitivity when the intervals are very regular
+
+	lock          sync.Mutex
+	intervals     []float64 // Seconds. Ring buffer of the last window intervals
+	next          int
+	lastHeartbeat time.Time
+}
+
+// expectedInterval bootstraps the interval distribution, until enough heartbeats are received.
+func NewPhiAccrual(threshold float64, expectedInterval time.Duration) *PhiAccrual {
+	deviation := time.Duration(float64(expectedInterval) * phi_min_stddev_ratio)
+	phi := &PhiAccrual{
+		Threshold: threshold,
+		MinStdDev: deviation,
+		intervals: make([]float64, 0, default_phi_window),
+	}
+	phi.addInterval(expectedInterval - deviation)
+	phi.addInterval(expectedInterval + deviation)
+	return phi
+}
+
+// Intervals that exceeded the threshold are not learned, so that outages
+// do not distort the distribution.
+func (phi *PhiAccrual) Heartbeat(received time.Time) {
+	phi.lock.Lock()
+	defer phi.lock.Unlock()
+	if !phi.lastHeartbeat.IsZero() && phi.phi(received) < phi.Threshold {
+		phi.addInterval(received.Sub(phi.lastHeartbeat))
+	}
+	phi.lastHeartbeat = received
+}
+
+func (phi *PhiAccrual) addInterval(interval time.Duration) {
+	if len(phi.intervals) < cap(phi.intervals) {
+		phi.intervals = append(phi.intervals, interval.Seconds())
+	} else {
+		phi.intervals[phi.next] = interval.Seconds()
+		phi.next = (phi.next + 1) % len(phi.intervals)
+	}
+}
+
+// Returns +Inf if no heartbeat was received yet.
+func (phi *PhiAccrual) Phi(now time.Time) float64 {
+	phi.lock.Lock()
+	defer phi.lock.Unlock()
+	return phi.phi(now)
+}
+
+func (phi *PhiAccrual) phi(now time.Time) float64 {
+	if phi.lastHeartbeat.IsZero() {
+		return math.Inf(1)
+	}
+	mean, stddev := phi.distribution()
+	return computePhi(now.Sub(phi.lastHeartbeat).Seconds(), mean, stddev)
+}
+
+// Returns an error if phi reached the threshold.
+func (phi *PhiAccrual) Check(now time.Time) error {
+	value := phi.Phi(now)
+	if value < phi.Threshold {
+		return nil
+	}
+	phi.lock.Lock()
+	last := phi.lastHeartbeat
+	phi.lock.Unlock()
+	if last.IsZero() {
+		return fmt.Errorf("No heartbeat received yet")
+	}
+	return fmt.Errorf("Suspicion level phi=%.2f reached threshold %v: last heartbeat %v ago", value, phi.Threshold, now.Sub(last))
+}
+
+func (phi *PhiAccrual) distribution() (mean, stddev float64) {
+	for _, interval := range phi.intervals {
+		mean += interval
+	}
+	mean /= float64(len(phi.intervals))
+	var variance float64
+	for _, interval := range phi.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	variance /= float64(len(phi.intervals))
+	stddev = math.Max(math.Sqrt(variance), phi.MinStdDev.Seconds())
+	return
+}
+
+// Logistic approximation of the cumulative normal distribution
+func computePhi(elapsed, mean, stddev float64) float64 {
+	y := (elapsed - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	} else {
+		return -math.Log10(1 - 1/(1+e))
+	}
+}
@@ -0,0 +1,95 @@
+package protocols
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestComputePhi(t *testing.T) {
+	for _, test := range []struct {
+		elapsed, mean, stddev float64
+		min, max              float64
+	}{
+		{0, 1, 0.25, 0, 0.0001},
+		{1, 1, 0.25, 0.30, 0.31}, // Exactly on time: 50% chance of a later heartbeat
+		{1.25, 1, 0.25, 0.7, 0.9},
+		{1.5, 1, 0.25, 1.5, 1.8},
+		{2, 1, 0.25, 4, 5},
+		{3, 1, 0.25, 20, 23},
+		{3, 1, 1, 1.5, 1.8}, // Same as 1.5 with a smaller stddev
+	} {
+		phi := computePhi(test.elapsed, test.mean, test.stddev)
+		if phi < test.min || phi > test.max {
+			t.Errorf("computePhi(%v, %v, %v) = %v, expected between %v and %v",
+				test.elapsed, test.mean, test.stddev, phi, test.min, test.max)
+		}
+	}
+	last := computePhi(0, 1, 0.25)
+	for elapsed := 0.1; elapsed < 3; elapsed += 0.1 {
+		phi := computePhi(elapsed, 1, 0.25)
+		if phi < last {
+			t.Errorf("computePhi not monotonic: phi(%v) = %v < %v", elapsed, phi, last)
+		}
+		last = phi
+	}
+}
+
+func TestPhiAccrual(t *testing.T) {
+	interval := time.Second
+	start := time.Unix(1000, 0)
+	for _, test := range []struct {
+		name       string
+		heartbeats []time.Duration // Relative to start
+		check      time.Duration   // Relative to the last heartbeat
+		online     bool
+		intervals  int // Number of learned intervals, including the 2 bootstrapped ones
+	}{
+		{"no heartbeat", nil, 0, false, 2},
+		{"first heartbeat", []time.Duration{0}, 0, true, 2},
+		{"on time", []time.Duration{0, interval, 2 * interval}, interval, true, 4},
+		{"slightly late", []time.Duration{0, interval}, 1500 * time.Millisecond, true, 3},
+		{"timeout", []time.Duration{0, interval}, 5 * interval, false, 3},
+		{"outage not learned", []time.Duration{0, interval, 20 * interval, 21 * interval}, interval, true, 4},
+	} {
+		phi := NewPhiAccrual(DefaultPhiThreshold, interval)
+		var last time.Time
+		for _, beat := range test.heartbeats {
+			last = start.Add(beat)
+			phi.Heartbeat(last)
+		}
+		now := last.Add(test.check)
+		if len(test.heartbeats) == 0 {
+			now = start
+			if !math.IsInf(phi.Phi(now), 1) {
+				t.Errorf("%v: expected infinite phi, got %v", test.name, phi.Phi(now))
+			}
+		}
+		err := phi.Check(now)
+		if (err == nil) != test.online {
+			t.Errorf("%v: expected online %v, got error %v (phi %v)", test.name, test.online, err, phi.Phi(now))
+		}
+		if len(phi.intervals) != test.intervals {
+			t.Errorf("%v: %v intervals learned, expected %v", test.name, len(phi.intervals), test.intervals)
+		}
+	}
+}
+
+func TestPhiAccrualWindow(t *testing.T) {
+	phi := NewPhiAccrual(DefaultPhiThreshold, time.Second)
+	now := time.Unix(1000, 0)
+	for i := 0; i < default_phi_window+10; i++ {
+		now = now.Add(2 * time.Second)
+		phi.Heartbeat(now)
+	}
+	if len(phi.intervals) != default_phi_window {
+		t.Errorf("Window contains %v intervals, expected %v", len(phi.intervals), default_phi_window)
+	}
+	// The bootstrapped intervals are overwritten: the distribution adapts to the slower heartbeats
+	if mean, _ := phi.distribution(); math.Abs(mean-2) > 0.0001 {
+		t.Errorf("Mean interval %v, expected 2", mean)
+	}
+	if err := phi.Check(now.Add(3 * time.Second)); err != nil {
+		t.Errorf("Unexpected error after adapting to the interval: %v", err)
+	}
+}
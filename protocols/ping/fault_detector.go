@@ -1,18 +1,23 @@
 package ping
 
 import (
+	"math"
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
 )
 
 const (
 	default_ping_check_duration = 200 * time.Millisecond
+	ping_rtt_window             = 100
 )
 
 type FaultDetector struct {
 	*protocols.FaultDetectorBase
 	client *Client
+	phi    *protocols.PhiAccrual
+	rtt    *stats.RttStats
 }
 
 func NewFaultDetector(client protocols.Client, server string) (*FaultDetector, error) {
@@ -28,6 +33,7 @@ func NewFaultDetector(client protocols.Client, server string) (*FaultDetector, e
 	return &FaultDetector{
 		FaultDetectorBase: protocols.NewFaultDetectorBase(client.Protocol(), pingClient.Server()),
 		client:            pingClient,
+		rtt:               stats.NewRttStats(ping_rtt_window),
 	}, nil
 }
 
@@ -36,6 +42,22 @@ func DialNewFaultDetector(endpoint string) (*FaultDetector, error) {
 	return NewFaultDetector(client, endpoint)
 }
 
+// Learns the distribution of the intervals between successful pings. Single lost pings
+// do not make the server offline, as long as the suspicion level stays below threshold.
+func NewPhiFaultDetector(client protocols.Client, server string, threshold float64) (*FaultDetector, error) {
+	detector, err := NewFaultDetector(client, server)
+	if err != nil {
+		return nil, err
+	}
+	detector.phi = protocols.NewPhiAccrual(threshold, default_ping_check_duration)
+	return detector, nil
+}
+
+func DialNewPhiFaultDetector(endpoint string, threshold float64) (*FaultDetector, error) {
+	client := protocols.NewClient(MiniProtocol)
+	return NewPhiFaultDetector(client, endpoint, threshold)
+}
+
 func (detector *FaultDetector) Start() {
 	go detector.LoopCheck(detector.Check, default_ping_check_duration)
 }
@@ -48,11 +70,42 @@ func (detector *FaultDetector) Close() (err error) {
 }
 
 func (detector *FaultDetector) Check() {
-	detector.PerformCheck(detector.doPing)
+	if detector.phi == nil {
+		detector.PerformCheck(detector.doPing)
+	} else {
+		detector.PerformCheck(detector.doPhiCheck)
+	}
+}
+
+// Implements protocols.SuspicionDetector. Without phi-accrual detection,
+// the suspicion is either 0 or +Inf.
+func (detector *FaultDetector) Suspicion() float64 {
+	if detector.phi == nil {
+		if detector.Online() {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return detector.phi.Phi(time.Now())
+}
+
+func (detector *FaultDetector) doPhiCheck() error {
+	if err := detector.doPing(); err == nil {
+		detector.phi.Heartbeat(time.Now())
+	}
+	return detector.phi.Check(time.Now())
+}
+
+// Implements protocols.LatencyDetector. Only successful pings are measured.
+func (detector *FaultDetector) Latency() stats.RttSummary {
+	return detector.rtt.Summary()
 }
 
 func (detector *FaultDetector) doPing() error {
-	err := detector.client.Ping()
+	rtt, err := detector.client.PingRtt()
+	if err == nil {
+		detector.rtt.Add(rtt)
+	}
 	// Next ping with fresh connection
 	detector.client.ResetConnection()
 	return err
@@ -0,0 +1,14 @@
+package ping
+
+import (
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzPing(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codePing, Val: &PingPacket{Value: 1}},
+		{Code: codePong, Val: &PongPacket{Value: 2}},
+	})
+}
@@ -122,20 +122,27 @@ func NewClientFor(server_addr string) (*Client, error) {
 }
 
 func (client *Client) Ping() error {
+	_, err := client.PingRtt()
+	return err
+}
+
+// Returns the time between sending the Ping and receiving the matching Pong, on an established
+// connection. With the tcp transport, the handshake of the new connection used for every request is not included.
+func (client *Client) PingRtt() (time.Duration, error) {
 	ping := &PingPacket{Value: pingRand.Int()}
-	reply, err := client.SendRequest(codePing, ping)
+	reply, rtt, err := client.SendRequestTimed(codePing, ping)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if err = client.CheckError(reply, codePong); err != nil {
-		return err
+		return 0, err
 	}
 	pong, ok := reply.Val.(*PongPacket)
 	if !ok {
-		return fmt.Errorf("Illegal Pong payload: (%T) %s", reply.Val, reply.Val)
+		return 0, fmt.Errorf("Illegal Pong payload: (%T) %s", reply.Val, reply.Val)
 	}
 	if !pong.Check(ping) {
-		return fmt.Errorf("Server returned wrong Pong %s (expected %s)", pong.Value, ping.Pong())
+		return 0, fmt.Errorf("Server returned wrong Pong %v (expected %v)", pong.Value, ping.Pong())
 	}
-	return nil
+	return rtt, nil
 }
@@ -3,19 +3,35 @@ package protocols
 // Extension of server.go allowing for multiple "plugins" to handle one session
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/antongulenko/golib"
 )
 
 type PluginServer struct {
 	*Server
-	sessions Sessions
+	sessions *SessionManager
 
 	plugins []Plugin
 
-	SessionStartedCallback func(session *PluginSession)
-	SessionStoppedCallback func(session *PluginSession)
+	// Optional: select the plugins used for a session. The result must keep the order
+	// in which the plugins were added. By default, all plugins are used for every session.
+	PluginSelector func(param SessionParameter) []Plugin
+
+	// Optional: when stopping the server, running sessions are migrated through this
+	// before the remaining sessions are stopped. See MigrateSessions().
+	MigrateOnStop SessionMigrator
+
+	// Events about PluginSessions. Failover events are published by the plugins.
+	Events *SessionEventBus
+
+	// Limits the sessions per receiver host. Backend limits are enforced by the plugins.
+	Quota *SessionQuota
+
+	stopRetries chan struct{} // Closed when stopping, ends the retries of failed aborts
 }
 
 type Plugin interface {
@@ -25,14 +41,45 @@ type Plugin interface {
 	// Create and fully initialize new session. The param data is passed from
 	// plugin to plugin, enabling one plugin to modify the input data for the next plugin.
 	// Modify param if necessary and copy values from it. Do not store it.
+	// Return SkipPlugin to not take part in this session.
 	NewSession(param SessionParameter) (PluginSessionHandler, error)
 }
 
+var SkipPlugin = errors.New("Plugin skipped for this session")
+
+var (
+	// Delay between retries of failed PreparedSession.Abort() calls
+	AbortRetryInterval = 500 * time.Millisecond
+)
+
+// Plugins implementing this take part in the two-phase session setup: first, all plugins
+// reserve resources for the session, then all plugins start the session. Plugins not implementing
+// this are fully initialized with NewSession() in the first phase.
+type PreparingPlugin interface {
+	Plugin
+
+	// Reserve the resources for the session, without starting it.
+	// param is handled as in NewSession(). Return SkipPlugin to not take part in this session.
+	PrepareSession(param SessionParameter) (PreparedSession, error)
+}
+
+type PreparedSession interface {
+	// Start the session using the reserved resources.
+	Commit() (PluginSessionHandler, error)
+
+	// Release the reserved resources, or stop the session if it was already committed.
+	// Failed aborts are retried until they succeed, so only return an error if the
+	// remote side did not confirm the abort.
+	Abort() error
+}
+
 type PluginSession struct {
 	Base    *SessionBase
 	Client  string // From the originating SessionParameter
 	Server  *PluginServer
-	Plugins []PluginSessionHandler
+	Plugins []PluginSessionHandler // Only the plugins taking part in this session
+
+	plugins []Plugin // The plugins that created the entries in Plugins
 }
 
 type PluginSessionHandler interface {
@@ -42,16 +89,70 @@ type PluginSessionHandler interface {
 	String() string
 }
 
+// Plugin sessions implementing this are included in the journal of the PluginServer.
+type JournaledPluginSessionHandler interface {
+	PluginSessionHandler
+	JournalValue() interface{}
+}
+
+// Plugins implementing this can clean up the resources of sessions
+// that were orphaned in the journal of the PluginServer.
+type RestorablePlugin interface {
+	Plugin
+	CleanupOrphanedSession(value interface{}) error
+}
+
+// Journaled for every PluginSession. Contains one value per plugin, nil if the plugin session is not journaled
+// or the plugin did not take part in the session.
+type PluginJournalValue struct {
+	Values []interface{}
+}
+
+func init() {
+	RegisterJournalValue(new(PluginJournalValue))
+}
+
+// Plugin sessions implementing this can be migrated to another PluginServer.
+// Release() frees the local resources of the session without stopping the remote resources,
+// which are handled by the other server afterwards.
+type MigratablePluginSessionHandler interface {
+	JournaledPluginSessionHandler
+	Release()
+}
+
+// Plugins implementing this can take over sessions migrated from another PluginServer.
+// value was returned by JournalValue() of the migrated session handler.
+type MigratablePlugin interface {
+	Plugin
+	AdoptSession(client string, value interface{}) (PluginSessionHandler, error)
+}
+
+// Plugins implementing this observe backend servers with FaultDetectors.
+type ObservingPlugin interface {
+	Plugin
+	DetectorHistories() []*DetectorHistory
+}
+
+// Hands over one session to another PluginServer, which must have the same plugins in the same order.
+// lease is the remaining lease of the session.
+type SessionMigrator func(client string, lease time.Duration, value *PluginJournalValue) error
+
 type SessionParameter interface {
 	// This string will be used as key in the sessions dictionary
 	Client() string
 }
 
 func NewPluginServer(server *Server) *PluginServer {
-	return &PluginServer{
+	pluginServer := &PluginServer{
 		Server:   server,
-		sessions: make(Sessions),
+		sessions: NewSessionManager(),
+		Events:   NewSessionEventBus(),
+		Quota:    NewSessionQuota(),
+
+		stopRetries: make(chan struct{}),
 	}
+	pluginServer.sessions.ExpiredCallback = server.LogSessionExpired
+	return pluginServer
 }
 
 func (server *PluginServer) AddPlugin(plugin Plugin) {
@@ -60,6 +161,12 @@ func (server *PluginServer) AddPlugin(plugin Plugin) {
 }
 
 func (server *PluginServer) StopServer() {
+	close(server.stopRetries)
+	if server.MigrateOnStop != nil {
+		if err := server.MigrateSessions(server.MigrateOnStop); err != nil {
+			server.LogError(fmt.Errorf("Error migrating sessions: %v", err))
+		}
+	}
 	if err := server.sessions.DeleteSessions(); err != nil {
 		server.LogError(fmt.Errorf("Error stopping sessions: %v", err))
 	}
@@ -72,37 +179,267 @@ func (server *PluginServer) StopServer() {
 
 func (server *PluginServer) NewSession(param SessionParameter) error {
 	clientAddr := param.Client()
-	if _, ok := server.sessions[clientAddr]; ok {
-		return fmt.Errorf("Session already running for client %v", clientAddr)
+	return server.admitSession(clientAddr, func() (Session, error) {
+		return server.newPluginSession(clientAddr, param)
+	})
+}
+
+// The quota is left again in PluginSession.Cleanup()
+func (server *PluginServer) admitSession(clientAddr string, create func() (Session, error)) error {
+	host := QuotaHost(clientAddr)
+	if err := server.Quota.Admit(host); err != nil {
+		return err
+	}
+	err := server.sessions.NewSession(clientAddr, create)
+	if err != nil {
+		server.Quota.Leave(host)
+	}
+	return err
+}
+
+func (server *PluginServer) selectPlugins(param SessionParameter) []Plugin {
+	if server.PluginSelector == nil {
+		return server.plugins
 	}
+	return server.PluginSelector(param)
+}
+
+func (server *PluginServer) newPluginSession(clientAddr string, param SessionParameter) (*PluginSession, error) {
+	// Iterate plugin chain backwards: last plugin is facing the client
+	allPlugins := server.selectPlugins(param)
+	var plugins []Plugin
+	var prepared []PreparedSession
+	for i := len(allPlugins) - 1; i >= 0; i-- {
+		plugin := allPlugins[i]
+		preparedSession, err := server.prepareSession(plugin, param)
+		if err == SkipPlugin {
+			continue
+		}
+		if err != nil {
+			server.abortSessions(prepared)
+			return nil, err
+		}
+		plugins = append([]Plugin{plugin}, plugins...)
+		prepared = append([]PreparedSession{preparedSession}, prepared...)
+	}
+	if len(prepared) == 0 {
+		return nil, fmt.Errorf("No plugins available for session %v", clientAddr)
+	}
+
+	// All resources are reserved, now start the session in the same order
 	session := &PluginSession{
 		Client:  clientAddr,
 		Server:  server,
-		Plugins: make([]PluginSessionHandler, len(server.plugins)),
+		Plugins: make([]PluginSessionHandler, len(prepared)),
+		plugins: plugins,
 	}
-
-	// Iterate plugin chain backwards: last plugin is facing the client
-	for i := len(server.plugins) - 1; i >= 0; i-- {
-		plugin := server.plugins[i]
-		handler, err := plugin.NewSession(param)
+	for i := len(prepared) - 1; i >= 0; i-- {
+		handler, err := prepared[i].Commit()
 		if err != nil {
-			_ = session.cleanupPlugins() // Drop error
-			return err
+			server.abortSessions(prepared)
+			return nil, err
 		}
 		session.Plugins[i] = handler
 	}
-	server.sessions.StartSession(clientAddr, session)
+	return session, nil
+}
+
+func (server *PluginServer) prepareSession(plugin Plugin, param SessionParameter) (PreparedSession, error) {
+	if preparing, ok := plugin.(PreparingPlugin); ok {
+		return preparing.PrepareSession(param)
+	}
+	handler, err := plugin.NewSession(param)
+	if err != nil {
+		return nil, err
+	}
+	return &committedSession{handler: handler}, nil
+}
+
+// Failed aborts are logged and retried in the background, until they succeed or the server is stopped.
+func (server *PluginServer) abortSessions(prepared []PreparedSession) {
+	for _, preparedSession := range prepared {
+		if err := preparedSession.Abort(); err != nil {
+			server.LogError(fmt.Errorf("Error aborting session setup, retrying: %v", err))
+			go server.retryAbort(preparedSession)
+		}
+	}
+}
+
+func (server *PluginServer) retryAbort(prepared PreparedSession) {
+	for {
+		select {
+		case <-time.After(AbortRetryInterval):
+		case <-server.stopRetries:
+			return
+		}
+		if err := prepared.Abort(); err == nil {
+			return
+		}
+	}
+}
+
+// Wraps sessions of plugins that do not implement PreparingPlugin
+type committedSession struct {
+	handler PluginSessionHandler
+	aborted bool
+}
+
+func (session *committedSession) Commit() (PluginSessionHandler, error) {
+	return session.handler, nil
+}
+
+// Cleanup() is not guaranteed to be repeatable, so it is not called again after it succeeded.
+// A failed Cleanup() is retried by the next Abort().
+func (session *committedSession) Abort() error {
+	if session.aborted {
+		return nil
+	}
+	if err := session.handler.Cleanup(); err != nil {
+		return err
+	}
+	session.aborted = true
 	return nil
 }
 
-func (server *PluginServer) StopSession(client string) error {
-	return server.sessions.StopSession(client)
+func (server *PluginServer) StopSession(client string, reason StopReason) error {
+	return server.sessions.StopSession(client, reason)
 }
 
 func (server *PluginServer) DeleteSession(client string) error {
 	return server.sessions.DeleteSession(client)
 }
 
+func (server *PluginServer) SetLease(client string, lease time.Duration) error {
+	return server.sessions.SetLease(client, lease)
+}
+
+func (server *PluginServer) RenewSession(client string) error {
+	return server.sessions.Renew(client)
+}
+
+func (server *PluginServer) Sessions() []*SessionSnapshot {
+	return server.sessions.Snapshot()
+}
+
+func (server *PluginServer) QuotaUsage() *QuotaUsage {
+	return server.Quota.Usage()
+}
+
+// The histories of the FaultDetectors of all plugins implementing ObservingPlugin.
+func (server *PluginServer) DetectorHistories() []*DetectorHistory {
+	var histories []*DetectorHistory
+	for _, plugin := range server.plugins {
+		if observing, ok := plugin.(ObservingPlugin); ok {
+			histories = append(histories, observing.DetectorHistories()...)
+		}
+	}
+	return histories
+}
+
+func (server *PluginServer) UpdateJournal(client string) error {
+	return server.sessions.UpdateJournal(client)
+}
+
+// Must be called after all plugins have been added and configured. The remote resources of orphaned
+// sessions are cleaned up by the plugins. Sessions are not restored, since they could not be
+// re-attached to the clients and backend servers reliably.
+func (server *PluginServer) RestoreSessions(journal *SessionJournal) error {
+	return server.sessions.RestoreSessions(journal, func(key, value interface{}) error {
+		journaled, ok := value.(*PluginJournalValue)
+		if !ok {
+			return fmt.Errorf("Illegal journal value for plugin session: (%T) %v", value, value)
+		}
+		if len(journaled.Values) != len(server.plugins) {
+			return fmt.Errorf("Journaled session has %v plugins, but server has %v", len(journaled.Values), len(server.plugins))
+		}
+		var errors golib.MultiError
+		for i, plugin := range server.plugins {
+			if restorable, ok := plugin.(RestorablePlugin); ok && journaled.Values[i] != nil {
+				errors.Add(restorable.CleanupOrphanedSession(journaled.Values[i]))
+			}
+		}
+		return errors.NilOrError()
+	})
+}
+
+// Hand over all running sessions through migrate. Migrated sessions are removed without stopping
+// their remote resources. Sessions that could not be migrated keep running here.
+// Clients must renew the leases of migrated sessions at the other server.
+func (server *PluginServer) MigrateSessions(migrate SessionMigrator) error {
+	var errors golib.MultiError
+	for _, snapshot := range server.sessions.Snapshot() {
+		session, ok := snapshot.Session.(*PluginSession)
+		if !ok || snapshot.State != SessionRunning {
+			continue
+		}
+		lease := snapshot.Lease
+		if lease > 0 {
+			if lease = snapshot.Expires.Sub(time.Now()); lease <= 0 {
+				continue // Expired, will be deleted by the SessionManager
+			}
+		}
+		value, err := session.migrationValue()
+		if err == nil {
+			err = migrate(session.Client, lease, value)
+		}
+		if err == nil {
+			err = server.sessions.deleteSession(session.Client, StopMigrated)
+		}
+		if err != nil {
+			errors.Add(fmt.Errorf("Error migrating session %v: %v", session.Client, err))
+		}
+	}
+	return errors.NilOrError()
+}
+
+// Take over a session migrated from another PluginServer. The remote resources of the session
+// are not touched, if the session cannot be adopted.
+func (server *PluginServer) AdoptSession(client string, lease time.Duration, value *PluginJournalValue) error {
+	if len(value.Values) != len(server.plugins) {
+		return fmt.Errorf("Migrated session has %v plugins, but server has %v", len(value.Values), len(server.plugins))
+	}
+	err := server.admitSession(client, func() (Session, error) {
+		session := &PluginSession{
+			Client: client,
+			Server: server,
+		}
+		for i, plugin := range server.plugins {
+			if value.Values[i] == nil {
+				continue // Plugin did not take part in the session
+			}
+			migratable, ok := plugin.(MigratablePlugin)
+			if !ok {
+				session.releasePlugins()
+				return nil, fmt.Errorf("Plugin %T cannot adopt migrated sessions", plugin)
+			}
+			handler, err := migratable.AdoptSession(client, value.Values[i])
+			if err != nil {
+				session.releasePlugins()
+				return nil, err
+			}
+			session.Plugins = append(session.Plugins, handler)
+			session.plugins = append(session.plugins, plugin)
+		}
+		if len(session.Plugins) == 0 {
+			return nil, fmt.Errorf("No plugins available for session %v", client)
+		}
+		return session, nil
+	})
+	if err == nil && lease > 0 {
+		err = server.sessions.SetLease(client, lease)
+	}
+	return err
+}
+
+func (server *PluginServer) pluginIndex(plugin Plugin) int {
+	for i, p := range server.plugins {
+		if p == plugin {
+			return i
+		}
+	}
+	return -1 // PluginSelector returned a plugin that was not added
+}
+
 func (session *PluginSession) Tasks() (result []golib.Task) {
 	for _, plugin := range session.Plugins {
 		result = append(result, plugin.Tasks()...)
@@ -119,8 +456,39 @@ func (session *PluginSession) Start(base *SessionBase) {
 		}
 		session.Plugins[i].Start(sendingSession)
 	}
-	if session.Server.SessionStartedCallback != nil {
-		session.Server.SessionStartedCallback(session)
+	session.Server.Events.Publish(&SessionEvent{
+		Type:    SessionStartedEvent,
+		Key:     session.Client,
+		Session: session,
+		Message: session.String(),
+	})
+}
+
+func (session *PluginSession) JournalValue() interface{} {
+	values := make([]interface{}, len(session.Server.plugins))
+	for i, handler := range session.Plugins {
+		index := session.Server.pluginIndex(session.plugins[i])
+		if journaled, ok := handler.(JournaledPluginSessionHandler); ok && index >= 0 {
+			values[index] = journaled.JournalValue()
+		}
+	}
+	return &PluginJournalValue{Values: values}
+}
+
+func (session *PluginSession) migrationValue() (*PluginJournalValue, error) {
+	for _, handler := range session.Plugins {
+		if _, ok := handler.(MigratablePluginSessionHandler); !ok {
+			return nil, fmt.Errorf("Plugin session %v cannot be migrated", handler)
+		}
+	}
+	return session.JournalValue().(*PluginJournalValue), nil
+}
+
+func (session *PluginSession) releasePlugins() {
+	for _, plugin := range session.Plugins {
+		if migratable, ok := plugin.(MigratablePluginSessionHandler); ok {
+			migratable.Release()
+		}
 	}
 }
 
@@ -137,10 +505,26 @@ func (session *PluginSession) cleanupPlugins() error {
 }
 
 func (session *PluginSession) Cleanup() {
-	if err := session.cleanupPlugins(); err != nil {
+	if session.Base.StopInfo().Reason == StopMigrated {
+		// The remote resources are now handled by another server
+		session.releasePlugins()
+	} else if err := session.cleanupPlugins(); err != nil {
 		session.Base.CleanupErr = err
 	}
-	if session.Server.SessionStoppedCallback != nil {
-		session.Server.SessionStoppedCallback(session)
+	session.Server.Quota.Leave(QuotaHost(session.Client))
+	session.Server.Events.Publish(&SessionEvent{
+		Type:    SessionStoppedEvent,
+		Key:     session.Client,
+		Session: session,
+		Stop:    session.Base.StopInfo(),
+	})
+}
+
+// Lists the plugin sessions taking part in this session
+func (session *PluginSession) String() string {
+	plugins := make([]string, len(session.Plugins))
+	for i, plugin := range session.Plugins {
+		plugins[i] = plugin.String()
 	}
+	return strings.Join(plugins, ", ")
 }
@@ -0,0 +1,453 @@
+package protocols
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+type testParam string
+
+func (param testParam) Client() string {
+	return string(param)
+}
+
+// Records the calls to all testPlugins
+type testCalls struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (calls *testCalls) add(format string, args ...interface{}) {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	calls.calls = append(calls.calls, fmt.Sprintf(format, args...))
+}
+
+func (calls *testCalls) get() []string {
+	calls.lock.Lock()
+	defer calls.lock.Unlock()
+	return append([]string(nil), calls.calls...)
+}
+
+type testPlugin struct {
+	name       string
+	calls      *testCalls
+	skip       bool
+	prepareErr bool
+	commitErr  bool
+	abortFails int // Number of failing Abort() calls
+	migratable bool
+	adoptErr   bool
+	sender     string // String() of the sendingSession passed to the last started handler
+}
+
+type testPrepared struct {
+	plugin *testPlugin
+	lock   sync.Mutex
+	failed int
+}
+
+type testHandler struct {
+	plugin *testPlugin
+}
+
+type testMigratableHandler struct {
+	testHandler
+}
+
+func (plugin *testPlugin) Start(server *PluginServer) {
+}
+
+func (plugin *testPlugin) Stop() error {
+	return nil
+}
+
+func (plugin *testPlugin) NewSession(param SessionParameter) (PluginSessionHandler, error) {
+	return nil, fmt.Errorf("Not used, testPlugin implements PreparingPlugin")
+}
+
+func (plugin *testPlugin) PrepareSession(param SessionParameter) (PreparedSession, error) {
+	if plugin.skip {
+		return nil, SkipPlugin
+	}
+	plugin.calls.add("prepare %v", plugin.name)
+	if plugin.prepareErr {
+		return nil, fmt.Errorf("%v failed to prepare", plugin.name)
+	}
+	return &testPrepared{plugin: plugin}, nil
+}
+
+func (prepared *testPrepared) Commit() (PluginSessionHandler, error) {
+	prepared.plugin.calls.add("commit %v", prepared.plugin.name)
+	if prepared.plugin.commitErr {
+		return nil, fmt.Errorf("%v failed to commit", prepared.plugin.name)
+	}
+	return prepared.plugin.newHandler(), nil
+}
+
+func (plugin *testPlugin) newHandler() PluginSessionHandler {
+	if plugin.migratable {
+		return &testMigratableHandler{testHandler{plugin}}
+	}
+	return &testHandler{plugin}
+}
+
+func (plugin *testPlugin) AdoptSession(client string, value interface{}) (PluginSessionHandler, error) {
+	plugin.calls.add("adopt %v %v", plugin.name, value)
+	if plugin.adoptErr {
+		return nil, fmt.Errorf("%v failed to adopt", plugin.name)
+	}
+	return plugin.newHandler(), nil
+}
+
+func (prepared *testPrepared) Abort() error {
+	prepared.plugin.calls.add("abort %v", prepared.plugin.name)
+	prepared.lock.Lock()
+	defer prepared.lock.Unlock()
+	if prepared.failed < prepared.plugin.abortFails {
+		prepared.failed++
+		return fmt.Errorf("%v failed to abort", prepared.plugin.name)
+	}
+	return nil
+}
+
+func (handler *testHandler) Start(sendingSession PluginSessionHandler) {
+	handler.plugin.calls.add("start %v", handler.plugin.name)
+	handler.plugin.sender = ""
+	if sendingSession != nil {
+		handler.plugin.sender = sendingSession.String()
+	}
+}
+
+func (handler *testHandler) Tasks() []golib.Task {
+	return nil
+}
+
+func (handler *testHandler) Cleanup() error {
+	handler.plugin.calls.add("cleanup %v", handler.plugin.name)
+	return nil
+}
+
+func (handler *testHandler) String() string {
+	return handler.plugin.name
+}
+
+func (handler *testMigratableHandler) JournalValue() interface{} {
+	return handler.plugin.name
+}
+
+func (handler *testMigratableHandler) Release() {
+	handler.plugin.calls.add("release %v", handler.plugin.name)
+}
+
+func newTestPluginServer(plugins ...*testPlugin) *PluginServer {
+	server := NewPluginServer(&Server{
+		errors:  make(chan error, ErrorChanBuffer),
+		stopped: golib.NewStopChan(),
+	})
+	for _, plugin := range plugins {
+		server.AddPlugin(plugin)
+	}
+	return server
+}
+
+func TestTwoPhaseSessionSetup(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		plugins []*testPlugin
+		err     bool
+		calls   []string
+	}{
+		{
+			name:    "success",
+			plugins: []*testPlugin{{name: "a"}, {name: "b"}},
+			calls:   []string{"prepare b", "prepare a", "commit b", "commit a", "start b", "start a"},
+		},
+		{
+			name:    "skipped",
+			plugins: []*testPlugin{{name: "a"}, {name: "b", skip: true}},
+			calls:   []string{"prepare a", "commit a", "start a"},
+		},
+		{
+			name:    "all skipped",
+			plugins: []*testPlugin{{name: "a", skip: true}},
+			err:     true,
+		},
+		{
+			name:    "prepare failed",
+			plugins: []*testPlugin{{name: "a", prepareErr: true}, {name: "b"}, {name: "c"}},
+			err:     true,
+			calls:   []string{"prepare c", "prepare b", "prepare a", "abort b", "abort c"},
+		},
+		{
+			name:    "commit failed",
+			plugins: []*testPlugin{{name: "a", commitErr: true}, {name: "b"}},
+			err:     true,
+			calls:   []string{"prepare b", "prepare a", "commit b", "commit a", "abort a", "abort b"},
+		},
+	} {
+		calls := new(testCalls)
+		for _, plugin := range test.plugins {
+			plugin.calls = calls
+		}
+		server := newTestPluginServer(test.plugins...)
+		err := server.NewSession(testParam("client:1"))
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error result: %v", test.name, err)
+		}
+		if result := calls.get(); !reflect.DeepEqual(result, test.calls) && (len(result) > 0 || len(test.calls) > 0) {
+			t.Errorf("%v: calls %v, expected %v", test.name, result, test.calls)
+		}
+		if usage := server.QuotaUsage(); test.err && usage.Sessions != 0 {
+			t.Errorf("%v: failed session is still counted in the quota: %v", test.name, usage.Sessions)
+		}
+		server.StopServer()
+	}
+}
+
+func TestPluginSelection(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		skip     string // Name of a plugin returning SkipPlugin
+		selected func(a, b, c Plugin) []Plugin
+		err      bool
+		chain    string
+		senders  map[string]string // Sending session of every started plugin
+	}{
+		{
+			name:    "all plugins",
+			chain:   "a, b, c",
+			senders: map[string]string{"a": "", "b": "a", "c": "b"},
+		},
+		{
+			name:     "selected",
+			selected: func(a, b, c Plugin) []Plugin { return []Plugin{a, c} },
+			chain:    "a, c",
+			senders:  map[string]string{"a": "", "c": "a"},
+		},
+		{
+			name:    "skipped",
+			skip:    "b",
+			chain:   "a, c",
+			senders: map[string]string{"a": "", "c": "a"},
+		},
+		{
+			name:    "first skipped",
+			skip:    "a",
+			chain:   "b, c",
+			senders: map[string]string{"b": "", "c": "b"},
+		},
+		{
+			name:     "selected and skipped",
+			skip:     "c",
+			selected: func(a, b, c Plugin) []Plugin { return []Plugin{b, c} },
+			chain:    "b",
+			senders:  map[string]string{"b": ""},
+		},
+		{
+			name:     "nothing selected",
+			selected: func(a, b, c Plugin) []Plugin { return nil },
+			err:      true,
+		},
+	} {
+		calls := new(testCalls)
+		plugins := []*testPlugin{{name: "a"}, {name: "b"}, {name: "c"}}
+		for _, plugin := range plugins {
+			plugin.calls = calls
+			plugin.skip = plugin.name == test.skip
+			plugin.sender = "not started"
+		}
+		server := newTestPluginServer(plugins...)
+		if test.selected != nil {
+			server.PluginSelector = func(param SessionParameter) []Plugin {
+				return test.selected(plugins[0], plugins[1], plugins[2])
+			}
+		}
+		err := server.NewSession(testParam("client:1"))
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error result: %v", test.name, err)
+		}
+		if err == nil {
+			session, err := server.sessions.Get("client:1")
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			if chain := session.(*PluginSession).String(); chain != test.chain {
+				t.Errorf("%v: plugin chain %v, expected %v", test.name, chain, test.chain)
+			}
+		}
+		for _, plugin := range plugins {
+			expected, ok := test.senders[plugin.name]
+			if !ok {
+				expected = "not started"
+			}
+			if plugin.sender != expected {
+				t.Errorf("%v: sending session of %v is %q, expected %q", test.name, plugin.name, plugin.sender, expected)
+			}
+		}
+		server.StopServer()
+	}
+}
+
+func TestAbortRetries(t *testing.T) {
+	calls := new(testCalls)
+	failing := &testPlugin{name: "a", calls: calls, abortFails: 1}
+	server := newTestPluginServer(&testPlugin{name: "b", calls: calls, prepareErr: true}, failing)
+	if err := server.NewSession(testParam("client:1")); err == nil {
+		t.Fatal("Expected error when preparing the session")
+	}
+	countAborts := func() (aborts int) {
+		for _, call := range calls.get() {
+			if call == "abort a" {
+				aborts++
+			}
+		}
+		return
+	}
+	deadline := time.Now().Add(4 * AbortRetryInterval)
+	for countAborts() < 2 && time.Now().Before(deadline) {
+		time.Sleep(AbortRetryInterval / 10)
+	}
+	if aborts := countAborts(); aborts != 2 {
+		t.Errorf("Abort() called %v times, expected a successful retry after the first failure", aborts)
+	}
+
+	server.StopServer()
+
+	// Retries end when the server is stopped
+	failing = &testPlugin{name: "a", calls: calls, abortFails: 1000}
+	server = newTestPluginServer(&testPlugin{name: "b", calls: calls, prepareErr: true}, failing)
+	if err := server.NewSession(testParam("client:1")); err == nil {
+		t.Fatal("Expected error when preparing the session")
+	}
+	server.StopServer()
+	aborts := countAborts()
+	time.Sleep(2 * AbortRetryInterval)
+	if after := countAborts(); after != aborts {
+		t.Errorf("Abort() retried %v times after stopping the server", after-aborts)
+	}
+}
+
+// Cleanup() fails the given number of times
+type failingCleanupHandler struct {
+	testHandler
+	fails int
+}
+
+func (handler *failingCleanupHandler) Cleanup() error {
+	if err := handler.testHandler.Cleanup(); err != nil {
+		return err
+	}
+	if handler.fails > 0 {
+		handler.fails--
+		return fmt.Errorf("%v failed to clean up", handler.plugin.name)
+	}
+	return nil
+}
+
+func TestCommittedSessionAbort(t *testing.T) {
+	for _, test := range []struct {
+		fails    int
+		cleanups int // After 3 calls to Abort()
+	}{
+		{0, 1},
+		{1, 2},
+		{2, 3},
+		{5, 3},
+	} {
+		calls := new(testCalls)
+		session := &committedSession{handler: &failingCleanupHandler{testHandler{&testPlugin{name: "a", calls: calls}}, test.fails}}
+		for i := 0; i < 3; i++ {
+			err := session.Abort()
+			if failed := i < test.fails; failed != (err != nil) {
+				t.Errorf("%v failures: Abort() %v returned %v", test.fails, i+1, err)
+			}
+		}
+		if cleanups := len(calls.get()); cleanups != test.cleanups {
+			t.Errorf("%v failures: Cleanup() called %v times, expected %v", test.fails, cleanups, test.cleanups)
+		}
+	}
+}
+
+func TestMigrateSessions(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		from     []*testPlugin
+		to       []*testPlugin
+		lease    time.Duration
+		migrated bool
+		calls    []string // After the session was started at the first server
+	}{
+		{
+			name:     "migrated",
+			from:     []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true}},
+			to:       []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true}},
+			migrated: true,
+			calls:    []string{"adopt a a", "adopt b b", "start b", "start a", "release a", "release b"},
+		},
+		{
+			name:     "migrated with lease",
+			from:     []*testPlugin{{name: "a", migratable: true}},
+			to:       []*testPlugin{{name: "a", migratable: true}},
+			lease:    time.Hour,
+			migrated: true,
+			calls:    []string{"adopt a a", "start a", "release a"},
+		},
+		{
+			name: "not migratable",
+			from: []*testPlugin{{name: "a", migratable: true}, {name: "b"}},
+			to:   []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true}},
+		},
+		{
+			name:  "adopt failed",
+			from:  []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true}},
+			to:    []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true, adoptErr: true}},
+			calls: []string{"adopt a a", "adopt b b", "release a"},
+		},
+		{
+			name: "different plugins",
+			from: []*testPlugin{{name: "a", migratable: true}},
+			to:   []*testPlugin{{name: "a", migratable: true}, {name: "b", migratable: true}},
+		},
+	} {
+		calls := new(testCalls)
+		for _, plugin := range append(test.from, test.to...) {
+			plugin.calls = calls
+		}
+		from := newTestPluginServer(test.from...)
+		to := newTestPluginServer(test.to...)
+		if err := from.NewSession(testParam("client:1")); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if test.lease > 0 {
+			if err := from.SetLease("client:1", test.lease); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+		}
+		started := len(calls.get())
+		err := from.MigrateSessions(to.AdoptSession)
+		if (err == nil) != test.migrated {
+			t.Errorf("%v: unexpected error result: %v", test.name, err)
+		}
+		if result := calls.get()[started:]; !reflect.DeepEqual(result, test.calls) && (len(result) > 0 || len(test.calls) > 0) {
+			t.Errorf("%v: calls %v, expected %v", test.name, result, test.calls)
+		}
+		fromSessions, toSessions := from.Sessions(), to.Sessions()
+		if test.migrated {
+			if len(fromSessions) != 0 || len(toSessions) != 1 {
+				t.Errorf("%v: %v sessions left, %v sessions adopted", test.name, len(fromSessions), len(toSessions))
+			} else if lease := toSessions[0].Lease; lease > test.lease || (test.lease > 0 && lease < test.lease-time.Minute) {
+				t.Errorf("%v: adopted lease %v, expected %v", test.name, lease, test.lease)
+			}
+		} else if len(fromSessions) != 1 || fromSessions[0].State != SessionRunning || len(toSessions) != 0 {
+			t.Errorf("%v: %v sessions left, %v sessions adopted", test.name, len(fromSessions), len(toSessions))
+		}
+		from.StopServer()
+		to.StopServer()
+	}
+}
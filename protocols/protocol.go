@@ -8,6 +8,15 @@ import (
 const (
 	CodeOK = iota
 	CodeError
+	CodeQuotaExceeded // Error reply carrying a *QuotaExceededError
+)
+
+const (
+	// Maximum size of an encoded packet value, unless the ProtocolFragment
+	// owning the packet code implements LimitedProtocolFragment. Also applies to error
+	// replies, which can get large, e.g. for a MultiError. The tcp transport must be able
+	// to receive packets of this size.
+	DefaultMaxValueSize = 16384
 )
 
 type Decoder func(decoder *gob.Decoder) (interface{}, error)
@@ -18,12 +27,20 @@ type ProtocolFragment interface {
 	Decoders() DecoderMap
 }
 
+// Fragments with packets larger than DefaultMaxValueSize must implement this.
+// Larger incoming packets will be rejected without decoding them.
+type LimitedProtocolFragment interface {
+	ProtocolFragment
+	MaxValueSize() int
+}
+
 type Protocol interface {
 	Name() string
 	CheckIncludesFragment(fragmentName string) error
 	Transport() TransportProvider
 
 	decodeValue(code Code, decoder *gob.Decoder) (interface{}, error)
+	maxValueSize(code Code) int
 	instantiateServer(server *Server) (*serverProtocolInstance, error)
 }
 
@@ -55,7 +72,7 @@ func NewProtocolTransport(name string, transport TransportProvider, fragments ..
 	for _, fragment := range fragments {
 		for code, decoder := range fragment.Decoders() {
 			if existing, exists := decoders[code]; exists {
-				return nil, fmt.Errorf("Code %v used by multiple ProtocolFragments: %v, %v", existing.owner.Name(), fragment.Name())
+				return nil, fmt.Errorf("Code %v used by multiple ProtocolFragments: %v, %v", code, existing.owner.Name(), fragment.Name())
 			}
 			decoders[code] = decoderDescription{decoder, fragment}
 		}
@@ -100,6 +117,15 @@ func (proto *protocol) decodeValue(code Code, decoder *gob.Decoder) (interface{}
 	return description.decode(decoder)
 }
 
+func (proto *protocol) maxValueSize(code Code) int {
+	if description, ok := proto.decoders[code]; ok {
+		if limited, ok := description.owner.(LimitedProtocolFragment); ok {
+			return limited.MaxValueSize()
+		}
+	}
+	return DefaultMaxValueSize
+}
+
 // =================== Extensions for Server
 
 type ServerRequestHandler func(packet *Packet) (reply *Packet)
@@ -126,6 +152,7 @@ func (proto *protocol) instantiateServer(server *Server) (*serverProtocolInstanc
 		Protocol: proto,
 		server:   server,
 	}
+	server.protocol = inst // Allows fragments to call RegisterStopHandler() in ServerHandlers()
 	for _, fragment := range proto.fragments {
 		if serverFragment, ok := fragment.(ServerProtocolFragment); ok {
 			if err := inst.registerHandlers(serverFragment.ServerHandlers(server)); err != nil {
@@ -185,8 +212,9 @@ type defaultServerState struct {
 
 func (frag *defaultProtocolFragment) Decoders() DecoderMap {
 	return DecoderMap{
-		CodeOK:    frag.decodeOK,
-		CodeError: frag.decodeError,
+		CodeOK:            frag.decodeOK,
+		CodeError:         frag.decodeError,
+		CodeQuotaExceeded: frag.decodeQuotaExceeded,
 	}
 }
 func (*defaultProtocolFragment) Name() string {
@@ -200,15 +228,29 @@ func (frag *defaultProtocolFragment) decodeError(decoder *gob.Decoder) (interfac
 	}
 	return val, nil
 }
+func (frag *defaultProtocolFragment) decodeQuotaExceeded(decoder *gob.Decoder) (interface{}, error) {
+	var val QuotaExceededError
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding QuotaExceeded value: %v", err)
+	}
+	return &val, nil
+}
 func (*defaultProtocolFragment) decodeOK(decoder *gob.Decoder) (interface{}, error) {
+	// Discard the value, but consume it so it is not taken for trailing garbage
+	var val string
+	if err := decoder.Decode(&val); err != nil {
+		return nil, fmt.Errorf("Error decoding OK value: %v", err)
+	}
 	return nil, nil
 }
 
 func (frag *defaultProtocolFragment) ServerHandlers(server *Server) ServerHandlerMap {
 	state := &defaultServerState{server}
 	return ServerHandlerMap{
-		CodeOK:    state.handleOK,
-		CodeError: state.handleError,
+		CodeOK:            state.handleOK,
+		CodeError:         state.handleError,
+		CodeQuotaExceeded: state.handleError,
 	}
 }
 func (state *defaultServerState) handleOK(packet *Packet) *Packet {
@@ -0,0 +1,204 @@
+package protocols
+
+// Admission control for sessions: limits for the total number of sessions,
+// the sessions per receiver host and the sessions per backend server.
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+)
+
+type QuotaLimit int
+
+const (
+	LimitSessions = QuotaLimit(iota)
+	LimitSessionsPerHost
+	LimitSessionsPerBackend
+)
+
+var quotaLimitNames = map[QuotaLimit]string{
+	LimitSessions:           "sessions",
+	LimitSessionsPerHost:    "sessions per host",
+	LimitSessionsPerBackend: "sessions per backend",
+}
+
+func (limit QuotaLimit) String() string {
+	if name, ok := quotaLimitNames[limit]; ok {
+		return name
+	}
+	return fmt.Sprintf("QuotaLimit(%d)", int(limit))
+}
+
+// Returned when a session is rejected by a SessionQuota. Servers send it to clients with
+// CodeQuotaExceeded, so it is also returned by clients when a remote quota was exceeded.
+type QuotaExceededError struct {
+	Limit QuotaLimit
+	Key   string // The host or backend that reached the limit. Empty for LimitSessions.
+	Max   int
+}
+
+func (err *QuotaExceededError) Error() string {
+	if err.Key == "" {
+		return fmt.Sprintf("Quota exceeded: maximum of %v %v reached", err.Max, err.Limit)
+	}
+	return fmt.Sprintf("Quota exceeded: maximum of %v %v reached for %v", err.Max, err.Limit, err.Key)
+}
+
+func IsQuotaExceeded(err error) bool {
+	_, ok := err.(*QuotaExceededError)
+	return ok
+}
+
+// All methods are safe for concurrent use. Zero limits mean unlimited.
+type SessionQuota struct {
+	MaxSessions           int
+	MaxSessionsPerHost    int
+	MaxSessionsPerBackend int
+
+	lock     sync.Mutex
+	sessions int
+	hosts    map[string]int
+	backends map[string]int
+}
+
+// Current usage and limits of a SessionQuota
+type QuotaUsage struct {
+	MaxSessions           int
+	MaxSessionsPerHost    int
+	MaxSessionsPerBackend int
+
+	Sessions int
+	Hosts    map[string]int
+	Backends map[string]int
+}
+
+func NewSessionQuota() *SessionQuota {
+	return &SessionQuota{
+		hosts:    make(map[string]int),
+		backends: make(map[string]int),
+	}
+}
+
+// Must be called before flag.Parse(), e.g. before ParseServerFlags().
+func SessionQuotaFlags() *SessionQuota {
+	quota := NewSessionQuota()
+	flag.IntVar(&quota.MaxSessions, "max_sessions", 0, "Maximum number of sessions (0: unlimited)")
+	flag.IntVar(&quota.MaxSessionsPerHost, "max_host_sessions", 0, "Maximum number of sessions per receiver host (0: unlimited)")
+	flag.IntVar(&quota.MaxSessionsPerBackend, "max_backend_sessions", 0, "Maximum number of sessions per backend server (0: unlimited)")
+	return quota
+}
+
+// The host part of addr, or addr itself if it has no port.
+func QuotaHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Check the limits for a new session of the given receiver host and count it.
+// Every successful Admit() must be followed by Leave() after the session is stopped.
+func (quota *SessionQuota) Admit(host string) error {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if err := quota.check(host); err != nil {
+		return err
+	}
+	quota.sessions++
+	quota.hosts[host]++
+	return nil
+}
+
+func (quota *SessionQuota) Leave(host string) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	quota.sessions--
+	quota.leaveHost(host)
+}
+
+// Move a session to another receiver host, e.g. when redirecting it.
+// Only the per-host limit of the new host is checked.
+func (quota *SessionQuota) Move(oldHost, newHost string) error {
+	if oldHost == newHost {
+		return nil
+	}
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if max := quota.MaxSessionsPerHost; max > 0 && quota.hosts[newHost] >= max {
+		return &QuotaExceededError{Limit: LimitSessionsPerHost, Key: newHost, Max: max}
+	}
+	quota.hosts[newHost]++
+	quota.leaveHost(oldHost)
+	return nil
+}
+
+func (quota *SessionQuota) check(host string) error {
+	if max := quota.MaxSessions; max > 0 && quota.sessions >= max {
+		return &QuotaExceededError{Limit: LimitSessions, Max: max}
+	}
+	if max := quota.MaxSessionsPerHost; max > 0 && quota.hosts[host] >= max {
+		return &QuotaExceededError{Limit: LimitSessionsPerHost, Key: host, Max: max}
+	}
+	return nil
+}
+
+func (quota *SessionQuota) leaveHost(host string) {
+	if quota.hosts[host] <= 1 {
+		delete(quota.hosts, host)
+	} else {
+		quota.hosts[host]--
+	}
+}
+
+// Count a new session on the backend, or return a QuotaExceededError if the backend
+// cannot take another session. Every successful ReserveBackend() must be followed by
+// RemoveBackend() after the session is stopped or moved to another backend.
+func (quota *SessionQuota) ReserveBackend(backend string) error {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if max := quota.MaxSessionsPerBackend; max > 0 && quota.backends[backend] >= max {
+		return &QuotaExceededError{Limit: LimitSessionsPerBackend, Key: backend, Max: max}
+	}
+	quota.backends[backend]++
+	return nil
+}
+
+// Count a session on the backend without checking the limit. Backend limits are only
+// enforced for new sessions in ReserveBackend(), because sessions can be moved to other backends without asking for permission, e.g. on failover.
+func (quota *SessionQuota) AddBackend(backend string) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	quota.backends[backend]++
+}
+
+func (quota *SessionQuota) RemoveBackend(backend string) {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if quota.backends[backend] <= 1 {
+		delete(quota.backends, backend)
+	} else {
+		quota.backends[backend]--
+	}
+}
+
+func (quota *SessionQuota) Usage() *QuotaUsage {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	usage := &QuotaUsage{
+		MaxSessions:           quota.MaxSessions,
+		MaxSessionsPerHost:    quota.MaxSessionsPerHost,
+		MaxSessionsPerBackend: quota.MaxSessionsPerBackend,
+		Sessions:              quota.sessions,
+		Hosts:                 make(map[string]int, len(quota.hosts)),
+		Backends:              make(map[string]int, len(quota.backends)),
+	}
+	for host, num := range quota.hosts {
+		usage.Hosts[host] = num
+	}
+	for backend, num := range quota.backends {
+		usage.Backends[backend] = num
+	}
+	return usage
+}
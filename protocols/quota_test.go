@@ -0,0 +1,158 @@
+package protocols
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+)
+
+func TestSessionQuota(t *testing.T) {
+	type op struct {
+		name  string // admit, leave, move, reserve, add, remove
+		key   string
+		key2  string // New host for move
+		limit QuotaLimit
+		err   bool
+	}
+	for _, test := range []struct {
+		name     string
+		max      [3]int // MaxSessions, MaxSessionsPerHost, MaxSessionsPerBackend
+		ops      []op
+		sessions int
+		hosts    map[string]int
+		backends map[string]int
+	}{
+		{
+			name: "unlimited",
+			max:  [3]int{},
+			ops: []op{
+				{name: "admit", key: "a"}, {name: "admit", key: "a"}, {name: "admit", key: "b"},
+				{name: "reserve", key: "x"}, {name: "reserve", key: "x"},
+			},
+			sessions: 3,
+			hosts:    map[string]int{"a": 2, "b": 1},
+			backends: map[string]int{"x": 2},
+		},
+		{
+			name: "max sessions",
+			max:  [3]int{2, 0, 0},
+			ops: []op{
+				{name: "admit", key: "a"}, {name: "admit", key: "b"},
+				{name: "admit", key: "c", err: true, limit: LimitSessions},
+				{name: "leave", key: "a"}, {name: "admit", key: "c"},
+			},
+			sessions: 2,
+			hosts:    map[string]int{"b": 1, "c": 1},
+			backends: map[string]int{},
+		},
+		{
+			name: "max sessions per host",
+			max:  [3]int{0, 1, 0},
+			ops: []op{
+				{name: "admit", key: "a"}, {name: "admit", key: "b"},
+				{name: "admit", key: "a", err: true, limit: LimitSessionsPerHost},
+				{name: "move", key: "a", key2: "b", err: true, limit: LimitSessionsPerHost},
+				{name: "move", key: "a", key2: "c"},
+				{name: "admit", key: "a"},
+			},
+			sessions: 3,
+			hosts:    map[string]int{"a": 1, "b": 1, "c": 1},
+			backends: map[string]int{},
+		},
+		{
+			name: "max sessions per backend",
+			max:  [3]int{0, 0, 2},
+			ops: []op{
+				{name: "reserve", key: "x"}, {name: "reserve", key: "x"},
+				{name: "reserve", key: "x", err: true, limit: LimitSessionsPerBackend},
+				{name: "reserve", key: "y"},
+				// Failover: sessions are moved regardless of the limit
+				{name: "add", key: "x"}, {name: "remove", key: "y"},
+				{name: "remove", key: "x"},
+				{name: "reserve", key: "x", err: true, limit: LimitSessionsPerBackend},
+				{name: "remove", key: "x"},
+				{name: "reserve", key: "x"},
+			},
+			sessions: 0,
+			hosts:    map[string]int{},
+			backends: map[string]int{"x": 2},
+		},
+	} {
+		quota := NewSessionQuota()
+		quota.MaxSessions = test.max[0]
+		quota.MaxSessionsPerHost = test.max[1]
+		quota.MaxSessionsPerBackend = test.max[2]
+		for i, op := range test.ops {
+			var err error
+			switch op.name {
+			case "admit":
+				err = quota.Admit(op.key)
+			case "leave":
+				quota.Leave(op.key)
+			case "move":
+				err = quota.Move(op.key, op.key2)
+			case "reserve":
+				err = quota.ReserveBackend(op.key)
+			case "add":
+				quota.AddBackend(op.key)
+			case "remove":
+				quota.RemoveBackend(op.key)
+			}
+			if (err != nil) != op.err {
+				t.Errorf("%v: op %v (%v %v): unexpected error result: %v", test.name, i, op.name, op.key, err)
+			} else if err != nil {
+				if quotaErr, ok := err.(*QuotaExceededError); !ok || quotaErr.Limit != op.limit {
+					t.Errorf("%v: op %v (%v %v): expected QuotaExceededError for %v, got %v", test.name, i, op.name, op.key, op.limit, err)
+				}
+			}
+		}
+		usage := quota.Usage()
+		if usage.Sessions != test.sessions || !reflect.DeepEqual(usage.Hosts, test.hosts) || !reflect.DeepEqual(usage.Backends, test.backends) {
+			t.Errorf("%v: usage %v sessions, hosts %v, backends %v; expected %v, %v, %v", test.name,
+				usage.Sessions, usage.Hosts, usage.Backends, test.sessions, test.hosts, test.backends)
+		}
+	}
+}
+
+func TestQuotaExceededReply(t *testing.T) {
+	protocol, err := NewProtocol("Test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{errors: make(chan error, ErrorChanBuffer)}
+	client := NewClient(protocol).(*client)
+	for _, test := range []struct {
+		err   error
+		quota bool
+	}{
+		{&QuotaExceededError{Limit: LimitSessionsPerHost, Key: "10.0.0.1", Max: 2}, true},
+		{&QuotaExceededError{Limit: LimitSessions, Max: 10}, true},
+		{&RemoteError{Protocol: "Test", Message: "failed"}, false},
+	} {
+		// Encode and decode the reply, as it is sent over the network
+		reply := server.ReplyError(test.err)
+		data, err := Marshaller.MarshalPacket(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, err := Marshaller.UnmarshalPacket(data, protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = client.CheckReply(received)
+		if IsQuotaExceeded(err) != test.quota {
+			t.Errorf("Reply for %v: client returned %v, IsQuotaExceeded: %v", test.err, err, IsQuotaExceeded(err))
+		}
+		if test.quota && !reflect.DeepEqual(err, test.err) {
+			t.Errorf("Client returned %v, expected %v", err, test.err)
+		}
+		if err == nil || err.Error() == "" {
+			t.Errorf("Reply for %v: no error returned by the client", test.err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&QuotaExceededError{}); err != nil {
+		t.Errorf("QuotaExceededError cannot be encoded: %v", err)
+	}
+}
@@ -132,7 +132,11 @@ func (server *Server) ReplyOK() *Packet {
 	return server.Reply(CodeOK, "")
 }
 
+// A *QuotaExceededError is sent with its own code, so clients can recognize it.
 func (server *Server) ReplyError(err error) *Packet {
+	if quotaErr, ok := err.(*QuotaExceededError); ok {
+		return server.Reply(CodeQuotaExceeded, quotaErr)
+	}
 	return server.Reply(CodeError, err.Error())
 }
 
@@ -144,9 +148,22 @@ func (server *Server) LogError(err error) {
 	}
 }
 
+// Can be used as SessionManager.ExpiredCallback
+func (server *Server) LogSessionExpired(key interface{}, err error) {
+	if err == nil {
+		server.LogError(fmt.Errorf("Session for %v expired", key))
+	} else {
+		server.LogError(fmt.Errorf("Session for %v expired: %v", key, err))
+	}
+}
+
 func ParseServerFlags(default_ip string, default_port int) string {
 	port := flag.Int("port", default_port, "The port to start the server")
 	ip := flag.String("host", default_ip, "The ip to listen for traffic")
+	capture := flag.String("capture", "", "Record all sent and received control packets to this file")
 	flag.Parse()
+	if *capture != "" {
+		golib.Checkerr(StartCapture(*capture))
+	}
 	return net.JoinHostPort(*ip, strconv.Itoa(int(*port)))
 }
@@ -3,17 +3,134 @@ package protocols
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/antongulenko/golib"
 )
 
-type Sessions map[interface{}]*SessionBase
+var (
+	// How often sessions with a lease are checked for expiry
+	LeaseCheckInterval = 200 * time.Millisecond
+)
+
+type SessionState int
+
+const (
+	SessionStarting = SessionState(iota)
+	SessionRunning
+	SessionStopping
+	SessionStopped
+	SessionFailed
+)
+
+var sessionStateNames = map[SessionState]string{
+	SessionStarting: "starting",
+	SessionRunning:  "running",
+	SessionStopping: "stopping",
+	SessionStopped:  "stopped",
+	SessionFailed:   "failed",
+}
+
+func (state SessionState) String() string {
+	if name, ok := sessionStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("SessionState(%d)", int(state))
+}
+
+type StopReason int
+
+const (
+	StopClientRequest = StopReason(iota)
+	StopTaskFailed
+	StopFailoverFailed
+	StopServerShutdown
+	StopLeaseExpired
+	StopMigrated
+)
+
+var stopReasonNames = map[StopReason]string{
+	StopClientRequest:  "client request",
+	StopTaskFailed:     "task failed",
+	StopFailoverFailed: "failover failed",
+	StopServerShutdown: "server shutdown",
+	StopLeaseExpired:   "lease expired",
+	StopMigrated:       "migrated",
+}
+
+func (reason StopReason) String() string {
+	if name, ok := stopReasonNames[reason]; ok {
+		return name
+	}
+	return fmt.Sprintf("StopReason(%d)", int(reason))
+}
+
+// Why and when a session was stopped. Only the first reason is recorded.
+type StopInfo struct {
+	Reason StopReason
+	Time   time.Time  // Zero while the session was not stopped
+	Task   golib.Task // For StopTaskFailed: the task that ended first and stopped the session
+	Err    error      // For StopTaskFailed: the error of Task, if known
+}
+
+func (info StopInfo) String() string {
+	if info.Time.IsZero() {
+		return "not stopped"
+	}
+	str := fmt.Sprintf("%v at %v", info.Reason, info.Time.Format("15:04:05.000"))
+	if info.Task != nil {
+		str += fmt.Sprintf(" (%v", info.Task)
+		if info.Err != nil {
+			str += fmt.Sprintf(": %v", info.Err)
+		}
+		str += ")"
+	}
+	return str
+}
+
+// All methods are safe for concurrent use. Sessions are stopped outside of
+// the internal lock, so Session implementations may access their SessionManager.
+type SessionManager struct {
+	lock          sync.Mutex
+	sessions      map[interface{}]*SessionBase
+	reaperRunning bool
+
+	// Called after a session was deleted because its lease was not renewed in time.
+	// err is the result of stopping the session.
+	ExpiredCallback func(key interface{}, err error)
+
+	// If set, sessions implementing JournaledSession are recorded here.
+	Journal *SessionJournal
+}
 
 type SessionBase struct {
 	Wg         *sync.WaitGroup
 	Stopped    golib.StopChan
 	CleanupErr error
 	Session    Session
+	StartTime  time.Time
+
+	stateLock sync.Mutex
+	stopInfo  StopInfo
+	state     SessionState
+	lease     time.Duration // Zero means no lease: the session never expires
+	expires   time.Time
+
+	// Used to record sessions that stop on their own. key and journaled are guarded by manager.lock.
+	manager   *SessionManager
+	key       interface{}
+	journaled bool // A Create entry was recorded, but no Delete entry yet
+}
+
+// Point-in-time view of a session, e.g. for answering queries about running sessions.
+type SessionSnapshot struct {
+	Key     interface{}
+	State   SessionState
+	Started time.Time
+	Lease   time.Duration
+	Expires time.Time
+	Stop    StopInfo
+	Session Session // Session and Started are not set while the session is starting
 }
 
 type Session interface {
@@ -22,35 +139,130 @@ type Session interface {
 	Cleanup()
 }
 
-func (sessions Sessions) StartSession(key interface{}, session Session) {
-	base := &SessionBase{
+// Sessions implementing this can report the error of the task that stopped them.
+type TaskErrorSession interface {
+	Session
+	TaskError(task golib.Task) error
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[interface{}]*SessionBase),
+	}
+}
+
+func newSessionBase() *SessionBase {
+	return &SessionBase{
 		Wg:      new(sync.WaitGroup),
 		Stopped: golib.NewStopChan(),
-		Session: session,
+		state:   SessionStarting,
 	}
-	sessions[key] = base
-	base.start()
-	session.Start(base)
 }
 
-func (sessions Sessions) Get(key interface{}) Session {
-	if base, ok := sessions[key]; ok {
-		return base.Session
-	} else {
-		return nil
+// Atomically reserve the key, then create and start the session. While create()
+// is running, the key is in state SessionStarting and cannot be used by other sessions.
+func (sessions *SessionManager) NewSession(key interface{}, create func() (Session, error)) error {
+	base, err := sessions.reserve(key)
+	if err != nil {
+		return err
+	}
+	session, err := create()
+	if err != nil {
+		sessions.release(key, base)
+		return err
+	}
+	sessions.created(key, base, session)
+	base.run(session)
+	return nil
+}
+
+// Start an already created session, if the key is not used yet.
+func (sessions *SessionManager) StartSession(key interface{}, session Session) error {
+	base, err := sessions.reserve(key)
+	if err != nil {
+		return err
+	}
+	sessions.created(key, base, session)
+	base.run(session)
+	return nil
+}
+
+func (sessions *SessionManager) reserve(key interface{}) (*SessionBase, error) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	if _, ok := sessions.sessions[key]; ok {
+		return nil, fmt.Errorf("Session already exists for %v", key)
+	}
+	base := newSessionBase()
+	base.manager = sessions
+	base.key = key
+	sessions.sessions[key] = base
+	return base, nil
+}
+
+// The Create entry is written under the lock, before the session is started.
+// A Delete entry for the session can only be written afterwards.
+func (sessions *SessionManager) created(key interface{}, base *SessionBase, session Session) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	base.stateLock.Lock()
+	base.Session = session
+	base.stateLock.Unlock()
+	if sessions.sessions[key] == base {
+		sessions.record(JournalCreate, key, nil, base)
+	}
+}
+
+// The session stopped without being deleted, e.g. because a task failed. It is kept
+// until it is deleted, but its resources are released, so it is removed from the journal.
+func (sessions *SessionManager) stopped(base *SessionBase) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	if sessions.sessions[base.key] == base {
+		sessions.record(JournalDelete, base.key, nil, base)
 	}
 }
 
-func (sessions Sessions) ReKeySession(oldKey, newKey interface{}) (*SessionBase, error) {
-	if session, ok := sessions[oldKey]; ok {
+func (sessions *SessionManager) release(key interface{}, base *SessionBase) {
+	base.setState(SessionFailed)
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	if sessions.sessions[key] == base {
+		delete(sessions.sessions, key)
+	}
+}
+
+// Returns an error if the session does not exist or is not running.
+func (sessions *SessionManager) Get(key interface{}) (Session, error) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	base, ok := sessions.sessions[key]
+	if !ok {
+		return nil, fmt.Errorf("No session found for %v", key)
+	}
+	if state := base.State(); state != SessionRunning {
+		return nil, fmt.Errorf("Session for %v is %v", key, state)
+	}
+	return base.Session, nil
+}
+
+func (sessions *SessionManager) ReKeySession(oldKey, newKey interface{}) (*SessionBase, error) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	if session, ok := sessions.sessions[oldKey]; ok {
+		if state := session.State(); state != SessionRunning {
+			return nil, fmt.Errorf("Session for %v is %v", oldKey, state)
+		}
 		if newKey == oldKey {
 			return session, nil
 		}
-		if _, ok := sessions[newKey]; ok {
+		if _, ok := sessions.sessions[newKey]; ok {
 			return nil, fmt.Errorf("Session already exists for %v", newKey)
 		} else {
-			sessions[newKey] = session
-			delete(sessions, oldKey)
+			sessions.sessions[newKey] = session
+			delete(sessions.sessions, oldKey)
+			session.key = newKey
+			sessions.record(JournalReKey, oldKey, newKey, session)
 			return session, nil
 		}
 	} else {
@@ -58,35 +270,274 @@ func (sessions Sessions) ReKeySession(oldKey, newKey interface{}) (*SessionBase,
 	}
 }
 
-func (sessions Sessions) DeleteSessions() error {
-	errors := make(golib.MultiError, 0, len(sessions))
-	for key, session := range sessions {
+// After the lease expires, the session will be deleted, unless it is renewed.
+func (sessions *SessionManager) SetLease(key interface{}, lease time.Duration) error {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	session, ok := sessions.sessions[key]
+	if !ok {
+		return fmt.Errorf("No session found for %v", key)
+	}
+	session.stateLock.Lock()
+	session.lease = lease
+	session.expires = time.Now().Add(lease)
+	session.stateLock.Unlock()
+	sessions.record(JournalUpdate, key, nil, session)
+	if lease > 0 && !sessions.reaperRunning {
+		sessions.reaperRunning = true
+		go sessions.reapExpiredSessions()
+	}
+	return nil
+}
+
+func (sessions *SessionManager) Renew(key interface{}) error {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	session, ok := sessions.sessions[key]
+	if !ok {
+		return fmt.Errorf("No session found for %v", key)
+	}
+	session.stateLock.Lock()
+	defer session.stateLock.Unlock()
+	if session.state != SessionRunning {
+		return fmt.Errorf("Session for %v is %v", key, session.state)
+	}
+	session.expires = time.Now().Add(session.lease)
+	return nil
+}
+
+func (sessions *SessionManager) reapExpiredSessions() {
+	for {
+		time.Sleep(LeaseCheckInterval)
+		expired, leased := sessions.expiredSessions()
+		for _, key := range expired {
+			err := sessions.deleteSession(key, StopLeaseExpired)
+			if callback := sessions.ExpiredCallback; callback != nil {
+				callback(key, err)
+			}
+		}
+		if !leased {
+			return
+		}
+	}
+}
+
+// Also stops the reaper goroutine if there are no more sessions with leases.
+func (sessions *SessionManager) expiredSessions() (expired []interface{}, leased bool) {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	now := time.Now()
+	for key, session := range sessions.sessions {
+		session.stateLock.Lock()
+		if session.lease > 0 {
+			if session.state == SessionRunning && now.After(session.expires) {
+				expired = append(expired, key)
+			} else {
+				leased = true
+			}
+		}
+		session.stateLock.Unlock()
+	}
+	if !leased {
+		sessions.reaperRunning = false
+	}
+	return
+}
+
+func (sessions *SessionManager) DeleteSessions() error {
+	sessions.lock.Lock()
+	deleted := make(map[interface{}]*SessionBase, len(sessions.sessions))
+	for key, session := range sessions.sessions {
+		deleted[key] = session
+		delete(sessions.sessions, key)
+		sessions.record(JournalDelete, key, nil, session)
+	}
+	sessions.lock.Unlock()
+	for _, session := range deleted {
+		session.setStopReason(StopServerShutdown, nil)
+	}
+
+	errors := make(golib.MultiError, 0, len(deleted))
+	for _, session := range deleted {
+		if session.abandonIfStarting() {
+			continue
+		}
 		if err := session.StopAndFormatError(); err != nil {
 			errors = append(errors, err)
 		}
-		delete(sessions, key)
 	}
 	return errors.NilOrError()
 }
 
-func (sessions Sessions) DeleteSession(key interface{}) error {
-	if session, ok := sessions[key]; !ok {
+func (sessions *SessionManager) DeleteSession(key interface{}) error {
+	return sessions.deleteSession(key, StopClientRequest)
+}
+
+func (sessions *SessionManager) deleteSession(key interface{}, reason StopReason) error {
+	sessions.lock.Lock()
+	session, ok := sessions.sessions[key]
+	if ok {
+		delete(sessions.sessions, key)
+		sessions.record(JournalDelete, key, nil, session)
+	}
+	sessions.lock.Unlock()
+	if !ok {
 		return fmt.Errorf("No session found for %v", key)
-	} else {
-		err := session.StopAndFormatError()
-		delete(sessions, key)
-		return err
 	}
-	return nil
+	session.setStopReason(reason, nil)
+	if session.abandonIfStarting() {
+		return nil
+	}
+	return session.StopAndFormatError()
 }
 
-func (sessions Sessions) StopSession(key interface{}) error {
-	if session, ok := sessions[key]; !ok {
+// Stop the session without deleting it.
+func (sessions *SessionManager) StopSession(key interface{}, reason StopReason) error {
+	sessions.lock.Lock()
+	session, ok := sessions.sessions[key]
+	sessions.lock.Unlock()
+	if !ok {
 		return fmt.Errorf("No session found for %v", key)
-	} else {
-		session.Stop()
-		return session.CleanupErr
 	}
+	if state := session.State(); state == SessionStarting {
+		return fmt.Errorf("Session for %v is %v", key, state)
+	}
+	session.StopFor(reason)
+	return session.CleanupErr
+}
+
+func (sessions *SessionManager) Snapshot() []*SessionSnapshot {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	result := make([]*SessionSnapshot, 0, len(sessions.sessions))
+	for key, base := range sessions.sessions {
+		result = append(result, base.snapshot(key))
+	}
+	return result
+}
+
+// Record the current JournalValue of the session, e.g. after it was redirected.
+func (sessions *SessionManager) UpdateJournal(key interface{}) error {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+	session, ok := sessions.sessions[key]
+	if !ok {
+		return fmt.Errorf("No session found for %v", key)
+	}
+	sessions.record(JournalUpdate, key, nil, session)
+	return nil
+}
+
+// Use the journal for all following session operations, and call restore for every session
+// that was orphaned in the journal. restore should either re-create the session under the
+// same key, or clean up the resources referenced by the journaled value. Sessions that are
+// not re-created are removed from the journal. A journaled lease is applied to re-created sessions.
+func (sessions *SessionManager) RestoreSessions(journal *SessionJournal, restore func(key, value interface{}) error) error {
+	sessions.Journal = journal
+	var errors golib.MultiError
+	for _, entry := range journal.Orphaned() {
+		if err := restore(entry.Key, entry.Value); err != nil {
+			errors.Add(fmt.Errorf("Error restoring session for %v: %v", entry.Key, err))
+		}
+		sessions.lock.Lock()
+		_, ok := sessions.sessions[entry.Key]
+		sessions.lock.Unlock()
+		if !ok {
+			journal.Record(&JournalEntry{Op: JournalDelete, Key: entry.Key})
+		} else if entry.Lease > 0 {
+			errors.Add(sessions.SetLease(entry.Key, entry.Lease))
+		}
+	}
+	return errors.NilOrError()
+}
+
+// Records nothing if there is no Journal or the session does not implement JournaledSession.
+// Only a Create entry is recorded for sessions that are not journaled, e.g. after they stopped.
+// sessions.lock must be held.
+func (sessions *SessionManager) record(op JournalOp, key, newKey interface{}, base *SessionBase) {
+	journal := sessions.Journal
+	if journal == nil || (op != JournalCreate && !base.journaled) {
+		return
+	}
+	base.stateLock.Lock()
+	session, ok := base.Session.(JournaledSession)
+	lease := base.lease
+	base.stateLock.Unlock()
+	if !ok {
+		return
+	}
+	base.journaled = op != JournalDelete
+	entry := &JournalEntry{Op: op, Key: key, NewKey: newKey}
+	if op == JournalCreate || op == JournalUpdate {
+		entry.Value = session.JournalValue()
+		entry.Lease = lease
+	}
+	journal.Record(entry)
+}
+
+func (base *SessionBase) State() SessionState {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	return base.state
+}
+
+func (base *SessionBase) snapshot(key interface{}) *SessionSnapshot {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	snapshot := &SessionSnapshot{
+		Key:     key,
+		State:   base.state,
+		Lease:   base.lease,
+		Expires: base.expires,
+		Stop:    base.stopInfo,
+	}
+	if base.state != SessionStarting {
+		snapshot.Session = base.Session
+		snapshot.Started = base.StartTime
+	}
+	return snapshot
+}
+
+func (base *SessionBase) StopInfo() StopInfo {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	return base.stopInfo
+}
+
+// Returns false, if a reason was recorded before.
+func (base *SessionBase) setStopReason(reason StopReason, task golib.Task) bool {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	if !base.stopInfo.Time.IsZero() {
+		return false
+	}
+	base.stopInfo = StopInfo{
+		Reason: reason,
+		Time:   time.Now(),
+		Task:   task,
+	}
+	return true
+}
+
+func (base *SessionBase) setState(state SessionState) {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	base.state = state
+}
+
+func (base *SessionBase) setStateIf(expected, state SessionState) bool {
+	base.stateLock.Lock()
+	defer base.stateLock.Unlock()
+	if base.state == expected {
+		base.state = state
+		return true
+	}
+	return false
+}
+
+// A session that was deleted while starting up is stopped as soon as it is running.
+func (base *SessionBase) abandonIfStarting() bool {
+	return base.setStateIf(SessionStarting, SessionStopping)
 }
 
 func (base *SessionBase) StopAndFormatError() error {
@@ -104,23 +555,57 @@ func (base *SessionBase) StopAndFormatError() error {
 	}
 }
 
+// base.Session is already set, see SessionManager.created().
+func (base *SessionBase) run(session Session) {
+	base.StartTime = time.Now()
+	base.start()
+	session.Start(base)
+	if !base.setStateIf(SessionStarting, SessionRunning) {
+		// Deleted while starting, or a task already stopped the session
+		base.Stop()
+	}
+}
+
 func (base *SessionBase) start() {
 	if len(base.Session.Tasks()) < 1 {
 		return
 	}
 	go func() {
-		// TODO handle results
-		golib.WaitForAnyTask(base.Wg, base.Session.Tasks())
+		task, _ := golib.WaitForAnyTask(base.Wg, base.Session.Tasks())
+		if base.setStopReason(StopTaskFailed, task) {
+			if session, ok := base.Session.(TaskErrorSession); ok {
+				err := session.TaskError(task)
+				base.stateLock.Lock()
+				base.stopInfo.Err = err
+				base.stateLock.Unlock()
+			}
+		}
 		base.Stop()
 	}()
 }
 
+func (base *SessionBase) StopFor(reason StopReason) {
+	base.setStopReason(reason, nil)
+	base.Stop()
+}
+
+// Stopping without a recorded reason counts as StopClientRequest.
 func (base *SessionBase) Stop() {
+	base.setStopReason(StopClientRequest, nil)
 	base.Stopped.Enable(func() {
+		base.setState(SessionStopping)
 		for _, task := range base.Session.Tasks() {
 			task.Stop()
 		}
 		base.Wg.Wait()
 		base.Session.Cleanup()
+		if base.CleanupErr == nil {
+			base.setState(SessionStopped)
+		} else {
+			base.setState(SessionFailed)
+		}
+		if base.manager != nil {
+			base.manager.stopped(base)
+		}
 	})
 }
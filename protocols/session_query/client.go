@@ -0,0 +1,89 @@
+package session_query
+
+import (
+	"fmt"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+type Client struct {
+	protocols.Client
+}
+
+func NewClient(client protocols.Client) (*Client, error) {
+	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+func NewClientFor(server_addr string) (*Client, error) {
+	client, err := protocols.NewMiniClientFor(server_addr, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+// An empty state lists all sessions.
+func (client *Client) ListSessions(state string) (*ListSessionsResponse, error) {
+	reply, err := client.SendRequest(codeListSessions, &ListSessions{State: state})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeListSessionsResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*ListSessionsResponse)
+	if !ok {
+		return nil, fmt.Errorf("Illegal ListSessionsResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
+}
+
+func (client *Client) GetSession(key string) (*SessionInfo, error) {
+	reply, err := client.SendRequest(codeGetSession, &GetSession{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeGetSessionResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*SessionInfo)
+	if !ok {
+		return nil, fmt.Errorf("Illegal GetSessionResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
+}
+
+// An empty host includes the usage of all receiver hosts.
+func (client *Client) GetQuota(host string) (*protocols.QuotaUsage, error) {
+	reply, err := client.SendRequest(codeGetQuota, &GetQuota{Host: host})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeGetQuotaResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*protocols.QuotaUsage)
+	if !ok {
+		return nil, fmt.Errorf("Illegal GetQuotaResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
+}
+
+// An empty server includes the histories of all observed servers.
+func (client *Client) GetDetectorHistory(server string) (*DetectorHistoryResponse, error) {
+	reply, err := client.SendRequest(codeGetDetectorHistory, &GetDetectorHistory{Server: server})
+	if err != nil {
+		return nil, err
+	}
+	if err = client.CheckError(reply, codeGetDetectorHistoryResponse); err != nil {
+		return nil, err
+	}
+	response, ok := reply.Val.(*DetectorHistoryResponse)
+	if !ok {
+		return nil, fmt.Errorf("Illegal GetDetectorHistoryResponse payload: (%T) %s", reply.Val, reply.Val)
+	}
+	return response, nil
+}
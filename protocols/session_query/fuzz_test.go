@@ -0,0 +1,21 @@
+package session_query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzSessionQuery(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeListSessions, Val: &ListSessions{State: "running"}},
+		{Code: codeListSessionsResponse, Val: &ListSessionsResponse{Sessions: []*SessionInfo{{Key: "127.0.0.1:9000", State: "running", Started: time.Now()}}}},
+		{Code: codeGetSession, Val: &GetSession{Key: "127.0.0.1:9000"}},
+		{Code: codeGetSessionResponse, Val: &SessionInfo{Key: "127.0.0.1:9000", Stats: []*StatsInfo{{Name: "rtp", Packets: 10}}}},
+		{Code: codeGetQuota, Val: &GetQuota{Host: "127.0.0.1"}},
+		{Code: codeGetQuotaResponse, Val: &protocols.QuotaUsage{Sessions: 1, Hosts: map[string]int{"127.0.0.1": 1}}},
+		{Code: codeGetDetectorHistory, Val: &GetDetectorHistory{Server: "127.0.0.1:7777"}},
+		{Code: codeGetDetectorHistoryResponse, Val: &DetectorHistoryResponse{Histories: []*protocols.DetectorHistory{{Server: "127.0.0.1:7777", Transitions: []protocols.DetectorTransition{{Time: time.Now(), State: protocols.DetectorOffline, Error: "timeout"}}}}}},
+	})
+}
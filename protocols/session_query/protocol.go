@@ -0,0 +1,188 @@
+package session_query
+
+// Protocol for listing and inspecting the sessions of a server,
+// and the FaultDetectors of the backend servers of a balancer
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+var (
+	Protocol     *sessionQueryProtocol
+	MiniProtocol = protocols.NewMiniProtocol(Protocol)
+)
+
+const (
+	// Session lists can get large. The tcp transport must be able to receive packets of this size.
+	maxValueSize = 16384
+)
+
+// ======================= Packets =======================
+
+const (
+	codeListSessions = protocols.Code(26 + iota)
+	codeListSessionsResponse
+	codeGetSession
+	codeGetSessionResponse
+)
+
+const (
+	codeGetQuota = protocols.Code(33 + iota)
+	codeGetQuotaResponse
+)
+
+const (
+	codeGetDetectorHistory = protocols.Code(40 + iota)
+	codeGetDetectorHistoryResponse
+)
+
+type ListSessions struct {
+	State string // If not empty, only list sessions in this state
+}
+
+type ListSessionsResponse struct {
+	Sessions  []*SessionInfo
+	Truncated bool // Not all sessions fit into one packet
+}
+
+type GetSession struct {
+	Key string // As in SessionInfo.Key
+}
+
+// Answered with a protocols.QuotaUsage
+type GetQuota struct {
+	Host string // If not empty, only the usage of this receiver host is included
+}
+
+type GetDetectorHistory struct {
+	Server string // If not empty, only the history of detectors observing this server is included
+}
+
+type DetectorHistoryResponse struct {
+	Histories []*protocols.DetectorHistory
+	Truncated bool // Older transitions were dropped to fit into one packet
+}
+
+type SessionInfo struct {
+	Key     string
+	State   string
+	Started time.Time
+	Lease   time.Duration
+	Expires time.Time
+	Stopped string // Reason why the session was stopped, if it is not running anymore
+	Tasks   []string
+
+	// Filled by sessions implementing DescribedSession
+	Client  string
+	Ports   []int
+	Servers []string
+	Stats   []*StatsInfo
+}
+
+type StatsInfo struct {
+	Name             string
+	Packets          uint
+	Bytes            uint
+	PacketsPerSecond float32
+	BytesPerSecond   float32
+}
+
+func (info *SessionInfo) String() string {
+	return fmt.Sprintf("Session %v (%v, started %v)", info.Key, info.State, info.Started.Format("15:04:05"))
+}
+
+// ======================= Protocol =======================
+
+type sessionQueryProtocol struct {
+}
+
+func (*sessionQueryProtocol) Name() string {
+	return "SessionQuery"
+}
+
+func (*sessionQueryProtocol) MaxValueSize() int {
+	return maxValueSize
+}
+
+func (proto *sessionQueryProtocol) Decoders() protocols.DecoderMap {
+	return protocols.DecoderMap{
+		codeListSessions:         proto.decodeListSessions,
+		codeListSessionsResponse: proto.decodeListSessionsResponse,
+		codeGetSession:           proto.decodeGetSession,
+		codeGetSessionResponse:   proto.decodeGetSessionResponse,
+		codeGetQuota:             proto.decodeGetQuota,
+		codeGetQuotaResponse:     proto.decodeGetQuotaResponse,
+
+		codeGetDetectorHistory:         proto.decodeGetDetectorHistory,
+		codeGetDetectorHistoryResponse: proto.decodeGetDetectorHistoryResponse,
+	}
+}
+
+func (proto *sessionQueryProtocol) decodeListSessions(decoder *gob.Decoder) (interface{}, error) {
+	var val ListSessions
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery ListSessions value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeListSessionsResponse(decoder *gob.Decoder) (interface{}, error) {
+	var val ListSessionsResponse
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery ListSessionsResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetSession(decoder *gob.Decoder) (interface{}, error) {
+	var val GetSession
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetSession value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetSessionResponse(decoder *gob.Decoder) (interface{}, error) {
+	var val SessionInfo
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetSessionResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetQuota(decoder *gob.Decoder) (interface{}, error) {
+	var val GetQuota
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetQuota value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetQuotaResponse(decoder *gob.Decoder) (interface{}, error) {
+	var val protocols.QuotaUsage
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetQuotaResponse value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetDetectorHistory(decoder *gob.Decoder) (interface{}, error) {
+	var val GetDetectorHistory
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetDetectorHistory value: %v", err)
+	}
+	return &val, nil
+}
+func (proto *sessionQueryProtocol) decodeGetDetectorHistoryResponse(decoder *gob.Decoder) (interface{}, error) {
+	var val DetectorHistoryResponse
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding SessionQuery GetDetectorHistoryResponse value: %v", err)
+	}
+	return &val, nil
+}
@@ -0,0 +1,213 @@
+package session_query
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/stats"
+)
+
+type Handler interface {
+	// Usually implemented by returning SessionManager.Snapshot()
+	Sessions() []*protocols.SessionSnapshot
+}
+
+// Implemented by servers that limit their sessions with a protocols.SessionQuota.
+type QuotaHandler interface {
+	QuotaUsage() *protocols.QuotaUsage
+}
+
+// Implemented by servers observing backend servers, e.g. *protocols.PluginServer with balancing plugins.
+type DetectorHistoryHandler interface {
+	DetectorHistories() []*protocols.DetectorHistory
+}
+
+// Implemented by sessions that can add details about themselves to the query results.
+type DescribedSession interface {
+	DescribeSession(info *SessionInfo)
+}
+
+func RegisterServer(server *protocols.Server, handler Handler) error {
+	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return err
+	}
+	state := &serverState{
+		Server:  server,
+		handler: handler,
+	}
+	return server.RegisterHandlers(protocols.ServerHandlerMap{
+		codeListSessions: state.handleListSessions,
+		codeGetSession:   state.handleGetSession,
+		codeGetQuota:     state.handleGetQuota,
+
+		codeGetDetectorHistory: state.handleGetDetectorHistory,
+	})
+}
+
+type serverState struct {
+	*protocols.Server
+	handler Handler
+}
+
+func (server *serverState) handleListSessions(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*ListSessions); ok {
+		var sessions []*SessionInfo
+		for _, info := range server.sessionInfos() {
+			if desc.State == "" || desc.State == info.State {
+				sessions = append(sessions, info)
+			}
+		}
+		return server.Reply(codeListSessionsResponse, limitResponse(sessions))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for SessionQuery ListSessions: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handleGetSession(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*GetSession); ok {
+		for _, info := range server.sessionInfos() {
+			if info.Key == desc.Key {
+				return server.Reply(codeGetSessionResponse, info)
+			}
+		}
+		return server.ReplyError(fmt.Errorf("No session found for %v", desc.Key))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for SessionQuery GetSession: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handleGetQuota(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*GetQuota); ok {
+		if quota, ok := server.handler.(QuotaHandler); ok {
+			usage := quota.QuotaUsage()
+			if desc.Host != "" {
+				usage.Hosts = map[string]int{desc.Host: usage.Hosts[desc.Host]}
+			}
+			return server.Reply(codeGetQuotaResponse, usage)
+		}
+		return server.ReplyError(fmt.Errorf("Server does not have a session quota"))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for SessionQuery GetQuota: %v", packet.Val))
+	}
+}
+
+func (server *serverState) handleGetDetectorHistory(packet *protocols.Packet) *protocols.Packet {
+	if desc, ok := packet.Val.(*GetDetectorHistory); ok {
+		if observing, ok := server.handler.(DetectorHistoryHandler); ok {
+			var histories []*protocols.DetectorHistory
+			for _, history := range observing.DetectorHistories() {
+				if desc.Server == "" || desc.Server == history.Server {
+					histories = append(histories, history)
+				}
+			}
+			return server.Reply(codeGetDetectorHistoryResponse, limitHistories(histories))
+		}
+		return server.ReplyError(fmt.Errorf("Server does not observe any backend servers"))
+	} else {
+		return server.ReplyError(fmt.Errorf("Illegal value for SessionQuery GetDetectorHistory: %v", packet.Val))
+	}
+}
+
+// Sorted by key
+func (server *serverState) sessionInfos() []*SessionInfo {
+	snapshots := server.handler.Sessions()
+	infos := make(sessionInfoSlice, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		infos = append(infos, NewSessionInfo(snapshot))
+	}
+	sort.Sort(infos)
+	return infos
+}
+
+func NewSessionInfo(snapshot *protocols.SessionSnapshot) *SessionInfo {
+	info := &SessionInfo{
+		Key:     fmt.Sprintf("%v", snapshot.Key),
+		State:   snapshot.State.String(),
+		Started: snapshot.Started,
+		Lease:   snapshot.Lease,
+		Expires: snapshot.Expires,
+	}
+	if !snapshot.Stop.Time.IsZero() {
+		info.Stopped = snapshot.Stop.String()
+	}
+	if session := snapshot.Session; session != nil {
+		for _, task := range session.Tasks() {
+			info.Tasks = append(info.Tasks, fmt.Sprintf("%v", task))
+		}
+		if plugins, ok := session.(*protocols.PluginSession); ok {
+			info.Client = plugins.Client
+			for _, plugin := range plugins.Plugins {
+				if described, ok := plugin.(DescribedSession); ok {
+					described.DescribeSession(info)
+				}
+			}
+		} else if described, ok := session.(DescribedSession); ok {
+			described.DescribeSession(info)
+		}
+	}
+	return info
+}
+
+func NewStatsInfo(stats *stats.Stats) *StatsInfo {
+	return &StatsInfo{
+		Name:             stats.Name,
+		Packets:          stats.Results.Packets(),
+		Bytes:            stats.Results.Bytes(),
+		PacketsPerSecond: stats.Results.PacketsPerSecond(),
+		BytesPerSecond:   stats.Results.BytesPerSecond(),
+	}
+}
+
+// Drop sessions from the end of the list until the response fits into maxValueSize.
+func limitResponse(sessions []*SessionInfo) *ListSessionsResponse {
+	response := &ListSessionsResponse{Sessions: sessions}
+	for len(response.Sessions) > 0 && encodedSize(response) > maxValueSize {
+		response.Sessions = response.Sessions[:len(response.Sessions)/2]
+		response.Truncated = true
+	}
+	return response
+}
+
+// Drop the oldest transitions of all histories until the response fits into maxValueSize.
+func limitHistories(histories []*protocols.DetectorHistory) *DetectorHistoryResponse {
+	response := &DetectorHistoryResponse{Histories: histories}
+	for encodedSize(response) > maxValueSize {
+		dropped := false
+		for _, history := range histories {
+			if num := len(history.Transitions); num > 0 {
+				history.Transitions = history.Transitions[num-num/2:]
+				history.Dropped += uint64(num - num/2)
+				dropped = true
+			}
+		}
+		if !dropped {
+			break
+		}
+		response.Truncated = true
+	}
+	return response
+}
+
+func encodedSize(val interface{}) int {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(val); err != nil {
+		return 0 // The error will occur again when sending the reply
+	}
+	return buf.Len()
+}
+
+type sessionInfoSlice []*SessionInfo
+
+// Implement sort.Interface
+func (slice sessionInfoSlice) Len() int {
+	return len(slice)
+}
+func (slice sessionInfoSlice) Less(i, j int) bool {
+	return slice[i].Key < slice[j].Key
+}
+func (slice sessionInfoSlice) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
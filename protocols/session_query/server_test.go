@@ -0,0 +1,80 @@
+package session_query
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func TestLimitResponse(t *testing.T) {
+	for _, test := range []struct {
+		sessions  int
+		truncated bool
+	}{
+		{0, false},
+		{1, false},
+		{10, false},
+		{1000, true},
+	} {
+		sessions := make([]*SessionInfo, test.sessions)
+		for i := range sessions {
+			sessions[i] = &SessionInfo{
+				Key:     fmt.Sprintf("127.0.0.1:%v", 10000+i),
+				State:   protocols.SessionRunning.String(),
+				Started: time.Now(),
+				Servers: []string{"127.0.0.1:7777", "127.0.0.1:7778"},
+			}
+		}
+		response := limitResponse(sessions)
+		if response.Truncated != test.truncated {
+			t.Errorf("%v sessions: truncated = %v, expected %v", test.sessions, response.Truncated, test.truncated)
+		}
+		if size := encodedSize(response); size > maxValueSize {
+			t.Errorf("%v sessions: response of %v bytes exceeds %v bytes", test.sessions, size, maxValueSize)
+		}
+		if !test.truncated && len(response.Sessions) != test.sessions {
+			t.Errorf("%v sessions: response contains %v sessions", test.sessions, len(response.Sessions))
+		}
+	}
+}
+
+func TestLimitHistories(t *testing.T) {
+	for _, test := range []struct {
+		transitions int
+		truncated   bool
+	}{
+		{0, false},
+		{10, false},
+		{2000, true},
+	} {
+		histories := make([]*protocols.DetectorHistory, 3)
+		for i := range histories {
+			history := &protocols.DetectorHistory{Server: fmt.Sprintf("127.0.0.1:%v", 7777+i), Protocol: "Ping"}
+			for j := 0; j < test.transitions; j++ {
+				history.Transitions = append(history.Transitions, protocols.DetectorTransition{
+					Time:  time.Now(),
+					State: protocols.DetectorOffline,
+					Error: fmt.Sprintf("Check %v failed", j),
+				})
+			}
+			histories[i] = history
+		}
+		response := limitHistories(histories)
+		if response.Truncated != test.truncated {
+			t.Errorf("%v transitions: truncated = %v, expected %v", test.transitions, response.Truncated, test.truncated)
+		}
+		if size := encodedSize(response); size > maxValueSize {
+			t.Errorf("%v transitions: response of %v bytes exceeds %v bytes", test.transitions, size, maxValueSize)
+		}
+		for _, history := range response.Histories {
+			if total := uint64(len(history.Transitions)) + history.Dropped; total != uint64(test.transitions) {
+				t.Errorf("%v transitions: %v kept and %v dropped", test.transitions, len(history.Transitions), history.Dropped)
+			}
+			if num := len(history.Transitions); num > 0 && history.Transitions[num-1].Error != fmt.Sprintf("Check %v failed", test.transitions-1) {
+				t.Errorf("%v transitions: latest transition was dropped", test.transitions)
+			}
+		}
+	}
+}
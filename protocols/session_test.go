@@ -0,0 +1,309 @@
+package protocols
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+type testSession struct {
+	lock     sync.Mutex
+	started  int
+	cleanups int
+}
+
+func (session *testSession) Start(base *SessionBase) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.started++
+}
+
+func (session *testSession) Tasks() []golib.Task {
+	return nil
+}
+
+func (session *testSession) Cleanup() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.cleanups++
+}
+
+func (session *testSession) counts() (started, cleanups int) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.started, session.cleanups
+}
+
+func TestSessionStates(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		action   func(sessions *SessionManager) error
+		err      bool
+		state    SessionState
+		exists   bool // The key "a" is still used after the action
+		cleanups int
+		reason   StopReason
+	}{
+		{
+			name:   "running",
+			action: func(sessions *SessionManager) error { return nil },
+			state:  SessionRunning, exists: true,
+		},
+		{
+			name: "duplicate key",
+			action: func(sessions *SessionManager) error {
+				return sessions.StartSession("a", new(testSession))
+			},
+			err: true, state: SessionRunning, exists: true,
+		},
+		{
+			name: "stopped",
+			action: func(sessions *SessionManager) error {
+				return sessions.StopSession("a", StopFailoverFailed)
+			},
+			state: SessionStopped, exists: true, cleanups: 1, reason: StopFailoverFailed,
+		},
+		{
+			name: "stopped twice",
+			action: func(sessions *SessionManager) error {
+				if err := sessions.StopSession("a", StopFailoverFailed); err != nil {
+					return err
+				}
+				return sessions.StopSession("a", StopClientRequest)
+			},
+			state: SessionStopped, exists: true, cleanups: 1, reason: StopFailoverFailed,
+		},
+		{
+			name: "deleted",
+			action: func(sessions *SessionManager) error {
+				return sessions.DeleteSession("a")
+			},
+			state: SessionStopped, cleanups: 1, reason: StopClientRequest,
+		},
+		{
+			name: "deleted on shutdown",
+			action: func(sessions *SessionManager) error {
+				return sessions.DeleteSessions()
+			},
+			state: SessionStopped, cleanups: 1, reason: StopServerShutdown,
+		},
+		{
+			name: "rekeyed",
+			action: func(sessions *SessionManager) error {
+				_, err := sessions.ReKeySession("a", "b")
+				return err
+			},
+			state: SessionRunning,
+		},
+		{
+			name: "rekeyed to used key",
+			action: func(sessions *SessionManager) error {
+				if err := sessions.StartSession("b", new(testSession)); err != nil {
+					return err
+				}
+				_, err := sessions.ReKeySession("a", "b")
+				return err
+			},
+			err: true, state: SessionRunning, exists: true,
+		},
+		{
+			name: "rekeyed after stopping",
+			action: func(sessions *SessionManager) error {
+				if err := sessions.StopSession("a", StopClientRequest); err != nil {
+					return err
+				}
+				_, err := sessions.ReKeySession("a", "b")
+				return err
+			},
+			err: true, state: SessionStopped, exists: true, cleanups: 1, reason: StopClientRequest,
+		},
+	} {
+		sessions := NewSessionManager()
+		session := new(testSession)
+		if err := sessions.StartSession("a", session); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		base := sessions.sessions["a"]
+		err := test.action(sessions)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error result: %v", test.name, err)
+		}
+		if state := base.State(); state != test.state {
+			t.Errorf("%v: state %v, expected %v", test.name, state, test.state)
+		}
+		if _, err := sessions.Get("a"); (err == nil) != (test.exists && test.state == SessionRunning) {
+			t.Errorf("%v: unexpected result of Get(): %v", test.name, err)
+		}
+		sessions.lock.Lock()
+		_, exists := sessions.sessions["a"]
+		sessions.lock.Unlock()
+		if exists != test.exists {
+			t.Errorf("%v: session exists: %v, expected %v", test.name, exists, test.exists)
+		}
+		if started, cleanups := session.counts(); started != 1 || cleanups != test.cleanups {
+			t.Errorf("%v: started %v times and cleaned up %v times, expected 1 and %v", test.name, started, cleanups, test.cleanups)
+		}
+		if info := base.StopInfo(); test.cleanups > 0 && info.Reason != test.reason {
+			t.Errorf("%v: stop reason %v, expected %v", test.name, info.Reason, test.reason)
+		}
+	}
+}
+
+func TestNewSessionFailures(t *testing.T) {
+	sessions := NewSessionManager()
+	err := sessions.NewSession("a", func() (Session, error) {
+		return nil, fmt.Errorf("create failed")
+	})
+	if err == nil {
+		t.Fatal("Expected error from failed create()")
+	}
+	if err := sessions.StartSession("a", new(testSession)); err != nil {
+		t.Errorf("Key not released after failed create(): %v", err)
+	}
+
+	// Deleted while starting: stopped as soon as it is running
+	session := new(testSession)
+	err = sessions.NewSession("b", func() (Session, error) {
+		if err := sessions.NewSession("b", nil); err == nil {
+			t.Error("Key of starting session was not reserved")
+		}
+		return session, sessions.DeleteSession("b")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started, cleanups := session.counts(); started != 1 || cleanups != 1 {
+		t.Errorf("Session deleted while starting was started %v times and cleaned up %v times, expected 1 and 1", started, cleanups)
+	}
+}
+
+func TestSessionLeases(t *testing.T) {
+	// Sessions are checked for expiry every LeaseCheckInterval
+	for _, test := range []struct {
+		name    string
+		lease   time.Duration
+		renew   time.Duration // Renew with this interval while waiting, 0 for no renewals
+		wait    time.Duration
+		expired bool
+	}{
+		{"no lease", 0, 0, 2 * LeaseCheckInterval, false},
+		{"expired", LeaseCheckInterval / 4, 0, 2 * LeaseCheckInterval, true},
+		{"renewed", LeaseCheckInterval, LeaseCheckInterval / 4, 3 * LeaseCheckInterval, false},
+		{"not expired yet", 10 * LeaseCheckInterval, 0, 2 * LeaseCheckInterval, false},
+	} {
+		sessions := NewSessionManager()
+		expired := make(chan interface{}, 1)
+		sessions.ExpiredCallback = func(key interface{}, err error) {
+			expired <- key
+		}
+		session := new(testSession)
+		if err := sessions.StartSession("a", session); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		base := sessions.sessions["a"]
+		if err := sessions.SetLease("a", test.lease); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		deadline := time.Now().Add(test.wait)
+		for time.Now().Before(deadline) {
+			if test.renew > 0 {
+				time.Sleep(test.renew)
+				if err := sessions.Renew("a"); err != nil {
+					t.Errorf("%v: error renewing: %v", test.name, err)
+					break
+				}
+			} else {
+				time.Sleep(test.wait)
+			}
+		}
+		select {
+		case key := <-expired:
+			if !test.expired {
+				t.Errorf("%v: session %v expired unexpectedly", test.name, key)
+			}
+			if info := base.StopInfo(); info.Reason != StopLeaseExpired {
+				t.Errorf("%v: stop reason %v, expected %v", test.name, info.Reason, StopLeaseExpired)
+			}
+			if _, cleanups := session.counts(); cleanups != 1 {
+				t.Errorf("%v: expired session cleaned up %v times", test.name, cleanups)
+			}
+			if err := sessions.Renew("a"); err == nil {
+				t.Errorf("%v: expired session could be renewed", test.name)
+			}
+		default:
+			if test.expired {
+				t.Errorf("%v: session did not expire", test.name)
+			}
+		}
+		_ = sessions.DeleteSessions()
+	}
+}
+
+// Keeps the SessionBase, to inspect it after the session was deleted.
+type baseSession struct {
+	testSession
+	base *SessionBase
+}
+
+func (session *baseSession) Start(base *SessionBase) {
+	session.testSession.Start(base)
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.base = base
+}
+
+func TestStopReasons(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		stop   func(sessions *SessionManager, base *SessionBase)
+		reason StopReason
+	}{
+		{"stopped", func(sessions *SessionManager, base *SessionBase) {
+			_ = sessions.StopSession("a", StopFailoverFailed)
+		}, StopFailoverFailed},
+		{"deleted", func(sessions *SessionManager, base *SessionBase) {
+			_ = sessions.DeleteSession("a")
+		}, StopClientRequest},
+		{"all deleted", func(sessions *SessionManager, base *SessionBase) {
+			_ = sessions.DeleteSessions()
+		}, StopServerShutdown},
+		{"first reason kept", func(sessions *SessionManager, base *SessionBase) {
+			_ = sessions.StopSession("a", StopMigrated)
+			_ = sessions.DeleteSession("a")
+		}, StopMigrated},
+		{"stopped without reason", func(sessions *SessionManager, base *SessionBase) {
+			base.Stop()
+		}, StopClientRequest},
+		{"stopped for reason", func(sessions *SessionManager, base *SessionBase) {
+			base.StopFor(StopLeaseExpired)
+			base.StopFor(StopTaskFailed)
+		}, StopLeaseExpired},
+	} {
+		sessions := NewSessionManager()
+		session := new(baseSession)
+		if err := sessions.StartSession("a", session); err != nil {
+			t.Fatal(err)
+		}
+		session.lock.Lock()
+		base := session.base
+		session.lock.Unlock()
+		if info := base.StopInfo(); !info.Time.IsZero() || info.String() != "not stopped" {
+			t.Errorf("%v: running session has stop info: %v", test.name, info)
+		}
+		before := time.Now()
+		test.stop(sessions, base)
+		info := base.StopInfo()
+		if info.Reason != test.reason {
+			t.Errorf("%v: stop reason %v, expected %v", test.name, info.Reason, test.reason)
+		}
+		if info.Time.Before(before) || info.Time.After(time.Now()) {
+			t.Errorf("%v: unexpected stop time %v", test.name, info.Time)
+		}
+		if info.Task != nil || info.Err != nil {
+			t.Errorf("%v: unexpected task in stop info: %v", test.name, info)
+		}
+	}
+}
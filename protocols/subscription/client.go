@@ -0,0 +1,50 @@
+package subscription
+
+import "github.com/antongulenko/RTP/protocols"
+
+type Client struct {
+	protocols.Client
+}
+
+func NewClient(client protocols.Client) (*Client, error) {
+	if err := client.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+func NewClientFor(server_addr string) (*Client, error) {
+	client, err := protocols.NewMiniClientFor(server_addr, Protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{client}, nil
+}
+
+// The receiver must be registered with RegisterEventHandler.
+// An empty sessionClient subscribes to events of all sessions.
+// No types subscribes to all event types.
+func (client *Client) Subscribe(receiver *protocols.Server, sessionClient string, types ...EventType) error {
+	val := &Subscribe{
+		Receiver: receiver.LocalAddr().String(),
+		Client:   sessionClient,
+		Types:    types,
+	}
+	reply, err := client.SendRequest(codeSubscribe, val)
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
+
+func (client *Client) Unsubscribe(receiver *protocols.Server, sessionClient string) error {
+	val := &Unsubscribe{
+		Receiver: receiver.LocalAddr().String(),
+		Client:   sessionClient,
+	}
+	reply, err := client.SendRequest(codeUnsubscribe, val)
+	if err != nil {
+		return err
+	}
+	return client.CheckReply(reply)
+}
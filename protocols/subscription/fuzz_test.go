@@ -0,0 +1,16 @@
+package subscription
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func FuzzSubscription(f *testing.F) {
+	protocols.FuzzPackets(f, MiniProtocol, []*protocols.Packet{
+		{Code: codeSubscribe, Val: &Subscribe{Receiver: "127.0.0.1:9100", Types: []EventType{EventFailover}}},
+		{Code: codeUnsubscribe, Val: &Unsubscribe{Receiver: "127.0.0.1:9100"}},
+		{Code: codeEvent, Val: &Event{Type: EventServerOffline, Time: time.Now(), Source: "127.0.0.1:7779", Message: "down"}},
+	})
+}
@@ -0,0 +1,130 @@
+package subscription
+
+// Protocol for subscribing to events of a server. The server pushes matching
+// events to a server run by the subscriber, similar to heartbeats.
+
+import (
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+var (
+	Protocol     *subscriptionProtocol
+	MiniProtocol = protocols.NewMiniProtocol(Protocol)
+)
+
+// ======================= Packets =======================
+
+const (
+	codeSubscribe = protocols.Code(21 + iota)
+	codeUnsubscribe
+	codeEvent
+)
+
+type EventType int
+
+const (
+	EventSessionStarted = EventType(iota)
+	EventSessionStopped
+	EventFailover
+	EventFailoverFailed
+	EventServerOnline
+	EventServerOffline
+)
+
+var eventTypeNames = map[EventType]string{
+	EventSessionStarted: "session started",
+	EventSessionStopped: "session stopped",
+	EventFailover:       "failover",
+	EventFailoverFailed: "failover failed",
+	EventServerOnline:   "server online",
+	EventServerOffline:  "server offline",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+type Subscribe struct {
+	Receiver string
+	Client   string      // Only events concerning this client. Empty for all events.
+	Types    []EventType // Empty for all event types.
+}
+
+type Unsubscribe struct {
+	Receiver string
+	Client   string
+}
+
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Source  string // The server publishing the event
+	Client  string // The client of the affected session, if any
+	Server  string // The affected backend server, if any
+	Message string
+}
+
+func (event *Event) String() string {
+	str := fmt.Sprintf("%v from %v", event.Type, event.Source)
+	if event.Client != "" {
+		str += fmt.Sprintf(", client %v", event.Client)
+	}
+	if event.Server != "" {
+		str += fmt.Sprintf(", server %v", event.Server)
+	}
+	if event.Message != "" {
+		str += ": " + event.Message
+	}
+	return str
+}
+
+// ======================= Protocol =======================
+
+type subscriptionProtocol struct {
+}
+
+func (*subscriptionProtocol) Name() string {
+	return "Subscription"
+}
+
+func (proto *subscriptionProtocol) Decoders() protocols.DecoderMap {
+	return protocols.DecoderMap{
+		codeSubscribe:   proto.decodeSubscribe,
+		codeUnsubscribe: proto.decodeUnsubscribe,
+		codeEvent:       proto.decodeEvent,
+	}
+}
+
+func (proto *subscriptionProtocol) decodeSubscribe(decoder *gob.Decoder) (interface{}, error) {
+	var val Subscribe
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Subscribe value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *subscriptionProtocol) decodeUnsubscribe(decoder *gob.Decoder) (interface{}, error) {
+	var val Unsubscribe
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Unsubscribe value: %v", err)
+	}
+	return &val, nil
+}
+
+func (proto *subscriptionProtocol) decodeEvent(decoder *gob.Decoder) (interface{}, error) {
+	var val Event
+	err := decoder.Decode(&val)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding Event value: %v", err)
+	}
+	return &val, nil
+}
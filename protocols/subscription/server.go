@@ -0,0 +1,216 @@
+package subscription
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+const (
+	eventBuffer         = 32
+	eventSendTimeout    = 500 * time.Millisecond
+	maxSubscriberErrors = 3
+)
+
+// ======================= Receiving events =======================
+
+type Handler interface {
+	EventReceived(event *Event)
+}
+
+type HandlerFunc func(event *Event)
+
+func (f HandlerFunc) EventReceived(event *Event) {
+	f(event)
+}
+
+func RegisterEventHandler(server *protocols.Server, handler Handler) error {
+	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return err
+	}
+	return server.RegisterHandlers(protocols.ServerHandlerMap{
+		codeEvent: func(packet *protocols.Packet) *protocols.Packet {
+			val := packet.Val
+			if event, ok := val.(*Event); ok {
+				handler.EventReceived(event)
+			} else {
+				server.LogError(fmt.Errorf("Event received with wrong payload: (%T) %v", val, val))
+			}
+			return nil
+		},
+	})
+}
+
+// ======================= Publishing events =======================
+
+type Publisher struct {
+	*protocols.Server
+	lock        sync.Mutex
+	subscribers map[subscriberKey]*subscriber
+}
+
+type subscriberKey struct {
+	receiver string
+	client   string
+}
+
+type subscriber struct {
+	key    subscriberKey
+	types  map[EventType]bool
+	client protocols.Client
+	events chan *Event
+}
+
+func RegisterPublisher(server *protocols.Server) (*Publisher, error) {
+	if err := server.Protocol().CheckIncludesFragment(Protocol.Name()); err != nil {
+		return nil, err
+	}
+	publisher := &Publisher{
+		Server:      server,
+		subscribers: make(map[subscriberKey]*subscriber),
+	}
+	if err := server.RegisterHandlers(protocols.ServerHandlerMap{
+		codeSubscribe:   publisher.handleSubscribe,
+		codeUnsubscribe: publisher.handleUnsubscribe,
+	}); err != nil {
+		return nil, err
+	}
+	server.RegisterStopHandler(publisher.stopServer)
+	return publisher, nil
+}
+
+func (publisher *Publisher) stopServer() {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	for _, sub := range publisher.subscribers {
+		publisher.removeSubscriber(sub)
+	}
+}
+
+func (publisher *Publisher) handleSubscribe(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*Subscribe); ok {
+		return publisher.ReplyCheck(publisher.subscribe(desc))
+	} else {
+		return publisher.ReplyError(fmt.Errorf("Illegal value for Subscribe: %v", packet.Val))
+	}
+}
+
+func (publisher *Publisher) handleUnsubscribe(packet *protocols.Packet) *protocols.Packet {
+	val := packet.Val
+	if desc, ok := val.(*Unsubscribe); ok {
+		return publisher.ReplyCheck(publisher.unsubscribe(desc))
+	} else {
+		return publisher.ReplyError(fmt.Errorf("Illegal value for Unsubscribe: %v", packet.Val))
+	}
+}
+
+// The client is created without holding the lock, resolving the receiver can take a while.
+func (publisher *Publisher) subscribe(desc *Subscribe) error {
+	key := subscriberKey{desc.Receiver, desc.Client}
+	types := make(map[EventType]bool)
+	for _, t := range desc.Types {
+		types[t] = true
+	}
+	client, err := protocols.NewClientFor(desc.Receiver, MiniProtocol)
+	if err != nil {
+		return err
+	}
+	client.SetTimeout(eventSendTimeout)
+
+	publisher.lock.Lock()
+	existing, ok := publisher.subscribers[key]
+	if ok {
+		// Only update the event types
+		existing.types = types
+	} else {
+		sub := &subscriber{
+			key:    key,
+			types:  types,
+			client: client,
+			events: make(chan *Event, eventBuffer),
+		}
+		publisher.subscribers[key] = sub
+		go publisher.sendEvents(sub)
+	}
+	publisher.lock.Unlock()
+	if ok {
+		_ = client.Close() // Drop error, the client was not used
+	}
+	return nil
+}
+
+func (publisher *Publisher) unsubscribe(desc *Unsubscribe) error {
+	publisher.lock.Lock()
+	defer publisher.lock.Unlock()
+	key := subscriberKey{desc.Receiver, desc.Client}
+	sub, ok := publisher.subscribers[key]
+	if !ok {
+		return fmt.Errorf("No subscription for %v (client %v)", desc.Receiver, desc.Client)
+	}
+	publisher.removeSubscriber(sub)
+	return nil
+}
+
+// publisher.lock must be held
+func (publisher *Publisher) removeSubscriber(sub *subscriber) {
+	if publisher.subscribers[sub.key] == sub {
+		delete(publisher.subscribers, sub.key)
+		close(sub.events)
+	}
+}
+
+func (sub *subscriber) matches(event *Event) bool {
+	if sub.key.client != "" && sub.key.client != event.Client {
+		return false
+	}
+	return len(sub.types) == 0 || sub.types[event.Type]
+}
+
+// Publish the event to all matching subscribers. Does not block.
+func (publisher *Publisher) Publish(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Source == "" {
+		event.Source = publisher.LocalAddr().String()
+	}
+	var dropped []string
+	publisher.lock.Lock()
+	for _, sub := range publisher.subscribers {
+		if sub.matches(event) {
+			select {
+			case sub.events <- event:
+			default:
+				dropped = append(dropped, sub.key.receiver)
+			}
+		}
+	}
+	publisher.lock.Unlock()
+	for _, receiver := range dropped {
+		publisher.LogError(fmt.Errorf("Dropped event for subscriber %v: %v", receiver, event))
+	}
+}
+
+func (publisher *Publisher) sendEvents(sub *subscriber) {
+	var errors int
+	for event := range sub.events {
+		err := sub.client.Send(codeEvent, event)
+		sub.client.ResetConnection()
+		if err == nil {
+			errors = 0
+			continue
+		}
+		errors++
+		publisher.LogError(fmt.Errorf("Error sending event to %v: %v", sub.key.receiver, err))
+		if errors >= maxSubscriberErrors {
+			publisher.LogError(fmt.Errorf("Removing subscriber %v after %v errors", sub.key.receiver, errors))
+			publisher.lock.Lock()
+			publisher.removeSubscriber(sub)
+			publisher.lock.Unlock()
+		}
+	}
+	_ = sub.client.Close() // Drop error
+}
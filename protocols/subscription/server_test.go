@@ -0,0 +1,87 @@
+package subscription
+
+import (
+	"testing"
+
+	"github.com/antongulenko/RTP/protocols"
+)
+
+func TestSubscriberMatches(t *testing.T) {
+	for _, test := range []struct {
+		client  string
+		types   []EventType
+		event   Event
+		matches bool
+	}{
+		{"", nil, Event{Type: EventFailover, Client: "a"}, true},
+		{"", nil, Event{Type: EventServerOffline}, true},
+		{"a", nil, Event{Type: EventFailover, Client: "a"}, true},
+		{"a", nil, Event{Type: EventFailover, Client: "b"}, false},
+		{"a", nil, Event{Type: EventServerOffline}, false},
+		{"", []EventType{EventFailover, EventFailoverFailed}, Event{Type: EventFailoverFailed}, true},
+		{"", []EventType{EventFailover, EventFailoverFailed}, Event{Type: EventSessionStarted}, false},
+		{"a", []EventType{EventSessionStopped}, Event{Type: EventSessionStopped, Client: "a"}, true},
+		{"a", []EventType{EventSessionStopped}, Event{Type: EventSessionStopped, Client: "b"}, false},
+	} {
+		sub := &subscriber{key: subscriberKey{client: test.client}, types: make(map[EventType]bool)}
+		for _, t := range test.types {
+			sub.types[t] = true
+		}
+		if matches := sub.matches(&test.event); matches != test.matches {
+			t.Errorf("Subscriber for client %q and types %v: matches(%v) = %v, expected %v",
+				test.client, test.types, &test.event, matches, test.matches)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	server, err := protocols.NewServer("127.0.0.1:0", MiniProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher, err := RegisterPublisher(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := "127.0.0.1:17011", "127.0.0.1:17012"
+	for i, test := range []struct {
+		subscribe   *Subscribe
+		unsubscribe *Unsubscribe
+		err         bool
+		subscribers int
+	}{
+		{subscribe: &Subscribe{Receiver: a}, subscribers: 1},
+		{subscribe: &Subscribe{Receiver: a, Client: "x"}, subscribers: 2},
+		{subscribe: &Subscribe{Receiver: b, Types: []EventType{EventFailover}}, subscribers: 3},
+		{subscribe: &Subscribe{Receiver: b, Types: []EventType{EventServerOnline}}, subscribers: 3}, // Updates the types
+		{unsubscribe: &Unsubscribe{Receiver: a}, subscribers: 2},
+		{unsubscribe: &Unsubscribe{Receiver: a}, err: true, subscribers: 2},
+		{unsubscribe: &Unsubscribe{Receiver: b, Client: "x"}, err: true, subscribers: 2},
+		{unsubscribe: &Unsubscribe{Receiver: a, Client: "x"}, subscribers: 1},
+	} {
+		if test.subscribe != nil {
+			err = publisher.subscribe(test.subscribe)
+		} else {
+			err = publisher.unsubscribe(test.unsubscribe)
+		}
+		if (err != nil) != test.err {
+			t.Errorf("Step %v: unexpected error result: %v", i, err)
+		}
+		publisher.lock.Lock()
+		num := len(publisher.subscribers)
+		publisher.lock.Unlock()
+		if num != test.subscribers {
+			t.Errorf("Step %v: %v subscribers, expected %v", i, num, test.subscribers)
+		}
+	}
+	publisher.lock.Lock()
+	sub := publisher.subscribers[subscriberKey{b, ""}]
+	publisher.lock.Unlock()
+	if sub == nil || len(sub.types) != 1 || !sub.types[EventServerOnline] {
+		t.Errorf("Event types of the subscriber were not updated: %v", sub)
+	}
+	server.Stop()
+	if len(publisher.subscribers) != 0 {
+		t.Errorf("%v subscribers left after stopping the server", len(publisher.subscribers))
+	}
+}
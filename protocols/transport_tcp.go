@@ -1,20 +1,32 @@
 package protocols
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"time"
 )
 
 // =============================== TCP Transport ===============================
 
+// Packets on a TCP connection are framed by a 4 byte big endian length prefix,
+// because a single Read can return only a part of a packet, or several packets.
+const tcp_frame_header = 4
+
 type tcpTransportProvider struct {
 	net        string
 	bufferSize int
 }
 
 func TcpTransport() TransportProvider {
-	return &tcpTransportProvider{"tcp4", 512}
+	// Must hold the largest packets, e.g. responses of the SessionQuery fragment
+	return TcpTransportB(32768)
+}
+
+// bufferSize is the largest packet accepted by Receive.
+func TcpTransportB(bufferSize int) TransportProvider {
+	return &tcpTransportProvider{"tcp4", bufferSize}
 }
 
 func (trans *tcpTransportProvider) String() string {
@@ -57,7 +69,7 @@ func (trans *tcpTransportProvider) Listen(local Addr, protocol Protocol) (Listen
 	}
 	localTcp, ok := listener.Addr().(*net.TCPAddr)
 	if !ok {
-		return nil, fmt.Errorf("Could not convert Listen addr to *net.TCPAddr", listener.Addr())
+		return nil, fmt.Errorf("Could not convert Listen addr to *net.TCPAddr: %v", listener.Addr())
 	}
 	return &tcpListener{
 		trans:    trans,
@@ -201,9 +213,8 @@ func (conn *tcpConn) doSend(packet *Packet) error {
 	if err != nil {
 		return err
 	}
-	_, err = conn.tcp.Write(b)
-	// TODO check if everything was written?
-	return err
+	capturePacket(PacketSent, conn.trans.net, conn.protocol, packet, nil, b, &conn.local, &conn.remote)
+	return WriteTcpFrame(conn.tcp, b)
 }
 
 func (conn *tcpConn) Receive(timeout time.Duration) (*Packet, error) {
@@ -213,14 +224,17 @@ func (conn *tcpConn) Receive(timeout time.Duration) (*Packet, error) {
 			return nil, err
 		}
 	}
-	buf := make([]byte, conn.trans.bufferSize)
-	n, err := conn.tcp.Read(buf)
-	// TODO check if data did not fit in buffer?
+	buf, err := ReadTcpFrame(conn.tcp, conn.trans.bufferSize)
 	if err != nil {
 		return nil, fmt.Errorf("Error receiving: %v", err)
 	}
-	buf = buf[:n]
-	return Marshaller.UnmarshalPacket(buf, conn.protocol)
+	// The raw frame is captured even if it cannot be decoded, so that it can be replayed
+	packet, err := Marshaller.UnmarshalPacket(buf, conn.protocol)
+	capturePacket(PacketReceived, conn.trans.net, conn.protocol, packet, err, buf, &conn.remote, &conn.local)
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
 }
 
 func (conn *tcpConn) timeout(timeout time.Duration) error {
@@ -231,3 +245,29 @@ func (conn *tcpConn) resetTimeout() {
 	var zeroTime time.Time
 	_ = conn.tcp.SetDeadline(zeroTime)
 }
+
+// Write data with the length prefix used by the TCP transport.
+func WriteTcpFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, tcp_frame_header+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[tcp_frame_header:], data)
+	_, err := w.Write(frame) // Write returns an error if not everything was written
+	return err
+}
+
+// Read one packet written by WriteTcpFrame. Packets larger than maxSize are rejected.
+func ReadTcpFrame(r io.Reader, maxSize int) ([]byte, error) {
+	var header [tcp_frame_header]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("Packet of %v bytes exceeds buffer size %v", size, maxSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
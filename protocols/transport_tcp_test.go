@@ -0,0 +1,61 @@
+package protocols
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTcpFrames(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		size    int
+		maxSize int
+		err     bool
+	}{
+		{"empty", 0, 16, false},
+		{"small", 10, 16, false},
+		{"exact", 16, 16, false},
+		{"too large", 17, 16, true},
+		{"larger than a single read", 100000, 200000, false},
+	} {
+		data := make([]byte, test.size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		var buf bytes.Buffer
+		// Two frames back to back, as a stream would deliver them
+		for i := 0; i < 2; i++ {
+			if err := WriteTcpFrame(&buf, data); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			read, err := ReadTcpFrame(&buf, test.maxSize)
+			if test.err {
+				if err == nil {
+					t.Errorf("%v: expected error for frame of %v bytes with maximum %v", test.name, test.size, test.maxSize)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			if !bytes.Equal(read, data) {
+				t.Errorf("%v: frame %v: read %v bytes differing from the %v written bytes", test.name, i, len(read), len(data))
+			}
+		}
+	}
+}
+
+func TestTcpFrameTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteTcpFrame(&buf, []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	frame := buf.Bytes()
+	for _, size := range []int{0, 2, tcp_frame_header, len(frame) - 1} {
+		if _, err := ReadTcpFrame(bytes.NewReader(frame[:size]), 100); err == nil {
+			t.Errorf("No error for frame truncated to %v bytes", size)
+		}
+	}
+}
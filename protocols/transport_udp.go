@@ -297,6 +297,9 @@ func (conn *udpConn) prepareSend(packet *Packet, addr Addr) (udp *udpAddr, b []b
 		return
 	}
 	b, err = Marshaller.MarshalPacket(packet)
+	if err == nil {
+		capturePacket(PacketSent, conn.trans.net, conn.protocol, packet, nil, b, &conn.local, udp)
+	}
 	return
 }
 
@@ -312,12 +315,14 @@ func (conn *udpConn) Receive(timeout time.Duration) (*Packet, error) {
 		return nil, fmt.Errorf("Error receiving: %v", err)
 	}
 	// TODO check if Ack was received...
+	source := &udpAddr{conn.trans, addr}
 	packet, err := Marshaller.UnmarshalPacket(buf, conn.protocol)
+	capturePacket(PacketReceived, conn.trans.net, conn.protocol, packet, err, buf, source, &conn.local)
 	if err != nil {
 		return nil, err
 	}
 	if err := conn.sendAck(addr); err == nil {
-		packet.SourceAddr = &udpAddr{conn.trans, addr}
+		packet.SourceAddr = source
 		return packet, nil
 	} else {
 		return nil, err
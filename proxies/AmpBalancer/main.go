@@ -1,17 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/balancer"
+	"github.com/antongulenko/RTP/protocols/gossip"
 	"github.com/antongulenko/RTP/protocols/heartbeat"
+	"github.com/antongulenko/RTP/protocols/migration"
 	"github.com/antongulenko/RTP/protocols/ping"
+	"github.com/antongulenko/RTP/protocols/session_query"
+	"github.com/antongulenko/RTP/protocols/subscription"
 	"github.com/antongulenko/RTP/proxies/amp_balancer"
 	"github.com/antongulenko/golib"
 )
@@ -21,6 +26,8 @@ var (
 	amp_servers      = []string{"127.0.0.1:7777"}
 	pcp_servers      = []string{"127.0.0.1:7778", "127.0.0.1:7776"}
 	heartbeat_server = "127.0.0.1:0" // Random port
+
+	publisher *subscription.Publisher
 )
 
 func printServerErrors(servername string, server *protocols.Server) {
@@ -29,34 +36,78 @@ func printServerErrors(servername string, server *protocols.Server) {
 	}
 }
 
-func printSessionStarted(session *protocols.PluginSession) {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "Started session for %v (", session.Client)
-	for i, plugin := range session.Plugins {
-		if i != 0 {
-			fmt.Fprintf(&buf, ", ")
-		}
-		fmt.Fprintf(&buf, "%v", plugin)
-	}
-	fmt.Fprintf(&buf, ")")
-	log.Println(buf.String())
+func logSessionEvent(event *protocols.SessionEvent) {
+	log.Println(event)
 }
 
-func printSessionStopped(session *protocols.PluginSession) {
-	log.Printf("Stopped session for %v\n", session.Client)
+// Forward session events to the subscribers of the subscription protocol
+func publishSessionEvent(event *protocols.SessionEvent) {
+	published := &subscription.Event{
+		Time:   event.Time,
+		Client: fmt.Sprint(event.Key),
+	}
+	switch event.Type {
+	case protocols.SessionStartedEvent:
+		published.Type = subscription.EventSessionStarted
+		published.Message = event.Message
+	case protocols.SessionStoppedEvent:
+		published.Type = subscription.EventSessionStopped
+		published.Time = event.Stop.Time
+		published.Message = event.Stop.String()
+	case protocols.SessionFailoverEvent:
+		published.Server = event.From
+		if event.Err == nil {
+			published.Type = subscription.EventFailover
+			published.Message = fmt.Sprintf("Failed over to %v", event.To)
+		} else {
+			published.Type = subscription.EventFailoverFailed
+			published.Message = event.Err.Error()
+		}
+	default:
+		return
+	}
+	publisher.Publish(published)
 }
 
-func stateChangePrinter(key interface{}) {
+func stateChanged(key interface{}) {
 	breaker, ok := key.(protocols.CircuitBreaker)
 	if !ok {
 		log.Printf("Failed to convert %v (%T) to CircuitBreaker\n", key, key)
 		return
 	}
 	err, server := breaker.Error(), breaker.String()
+	availability := breaker.History().Availability * 100
+	event := &subscription.Event{Server: breaker.Server().String()}
 	if err != nil {
-		log.Printf("%s down: %v\n", server, err)
+		log.Printf("%s down (availability %.3f%%): %v\n", server, availability, err)
+		event.Type = subscription.EventServerOffline
+		event.Message = err.Error()
 	} else {
-		log.Printf("%s up\n", server)
+		log.Printf("%s up (availability %.3f%%)\n", server, availability)
+		event.Type = subscription.EventServerOnline
+	}
+	publisher.Publish(event)
+}
+
+// Add backend servers joining the gossip group, remove them when they leave.
+// Failed members stay, their FaultDetectors report them offline.
+func membershipChanged(plugins map[string]*balancer.BalancingPlugin) func(event *gossip.MemberEvent) {
+	return func(event *gossip.MemberEvent) {
+		log.Println(event)
+		plugin, ok := plugins[event.Member.Role]
+		if !ok {
+			return
+		}
+		addr := event.Member.Addr
+		if event.State.Reachable() && (event.New || event.Previous == gossip.MemberLeft) {
+			if err := plugin.AddBackendServer(addr, stateChanged); err != nil {
+				log.Printf("Failed to add %v backend server %v: %v\n", event.Member.Role, addr, err)
+			}
+		} else if event.State == gossip.MemberLeft {
+			if err := plugin.RemoveBackendServer(addr); err != nil {
+				log.Printf("Failed to remove %v backend server %v: %v\n", event.Member.Role, addr, err)
+			}
+		}
 	}
 }
 
@@ -65,6 +116,16 @@ func main() {
 	useHeartbeat := flag.Bool("heartbeat", false, "Use heartbeat-based fault detection instead of active ping-based detection")
 	_heartbeat_frequency := flag.Uint("heartbeat_frequency", 200, "Time between two heartbeats which observers will send (milliseconds)")
 	_heartbeat_timeout := flag.Uint("heartbeat_timeout", 350, "Time between two heartbeats before assuming offline server (milliseconds)")
+	phi_threshold := flag.Float64("phi_threshold", 0, fmt.Sprintf("Use phi-accrual fault detection, considering servers offline at this suspicion level (e.g. %v). Replaces -heartbeat_timeout", protocols.DefaultPhiThreshold))
+	combine_detectors := flag.String("combine_detectors", "", "Use both ping- and heartbeat-based fault detection. Servers are offline when 'any', 'all', or the given number of detectors report it")
+	journal := flag.String("journal", "", "Record sessions to this file and clean up their backend resources after a restart")
+	flag.DurationVar(&amp_balancer.BackendLease, "backend_lease", amp_balancer.BackendLease, "Lease of the sessions on the backend servers. Must be longer than a restart with -journal or a migration with -migrate_to")
+	migrate_to := flag.String("migrate_to", "", "When stopping, hand over running sessions to the balancer at this address instead of stopping them")
+	direct_subnet := flag.String("direct_subnet", "", "Stream directly to clients in this subnet (e.g. 192.168.0.0/16), without PCP proxies")
+	strategy := flag.String("strategy", "least-load", fmt.Sprintf("Strategy for selecting the backend servers of new sessions: %v", strings.Join(balancer.StrategyNames, ", ")))
+	quota := protocols.SessionQuotaFlags()
+	gossipConfig := gossip.NodeFlags()
+	protocols.FaultDetectorFlags()
 	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7779)
 	heartbeat_frequency := time.Duration(*_heartbeat_frequency) * time.Millisecond
 	heartbeat_timeout := time.Duration(*_heartbeat_timeout) * time.Millisecond
@@ -72,59 +133,145 @@ func main() {
 	var detector_factory balancer.FaultDetectorFactory
 	tasks := golib.NewTaskGroup()
 	var heartbeatServer *heartbeat.HeartbeatServer
-	if *useHeartbeat {
+	pingFactory := func(endpoint string) (protocols.FaultDetector, error) {
+		var detector *ping.FaultDetector
+		var err error
+		if *phi_threshold > 0 {
+			detector, err = ping.DialNewPhiFaultDetector(endpoint, *phi_threshold)
+		} else {
+			detector, err = ping.DialNewFaultDetector(endpoint)
+		}
+		if err != nil {
+			return nil, err
+		}
+		detector.Start()
+		return detector, nil
+	}
+	heartbeatFactory := func(endpoint string) (protocols.FaultDetector, error) {
+		if *phi_threshold > 0 {
+			return heartbeatServer.ObservePhi(endpoint, heartbeat_frequency, *phi_threshold)
+		}
+		return heartbeatServer.ObserveServer(endpoint, heartbeat_frequency, heartbeat_timeout)
+	}
+	if *useHeartbeat || *combine_detectors != "" {
 		var err error
 		heartbeatServer, err = heartbeat.NewHeartbeatServer(heartbeat_server)
 		golib.Checkerr(err)
 		go printServerErrors("Heartbeat", heartbeatServer.Server)
 		log.Println("Listening for Heartbeats on", heartbeatServer.LocalAddr())
-		detector_factory = func(endpoint string) (protocols.FaultDetector, error) {
-			return heartbeatServer.ObserveServer(endpoint, heartbeat_frequency, heartbeat_timeout)
-		}
 		tasks.AddNamed("heartbeat", heartbeatServer)
-	} else {
+	}
+	if *combine_detectors != "" {
+		policy, k, err := protocols.ParseCompositePolicy(*combine_detectors)
+		golib.Checkerr(err)
 		detector_factory = func(endpoint string) (protocols.FaultDetector, error) {
-			detector, err := ping.DialNewFaultDetector(endpoint)
+			pingDetector, err := pingFactory(endpoint)
 			if err != nil {
 				return nil, err
 			}
-			detector.Start()
+			heartbeatDetector, err := heartbeatFactory(endpoint)
+			if err != nil {
+				_ = pingDetector.Close()
+				return nil, err
+			}
+			detector, err := protocols.NewCompositeFaultDetector(policy, k, pingDetector, heartbeatDetector)
+			if err != nil {
+				_ = pingDetector.Close()
+				_ = heartbeatDetector.Close()
+				return nil, err
+			}
 			return detector, nil
 		}
+	} else if *useHeartbeat {
+		detector_factory = heartbeatFactory
+	} else {
+		detector_factory = pingFactory
 	}
 
-	protocol, err := protocols.NewProtocol("AMP", amp.Protocol, ping.Protocol, heartbeat.Protocol)
+	protocol, err := protocols.NewProtocol("AMP", amp.Protocol, ping.Protocol, heartbeat.Protocol, subscription.Protocol, session_query.Protocol, migration.Protocol, gossip.Protocol)
 	golib.Checkerr(err)
 	baseServer, err := protocols.NewServer(amp_addr, protocol)
 	golib.Checkerr(err)
 	server, err := amp_balancer.RegisterPluginServer(baseServer)
 	golib.Checkerr(err)
+	publisher, err = subscription.RegisterPublisher(baseServer)
+	golib.Checkerr(err)
+	golib.Checkerr(session_query.RegisterServer(baseServer, server))
+	golib.Checkerr(migration.RegisterServer(baseServer, server))
+	server.Quota = quota
 	tasks.AddNamed("server", server)
+	var node *gossip.Node
+	if gossipConfig.Enabled() {
+		// Backend servers and their failures are learned from the gossip group
+		node, err = gossipConfig.NewNode(baseServer, gossip.RoleBalancer)
+		golib.Checkerr(err)
+		detector_factory = node.DetectorFactory()
+	}
 
 	ampPlugin := amp_balancer.NewAmpBalancingPlugin(detector_factory)
+	ampPlugin.Strategy, err = balancer.NewStrategy(*strategy)
+	golib.Checkerr(err)
 	server.AddPlugin(ampPlugin)
 	pcpPlugin := amp_balancer.NewPcpBalancingPlugin(detector_factory)
+	pcpPlugin.Strategy, err = balancer.NewStrategy(*strategy)
+	golib.Checkerr(err)
 	server.AddPlugin(pcpPlugin)
+	if *direct_subnet != "" {
+		_, subnet, err := net.ParseCIDR(*direct_subnet)
+		golib.Checkerr(err)
+		allPlugins := []protocols.Plugin{ampPlugin, pcpPlugin}
+		directPlugins := []protocols.Plugin{ampPlugin}
+		server.PluginSelector = func(param protocols.SessionParameter) []protocols.Plugin {
+			host, _, err := net.SplitHostPort(param.Client())
+			if ip := net.ParseIP(host); err == nil && ip != nil && subnet.Contains(ip) {
+				return directPlugins
+			}
+			return allPlugins
+		}
+	}
 
-	if *loadBackend {
+	if node != nil {
+		plugins := map[string]*balancer.BalancingPlugin{gossip.RolePcp: pcpPlugin}
+		if *loadBackend {
+			plugins[gossip.RoleLoad] = ampPlugin
+		} else {
+			plugins[gossip.RoleAmp] = ampPlugin
+		}
+		node.Subscribe(membershipChanged(plugins))
+		node.Join(gossipConfig.SeedList())
+	} else if *loadBackend {
 		for _, load := range load_servers {
-			err := ampPlugin.AddBackendServer(load, stateChangePrinter)
+			err := ampPlugin.AddBackendServer(load, stateChanged)
 			golib.Checkerr(err)
 		}
 	} else {
 		for _, amp := range amp_servers {
-			err := ampPlugin.AddBackendServer(amp, stateChangePrinter)
+			err := ampPlugin.AddBackendServer(amp, stateChanged)
 			golib.Checkerr(err)
 		}
 	}
-	for _, pcp := range pcp_servers {
-		err := pcpPlugin.AddBackendServer(pcp, stateChangePrinter)
-		golib.Checkerr(err)
+	if node == nil {
+		for _, pcp := range pcp_servers {
+			err := pcpPlugin.AddBackendServer(pcp, stateChanged)
+			golib.Checkerr(err)
+		}
 	}
 
 	go printServerErrors("Server", server.Server)
-	server.SessionStartedCallback = printSessionStarted
-	server.SessionStoppedCallback = printSessionStopped
+	server.Events.Subscribe(logSessionEvent)
+	server.Events.Subscribe(publishSessionEvent)
+	if *migrate_to != "" {
+		migrationClient, err := migration.NewClientFor(*migrate_to)
+		golib.Checkerr(err)
+		server.MigrateOnStop = migrationClient.MigrateSession
+		log.Println("Sessions will be migrated to", *migrate_to)
+	}
+	if *journal != "" {
+		sessionJournal, err := protocols.OpenSessionJournal(*journal)
+		golib.Checkerr(err)
+		log.Printf("Cleaning up %v orphaned sessions from %v\n", len(sessionJournal.Orphaned()), *journal)
+		golib.Printerr(server.RestoreSessions(sessionJournal))
+	}
 
 	log.Println("Listening to AMP on " + amp_addr)
 	log.Println("Press Ctrl-C to close")
@@ -132,6 +279,7 @@ func main() {
 	if heartbeatServer != nil {
 		tasks.Add(heartbeatServer)
 	}
+	tasks.Add(protocols.StopCaptureTask())
 	tasks.Add(&golib.NoopTask{golib.ExternalInterrupt(), "external interrupt"})
 	tasks.WaitAndExit()
 }
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/amp_control"
+	"github.com/antongulenko/RTP/protocols/gossip"
 	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/ping"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/RTP/proxies"
 	"github.com/antongulenko/golib"
 )
@@ -23,35 +26,46 @@ func printAmpErrors(proxy *proxies.AmpProxy) {
 	}
 }
 
-func printRtspStart(rtsp *golib.Command, px []*proxies.UdpProxy) {
-	log.Printf("Session started. RTSP pid %v, logfile: %v\n", rtsp.Proc.Pid, rtsp.Logfile)
-	log.Println("\t\tProxies started:", px)
-}
-
-func printRtspStop(rtsp *golib.Command, px []*proxies.UdpProxy) {
-	log.Printf("Session stopped. RTSP: %s (logfile: %v)\n", rtsp.StateString(), rtsp.Logfile)
-	log.Println("\t\tProxies stopped:", px)
+func logSessionEvent(event *protocols.SessionEvent) {
+	log.Println(event)
 }
 
 func main() {
 	proxies.UdpProxyFlags()
+	journal := flag.String("journal", "", "Record sessions to this file and clean up their RTSP clients after a restart")
+	quota := protocols.SessionQuotaFlags()
+	gossipConfig := gossip.NodeFlags()
 	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7777)
 
-	proto, err := protocols.NewProtocol("AMP", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol)
+	proto, err := protocols.NewProtocol("AMP", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol, session_query.Protocol, gossip.Protocol)
 	golib.Checkerr(err)
 	server, err := protocols.NewServer(amp_addr, proto)
 	golib.Checkerr(err)
 	proxy, err := proxies.RegisterAmpProxy(server, rtsp_url, local_media_ip)
 	golib.Checkerr(err)
+	golib.Checkerr(session_query.RegisterServer(server, proxy))
+	golib.Checkerr(heartbeat.RegisterMetricsProvider(server, proxy))
+	if gossipConfig.Enabled() {
+		node, err := gossipConfig.NewNode(server, gossip.RoleAmp)
+		golib.Checkerr(err)
+		node.Join(gossipConfig.SeedList())
+	}
 
 	go printAmpErrors(proxy)
-	proxy.StreamStartedCallback = printRtspStart
-	proxy.StreamStoppedCallback = printRtspStop
+	proxy.Events.Subscribe(logSessionEvent)
+	proxy.Quota = quota
+	if *journal != "" {
+		sessionJournal, err := protocols.OpenSessionJournal(*journal)
+		golib.Checkerr(err)
+		log.Printf("Cleaning up %v orphaned sessions from %v\n", len(sessionJournal.Orphaned()), *journal)
+		golib.Printerr(proxy.RestoreSessions(sessionJournal))
+	}
 
 	log.Println("Listening:", server, "Backend URL:", rtsp_url)
 	log.Println("Press Ctrl-D to close")
 	golib.NewTaskGroup(
 		server,
+		protocols.StopCaptureTask(),
 		&golib.NoopTask{golib.StdinClosed(), "stdin closed"},
 	).WaitAndExit()
 }
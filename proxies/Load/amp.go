@@ -2,13 +2,14 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/amp_control"
+	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/load"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/golib"
 )
 
@@ -18,22 +19,29 @@ var (
 
 type LoadServer struct {
 	*protocols.Server
-	sessions protocols.Sessions
+	sessions *protocols.SessionManager
 
 	PayloadSize uint
+	Events      *protocols.SessionEventBus
+	Quota       *protocols.SessionQuota
 }
 
 type loadSession struct {
 	*protocols.SessionBase
-	client *load.Client
-	load   uint64
+	client    *load.Client
+	load      uint64
+	quotaHost string
+	server    *LoadServer
 }
 
 func RegisterLoadServer(server *protocols.Server) (*LoadServer, error) {
 	load := &LoadServer{
-		sessions: make(protocols.Sessions),
+		sessions: protocols.NewSessionManager(),
 		Server:   server,
+		Events:   protocols.NewSessionEventBus(),
+		Quota:    protocols.NewSessionQuota(),
 	}
+	load.sessions.ExpiredCallback = server.LogSessionExpired
 	if err := amp.RegisterServer(server, load); err != nil {
 		return nil, err
 	}
@@ -50,25 +58,45 @@ func (server *LoadServer) StopServer() {
 	}
 }
 
+func (server *LoadServer) Sessions() []*protocols.SessionSnapshot {
+	return server.sessions.Snapshot()
+}
+
+func (server *LoadServer) QuotaUsage() *protocols.QuotaUsage {
+	return server.Quota.Usage()
+}
+
+// Implements heartbeat.MetricsProvider
+func (server *LoadServer) HeartbeatMetrics() *heartbeat.Metrics {
+	return heartbeat.SessionMetrics(server.sessions.Snapshot())
+}
+
 func (server *LoadServer) StartStream(desc *amp.StartStream) error {
-	client := desc.Client()
-	if _, ok := server.sessions[client]; ok {
-		return fmt.Errorf("Session already exists for client %v", client)
+	if err := server.Quota.Admit(desc.ReceiverHost); err != nil {
+		return err
 	}
-	session, err := server.newStreamSession(desc)
+	err := server.sessions.NewSession(desc.Client(), func() (protocols.Session, error) {
+		return server.newStreamSession(desc)
+	})
 	if err != nil {
-		return err
+		server.Quota.Leave(desc.ReceiverHost)
 	}
-	server.sessions.StartSession(client, session)
-	return nil
+	if err == nil && desc.Lease > 0 {
+		err = server.sessions.SetLease(desc.Client(), desc.Lease)
+	}
+	return err
 }
 
 func (server *LoadServer) StopStream(desc *amp.StopStream) error {
 	return server.sessions.DeleteSession(desc.Client())
 }
 
+func (server *LoadServer) KeepAlive(desc *amp.KeepAlive) error {
+	return server.sessions.Renew(desc.Client())
+}
+
 func (server *LoadServer) emergencyStopSession(client string, err error) error {
-	stopErr := server.sessions.StopSession(client)
+	stopErr := server.sessions.StopSession(client, protocols.StopFailoverFailed)
 	if stopErr == nil {
 		return fmt.Errorf("Error redirecting session for %v: %v", client, err)
 	} else {
@@ -79,8 +107,12 @@ func (server *LoadServer) emergencyStopSession(client string, err error) error {
 func (server *LoadServer) RedirectStream(desc *amp_control.RedirectStream) error {
 	oldClient := desc.OldClient.Client()
 	newClient := desc.NewClient.Client()
+	if err := server.moveQuota(oldClient, desc.NewClient.ReceiverHost); err != nil {
+		return err
+	}
 	sessionBase, err := server.sessions.ReKeySession(oldClient, newClient)
 	if err != nil {
+		_ = server.moveQuota(oldClient, desc.OldClient.ReceiverHost) // Drop error
 		return err
 	}
 	session, ok := sessionBase.Session.(*loadSession)
@@ -91,32 +123,55 @@ func (server *LoadServer) RedirectStream(desc *amp_control.RedirectStream) error
 	if err := session.client.SetServer(newClient); err != nil {
 		return server.emergencyStopSession(newClient, err)
 	}
+	session.publish(&protocols.SessionEvent{
+		Type: protocols.SessionRedirectedEvent,
+		From: oldClient,
+		To:   newClient,
+	})
 	return nil
 }
 
-func (proxy *LoadServer) PauseStream(val *amp_control.PauseStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+func (server *LoadServer) moveQuota(client string, newHost string) error {
+	session, err := server.getSession(client)
+	if err != nil {
+		return err
 	}
-	session, ok := sessionBase.Session.(*loadSession)
+	if err := server.Quota.Move(session.quotaHost, newHost); err != nil {
+		return err
+	}
+	session.quotaHost = newHost
+	return nil
+}
+
+func (server *LoadServer) getSession(client string) (*loadSession, error) {
+	session, err := server.sessions.Get(client)
+	if err != nil {
+		return nil, err
+	}
+	loadSession, ok := session.(*loadSession)
 	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+		return nil, fmt.Errorf("Illegal session type %T: %v", session, session)
+	}
+	return loadSession, nil
+}
+
+func (proxy *LoadServer) PauseStream(val *amp_control.PauseStream) error {
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
 	session.client.Pause()
+	session.publish(&protocols.SessionEvent{Type: protocols.SessionPausedEvent})
 	return nil
 }
 
 func (proxy *LoadServer) ResumeStream(val *amp_control.ResumeStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
-	}
-	session, ok := sessionBase.Session.(*loadSession)
-	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
 	session.client.Resume()
+	session.publish(&protocols.SessionEvent{Type: protocols.SessionResumedEvent})
 	return nil
 }
 
@@ -133,11 +188,18 @@ func (server *LoadServer) newStreamSession(desc *amp.StartStream) (*loadSession,
 	}
 	client.SetPayload(server.PayloadSize)
 	return &loadSession{
-		client: client,
-		load:   uint64(load),
+		client:    client,
+		load:      uint64(load),
+		quotaHost: desc.ReceiverHost,
+		server:    server,
 	}, nil
 }
 
+func (session *loadSession) DescribeSession(info *session_query.SessionInfo) {
+	info.Client = session.client.Server().String()
+	info.Stats = append(info.Stats, session_query.NewStatsInfo(session.client.Stats))
+}
+
 func (session *loadSession) Tasks() []golib.Task {
 	return nil
 }
@@ -145,10 +207,23 @@ func (session *loadSession) Tasks() []golib.Task {
 func (session *loadSession) Start(base *protocols.SessionBase) {
 	session.SessionBase = base
 	session.client.StartLoad(session.load)
-	log.Println("Sending Load to", session.client.Server())
+	session.publish(&protocols.SessionEvent{
+		Type:    protocols.SessionStartedEvent,
+		Message: fmt.Sprintf("sending %v bytes/s", session.load),
+	})
 }
 
 func (session *loadSession) Cleanup() {
 	session.CleanupErr = session.client.Close()
-	log.Println("Stopped Load to", session.client.Server())
+	session.server.Quota.Leave(session.quotaHost)
+	session.publish(&protocols.SessionEvent{
+		Type: protocols.SessionStoppedEvent,
+		Stop: session.StopInfo(),
+	})
+}
+
+func (session *loadSession) publish(event *protocols.SessionEvent) {
+	event.Key = session.client.Server().String()
+	event.Session = session
+	session.server.Events.Publish(event)
 }
@@ -7,8 +7,10 @@ import (
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/amp_control"
+	"github.com/antongulenko/RTP/protocols/gossip"
 	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/ping"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/golib"
 )
 
@@ -18,17 +20,32 @@ func printErrors(server *protocols.Server) {
 	}
 }
 
+func logSessionEvent(event *protocols.SessionEvent) {
+	log.Println(event)
+}
+
 func main() {
 	payloadSize := flag.Uint("payload", 0, "Additional payload to append to Load packets")
+	quota := protocols.SessionQuotaFlags()
+	gossipConfig := gossip.NodeFlags()
 	amp_addr := protocols.ParseServerFlags("0.0.0.0", 7770)
 
-	proto, err := protocols.NewProtocol("AMP/Load", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol)
+	proto, err := protocols.NewProtocol("AMP/Load", amp.Protocol, amp_control.Protocol, ping.Protocol, heartbeat.Protocol, session_query.Protocol, gossip.Protocol)
 	golib.Checkerr(err)
 	server, err := protocols.NewServer(amp_addr, proto)
 	golib.Checkerr(err)
 	loadServer, err := RegisterLoadServer(server)
 	golib.Checkerr(err)
 	loadServer.PayloadSize = *payloadSize
+	loadServer.Events.Subscribe(logSessionEvent)
+	loadServer.Quota = quota
+	golib.Checkerr(session_query.RegisterServer(server, loadServer))
+	golib.Checkerr(heartbeat.RegisterMetricsProvider(server, loadServer))
+	if gossipConfig.Enabled() {
+		node, err := gossipConfig.NewNode(server, gossip.RoleLoad)
+		golib.Checkerr(err)
+		node.Join(gossipConfig.SeedList())
+	}
 
 	go printErrors(server)
 
@@ -36,6 +53,7 @@ func main() {
 	log.Println("Press Ctrl-C to close")
 	golib.NewTaskGroup(
 		server,
+		protocols.StopCaptureTask(),
 		&golib.NoopTask{golib.ExternalInterrupt(), "external interrupt"},
 	).WaitAndExit()
 }
@@ -3,12 +3,15 @@ package main
 // Handle PCP requests. Set up and manage UDP proxies accordingly.
 
 import (
+	"flag"
 	"log"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/gossip"
 	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/pcp"
 	"github.com/antongulenko/RTP/protocols/ping"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/RTP/proxies"
 	"github.com/antongulenko/golib"
 )
@@ -19,33 +22,46 @@ func printPcpErrors(proxy *proxies.PcpProxy) {
 	}
 }
 
-func proxyStarted(proxy *proxies.UdpProxy) {
-	log.Println("Started proxy: " + proxy.String())
-}
-
-func proxyStopped(proxy *proxies.UdpProxy) {
-	log.Println("Stopped proxy " + proxy.String())
+func logSessionEvent(event *protocols.SessionEvent) {
+	log.Println(event)
 }
 
 func main() {
 	proxies.UdpProxyFlags()
+	journal := flag.String("journal", "", "Record sessions to this file and restore them after a restart")
+	quota := protocols.SessionQuotaFlags()
+	gossipConfig := gossip.NodeFlags()
 	pcp_addr := protocols.ParseServerFlags("0.0.0.0", 7778)
 
-	proto, err := protocols.NewProtocol("PCP", pcp.Protocol, ping.Protocol, heartbeat.Protocol)
+	proto, err := protocols.NewProtocol("PCP", pcp.Protocol, ping.Protocol, heartbeat.Protocol, session_query.Protocol, gossip.Protocol)
 	golib.Checkerr(err)
 	server, err := protocols.NewServer(pcp_addr, proto)
 	golib.Checkerr(err)
 	proxy, err := proxies.RegisterPcpProxy(server)
 	golib.Checkerr(err)
+	golib.Checkerr(session_query.RegisterServer(server, proxy))
+	golib.Checkerr(heartbeat.RegisterMetricsProvider(server, proxy))
+	if gossipConfig.Enabled() {
+		node, err := gossipConfig.NewNode(server, gossip.RolePcp)
+		golib.Checkerr(err)
+		node.Join(gossipConfig.SeedList())
+	}
 
 	go printPcpErrors(proxy)
-	proxy.ProxyStartedCallback = proxyStarted
-	proxy.ProxyStoppedCallback = proxyStopped
+	proxy.Events.Subscribe(logSessionEvent)
+	proxy.Quota = quota
+	if *journal != "" {
+		sessionJournal, err := protocols.OpenSessionJournal(*journal)
+		golib.Checkerr(err)
+		log.Printf("Restoring %v sessions from %v\n", len(sessionJournal.Orphaned()), *journal)
+		golib.Printerr(proxy.RestoreSessions(sessionJournal))
+	}
 
 	log.Println("Listening:", server)
 	log.Println("Press Ctrl-C to close")
 	golib.NewTaskGroup(
 		server,
+		protocols.StopCaptureTask(),
 		&golib.NoopTask{golib.ExternalInterrupt(), "external interrupt"},
 	).WaitAndExit()
 }
@@ -12,6 +12,8 @@ import (
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/amp_control"
+	"github.com/antongulenko/RTP/protocols/heartbeat"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/RTP/rtpClient"
 	"github.com/antongulenko/golib"
 )
@@ -22,25 +24,38 @@ const (
 
 type AmpProxy struct {
 	*protocols.Server
-	sessions protocols.Sessions
+	sessions *protocols.SessionManager
 
 	rtspURL   *url.URL
 	proxyHost string
 
-	StreamStartedCallback func(rtsp *golib.Command, proxies []*UdpProxy)
-	StreamStoppedCallback func(rtsp *golib.Command, proxies []*UdpProxy)
+	Events *protocols.SessionEventBus
+	Quota  *protocols.SessionQuota
 }
 
 type streamSession struct {
 	*protocols.SessionBase
 
-	backend   *golib.Command
-	rtpProxy  *UdpProxy
-	rtcpProxy *UdpProxy
-	port      int
-	mediaFile string
-	client    string
-	proxy     *AmpProxy
+	backend      *golib.Command
+	rtpProxy     *UdpProxy
+	rtcpProxy    *UdpProxy
+	receiverHost string
+	port         int
+	mediaFile    string
+	client       string
+	quotaHost    string // Receiver host counted in the quota of the proxy
+	proxy        *AmpProxy
+}
+
+// Journaled to stop the RTSP client of the stream after a restart
+type streamJournalValue struct {
+	Stream  *amp.StartStream
+	RtspPid int
+	RtpPort int // The port the RTSP client sends to
+}
+
+func init() {
+	protocols.RegisterJournalValue(new(streamJournalValue))
 }
 
 // ampAddr: address to listen on for AMP requests
@@ -63,9 +78,12 @@ func RegisterAmpProxy(server *protocols.Server, rtspURL, localProxyIP string) (*
 	proxy := &AmpProxy{
 		rtspURL:   u,
 		proxyHost: ip.String(),
-		sessions:  make(protocols.Sessions),
+		sessions:  protocols.NewSessionManager(),
 		Server:    server,
+		Events:    protocols.NewSessionEventBus(),
+		Quota:     protocols.NewSessionQuota(),
 	}
+	proxy.sessions.ExpiredCallback = server.LogSessionExpired
 	if err := amp.RegisterServer(server, proxy); err != nil {
 		return nil, err
 	}
@@ -82,26 +100,65 @@ func (proxy *AmpProxy) StopServer() {
 	}
 }
 
+// Clean up the streams that were running when the journal was last used. A stream cannot
+// be continued where it stopped, so the orphaned RTSP client is killed instead of restarting
+// the stream. The client of the stream has to start it again.
+func (proxy *AmpProxy) RestoreSessions(journal *protocols.SessionJournal) error {
+	return proxy.sessions.RestoreSessions(journal, func(key, value interface{}) error {
+		journaled, ok := value.(*streamJournalValue)
+		if !ok {
+			return fmt.Errorf("Illegal journal value for AMP session: (%T) %v", value, value)
+		}
+		mediaURL := proxy.mediaURL(journaled.Stream.MediaFile)
+		return rtpClient.KillRtspClient(journaled.RtspPid, mediaURL.String(), journaled.RtpPort)
+	})
+}
+
+func (proxy *AmpProxy) Sessions() []*protocols.SessionSnapshot {
+	return proxy.sessions.Snapshot()
+}
+
+func (proxy *AmpProxy) QuotaUsage() *protocols.QuotaUsage {
+	return proxy.Quota.Usage()
+}
+
+// Implements heartbeat.MetricsProvider
+func (proxy *AmpProxy) HeartbeatMetrics() *heartbeat.Metrics {
+	return heartbeat.SessionMetrics(proxy.sessions.Snapshot())
+}
+
 func (proxy *AmpProxy) StartStream(desc *amp.StartStream) error {
-	client := desc.Client()
-	if _, ok := proxy.sessions[client]; ok {
-		return fmt.Errorf("Session already exists for client %v", client)
+	err := proxy.startStreamSession(desc.Client(), desc)
+	if err == nil && desc.Lease > 0 {
+		err = proxy.sessions.SetLease(desc.Client(), desc.Lease)
 	}
+	return err
+}
 
-	session, err := proxy.newStreamSession(desc)
-	if err != nil {
+// The quota is left again in streamSession.Cleanup()
+func (proxy *AmpProxy) startStreamSession(key interface{}, desc *amp.StartStream) error {
+	if err := proxy.Quota.Admit(desc.ReceiverHost); err != nil {
 		return err
 	}
-	proxy.sessions.StartSession(client, session)
-	return nil
+	err := proxy.sessions.NewSession(key, func() (protocols.Session, error) {
+		return proxy.newStreamSession(desc)
+	})
+	if err != nil {
+		proxy.Quota.Leave(desc.ReceiverHost)
+	}
+	return err
 }
 
 func (proxy *AmpProxy) StopStream(desc *amp.StopStream) error {
 	return proxy.sessions.DeleteSession(desc.Client())
 }
 
+func (proxy *AmpProxy) KeepAlive(desc *amp.KeepAlive) error {
+	return proxy.sessions.Renew(desc.Client())
+}
+
 func (proxy *AmpProxy) emergencyStopSession(client string, err error) error {
-	stopErr := proxy.sessions.StopSession(client)
+	stopErr := proxy.sessions.StopSession(client, protocols.StopFailoverFailed)
 	if stopErr == nil {
 		return fmt.Errorf("Error redirecting session for %v: %v", client, err)
 	} else {
@@ -112,8 +169,12 @@ func (proxy *AmpProxy) emergencyStopSession(client string, err error) error {
 func (proxy *AmpProxy) RedirectStream(desc *amp_control.RedirectStream) error {
 	oldClient := desc.OldClient.Client()
 	newClient := desc.NewClient.Client()
+	if err := proxy.moveQuota(oldClient, desc.NewClient.ReceiverHost); err != nil {
+		return err
+	}
 	sessionBase, err := proxy.sessions.ReKeySession(oldClient, newClient)
 	if err != nil {
+		_ = proxy.moveQuota(oldClient, desc.OldClient.ReceiverHost) // Drop error
 		return err
 	}
 	session, ok := sessionBase.Session.(*streamSession)
@@ -131,34 +192,60 @@ func (proxy *AmpProxy) RedirectStream(desc *amp_control.RedirectStream) error {
 	if err != nil {
 		return proxy.emergencyStopSession(newClient, err)
 	}
+	session.receiverHost = desc.NewClient.ReceiverHost
+	session.port = desc.NewClient.Port
+	session.client = newClient
+	session.publish(&protocols.SessionEvent{
+		Type: protocols.SessionRedirectedEvent,
+		From: oldClient,
+		To:   newClient,
+	})
+	return proxy.sessions.UpdateJournal(newClient)
+}
+
+func (proxy *AmpProxy) moveQuota(client string, newHost string) error {
+	session, err := proxy.getSession(client)
+	if err != nil {
+		return err
+	}
+	if err := proxy.Quota.Move(session.quotaHost, newHost); err != nil {
+		return err
+	}
+	session.quotaHost = newHost
 	return nil
 }
 
-func (proxy *AmpProxy) PauseStream(val *amp_control.PauseStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
+func (proxy *AmpProxy) getSession(client string) (*streamSession, error) {
+	session, err := proxy.sessions.Get(client)
+	if err != nil {
+		return nil, err
 	}
-	session, ok := sessionBase.Session.(*streamSession)
+	streamSession, ok := session.(*streamSession)
 	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+		return nil, fmt.Errorf("Illegal session type %T: %v", session, session)
+	}
+	return streamSession, nil
+}
+
+func (proxy *AmpProxy) PauseStream(val *amp_control.PauseStream) error {
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
 	session.rtpProxy.PauseWrite()
 	session.rtcpProxy.PauseWrite()
+	session.publish(&protocols.SessionEvent{Type: protocols.SessionPausedEvent})
 	return nil
 }
 
 func (proxy *AmpProxy) ResumeStream(val *amp_control.ResumeStream) error {
-	sessionBase, ok := proxy.sessions[val.Client()]
-	if !ok {
-		return fmt.Errorf("Session not found exists for client %v", val.Client())
-	}
-	session, ok := sessionBase.Session.(*streamSession)
-	if !ok { // Should never happen
-		return fmt.Errorf("Illegal session type %T: %v", sessionBase, sessionBase)
+	session, err := proxy.getSession(val.Client())
+	if err != nil {
+		return err
 	}
 	session.rtpProxy.ResumeWrite()
 	session.rtcpProxy.ResumeWrite()
+	session.publish(&protocols.SessionEvent{Type: protocols.SessionResumedEvent})
 	return nil
 }
 
@@ -173,7 +260,7 @@ func (proxy *AmpProxy) newStreamSession(desc *amp.StartStream) (*streamSession,
 	rtcpProxy.OnError = proxyOnError
 	rtpPort := rtpProxy.listenAddr.Port
 
-	mediaURL := proxy.rtspURL.ResolveReference(&url.URL{Path: desc.MediaFile})
+	mediaURL := proxy.mediaURL(desc.MediaFile)
 	logfile := fmt.Sprintf("amp-proxy-%v-%v.log", rtpPort, desc.MediaFile)
 	rtsp, err := rtpClient.StartRtspClient(mediaURL.String(), rtpPort, logfile)
 	if err != nil {
@@ -182,20 +269,49 @@ func (proxy *AmpProxy) newStreamSession(desc *amp.StartStream) (*streamSession,
 		return nil, fmt.Errorf("Failed to start RTSP client: %v", err)
 	}
 	return &streamSession{
-		backend:   rtsp,
-		mediaFile: desc.MediaFile,
-		port:      desc.Port,
-		rtpProxy:  rtpProxy,
-		rtcpProxy: rtcpProxy,
-		client:    client,
-		proxy:     proxy,
+		backend:      rtsp,
+		mediaFile:    desc.MediaFile,
+		receiverHost: desc.ReceiverHost,
+		quotaHost:    desc.ReceiverHost,
+		port:         desc.Port,
+		rtpProxy:     rtpProxy,
+		rtcpProxy:    rtcpProxy,
+		client:       client,
+		proxy:        proxy,
 	}, nil
 }
 
+func (proxy *AmpProxy) mediaURL(mediaFile string) *url.URL {
+	return proxy.rtspURL.ResolveReference(&url.URL{Path: mediaFile})
+}
+
 func (session *streamSession) proxies() []*UdpProxy {
 	return []*UdpProxy{session.rtpProxy, session.rtcpProxy}
 }
 
+func (session *streamSession) JournalValue() interface{} {
+	return &streamJournalValue{
+		Stream: &amp.StartStream{
+			ClientDescription: amp.ClientDescription{
+				ReceiverHost: session.receiverHost,
+				Port:         session.port,
+			},
+			MediaFile: session.mediaFile,
+		},
+		RtspPid: session.backend.Proc.Pid,
+		RtpPort: session.rtpProxy.listenAddr.Port,
+	}
+}
+
+func (session *streamSession) DescribeSession(info *session_query.SessionInfo) {
+	info.Client = session.client
+	info.Servers = append(info.Servers, session.proxy.rtspURL.Host)
+	for _, p := range session.proxies() {
+		info.Ports = append(info.Ports, p.listenAddr.Port)
+		info.Stats = append(info.Stats, session_query.NewStatsInfo(p.Stats))
+	}
+}
+
 func (session *streamSession) Tasks() []golib.Task {
 	errors1 := session.rtpProxy.WriteErrors()
 	errors2 := session.rtcpProxy.WriteErrors()
@@ -215,11 +331,24 @@ func (session *streamSession) Tasks() []golib.Task {
 	}
 }
 
+func (session *streamSession) TaskError(task golib.Task) error {
+	for _, p := range session.proxies() {
+		if task == golib.Task(p) {
+			return p.Err
+		}
+	}
+	if task == golib.Task(session.backend) && !session.backend.Success() {
+		return fmt.Errorf("%s", session.backend.StateString())
+	}
+	return nil
+}
+
 func (session *streamSession) Start(base *protocols.SessionBase) {
 	session.SessionBase = base
-	if session.proxy.StreamStartedCallback != nil {
-		session.proxy.StreamStartedCallback(session.backend, session.proxies())
-	}
+	session.publish(&protocols.SessionEvent{
+		Type:    protocols.SessionStartedEvent,
+		Message: fmt.Sprintf("RTSP pid %v, logfile: %v, proxies: %v", session.backend.Proc.Pid, session.backend.Logfile, session.proxies()),
+	})
 }
 
 func (session *streamSession) Cleanup() {
@@ -233,7 +362,16 @@ func (session *streamSession) Cleanup() {
 		errors = append(errors, fmt.Errorf("%s", session.backend.StateString()))
 	}
 	session.CleanupErr = errors.NilOrError()
-	if session.proxy.StreamStoppedCallback != nil {
-		session.proxy.StreamStoppedCallback(session.backend, session.proxies())
-	}
+	session.proxy.Quota.Leave(session.quotaHost)
+	session.publish(&protocols.SessionEvent{
+		Type:    protocols.SessionStoppedEvent,
+		Stop:    session.StopInfo(),
+		Message: fmt.Sprintf("RTSP: %s, logfile: %v, proxies: %v", session.backend.StateString(), session.backend.Logfile, session.proxies()),
+	})
+}
+
+func (session *streamSession) publish(event *protocols.SessionEvent) {
+	event.Key = session.client
+	event.Session = session
+	session.proxy.Events.Publish(event)
 }
@@ -12,6 +12,15 @@ import (
 type ampBalancingHandler struct {
 }
 
+type ampJournalValue struct {
+	ReceiverHost string
+	ReceiverPort int
+}
+
+func init() {
+	protocols.RegisterJournalValue(new(ampJournalValue))
+}
+
 type ampBalancingSession struct {
 	balancingSession *balancer.BalancingSession
 	client           *amp.Client
@@ -20,6 +29,12 @@ type ampBalancingSession struct {
 	receiverPort     int
 }
 
+type preparedAmpSession struct {
+	session   *ampBalancingSession
+	mediaFile string
+	started   bool
+}
+
 func NewAmpBalancingPlugin(make_detector balancer.FaultDetectorFactory) *balancer.BalancingPlugin {
 	return balancer.NewBalancingPlugin(new(ampBalancingHandler), make_detector)
 }
@@ -36,38 +51,93 @@ func (handler *ampBalancingHandler) Protocol() protocols.Protocol {
 	return amp.MiniProtocol
 }
 
-func (handler *ampBalancingHandler) NewSession(balancerSession *balancer.BalancingSession, param protocols.SessionParameter) (balancer.BalancingSessionHandler, error) {
+// Nothing is reserved on the AMP server, the stream is started when committing.
+func (handler *ampBalancingHandler) PrepareSession(balancerSession *balancer.BalancingSession, param protocols.SessionParameter) (balancer.PreparedBalancingSession, error) {
 	desc, ok := param.(*amp.StartStream)
 	if !ok {
 		return nil, fmt.Errorf("Illegal session parameter type for ampBalancingHandler: %T", param)
 	}
-	breaker := balancerSession.PrimaryServer.Client
-	client, err := amp.NewClient(breaker)
+	session, err := newAmpBalancingSession(balancerSession, desc.ReceiverHost, desc.Port)
 	if err != nil {
 		return nil, err
 	}
-	control_client, err := amp_control.NewClient(breaker)
+	return &preparedAmpSession{
+		session:   session,
+		mediaFile: desc.MediaFile,
+	}, nil
+}
+
+func (handler *ampBalancingHandler) AdoptSession(balancerSession *balancer.BalancingSession, value interface{}) (balancer.BalancingSessionHandler, error) {
+	journaled, ok := value.(*ampJournalValue)
+	if !ok {
+		return nil, fmt.Errorf("Illegal migrated session for ampBalancingHandler: (%T) %v", value, value)
+	}
+	session, err := newAmpBalancingSession(balancerSession, journaled.ReceiverHost, journaled.ReceiverPort)
 	if err != nil {
 		return nil, err
 	}
+	session.client.AdoptStream(session.receiverHost, session.receiverPort)
+	return session, nil
+}
 
-	err = client.StartStream(desc.ReceiverHost, desc.Port, desc.MediaFile)
+func newAmpBalancingSession(balancerSession *balancer.BalancingSession, receiverHost string, receiverPort int) (*ampBalancingSession, error) {
+	breaker := balancerSession.PrimaryServer.Client
+	client, err := amp.NewClient(breaker)
+	if err != nil {
+		return nil, err
+	}
+	client.Lease = BackendLease
+	control_client, err := amp_control.NewClient(breaker)
 	if err != nil {
 		return nil, err
 	}
 	return &ampBalancingSession{
 		client:           client,
 		control_client:   control_client,
-		receiverHost:     desc.ReceiverHost,
-		receiverPort:     desc.Port,
+		receiverHost:     receiverHost,
+		receiverPort:     receiverPort,
 		balancingSession: balancerSession,
 	}, nil
 }
 
+func (prepared *preparedAmpSession) Commit() (balancer.BalancingSessionHandler, error) {
+	// Even if StartStream fails, the stream might have been started remotely
+	prepared.started = true
+	session := prepared.session
+	err := session.client.StartStream(session.receiverHost, session.receiverPort, prepared.mediaFile)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (prepared *preparedAmpSession) Abort() error {
+	if !prepared.started {
+		return nil
+	}
+	return confirmedAbort(prepared.session.StopRemote())
+}
+
+func (handler *ampBalancingHandler) CleanupOrphanedSession(server *balancer.BackendServer, value interface{}) error {
+	journaled, ok := value.(*ampJournalValue)
+	if !ok {
+		return fmt.Errorf("Illegal journal value for ampBalancingHandler: (%T) %v", value, value)
+	}
+	client, err := amp.NewClient(server.Client)
+	if err != nil {
+		return err
+	}
+	return client.StopStream(journaled.ReceiverHost, journaled.ReceiverPort)
+}
+
 func (session *ampBalancingSession) StopRemote() error {
 	return session.client.StopStream(session.receiverHost, session.receiverPort)
 }
 
+func (session *ampBalancingSession) Release() {
+	session.client.ReleaseStream(session.receiverHost, session.receiverPort)
+}
+
 func (session *ampBalancingSession) BackgroundStopRemote() {
 	client := session.client
 	host := session.receiverHost
@@ -80,12 +150,21 @@ func (session *ampBalancingSession) RedirectStream(newHost string, newPort int)
 	if err != nil {
 		return err
 	}
+	session.client.StreamRedirected(session.receiverHost, session.receiverPort, newHost, newPort)
 	session.receiverHost = newHost
 	session.receiverPort = newPort
 	return nil
 }
 
+func (session *ampBalancingSession) JournalValue() interface{} {
+	return &ampJournalValue{
+		ReceiverHost: session.receiverHost,
+		ReceiverPort: session.receiverPort,
+	}
+}
+
 func (session *ampBalancingSession) HandleServerFault() (*balancer.BackendServer, error) {
 	// Fault handling not implemented, just hope that Primary comes back online...
-	return session.balancingSession.PrimaryServer, nil
+	primary, _ := session.balancingSession.Servers()
+	return primary, nil
 }
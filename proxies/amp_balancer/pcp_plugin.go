@@ -7,11 +7,25 @@ import (
 	"github.com/antongulenko/RTP/protocols/amp"
 	"github.com/antongulenko/RTP/protocols/balancer"
 	"github.com/antongulenko/RTP/protocols/pcp"
+	"github.com/antongulenko/RTP/protocols/session_query"
 )
 
 type pcpBalancingHandler struct {
 }
 
+type pcpJournalValue struct {
+	ProxyPort int
+
+	// Needed for adopting migrated sessions
+	ProxyHost    string
+	ReceiverHost string
+	ReceiverPort int
+}
+
+func init() {
+	protocols.RegisterJournalValue(new(pcpJournalValue))
+}
+
 type pcpBalancingSession struct {
 	balancingSession *balancer.BalancingSession
 	client           *pcp.Client
@@ -21,6 +35,10 @@ type pcpBalancingSession struct {
 	proxyPort        int
 }
 
+type preparedPcpSession struct {
+	session *pcpBalancingSession
+}
+
 func NewPcpBalancingPlugin(make_detector balancer.FaultDetectorFactory) *balancer.BalancingPlugin {
 	return balancer.NewBalancingPlugin(new(pcpBalancingHandler), make_detector)
 }
@@ -33,7 +51,7 @@ func (handler *pcpBalancingHandler) Protocol() protocols.Protocol {
 	return pcp.MiniProtocol
 }
 
-func (handler *pcpBalancingHandler) NewSession(balancingSession *balancer.BalancingSession, param protocols.SessionParameter) (balancer.BalancingSessionHandler, error) {
+func (handler *pcpBalancingHandler) PrepareSession(balancingSession *balancer.BalancingSession, param protocols.SessionParameter) (balancer.PreparedBalancingSession, error) {
 	desc, ok := param.(*amp.StartStream)
 	if !ok {
 		return nil, fmt.Errorf("Illegal session parameter type for pcpBalancingHandler: %T", param)
@@ -42,11 +60,12 @@ func (handler *pcpBalancingHandler) NewSession(balancingSession *balancer.Balanc
 	if err != nil {
 		return nil, err
 	}
+	client.Lease = BackendLease
 
 	proxyHost := client.Server().IP().String()
 	// TODO the address for receiving traffic could be different from the protocol-API
 	// Check the address of the sending session plugin..?
-	resp, err := client.StartProxyPair(proxyHost, desc.ReceiverHost, desc.Port, desc.Port+1)
+	resp, err := client.PrepareProxyPair(proxyHost, desc.ReceiverHost, desc.Port, desc.Port+1)
 	if err != nil {
 		return nil, err
 	}
@@ -61,13 +80,63 @@ func (handler *pcpBalancingHandler) NewSession(balancingSession *balancer.Balanc
 	// Make sure the next plugin sends the data to the proxies instead of the actual client
 	desc.ReceiverHost = resp.ProxyHost
 	desc.Port = resp.ProxyPort1
+	return &preparedPcpSession{session}, nil
+}
+
+func (prepared *preparedPcpSession) Commit() (balancer.BalancingSessionHandler, error) {
+	session := prepared.session
+	if err := session.client.CommitProxyPair(session.proxyPort); err != nil {
+		return nil, err
+	}
 	return session, nil
 }
 
+// StopProxyPair releases both prepared and committed proxy pairs.
+func (prepared *preparedPcpSession) Abort() error {
+	return confirmedAbort(prepared.session.StopRemote())
+}
+
+func (handler *pcpBalancingHandler) AdoptSession(balancingSession *balancer.BalancingSession, value interface{}) (balancer.BalancingSessionHandler, error) {
+	journaled, ok := value.(*pcpJournalValue)
+	if !ok {
+		return nil, fmt.Errorf("Illegal migrated session for pcpBalancingHandler: (%T) %v", value, value)
+	}
+	client, err := pcp.NewClient(balancingSession.PrimaryServer.Client)
+	if err != nil {
+		return nil, err
+	}
+	client.Lease = BackendLease
+	client.AdoptProxyPair(journaled.ProxyPort)
+	return &pcpBalancingSession{
+		client:           client,
+		balancingSession: balancingSession,
+		receiverHost:     journaled.ReceiverHost,
+		receiverPort:     journaled.ReceiverPort,
+		proxyHost:        journaled.ProxyHost,
+		proxyPort:        journaled.ProxyPort,
+	}, nil
+}
+
+func (handler *pcpBalancingHandler) CleanupOrphanedSession(server *balancer.BackendServer, value interface{}) error {
+	journaled, ok := value.(*pcpJournalValue)
+	if !ok {
+		return fmt.Errorf("Illegal journal value for pcpBalancingHandler: (%T) %v", value, value)
+	}
+	client, err := pcp.NewClient(server.Client)
+	if err != nil {
+		return err
+	}
+	return client.StopProxyPair(journaled.ProxyPort)
+}
+
 func (session *pcpBalancingSession) StopRemote() error {
 	return session.client.StopProxyPair(session.proxyPort)
 }
 
+func (session *pcpBalancingSession) Release() {
+	session.client.ReleaseProxyPair(session.proxyPort)
+}
+
 func (session *pcpBalancingSession) backgroundStopRemote() {
 	client := session.client
 	port := session.proxyPort
@@ -78,6 +147,19 @@ func (session *pcpBalancingSession) RedirectStream(newHost string, newPort int)
 	return fmt.Errorf("RedirectStream not implemented for pcp balancer plugin")
 }
 
+func (session *pcpBalancingSession) DescribeSession(info *session_query.SessionInfo) {
+	info.Ports = append(info.Ports, session.proxyPort, session.proxyPort+1)
+}
+
+func (session *pcpBalancingSession) JournalValue() interface{} {
+	return &pcpJournalValue{
+		ProxyPort:    session.proxyPort,
+		ProxyHost:    session.proxyHost,
+		ReceiverHost: session.receiverHost,
+		ReceiverPort: session.receiverPort,
+	}
+}
+
 func (session *pcpBalancingSession) HandleServerFault() (*balancer.BackendServer, error) {
 	// Fencing: Stop the original node just to be sure.
 	// TODO more reliable fencing.
@@ -95,14 +177,16 @@ func (session *pcpBalancingSession) HandleServerFault() (*balancer.BackendServer
 	var usedBackup *balancer.BackendServer
 	var pcpBackup *pcp.Client
 	var resp *pcp.StartProxyPairResponse
-	for _, backup := range session.balancingSession.BackupServers {
+	_, backups := session.balancingSession.Servers()
+	for _, backup := range backups {
 		var err error
 		pcpBackup, err = pcp.NewClient(backup.Client)
 		// TODO log errors that prevented a backup server from being used?
 		if err == nil {
 			var err error
+			pcpBackup.Lease = BackendLease
 			proxyHost := pcpBackup.Server().IP().String()
-			// TODO The proxyHost could be different. See the comment above in NewSession.
+			// TODO The proxyHost could be different. See the comment above in PrepareSession.
 			resp, err = pcpBackup.StartProxyPair(proxyHost, session.receiverHost, session.receiverPort, session.receiverPort+1)
 			if err == nil {
 				usedBackup = backup
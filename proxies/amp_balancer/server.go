@@ -1,10 +1,26 @@
 package amp_balancer
 
 import (
+	"time"
+
 	"github.com/antongulenko/RTP/protocols"
 	"github.com/antongulenko/RTP/protocols/amp"
 )
 
+// Lease for sessions started on backend servers. Renewed by the clients in the balancing plugins.
+// Must cover the time a new balancer needs to take over the sessions, i.e. a restart restoring
+// the session journal or a migration to another balancer. Set before starting sessions.
+var BackendLease = 30 * time.Second
+
+// An error reply confirms that the session does not exist on the backend server (anymore).
+// Only transport errors leave the state of the remote session unknown.
+func confirmedAbort(err error) error {
+	if protocols.IsRemoteError(err) {
+		return nil
+	}
+	return err
+}
+
 func RegisterPluginServer(server *protocols.Server) (*protocols.PluginServer, error) {
 	handler := new(ampPluginServerHandler)
 	err := amp.RegisterServer(server, handler)
@@ -20,9 +36,17 @@ type ampPluginServerHandler struct {
 }
 
 func (handler *ampPluginServerHandler) StartStream(desc *amp.StartStream) error {
-	return handler.NewSession(desc)
+	err := handler.NewSession(desc)
+	if err == nil && desc.Lease > 0 {
+		err = handler.SetLease(desc.Client(), desc.Lease)
+	}
+	return err
 }
 
 func (handler *ampPluginServerHandler) StopStream(desc *amp.StopStream) error {
 	return handler.DeleteSession(desc.Client())
 }
+
+func (handler *ampPluginServerHandler) KeepAlive(desc *amp.KeepAlive) error {
+	return handler.RenewSession(desc.Client())
+}
@@ -4,34 +4,79 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/heartbeat"
 	"github.com/antongulenko/RTP/protocols/pcp"
+	"github.com/antongulenko/RTP/protocols/session_query"
 	"github.com/antongulenko/golib"
 )
 
+// Prepared proxy pairs are released if they are not committed within this time.
+var PrepareTimeout = 10 * time.Second
+
+const (
+	// Minimum time the throughput in the heartbeat metrics is averaged over
+	throughput_sample_interval = 1 * time.Second
+)
+
 type PcpProxy struct {
 	*protocols.Server
-	sessions protocols.Sessions
+	sessions *protocols.SessionManager
 
-	ProxyStartedCallback func(proxy *UdpProxy)
-	ProxyStoppedCallback func(proxy *UdpProxy)
+	prepared     map[int]*preparedProxyPair
+	preparedLock sync.Mutex
+
+	Events *protocols.SessionEventBus
+	Quota  *protocols.SessionQuota
+
+	// Throughput sampled by HeartbeatMetrics
+	metricsLock  sync.Mutex
+	metricsBytes uint
+	metricsTime  time.Time
+	metricsRate  float64 // Bytes per second
 }
 
 type udpSession struct {
 	*protocols.SessionBase
 
-	udp   *UdpProxy
-	udp2  *UdpProxy
-	port  int
-	proxy *PcpProxy
+	udp       *UdpProxy
+	udp2      *UdpProxy
+	port      int
+	quotaHost string // Receiver host counted in the quota of the proxy
+	proxy     *PcpProxy
+}
+
+// Journaled to re-create the UDP proxies after a restart
+type udpJournalValue struct {
+	ListenAddr  string
+	TargetAddr  string
+	ListenAddr2 string // Empty if not a proxy pair
+	TargetAddr2 string
+}
+
+func init() {
+	protocols.RegisterJournalValue(new(udpJournalValue))
+}
+
+// Proxy pair with allocated ports, waiting for CommitProxyPair
+type preparedProxyPair struct {
+	session *udpSession
+	lease   time.Duration
+	timer   *time.Timer
 }
 
 func RegisterPcpProxy(server *protocols.Server) (*PcpProxy, error) {
 	proxy := &PcpProxy{
-		sessions: make(protocols.Sessions),
+		sessions: protocols.NewSessionManager(),
 		Server:   server,
+		prepared: make(map[int]*preparedProxyPair),
+		Events:   protocols.NewSessionEventBus(),
+		Quota:    protocols.NewSessionQuota(),
 	}
+	proxy.sessions.ExpiredCallback = server.LogSessionExpired
 	if err := pcp.RegisterServer(server, proxy); err != nil {
 		return nil, err
 	}
@@ -42,6 +87,96 @@ func (proxy *PcpProxy) StopServer() {
 	if err := proxy.sessions.DeleteSessions(); err != nil {
 		proxy.LogError(fmt.Errorf("Error stopping sessions: %v", err))
 	}
+	proxy.preparedLock.Lock()
+	defer proxy.preparedLock.Unlock()
+	for port, prepared := range proxy.prepared {
+		prepared.timer.Stop()
+		prepared.session.stopProxies()
+		delete(proxy.prepared, port)
+	}
+}
+
+// Re-create the UDP proxies that were running when the journal was last used.
+func (proxy *PcpProxy) RestoreSessions(journal *protocols.SessionJournal) error {
+	return proxy.sessions.RestoreSessions(journal, func(key, value interface{}) error {
+		journaled, ok := value.(*udpJournalValue)
+		if !ok {
+			return fmt.Errorf("Illegal journal value for PCP session: (%T) %v", value, value)
+		}
+		port, ok := key.(int)
+		if !ok {
+			return fmt.Errorf("Illegal journal key for PCP session: (%T) %v", key, key)
+		}
+		session := &udpSession{
+			port:      port,
+			quotaHost: protocols.QuotaHost(journaled.TargetAddr),
+			proxy:     proxy,
+		}
+		if err := proxy.Quota.Admit(session.quotaHost); err != nil {
+			return err
+		}
+		var err error
+		if session.udp, err = NewUdpProxy(journaled.ListenAddr, journaled.TargetAddr); err != nil {
+			proxy.Quota.Leave(session.quotaHost)
+			return err
+		}
+		if journaled.ListenAddr2 != "" {
+			if session.udp2, err = NewUdpProxy(journaled.ListenAddr2, journaled.TargetAddr2); err != nil {
+				session.udp.Stop()
+				proxy.Quota.Leave(session.quotaHost)
+				return err
+			}
+		}
+		if err := proxy.sessions.StartSession(port, session); err != nil {
+			session.stopProxies()
+			return err
+		}
+		return nil
+	})
+}
+
+func (proxy *PcpProxy) Sessions() []*protocols.SessionSnapshot {
+	return proxy.sessions.Snapshot()
+}
+
+func (proxy *PcpProxy) QuotaUsage() *protocols.QuotaUsage {
+	return proxy.Quota.Usage()
+}
+
+// Implements heartbeat.MetricsProvider. The throughput is sampled at most once per
+// throughput_sample_interval, so heartbeats to several receivers all report the same rate,
+// independent of how often HeartbeatMetrics is called.
+func (proxy *PcpProxy) HeartbeatMetrics() *heartbeat.Metrics {
+	snapshot := proxy.sessions.Snapshot()
+	metrics := heartbeat.SessionMetrics(snapshot)
+	var bytes uint
+	for _, session := range snapshot {
+		if udp, ok := session.Session.(*udpSession); ok {
+			bytes += udp.udp.Stats.Results.Bytes()
+			if udp.udp2 != nil {
+				bytes += udp.udp2.Stats.Results.Bytes()
+			}
+		}
+	}
+	metrics.BytesPerSecond = proxy.sampleThroughput(bytes)
+	return metrics
+}
+
+func (proxy *PcpProxy) sampleThroughput(bytes uint) float64 {
+	proxy.metricsLock.Lock()
+	defer proxy.metricsLock.Unlock()
+	now := time.Now()
+	if bytes < proxy.metricsBytes {
+		// Bytes of stopped sessions are not counted anymore, the throughput is unknown until the next sample
+		proxy.metricsRate = 0
+	} else if elapsed := now.Sub(proxy.metricsTime); elapsed < throughput_sample_interval {
+		return proxy.metricsRate
+	} else if !proxy.metricsTime.IsZero() {
+		proxy.metricsRate = float64(bytes-proxy.metricsBytes) / elapsed.Seconds()
+	}
+	proxy.metricsBytes = bytes
+	proxy.metricsTime = now
+	return proxy.metricsRate
 }
 
 func (proxy *PcpProxy) StartProxy(desc *pcp.StartProxy) error {
@@ -49,21 +184,29 @@ func (proxy *PcpProxy) StartProxy(desc *pcp.StartProxy) error {
 	if err != nil {
 		return err
 	}
-	if _, ok := proxy.sessions[port]; ok {
-		return fmt.Errorf("UDP proxy already running for port %v", port)
+	host := protocols.QuotaHost(desc.TargetAddr)
+	if err := proxy.Quota.Admit(host); err != nil {
+		return err
 	}
-
-	udp, err := NewUdpProxy(desc.ListenAddr, desc.TargetAddr)
+	err = proxy.sessions.NewSession(port, func() (protocols.Session, error) {
+		udp, err := NewUdpProxy(desc.ListenAddr, desc.TargetAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &udpSession{
+			udp:       udp,
+			port:      port,
+			quotaHost: host,
+			proxy:     proxy,
+		}, nil
+	})
 	if err != nil {
-		return err
+		proxy.Quota.Leave(host)
 	}
-	session := &udpSession{
-		udp:   udp,
-		port:  port,
-		proxy: proxy,
+	if err == nil && desc.Lease > 0 {
+		err = proxy.sessions.SetLease(port, desc.Lease)
 	}
-	proxy.sessions.StartSession(port, session)
-	return nil
+	return err
 }
 
 func (proxy *PcpProxy) StopProxy(desc *pcp.StopProxy) error {
@@ -75,36 +218,147 @@ func (proxy *PcpProxy) StopProxy(desc *pcp.StopProxy) error {
 }
 
 func (proxy *PcpProxy) StartProxyPair(val *pcp.StartProxyPair) (*pcp.StartProxyPairResponse, error) {
+	session, err := proxy.newProxyPair(val)
+	if err != nil {
+		return nil, err
+	}
+	if err := proxy.startProxyPair(session, val.Lease); err != nil {
+		return nil, err
+	}
+	return session.pairResponse(val.ProxyHost), nil
+}
+
+func (proxy *PcpProxy) PrepareProxyPair(val *pcp.PrepareProxyPair) (*pcp.StartProxyPairResponse, error) {
+	session, err := proxy.newProxyPair(&val.StartProxyPair)
+	if err != nil {
+		return nil, err
+	}
+	port := session.port
+	proxy.preparedLock.Lock()
+	defer proxy.preparedLock.Unlock()
+	proxy.prepared[port] = &preparedProxyPair{
+		session: session,
+		lease:   val.Lease,
+		timer: time.AfterFunc(PrepareTimeout, func() {
+			if proxy.releasePrepared(port) {
+				proxy.LogError(fmt.Errorf("Prepared proxy pair on port %v was not committed in time", port))
+			}
+		}),
+	}
+	return session.pairResponse(val.ProxyHost), nil
+}
+
+func (proxy *PcpProxy) CommitProxyPair(val *pcp.CommitProxyPair) error {
+	proxy.preparedLock.Lock()
+	prepared, ok := proxy.prepared[val.ProxyPort1]
+	if ok {
+		prepared.timer.Stop()
+		delete(proxy.prepared, val.ProxyPort1)
+	}
+	proxy.preparedLock.Unlock()
+	if !ok {
+		return fmt.Errorf("No prepared proxy pair on port %v", val.ProxyPort1)
+	}
+	return proxy.startProxyPair(prepared.session, prepared.lease)
+}
+
+func (proxy *PcpProxy) StopProxyPair(val *pcp.StopProxyPair) error {
+	if proxy.releasePrepared(val.ProxyPort1) {
+		return nil
+	}
+	return proxy.sessions.DeleteSession(val.ProxyPort1)
+}
+
+func (proxy *PcpProxy) newProxyPair(val *pcp.StartProxyPair) (*udpSession, error) {
 	target1 := net.JoinHostPort(val.ReceiverHost, strconv.Itoa(val.ReceiverPort1))
 	target2 := net.JoinHostPort(val.ReceiverHost, strconv.Itoa(val.ReceiverPort2))
+	if err := proxy.Quota.Admit(val.ReceiverHost); err != nil {
+		return nil, err
+	}
 	udp1, udp2, err := NewUdpProxyPair(val.ProxyHost, target1, target2)
 	if err != nil {
+		proxy.Quota.Leave(val.ReceiverHost)
 		return nil, err
 	}
+	return &udpSession{
+		udp:       udp1,
+		udp2:      udp2,
+		port:      udp1.listenAddr.Port,
+		quotaHost: val.ReceiverHost,
+		proxy:     proxy,
+	}, nil
+}
 
-	port1, port2 := udp1.listenAddr.Port, udp2.listenAddr.Port
-	port := port1
-	if _, ok := proxy.sessions[port]; ok {
+func (proxy *PcpProxy) startProxyPair(session *udpSession, lease time.Duration) error {
+	if err := proxy.sessions.StartSession(session.port, session); err != nil {
 		// This should not happen due to the NewUdpProxyPair algorithm
-		return nil, fmt.Errorf("Session already exists for one of the proxies on port %v or %v", port1, port2)
+		session.stopProxies()
+		return fmt.Errorf("Session already exists for one of the proxies on port %v or %v", session.port, session.udp2.listenAddr.Port)
 	}
+	if lease > 0 {
+		if err := proxy.sessions.SetLease(session.port, lease); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	session := &udpSession{
-		udp:   udp1,
-		udp2:  udp2,
-		port:  port,
-		proxy: proxy,
+// Returns false if there is no prepared proxy pair on the given port.
+func (proxy *PcpProxy) releasePrepared(port int) bool {
+	proxy.preparedLock.Lock()
+	prepared, ok := proxy.prepared[port]
+	if ok {
+		prepared.timer.Stop()
+		delete(proxy.prepared, port)
+	}
+	proxy.preparedLock.Unlock()
+	if ok {
+		prepared.session.stopProxies()
 	}
-	proxy.sessions.StartSession(port, session)
+	return ok
+}
+
+func (proxy *PcpProxy) KeepAlive(val *pcp.KeepAlive) error {
+	return proxy.sessions.Renew(val.ProxyPort)
+}
+
+func (session *udpSession) pairResponse(proxyHost string) *pcp.StartProxyPairResponse {
 	return &pcp.StartProxyPairResponse{
-		ProxyHost:  val.ProxyHost,
-		ProxyPort1: port1,
-		ProxyPort2: port2,
-	}, nil
+		ProxyHost:  proxyHost,
+		ProxyPort1: session.udp.listenAddr.Port,
+		ProxyPort2: session.udp2.listenAddr.Port,
+	}
 }
 
-func (proxy *PcpProxy) StopProxyPair(val *pcp.StopProxyPair) error {
-	return proxy.sessions.DeleteSession(val.ProxyPort1)
+// Only for proxies that were never started as part of a session. Also leaves the quota.
+func (session *udpSession) stopProxies() {
+	session.udp.Stop()
+	if session.udp2 != nil {
+		session.udp2.Stop()
+	}
+	session.proxy.Quota.Leave(session.quotaHost)
+}
+
+func (session *udpSession) JournalValue() interface{} {
+	value := &udpJournalValue{
+		ListenAddr: session.udp.listenAddr.String(),
+		TargetAddr: session.udp.targetAddr.String(),
+	}
+	if session.udp2 != nil {
+		value.ListenAddr2 = session.udp2.listenAddr.String()
+		value.TargetAddr2 = session.udp2.targetAddr.String()
+	}
+	return value
+}
+
+func (session *udpSession) DescribeSession(info *session_query.SessionInfo) {
+	info.Client = session.udp.targetAddr.String()
+	for _, udp := range []*UdpProxy{session.udp, session.udp2} {
+		if udp != nil {
+			info.Ports = append(info.Ports, udp.listenAddr.Port)
+			info.Stats = append(info.Stats, session_query.NewStatsInfo(udp.Stats))
+		}
+	}
 }
 
 func (session *udpSession) Tasks() []golib.Task {
@@ -115,14 +369,21 @@ func (session *udpSession) Tasks() []golib.Task {
 	return result
 }
 
+func (session *udpSession) TaskError(task golib.Task) error {
+	if proxy, ok := task.(*UdpProxy); ok {
+		return proxy.Err
+	}
+	return nil
+}
+
 func (session *udpSession) Start(base *protocols.SessionBase) {
 	session.SessionBase = base
-	if session.proxy.ProxyStartedCallback != nil {
-		session.proxy.ProxyStartedCallback(session.udp)
-		if session.udp2 != nil {
-			session.proxy.ProxyStartedCallback(session.udp2)
-		}
-	}
+	session.proxy.Events.Publish(&protocols.SessionEvent{
+		Type:    protocols.SessionStartedEvent,
+		Key:     session.port,
+		Session: session,
+		Message: session.String(),
+	})
 }
 
 func (session *udpSession) Cleanup() {
@@ -134,10 +395,19 @@ func (session *udpSession) Cleanup() {
 		errors.Add(fmt.Errorf("UDP proxy %v error: %v", session.udp2, session.udp2.Err))
 	}
 	session.CleanupErr = errors.NilOrError()
-	if session.proxy.ProxyStoppedCallback != nil {
-		session.proxy.ProxyStoppedCallback(session.udp)
-		if session.udp2 != nil {
-			session.proxy.ProxyStoppedCallback(session.udp2)
-		}
+	session.proxy.Quota.Leave(session.quotaHost)
+	session.proxy.Events.Publish(&protocols.SessionEvent{
+		Type:    protocols.SessionStoppedEvent,
+		Key:     session.port,
+		Session: session,
+		Stop:    session.StopInfo(),
+		Message: session.String(),
+	})
+}
+
+func (session *udpSession) String() string {
+	if session.udp2 == nil {
+		return session.udp.String()
 	}
+	return fmt.Sprintf("%v, %v", session.udp, session.udp2)
 }
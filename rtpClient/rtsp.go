@@ -1,7 +1,11 @@
 package rtpClient
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"strconv"
+	"strings"
 
 	"github.com/antongulenko/golib"
 )
@@ -11,7 +15,30 @@ const (
 	logfile_dir = "openRTSP-logs"
 )
 
+func rtspParams(rtspUrl string, port int) []string {
+	return []string{"-v", "-r", "-p", strconv.Itoa(port), rtspUrl}
+}
+
 func StartRtspClient(rtspUrl string, port int, logfile string) (*golib.Command, error) {
-	rtsp_params := []string{"-v", "-r", "-p", strconv.Itoa(port), rtspUrl}
-	return golib.StartCommand(rtsp_exe, rtsp_params, "openRTSP", logfile_dir, logfile)
+	return golib.StartCommand(rtsp_exe, rtspParams(rtspUrl, port), "openRTSP", logfile_dir, logfile)
+}
+
+// Kill an RTSP client that was started before a restart of this program. Nothing is done
+// if the process already exited, or if the pid now belongs to a different process.
+func KillRtspClient(pid int, rtspUrl string, port int) error {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	expected := append([]string{rtsp_exe}, rtspParams(rtspUrl, port)...)
+	if strings.Join(expected, "\x00")+"\x00" != string(cmdline) {
+		return nil
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Kill()
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/antongulenko/RTP/protocols"
+	"github.com/antongulenko/RTP/protocols/subscription"
+	"github.com/antongulenko/golib"
+)
+
+var (
+	eventServer *protocols.Server
+)
+
+func printEvent(event *subscription.Event) {
+	switch event.Type {
+	case subscription.EventFailover:
+		log.Printf("Your stream %v failed over from %v: %v\n", event.Client, event.Server, event.Message)
+	case subscription.EventFailoverFailed:
+		log.Printf("Your stream %v could not fail over from %v: %v\n", event.Client, event.Server, event.Message)
+	default:
+		log.Println("Event:", event)
+	}
+}
+
+func startEventServer() *protocols.Server {
+	if eventServer == nil {
+		server, err := protocols.NewServer(net.JoinHostPort(rtp_ip, "0"), subscription.MiniProtocol)
+		golib.Checkerr(err)
+		golib.Checkerr(subscription.RegisterEventHandler(server, subscription.HandlerFunc(printEvent)))
+		go func() {
+			for err := range server.Errors() {
+				log.Println("Error receiving events:", err)
+			}
+		}()
+		tasks.AddNamed("events", server)
+		log.Println("Listening for events on", server.LocalAddr())
+		eventServer = server
+	}
+	return eventServer
+}
+
+// The stream works without events, e.g. if amp_url does not support the Subscription fragment.
+func subscribeEvents(streamClient string) {
+	server := startEventServer()
+	client, err := subscription.NewClientFor(amp_url)
+	if err != nil {
+		log.Println("Not receiving events:", err)
+		return
+	}
+	if err := client.Subscribe(server, streamClient); err != nil {
+		log.Printf("Not receiving events from %v: %v\n", amp_url, err)
+		golib.Printerr(client.Close())
+		return
+	}
+	tasks.AddNamed("events", &golib.CleanupTask{Description: "unsubscribe events",
+		Cleanup: func() {
+			golib.Printerr(client.Unsubscribe(server, streamClient))
+			golib.Printerr(client.Close())
+		}})
+}
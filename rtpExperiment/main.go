@@ -37,6 +37,7 @@ var (
 	use_amp        = false
 	amp_url        = "127.0.0.1:7779"
 	amp_media_file = "Sample.264"
+	amp_events     = false
 
 	use_proxy     = false
 	proxy_port    = 10000
@@ -51,6 +52,7 @@ var (
 	print_load_packets = false
 
 	client_timeout = 2.0
+	client_lease   = 5.0
 
 	rtp_ip         = "127.0.0.1"
 	start_rtp_port = 9000
@@ -132,12 +134,17 @@ func startStream(target_ip string, rtp_port int) {
 		client, err := amp.NewClientFor(amp_url)
 		golib.Checkerr(err)
 		client.SetTimeout(time.Duration(client_timeout * float64(time.Second)))
+		client.Lease = time.Duration(client_lease * float64(time.Second))
 		golib.Checkerr(client.StartStream(target_ip, rtp_port, amp_media_file))
 		tasks.AddNamed("stream", &golib.CleanupTask{Description: "stop rtp stream",
 			Cleanup: func() {
 				golib.Printerr(client.StopStream(target_ip, rtp_port))
 				golib.Printerr(client.Close())
 			}})
+		if amp_events {
+			desc := &amp.ClientDescription{ReceiverHost: target_ip, Port: rtp_port}
+			subscribeEvents(desc.Client())
+		}
 	}
 	if use_rtsp {
 		if target_ip != rtp_ip {
@@ -169,6 +176,7 @@ func parseFlags() {
 	flag.BoolVar(&use_amp, "amp", use_amp, "Initiate an AMP session at the server given by -amp_url")
 	flag.StringVar(&amp_url, "amp_url", amp_url, "The AMP server used if -amp is given")
 	flag.StringVar(&amp_media_file, "amp_file", amp_media_file, "The media file used with -amp")
+	flag.BoolVar(&amp_events, "events", amp_events, "With -amp, subscribe to events about the stream and print them")
 
 	flag.BoolVar(&use_proxy, "proxy", use_proxy, "Route the RTP traffic through a proxy")
 	flag.IntVar(&proxy_port, "proxy_port", proxy_port, "With -proxy, the port to receive traffic and forward it to -rtp_port")
@@ -182,6 +190,7 @@ func parseFlags() {
 	flag.BoolVar(&use_load, "load", use_load, "Listen for Load traffic instead of RTP/RTCP traffic")
 	flag.BoolVar(&print_load_packets, "print_load_packets", print_load_packets, "Print incoming Load packets with timestamp")
 	flag.Float64Var(&client_timeout, "timeout", client_timeout, "Timeout for client requests, if any are used")
+	flag.Float64Var(&client_lease, "lease", client_lease, "Lease in seconds for sessions started with -amp or -pcp. The lease is renewed periodically. 0 disables leases.")
 
 	flag.Parse()
 
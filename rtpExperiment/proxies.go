@@ -47,8 +47,9 @@ func startProxies(proxy_port, rtp_port int) (string, int) {
 		if use_pcp {
 			proxy_ip = pcpProxyIp()
 			client, err := pcp.NewClientFor(pcp_url)
-			client.SetTimeout(time.Duration(client_timeout * float64(time.Second)))
 			golib.Checkerr(err)
+			client.SetTimeout(time.Duration(client_timeout * float64(time.Second)))
+			client.Lease = time.Duration(client_lease * float64(time.Second))
 			log.Printf("Starting external proxies using %v\n", client)
 			makeProxyPCP(client, proxy_port, rtp_port)
 			makeProxyPCP(client, proxy_port+1, rtp_port+1)
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Link quality derived from received heartbeats: loss ratio, one-way delay and inter-arrival jitter.
+// Sender and receiver clocks are not synchronized, so the clock offset is estimated as the smallest
+// observed difference between receive and send time. The reported delays are relative to that offset,
+// i.e. they show the variation of the one-way delay, not its absolute value.
+// All methods are safe for concurrent use.
+type HeartbeatStats struct {
+	lock     sync.Mutex
+	window   []time.Duration // Ring buffer of raw delays (receive time - send time)
+	next     int
+	received uint64
+	lost     uint64
+	nextSeq  uint64
+	started  bool
+
+	jitter      float64 // Seconds, estimated as in RFC 3550
+	lastTransit time.Duration
+}
+
+type HeartbeatSummary struct {
+	Received  uint64
+	Lost      uint64
+	LossRatio float64
+
+	ClockOffset time.Duration
+	DelayMin    time.Duration
+	DelayMean   time.Duration
+	DelayMax    time.Duration
+	DelayStdDev time.Duration
+	Delay95     time.Duration // 95th percentile
+	Jitter      time.Duration
+}
+
+// window is the number of heartbeats used for the delay distribution.
+func NewHeartbeatStats(window int) *HeartbeatStats {
+	return &HeartbeatStats{
+		window: make([]time.Duration, 0, window),
+	}
+}
+
+func (stats *HeartbeatStats) Received(seq uint64, sent, received time.Time) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	switch {
+	case !stats.started:
+		stats.started = true
+	case seq >= stats.nextSeq:
+		stats.lost += seq - stats.nextSeq
+	case stats.lost > 0:
+		stats.lost-- // Reordered heartbeat, was counted as lost before
+	}
+	if seq >= stats.nextSeq {
+		stats.nextSeq = seq + 1
+	}
+	stats.received++
+
+	transit := received.Sub(sent)
+	if stats.received > 1 {
+		diff := math.Abs((transit - stats.lastTransit).Seconds())
+		stats.jitter += (diff - stats.jitter) / 16
+	}
+	stats.lastTransit = transit
+	if len(stats.window) < cap(stats.window) {
+		stats.window = append(stats.window, transit)
+	} else if len(stats.window) > 0 {
+		stats.window[stats.next] = transit
+		stats.next = (stats.next + 1) % len(stats.window)
+	}
+}
+
+// The sender restarted its sequence numbers, e.g. after reconfiguring it.
+func (stats *HeartbeatStats) ResetSequence() {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.started = false
+	stats.nextSeq = 0
+}
+
+func (stats *HeartbeatStats) Summary() HeartbeatSummary {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	summary := HeartbeatSummary{
+		Received: stats.received,
+		Lost:     stats.lost,
+		Jitter:   time.Duration(stats.jitter * float64(time.Second)),
+	}
+	if total := stats.received + stats.lost; total > 0 {
+		summary.LossRatio = float64(stats.lost) / float64(total)
+	}
+	if len(stats.window) == 0 {
+		return summary
+	}
+	delays := make([]time.Duration, len(stats.window))
+	copy(delays, stats.window)
+	sort.Sort(durations(delays))
+	offset := delays[0]
+	var sum, squares float64
+	for i, delay := range delays {
+		delays[i] = delay - offset
+		sum += delays[i].Seconds()
+		squares += delays[i].Seconds() * delays[i].Seconds()
+	}
+	mean := sum / float64(len(delays))
+	variance := math.Max(squares/float64(len(delays))-mean*mean, 0)
+	summary.ClockOffset = offset
+	summary.DelayMin = delays[0]
+	summary.DelayMax = delays[len(delays)-1]
+	summary.DelayMean = time.Duration(mean * float64(time.Second))
+	summary.DelayStdDev = time.Duration(math.Sqrt(variance) * float64(time.Second))
+	summary.Delay95 = delays[(len(delays)*95)/100]
+	return summary
+}
+
+func (summary HeartbeatSummary) String() string {
+	return fmt.Sprintf("received: %v, lost: %v (%.2f%%), delay: %v (stddev %v, 95%% %v, max %v), jitter: %v, clock offset: %v",
+		summary.Received, summary.Lost, summary.LossRatio*100,
+		summary.DelayMean, summary.DelayStdDev, summary.Delay95, summary.DelayMax,
+		summary.Jitter, summary.ClockOffset)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int {
+	return len(d)
+}
+func (d durations) Less(i, j int) bool {
+	return d[i] < d[j]
+}
+func (d durations) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
@@ -0,0 +1,75 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatLoss(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		seqs     []int64 // -1 resets the sequence
+		received uint64
+		lost     uint64
+		ratio    float64
+	}{
+		{"none", nil, 0, 0, 0},
+		{"in order", []int64{0, 1, 2, 3}, 4, 0, 0},
+		{"first seq ignored", []int64{5, 6, 7}, 3, 0, 0},
+		{"gap", []int64{0, 1, 4, 5}, 4, 2, 2.0 / 6},
+		{"reordered", []int64{0, 2, 1, 3}, 4, 0, 0},
+		{"duplicate", []int64{0, 1, 1, 2}, 4, 0, 0},
+		{"reset", []int64{0, 1, 2, -1, 0, 1}, 5, 0, 0},
+		{"gap after reset", []int64{10, 11, -1, 0, 3}, 4, 2, 2.0 / 6},
+	} {
+		stats := NewHeartbeatStats(10)
+		now := time.Now()
+		for _, seq := range test.seqs {
+			if seq < 0 {
+				stats.ResetSequence()
+			} else {
+				stats.Received(uint64(seq), now, now.Add(time.Millisecond))
+			}
+		}
+		summary := stats.Summary()
+		if summary.Received != test.received || summary.Lost != test.lost || summary.LossRatio != test.ratio {
+			t.Errorf("%v: received %v, lost %v (ratio %v); expected %v, %v (%v)", test.name,
+				summary.Received, summary.Lost, summary.LossRatio, test.received, test.lost, test.ratio)
+		}
+	}
+}
+
+func TestHeartbeatDelays(t *testing.T) {
+	ms := time.Millisecond
+	for _, test := range []struct {
+		name     string
+		window   int
+		transits []time.Duration // receive time - send time, including the clock offset
+		offset   time.Duration
+		min      time.Duration
+		mean     time.Duration
+		max      time.Duration
+		p95      time.Duration
+		jitter   bool // Whether any jitter is expected
+	}{
+		{"constant", 10, []time.Duration{5 * ms, 5 * ms, 5 * ms}, 5 * ms, 0, 0, 0, 0, false},
+		{"negative offset", 10, []time.Duration{-100 * ms, -90 * ms, -80 * ms}, -100 * ms, 0, 10 * ms, 20 * ms, 20 * ms, true},
+		{"varying", 10, []time.Duration{10 * ms, 20 * ms, 30 * ms, 40 * ms}, 10 * ms, 0, 15 * ms, 30 * ms, 30 * ms, true},
+		{"window", 2, []time.Duration{100 * ms, 10 * ms, 20 * ms}, 10 * ms, 0, 5 * ms, 10 * ms, 10 * ms, true},
+	} {
+		stats := NewHeartbeatStats(test.window)
+		sent := time.Now()
+		for i, transit := range test.transits {
+			stats.Received(uint64(i), sent, sent.Add(transit))
+			sent = sent.Add(time.Second)
+		}
+		summary := stats.Summary()
+		if summary.ClockOffset != test.offset || summary.DelayMin != test.min || summary.DelayMean != test.mean ||
+			summary.DelayMax != test.max || summary.Delay95 != test.p95 {
+			t.Errorf("%v: unexpected summary: %v", test.name, summary)
+		}
+		if (summary.Jitter > 0) != test.jitter {
+			t.Errorf("%v: unexpected jitter %v", test.name, summary.Jitter)
+		}
+	}
+}
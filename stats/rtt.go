@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	rtt_smoothing = 0.125 // Weight of a new sample in the smoothed RTT, as in TCP (RFC 6298)
+)
+
+// Round-trip times measured by request/reply exchanges, e.g. pings.
+// Min, max, percentiles and jitter are computed over the last window samples,
+// the smoothed RTT is an exponentially weighted moving average over all samples.
+// All methods are safe for concurrent use.
+type RttStats struct {
+	lock     sync.Mutex
+	window   []time.Duration // Ring buffer of the last samples, in the order they were added
+	next     int
+	samples  uint64
+	smoothed float64 // Seconds
+	last     time.Duration
+}
+
+type RttSummary struct {
+	Samples  uint64 // Total number of samples, including those that left the window
+	Last     time.Duration
+	Smoothed time.Duration
+	Min      time.Duration
+	Mean     time.Duration
+	Max      time.Duration
+	Median   time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	Jitter   time.Duration // Mean difference between consecutive samples in the window
+}
+
+// window is the number of samples used for the distribution and the jitter.
+func NewRttStats(window int) *RttStats {
+	return &RttStats{
+		window: make([]time.Duration, 0, window),
+	}
+}
+
+func (stats *RttStats) Add(rtt time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	if stats.samples == 0 {
+		stats.smoothed = rtt.Seconds()
+	} else {
+		stats.smoothed += (rtt.Seconds() - stats.smoothed) * rtt_smoothing
+	}
+	stats.samples++
+	stats.last = rtt
+	if len(stats.window) < cap(stats.window) {
+		stats.window = append(stats.window, rtt)
+	} else if len(stats.window) > 0 {
+		stats.window[stats.next] = rtt
+		stats.next = (stats.next + 1) % len(stats.window)
+	}
+}
+
+func (stats *RttStats) Summary() RttSummary {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	summary := RttSummary{
+		Samples:  stats.samples,
+		Last:     stats.last,
+		Smoothed: time.Duration(stats.smoothed * float64(time.Second)),
+	}
+	num := len(stats.window)
+	if num == 0 {
+		return summary
+	}
+	var sum, diffs time.Duration
+	for i := 0; i < num; i++ {
+		rtt := stats.window[(stats.next+i)%num]
+		sum += rtt
+		if i > 0 {
+			diff := rtt - stats.window[(stats.next+i-1)%num]
+			if diff < 0 {
+				diff = -diff
+			}
+			diffs += diff
+		}
+	}
+	if num > 1 {
+		summary.Jitter = diffs / time.Duration(num-1)
+	}
+	sorted := make([]time.Duration, num)
+	copy(sorted, stats.window)
+	sort.Sort(durations(sorted))
+	summary.Min = sorted[0]
+	summary.Max = sorted[num-1]
+	summary.Mean = sum / time.Duration(num)
+	summary.Median = sorted[num/2]
+	summary.P95 = sorted[(num*95)/100]
+	summary.P99 = sorted[(num*99)/100]
+	return summary
+}
+
+func (summary RttSummary) String() string {
+	return fmt.Sprintf("rtt: %v (smoothed %v, min %v, median %v, 95%% %v, 99%% %v, max %v), jitter: %v, samples: %v",
+		summary.Last, summary.Smoothed, summary.Min, summary.Median, summary.P95, summary.P99, summary.Max,
+		summary.Jitter, summary.Samples)
+}
@@ -0,0 +1,69 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRttStats(t *testing.T) {
+	ms := time.Millisecond
+	us := time.Microsecond
+	for _, test := range []struct {
+		name     string
+		window   int
+		samples  []time.Duration
+		expected RttSummary
+	}{
+		{"empty", 10, nil, RttSummary{}},
+		{"single", 10, []time.Duration{10 * ms},
+			RttSummary{Samples: 1, Last: 10 * ms, Smoothed: 10 * ms, Min: 10 * ms, Mean: 10 * ms, Max: 10 * ms,
+				Median: 10 * ms, P95: 10 * ms, P99: 10 * ms}},
+		{"increasing", 10, []time.Duration{10 * ms, 20 * ms, 30 * ms, 40 * ms},
+			RttSummary{Samples: 4, Last: 40 * ms, Smoothed: 16894531 * time.Nanosecond, Min: 10 * ms, Mean: 25 * ms, Max: 40 * ms,
+				Median: 30 * ms, P95: 40 * ms, P99: 40 * ms, Jitter: 10 * ms}},
+		{"alternating", 10, []time.Duration{10 * ms, 30 * ms, 10 * ms, 30 * ms, 10 * ms},
+			RttSummary{Samples: 5, Last: 10 * ms, Smoothed: 13862305 * time.Nanosecond, Min: 10 * ms, Mean: 18 * ms, Max: 30 * ms,
+				Median: 10 * ms, P95: 30 * ms, P99: 30 * ms, Jitter: 20 * ms}},
+		{"window", 3, []time.Duration{100 * ms, 10 * ms, 30 * ms, 20 * ms},
+			RttSummary{Samples: 4, Last: 20 * ms, Smoothed: 73730468 * time.Nanosecond, Min: 10 * ms, Mean: 20 * ms, Max: 30 * ms,
+				Median: 20 * ms, P95: 30 * ms, P99: 30 * ms, Jitter: 15 * ms}},
+	} {
+		stats := NewRttStats(test.window)
+		for _, sample := range test.samples {
+			stats.Add(sample)
+		}
+		summary := stats.Summary()
+		// The smoothed RTT is computed with floating point numbers
+		if diff := summary.Smoothed - test.expected.Smoothed; diff > us || diff < -us {
+			t.Errorf("%v: smoothed rtt %v, expected %v", test.name, summary.Smoothed, test.expected.Smoothed)
+		}
+		summary.Smoothed = test.expected.Smoothed
+		if summary != test.expected {
+			t.Errorf("%v: unexpected summary:\n%v\nexpected:\n%v", test.name, summary, test.expected)
+		}
+	}
+}
+
+func TestRttPercentiles(t *testing.T) {
+	stats := NewRttStats(200)
+	for i := 1; i <= 200; i++ {
+		stats.Add(time.Duration(i) * time.Millisecond)
+	}
+	summary := stats.Summary()
+	for _, test := range []struct {
+		name     string
+		value    time.Duration
+		expected time.Duration
+	}{
+		{"min", summary.Min, 1 * time.Millisecond},
+		{"median", summary.Median, 101 * time.Millisecond},
+		{"95th percentile", summary.P95, 191 * time.Millisecond},
+		{"99th percentile", summary.P99, 199 * time.Millisecond},
+		{"max", summary.Max, 200 * time.Millisecond},
+		{"jitter", summary.Jitter, 1 * time.Millisecond},
+	} {
+		if test.value != test.expected {
+			t.Errorf("%v is %v, expected %v", test.name, test.value, test.expected)
+		}
+	}
+}